@@ -22,6 +22,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"math/bits"
 	"sort"
 	"strings"
@@ -122,9 +123,14 @@ const (
 	VariantHexPatriciaTrie TrieVariant = "hex-patricia-hashed"
 	// VariantBinPatriciaTrie - Experimental mode with binary key representation
 	VariantBinPatriciaTrie TrieVariant = "bin-patricia-hashed"
+	// VariantVerkleTrie - Experimental mode with EIP-6800 Verkle tree
+	VariantVerkleTrie TrieVariant = "verkle"
 )
 
-func InitializeTrieAndUpdates(tv TrieVariant, mode Mode, tmpdir string) (Trie, *Updates) {
+// InitializeTrieAndUpdates creates trie of given variant and Updates hashing keys the same way as the trie.
+// Hasher is used for key derivation and node hashing of patricia trie, keccak256 if nil. Verkle trie has its own
+// key derivation and commitments and ignores the hasher.
+func InitializeTrieAndUpdates(tv TrieVariant, mode Mode, tmpdir string, hasher Hasher) (Trie, *Updates) {
 	switch tv {
 	case VariantBinPatriciaTrie:
 		//trie := NewBinPatriciaHashed(length.Addr, nil, tmpdir)
@@ -132,11 +138,14 @@ func InitializeTrieAndUpdates(tv TrieVariant, mode Mode, tmpdir string) (Trie, *
 		//tree := NewUpdateTree(mode, tmpdir, fn)
 		//return trie, tree
 		panic("omg its not supported")
+	case VariantVerkleTrie:
+		return NewVerkleTrie(nil), NewUpdates(mode, tmpdir, keyHasherNoop)
 	case VariantHexPatriciaTrie:
 		fallthrough
 	default:
 
 		trie := NewHexPatriciaHashed(length.Addr, nil, tmpdir)
+		trie.SetHasher(hasher)
 		tree := NewUpdates(mode, tmpdir, trie.hashAndNibblizeKey)
 		return trie, tree
 	}
@@ -668,6 +677,75 @@ func (branchData BranchData) decodeCells() (touchMap, afterMap uint16, row [16]*
 	return
 }
 
+// DiffCells returns bitmap of nibbles which children differ in two branches: child is present only in one of them
+// or has different extension, plain key or hash. Children which data is absent in any branch (not touched) are
+// not compared, as well as memoized state hashes.
+func (branchData BranchData) DiffCells(other BranchData) (diff uint16, err error) {
+	if len(branchData) < 4 || len(other) < 4 {
+		if len(branchData) == len(other) {
+			return 0, nil
+		}
+		return 0xffff, nil
+	}
+	_, afterMap1, row1, err := branchData.decodeCells()
+	if err != nil {
+		return 0, err
+	}
+	_, afterMap2, row2, err := other.decodeCells()
+	if err != nil {
+		return 0, err
+	}
+	diff = afterMap1 ^ afterMap2
+	for nibble := 0; nibble < 16; nibble++ {
+		c1, c2 := row1[nibble], row2[nibble]
+		if c1 == nil || c2 == nil {
+			continue
+		}
+		if !bytes.Equal(c1.extension[:c1.extLen], c2.extension[:c2.extLen]) ||
+			!bytes.Equal(c1.accountAddr[:c1.accountAddrLen], c2.accountAddr[:c2.accountAddrLen]) ||
+			!bytes.Equal(c1.storageAddr[:c1.storageAddrLen], c2.storageAddr[:c2.storageAddrLen]) ||
+			(c1.hashLen > 0 && c2.hashLen > 0 && !bytes.Equal(c1.hash[:c1.hashLen], c2.hash[:c2.hashLen])) {
+			diff |= uint16(1) << nibble
+		}
+	}
+	return diff, nil
+}
+
+// BranchCell is a decoded cell of branch node, see BranchData.Cells
+type BranchCell struct {
+	Nibble      int
+	Extension   []byte // nibbles down to the next branch node
+	AccountAddr []byte // plain key of account
+	StorageAddr []byte // plain key of storage slot
+	Hash        []byte
+	LeafHash    []byte // memoized hash of account or storage leaf
+}
+
+// Cells decodes branch node and returns cells which are present after update (set in afterMap) ordered by nibble.
+func (branchData BranchData) Cells() (touchMap, afterMap uint16, cells []BranchCell, err error) {
+	if len(branchData) < 4 {
+		return 0, 0, nil, fmt.Errorf("branch data is too short: %d bytes", len(branchData))
+	}
+	touchMap, afterMap, row, err := branchData.decodeCells()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	for nibble, c := range row {
+		if c == nil {
+			continue
+		}
+		cells = append(cells, BranchCell{
+			Nibble:      nibble,
+			Extension:   common.Copy(c.extension[:c.extLen]),
+			AccountAddr: common.Copy(c.accountAddr[:c.accountAddrLen]),
+			StorageAddr: common.Copy(c.storageAddr[:c.storageAddrLen]),
+			Hash:        common.Copy(c.hash[:c.hashLen]),
+			LeafHash:    common.Copy(c.stateHash[:c.stateHashLen]),
+		})
+	}
+	return touchMap, afterMap, cells, nil
+}
+
 type BranchMerger struct {
 	buf []byte
 	num [4]byte
@@ -804,6 +882,8 @@ type BranchStat struct {
 	MedianExt     uint64
 	MedianLH      uint64
 	IsRoot        bool
+	Depth         uint64 // nibbles in branch key
+	BranchCount   uint64
 }
 
 // do not add stat of root node to other branch stat
@@ -812,6 +892,7 @@ func (bs *BranchStat) Collect(other *BranchStat) {
 		return
 	}
 
+	bs.BranchCount += other.BranchCount
 	bs.KeySize += other.KeySize
 	bs.ValSize += other.ValSize
 	bs.MinCellSize = min(bs.MinCellSize, other.MinCellSize)
@@ -856,10 +937,12 @@ func DecodeBranchAndCollectStat(key, branch []byte, tv TrieVariant) *BranchStat
 	stat.KeySize = uint64(len(key))
 	stat.ValSize = uint64(len(branch))
 	stat.IsRoot = true
+	stat.BranchCount = 1
 
 	// if key is not "state" then we are interested in the branch data
 	if !bytes.Equal(key, []byte("state")) {
 		stat.IsRoot = false
+		stat.Depth = uint64(len(CompactedKeyToHex(key)))
 
 		tm, am, cells, err := BranchData(branch).decodeCells()
 		if err != nil {
@@ -867,6 +950,9 @@ func DecodeBranchAndCollectStat(key, branch []byte, tv TrieVariant) *BranchStat
 		}
 		stat.TAMapsSize = uint64(2 + 2) // touchMap + afterMap
 		stat.CellCount = uint64(bits.OnesCount16(tm & am))
+		if stat.CellCount > 0 {
+			stat.MinCellSize = math.MaxUint64
+		}
 
 		medians := make(map[string][]int)
 		for _, c := range cells {
@@ -973,6 +1059,15 @@ type Updates struct {
 	tree   *btree.BTreeG[*KeyUpdate]
 	mode   Mode
 	tmpdir string
+
+	journaling bool // see Checkpoint
+	journal    []updatesJournalEntry
+}
+
+type updatesJournalEntry struct {
+	key     string
+	existed bool
+	prev    Update
 }
 
 type keyHasher func(key []byte) []byte
@@ -1037,18 +1132,29 @@ func (t *Updates) TouchPlainKey(key, val []byte, fn func(c *KeyUpdate, val []byt
 
 		t.tree.DescendLessOrEqual(pivot, func(item *KeyUpdate) bool {
 			if bytes.Equal(item.plainKey, pivot.plainKey) {
+				if t.journaling {
+					t.journal = append(t.journal, updatesJournalEntry{key: string(key), existed: true, prev: *item.update})
+				}
 				fn(item, val)
 				updated = true
 			}
 			return false
 		})
 		if !updated {
+			if t.journaling {
+				t.journal = append(t.journal, updatesJournalEntry{key: string(key)})
+			}
 			pivot.hashedKey = t.hasher(pivot.plainKey)
 			fn(pivot, val)
 			t.tree.ReplaceOrInsert(pivot)
 		}
 	case ModeDirect:
 		if _, ok := t.keys[string(key)]; !ok {
+			if t.journaling { // collector is append-only: collect on ReleaseJournal
+				t.keys[string(key)] = struct{}{}
+				t.journal = append(t.journal, updatesJournalEntry{key: string(key)})
+				return
+			}
 			if err := t.etl.Collect(t.hasher(key), key); err != nil {
 				log.Warn("failed to collect updated key", "key", key, "err", err)
 			}
@@ -1058,6 +1164,15 @@ func (t *Updates) TouchPlainKey(key, val []byte, fn func(c *KeyUpdate, val []byt
 	}
 }
 
+// TouchUniquePlainKey marks plainKey as updated without deduplication, so memory usage doesn't depend on number of
+// touched keys. Caller guarantees that each key is touched once. Supported only in ModeDirect.
+func (t *Updates) TouchUniquePlainKey(key []byte) error {
+	if t.mode != ModeDirect {
+		return fmt.Errorf("unique keys touching is not supported in mode %s", t.mode)
+	}
+	return t.etl.Collect(t.hasher(key), key)
+}
+
 func (t *Updates) TouchAccount(c *KeyUpdate, val []byte) {
 	if len(val) == 0 {
 		c.update.Flags = DeleteUpdate
@@ -1122,8 +1237,51 @@ func (t *Updates) Close() {
 	}
 }
 
+// Checkpoint - starts journaling of touched keys (if not started yet) and returns position to revert to.
+// Journal is kept until ReleaseJournal.
+func (t *Updates) Checkpoint() int {
+	t.journaling = true
+	return len(t.journal)
+}
+
+// RevertTo - forgets keys touched after checkpoint `pos`
+func (t *Updates) RevertTo(pos int) {
+	for i := len(t.journal) - 1; i >= pos; i-- {
+		e := &t.journal[i]
+		switch t.mode {
+		case ModeDirect:
+			delete(t.keys, e.key)
+		case ModeUpdate:
+			if !e.existed {
+				t.tree.Delete(&KeyUpdate{plainKey: []byte(e.key)})
+				continue
+			}
+			if item, ok := t.tree.Get(&KeyUpdate{plainKey: []byte(e.key)}); ok {
+				*item.update = e.prev
+			}
+		}
+	}
+	t.journal = t.journal[:pos]
+}
+
+// ReleaseJournal - stops journaling: touched keys can't be reverted anymore
+func (t *Updates) ReleaseJournal() {
+	if !t.journaling {
+		return
+	}
+	if t.mode == ModeDirect {
+		for _, e := range t.journal {
+			if err := t.etl.Collect(t.hasher([]byte(e.key)), []byte(e.key)); err != nil {
+				log.Warn("failed to collect updated key", "key", e.key, "err", err)
+			}
+		}
+	}
+	t.journal, t.journaling = nil, false
+}
+
 // HashSort sorts and applies fn to each key-value pair in the order of hashed keys.
 func (t *Updates) HashSort(ctx context.Context, fn func(hk, pk []byte, update *Update) error) error {
+	t.ReleaseJournal()
 	switch t.mode {
 	case ModeDirect:
 		clear(t.keys)
@@ -1158,6 +1316,7 @@ func (t *Updates) HashSort(ctx context.Context, fn func(hk, pk []byte, update *U
 
 // Reset clears all updates
 func (t *Updates) Reset() {
+	t.journal, t.journaling = nil, false
 	switch t.mode {
 	case ModeDirect:
 		t.keys = nil
@@ -27,6 +27,7 @@ import (
 	"testing"
 
 	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
 
 	"github.com/stretchr/testify/require"
 )
@@ -162,6 +163,43 @@ func TestDecodeBranchWithLeafHashes(t *testing.T) {
 
 }
 
+func TestBranchData_DiffCells(t *testing.T) {
+	t.Parallel()
+
+	row, bm := generateCellRow(t, 16)
+	row[3].accountAddrLen, row[3].storageAddrLen, row[3].extLen = length.Addr, 0, 0
+	be := NewBranchEncoder(1024, t.TempDir())
+	encode := func(afterMap uint16) BranchData {
+		enc, _, err := be.EncodeBranch(afterMap, afterMap, afterMap, func(i int, skip bool) (*cell, error) {
+			return row[i], nil
+		})
+		require.NoError(t, err)
+		return enc
+	}
+	enc := encode(bm)
+
+	diff, err := enc.DiffCells(enc)
+	require.NoError(t, err)
+	require.Zero(t, diff)
+
+	// memoized state hash is ignored
+	row[3].stateHashLen = 32
+	withStateHash := encode(bm)
+	require.NotEqual(t, enc, withStateHash)
+	diff, err = enc.DiffCells(withStateHash)
+	require.NoError(t, err)
+	require.Zero(t, diff)
+
+	row[5].hash[0]++
+	diff, err = withStateHash.DiffCells(encode(bm))
+	require.NoError(t, err)
+	require.EqualValues(t, 1<<5, diff)
+
+	diff, err = encode(bm).DiffCells(encode(bm &^ (1 << 9)))
+	require.NoError(t, err)
+	require.EqualValues(t, 1<<9, diff)
+}
+
 // helper to decode row of cells from string
 func unfoldBranchDataFromString(tb testing.TB, encs string) (row []*cell, am uint16) {
 	tb.Helper()
@@ -400,3 +438,39 @@ func TestUpdates_TouchPlainKey(t *testing.T) {
 	require.NoError(t, err)
 	require.EqualValues(t, len(uniqUpds), i)
 }
+
+func TestUpdates_Checkpoint(t *testing.T) {
+	t.Parallel()
+
+	k1, k2 := common.FromHex("c17fa85f22306d37cec90b0ec74c5623dbbac68f"), common.FromHex("553bba1d92398a69fbc9f01593bbc51b58862366")
+	for _, mode := range []Mode{ModeDirect, ModeUpdate} {
+		ut := NewUpdates(mode, t.TempDir(), keyHasherNoop)
+		ut.TouchPlainKey(k1, []byte("v1"), ut.TouchStorage)
+
+		cp := ut.Checkpoint()
+		ut.TouchPlainKey(k1, []byte("v2"), ut.TouchStorage)
+		ut.TouchPlainKey(k2, []byte("v2"), ut.TouchStorage)
+		require.EqualValues(t, 2, ut.Size())
+		ut.RevertTo(cp)
+		require.EqualValues(t, 1, ut.Size())
+
+		ut.Checkpoint()
+		ut.TouchPlainKey(k2, []byte("v3"), ut.TouchStorage)
+		ut.ReleaseJournal()
+
+		var keys [][]byte
+		var storage [][]byte
+		err := ut.HashSort(context.Background(), func(hk, pk []byte, update *Update) error {
+			keys = append(keys, common.Copy(hk))
+			if update != nil {
+				storage = append(storage, common.Copy(update.Storage[:update.StorageLen]))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{k2, k1}, keys, mode.String())
+		if mode == ModeUpdate {
+			require.Equal(t, [][]byte{[]byte("v3"), []byte("v1")}, storage)
+		}
+	}
+}
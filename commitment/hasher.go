@@ -0,0 +1,68 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"hash"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+// Hasher is a hash function of patricia trie: it derives hashed keys (paths in the trie) from plain keys and hashes
+// trie nodes. Digest is length.Hash bytes long.
+type Hasher interface {
+	Name() string
+	New() HashState
+}
+
+// HashState wraps hash state. In addition to the usual hash methods, it also supports Read to get a digest
+// without copying the state (as sha3.state does). Read is called once after all writes, then the state is Reset.
+type HashState interface {
+	hash.Hash
+	Read([]byte) (int, error)
+}
+
+// keccakState is a hash state created by trie Hasher: it hashes plain keys into trie paths, trie nodes, and is used
+// to build and verify proofs (hex_patricia_proof.go). Code hashes are not part of the trie and are always keccak256
+// (see Updates.keccak, EmptyCodeHash).
+type keccakState = HashState
+
+// KeccakHasher is the default hasher: keccak256, as Ethereum uses.
+var KeccakHasher Hasher = keccakHasher{}
+
+type keccakHasher struct{}
+
+func (keccakHasher) Name() string   { return "keccak256" }
+func (keccakHasher) New() HashState { return sha3.NewLegacyKeccak256().(HashState) }
+
+// EmptyRoot returns root hash of empty trie computed by hasher: hash of RLP-encoded empty string.
+func EmptyRoot(h Hasher) []byte {
+	if h == nil || h == KeccakHasher {
+		return EmptyRootHash
+	}
+	return hashOf(h, []byte{0x80})
+}
+
+func hashOf(h Hasher, data []byte) []byte {
+	s := h.New()
+	s.Write(data)
+	res := make([]byte, length.Hash)
+	s.Read(res) //nolint:errcheck
+	return res
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+// Poseidon hash over BN254 scalar field with x^5 S-box, compatible with circomlib. Round constants and MDS matrix
+// are generated by Grain LFSR the same way as the reference implementation does, so they are not embedded.
+//
+// Byte strings are hashed by PoseidonHasher as a chain of 2-to-1 hashes: h = len(data), then h = poseidon(h, chunk)
+// for each 31-byte chunk of data (big-endian, the last one may be shorter). Digest is h, 32 bytes big-endian.
+
+// PoseidonHasher is a zk-friendly hasher of patricia trie.
+var PoseidonHasher Hasher = poseidonHasher{}
+
+type poseidonHasher struct{}
+
+func (poseidonHasher) Name() string   { return "poseidon" }
+func (poseidonHasher) New() HashState { return &poseidonState{} }
+
+const (
+	poseidonFullRounds = 8
+	poseidonChunkLen   = 31 // bytes packed into one field element
+)
+
+// number of partial rounds by width (number of inputs + 1), starting from 2
+var poseidonPartialRounds = [...]int{56, 57, 56, 60, 60, 63, 64, 63, 60, 66, 60, 65, 70, 60, 64, 68}
+
+type poseidonConstants struct {
+	c []fr.Element   // round constants, width per round
+	m [][]fr.Element // MDS matrix
+}
+
+var (
+	poseidonOnce   [len(poseidonPartialRounds)]sync.Once
+	poseidonParams [len(poseidonPartialRounds)]poseidonConstants
+)
+
+func poseidonConstantsOf(width int) *poseidonConstants {
+	i := width - 2
+	poseidonOnce[i].Do(func() {
+		const fieldBits = 254
+		partial := poseidonPartialRounds[i]
+		g := newGrainLFSR(fieldBits, width, poseidonFullRounds, partial)
+		modulus := fr.Modulus()
+		pc := &poseidonParams[i]
+
+		pc.c = make([]fr.Element, (poseidonFullRounds+partial)*width)
+		for j := range pc.c {
+			v := g.bits(fieldBits)
+			for v.Cmp(modulus) >= 0 {
+				v = g.bits(fieldBits)
+			}
+			pc.c[j].SetBigInt(v)
+		}
+
+		// Cauchy matrix 1/(x[i]+y[j]), x and y are random elements
+		xy := make([]fr.Element, 2*width)
+		for j := range xy {
+			xy[j].SetBigInt(g.bits(fieldBits))
+		}
+		pc.m = make([][]fr.Element, width)
+		for r := range pc.m {
+			pc.m[r] = make([]fr.Element, width)
+			for c := range pc.m[r] {
+				pc.m[r][c].Add(&xy[r], &xy[width+c])
+				pc.m[r][c].Inverse(&pc.m[r][c])
+			}
+		}
+	})
+	return &poseidonParams[i]
+}
+
+// poseidon returns hash of up to 16 field elements.
+func poseidon(inputs ...fr.Element) fr.Element {
+	state := make([]fr.Element, len(inputs)+1)
+	copy(state[1:], inputs)
+	poseidonPermute(state)
+	return state[0]
+}
+
+func poseidonPermute(state []fr.Element) {
+	width := len(state)
+	pc := poseidonConstantsOf(width)
+	partial := poseidonPartialRounds[width-2]
+	mixed := make([]fr.Element, width)
+	sbox := func(x *fr.Element) {
+		var x2, x4 fr.Element
+		x2.Square(x)
+		x4.Square(&x2)
+		x.Mul(x, &x4)
+	}
+	for r := 0; r < poseidonFullRounds+partial; r++ {
+		for i := range state {
+			state[i].Add(&state[i], &pc.c[r*width+i])
+		}
+		if r < poseidonFullRounds/2 || r >= poseidonFullRounds/2+partial {
+			for i := range state {
+				sbox(&state[i])
+			}
+		} else {
+			sbox(&state[0])
+		}
+		for i := range mixed {
+			mixed[i].SetZero()
+			for j := range state {
+				var t fr.Element
+				t.Mul(&pc.m[i][j], &state[j])
+				mixed[i].Add(&mixed[i], &t)
+			}
+		}
+		copy(state, mixed)
+	}
+}
+
+// grainLFSR is the generator of Poseidon parameters: 80-bit LFSR initialized by parameters, its output is
+// filtered by self-shrinking (of each pair of bits, the second one is taken if the first one is set).
+type grainLFSR struct {
+	state [80]byte
+	head  int
+}
+
+func newGrainLFSR(fieldBits, width, fullRounds, partialRounds int) *grainLFSR {
+	g := &grainLFSR{}
+	pos := 0
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			g.state[pos] = byte(v>>i) & 1
+			pos++
+		}
+	}
+	put(1, 2) // prime field
+	put(0, 4) // x^alpha S-box
+	put(fieldBits, 12)
+	put(width, 12)
+	put(fullRounds, 10)
+	put(partialRounds, 10)
+	put(1<<30-1, 30)
+	for i := 0; i < 160; i++ {
+		g.next()
+	}
+	return g
+}
+
+func (g *grainLFSR) next() byte {
+	at := func(i int) byte { return g.state[(g.head+i)%len(g.state)] }
+	b := at(62) ^ at(51) ^ at(38) ^ at(23) ^ at(13) ^ at(0)
+	g.state[g.head] = b
+	g.head = (g.head + 1) % len(g.state)
+	return b
+}
+
+func (g *grainLFSR) bit() uint {
+	for g.next() == 0 {
+		g.next()
+	}
+	return uint(g.next())
+}
+
+// bits returns integer of n random bits, the first one is the most significant
+func (g *grainLFSR) bits(n int) *big.Int {
+	v := new(big.Int)
+	for i := 0; i < n; i++ {
+		v.Lsh(v, 1)
+		v.SetBit(v, 0, g.bit())
+	}
+	return v
+}
+
+type poseidonState struct {
+	buf []byte
+}
+
+func (s *poseidonState) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+func (s *poseidonState) Read(out []byte) (int, error) {
+	d := s.digest()
+	return copy(out, d[:]), nil
+}
+
+func (s *poseidonState) Sum(b []byte) []byte {
+	d := s.digest()
+	return append(b, d[:]...)
+}
+
+func (s *poseidonState) Reset()         { s.buf = s.buf[:0] }
+func (s *poseidonState) Size() int      { return length.Hash }
+func (s *poseidonState) BlockSize() int { return poseidonChunkLen }
+
+func (s *poseidonState) digest() [length.Hash]byte {
+	var h, chunk fr.Element
+	h.SetUint64(uint64(len(s.buf)))
+	data := s.buf
+	for first := true; first || len(data) > 0; first = false {
+		n := min(len(data), poseidonChunkLen)
+		chunk.SetBytes(data[:n])
+		h = poseidon(h, chunk)
+		data = data[n:]
+	}
+	return h.Bytes()
+}
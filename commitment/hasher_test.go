@@ -0,0 +1,156 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+func TestPoseidon_Vectors(t *testing.T) {
+	t.Parallel()
+
+	// circomlib test vectors
+	for _, tc := range []struct {
+		inputs   []uint64
+		expected string
+	}{
+		{[]uint64{1}, "29176100eaa962bdc1fe6c654d6a3c130e96a4d1168b33848b897dc502820133"},
+		{[]uint64{1, 2}, "115cc0f5e7d690413df64c6b9662e9cf2a3617f2743245519e19607a4417189a"},
+		{[]uint64{0, 0}, "2098f5fb9e239eab3ceac3f27b81e481dc3124d55ffed523a839ee8446b64864"},
+		{[]uint64{1, 2, 3, 4}, "299c867db6c1fdd79dcefa40e4510b9837e60ebb1ce0663dbaa525df65250465"},
+	} {
+		inputs := make([]fr.Element, len(tc.inputs))
+		for i, v := range tc.inputs {
+			inputs[i].SetUint64(v)
+		}
+		h := poseidon(inputs...)
+		b := h.Bytes()
+		require.Equal(t, tc.expected, hex.EncodeToString(b[:]), "inputs %v", tc.inputs)
+	}
+}
+
+func TestPoseidonHasher(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		data     []byte
+		expected string
+	}{
+		{nil, "2098f5fb9e239eab3ceac3f27b81e481dc3124d55ffed523a839ee8446b64864"},
+		{[]byte{0x80}, "2dfd44f85de2c9d6183484a160d31f0f167936ed58185574f7e335281149800b"},
+		{data, "15f17eba5be13e7c411be22dea657485b4745b8980029a66f7443b2e772c12e0"},
+	} {
+		s := PoseidonHasher.New()
+		// written in parts, as trie does
+		for i := 0; i < len(tc.data); i += 7 {
+			_, err := s.Write(tc.data[i:min(i+7, len(tc.data))])
+			require.NoError(t, err)
+		}
+		digest := make([]byte, length.Hash)
+		_, err := s.Read(digest)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, hex.EncodeToString(digest))
+		require.Equal(t, digest, s.Sum(nil))
+
+		s.Reset()
+		s.Write(tc.data)
+		require.Equal(t, digest, s.Sum(nil))
+	}
+	require.Equal(t, "2dfd44f85de2c9d6183484a160d31f0f167936ed58185574f7e335281149800b", hex.EncodeToString(EmptyRoot(PoseidonHasher)))
+	require.Equal(t, EmptyRootHash, EmptyRoot(KeccakHasher))
+	require.Equal(t, EmptyRootHash, hashOf(KeccakHasher, []byte{0x80}))
+}
+
+func Test_HexPatriciaHashed_Hasher(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plainKeys, updates := NewUpdateBuilder().
+		Balance("68ee6c0e9cdc73b2b2d52dbd79f19d24fe25e2f9", 4).
+		Balance("18f4dcf2d94402019d5b00f71d5f9d02e4f70e40", 900234).
+		Balance("8e5476fc5990638a4fb0b5fd3f61bb4b5c5f395e", 1233).
+		Storage("8e5476fc5990638a4fb0b5fd3f61bb4b5c5f395e", "24f3a02dc65eda502dbf75919e795458413d3c45b38bb35b51235432707900ed", "0401").
+		Storage("8e5476fc5990638a4fb0b5fd3f61bb4b5c5f395e", "0fa41642c48ecf8f2059c275353ce4fee173b3a8ce5480f040c4d2901603d14e", "050505").
+		Balance("27456647f49ba65e220e86cba9abfc4fc1587b81", 065606).
+		Nonce("b13363d527cdc18173c54ac5d4a54af05dbec22e", 3).
+		Build()
+
+	compute := func(hasher Hasher, batches int) []byte {
+		ms := NewMockState(t)
+		trie, _ := InitializeTrieAndUpdates(VariantHexPatriciaTrie, ModeDirect, t.TempDir(), hasher)
+		hph := trie.(*HexPatriciaHashed)
+		hph.ResetContext(ms)
+
+		root, err := hph.RootHash()
+		require.NoError(t, err)
+		require.Equal(t, EmptyRoot(hasher), root)
+
+		step := (len(plainKeys) + batches - 1) / batches
+		for i := 0; i < len(plainKeys); i += step {
+			end := min(i+step, len(plainKeys))
+			require.NoError(t, ms.applyPlainUpdates(plainKeys[i:end], updates[i:end]))
+			upds := WrapKeyUpdates(t, ModeDirect, hph.hashAndNibblizeKey, plainKeys[i:end], updates[i:end])
+			root, err = hph.Process(ctx, upds, "")
+			require.NoError(t, err)
+			upds.Close()
+		}
+		return common.Copy(root)
+	}
+
+	keccakRoot := compute(nil, 1)
+	require.Equal(t, keccakRoot, compute(KeccakHasher, 3))
+
+	poseidonRoot := compute(PoseidonHasher, 1)
+	require.NotEqual(t, keccakRoot, poseidonRoot)
+	// root depends only on the state
+	require.Equal(t, poseidonRoot, compute(PoseidonHasher, 3))
+	require.Equal(t, poseidonRoot, compute(PoseidonHasher, len(plainKeys)))
+
+	// keys are derived by hasher
+	hph := NewHexPatriciaHashed(length.Addr, nil, t.TempDir())
+	hph.SetHasher(PoseidonHasher)
+	addr := plainKeys[0]
+	require.Equal(t, hashOf(PoseidonHasher, addr)[0]>>4, hph.hashAndNibblizeKey(addr)[0])
+
+	// proofs are verified by the same hasher
+	ms := NewMockState(t)
+	hph = NewHexPatriciaHashed(length.Addr, ms, ms.TempDir())
+	hph.SetHasher(PoseidonHasher)
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+	upds := WrapKeyUpdates(t, ModeDirect, hph.hashAndNibblizeKey, plainKeys, updates)
+	defer upds.Close()
+	root, err := hph.Process(ctx, upds, "")
+	require.NoError(t, err)
+	require.Equal(t, poseidonRoot, root)
+	p, err := hph.ProveAccount(decodeHex("8e5476fc5990638a4fb0b5fd3f61bb4b5c5f395e"), [][]byte{decodeHex("24f3a02dc65eda502dbf75919e795458413d3c45b38bb35b51235432707900ed")})
+	require.NoError(t, err)
+	require.Equal(t, decodeHex("0401"), p.StorageProof[0].Value)
+	require.NoError(t, VerifyAccountProof(PoseidonHasher, root, p))
+	require.ErrorIs(t, VerifyAccountProof(nil, root, p), ErrInvalidProof)
+}
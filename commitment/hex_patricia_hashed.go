@@ -23,7 +23,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"math/bits"
 	"path/filepath"
@@ -38,8 +37,6 @@ import (
 
 	"github.com/Tangui-Bitfly/erigon-lib/common/dbg"
 
-	"golang.org/x/crypto/sha3"
-
 	"github.com/Tangui-Bitfly/erigon-lib/common/hexutility"
 
 	"github.com/Tangui-Bitfly/erigon-lib/common"
@@ -47,16 +44,8 @@ import (
 	"github.com/Tangui-Bitfly/erigon-lib/rlp"
 )
 
-// keccakState wraps sha3.state. In addition to the usual hash methods, it also supports
-// Read to get a variable amount of data from the hash state. Read is faster than Sum
-// because it doesn't copy the internal state, but also modifies the internal state.
-type keccakState interface {
-	hash.Hash
-	Read([]byte) (int, error)
-}
-
 // HexPatriciaHashed implements commitment based on patricia merkle tree with radix 16,
-// with keys pre-hashed by keccak256
+// with keys pre-hashed by keccak256 (or other Hasher, see SetHasher)
 type HexPatriciaHashed struct {
 	root cell // Root cell of the tree
 	// How many rows (starting from row 0) are currently active and have corresponding selected columns
@@ -74,9 +63,11 @@ type HexPatriciaHashed struct {
 	branchBefore  [128]bool     // For each row, whether there was a branch node in the database loaded in unfold
 	touchMap      [128]uint16   // For each row, bitmap of cells that were either present before modification, or modified or deleted
 	afterMap      [128]uint16   // For each row, bitmap of cells that were present after modification
-	keccak        keccakState
+	hasher        Hasher
+	keccak        keccakState // hash states of hasher
 	keccak2       keccakState
-	rootChecked   bool // Set to false if it is not known whether the root is empty, set to true if it is checked
+	emptyRootHash []byte // root hash of empty trie computed by hasher
+	rootChecked   bool   // Set to false if it is not known whether the root is empty, set to true if it is checked
 	rootTouched   bool
 	rootPresent   bool
 	trace         bool
@@ -87,13 +78,18 @@ type HexPatriciaHashed struct {
 
 	depthsToTxNum [129]uint64 // endTxNum of file with branch data for that depth
 	hadToLoadL    map[uint64]skipStat
+
+	witness  *Witness // if set, Process records everything it reads (see SetWitness)
+	parallel bool     // if set, Process updates subtries of the root concurrently (see SetParallel)
 }
 
 func NewHexPatriciaHashed(accountKeyLen int, ctx PatriciaContext, tmpdir string) *HexPatriciaHashed {
 	hph := &HexPatriciaHashed{
 		ctx:           ctx,
-		keccak:        sha3.NewLegacyKeccak256().(keccakState),
-		keccak2:       sha3.NewLegacyKeccak256().(keccakState),
+		hasher:        KeccakHasher,
+		keccak:        KeccakHasher.New(),
+		keccak2:       KeccakHasher.New(),
+		emptyRootHash: EmptyRootHash,
 		accountKeyLen: accountKeyLen,
 		auxBuffer:     bytes.NewBuffer(make([]byte, 8192)),
 		hadToLoadL:    make(map[uint64]skipStat),
@@ -847,7 +843,7 @@ func (hph *HexPatriciaHashed) computeCellHash(cell *cell, depth int, buf []byte)
 			} else if cell.hashLen > 0 {
 				storageRootHash = cell.hash
 			} else {
-				storageRootHash = *(*[length.Hash]byte)(EmptyRootHash)
+				storageRootHash = *(*[length.Hash]byte)(hph.emptyRootHash)
 			}
 		}
 		if !cell.loaded.account() {
@@ -908,7 +904,7 @@ func (hph *HexPatriciaHashed) computeCellHash(cell *cell, depth int, buf []byte)
 		copy(cell.hash[:], storageRootHash[:])
 		cell.hashLen = len(storageRootHash)
 	} else {
-		buf = append(buf, EmptyRootHash...)
+		buf = append(buf, hph.emptyRootHash...)
 	}
 	return buf, nil
 }
@@ -1530,62 +1526,49 @@ func (hph *HexPatriciaHashed) Process(ctx context.Context, updates *Updates, log
 	defer logEvery.Stop()
 	//hph.trace = true
 
-	err = updates.HashSort(ctx, func(hashedKey, plainKey []byte, stateUpdate *Update) error {
-		select {
-		case <-logEvery.C:
-			dbg.ReadMemStats(&m)
-			log.Info(fmt.Sprintf("[%s][agg] computing trie", logPrefix),
-				"progress", fmt.Sprintf("%s/%s", common.PrettyCounter(ki), common.PrettyCounter(updatesCount)),
-				"alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
-
-		default:
+	var witnessRec *witnessRecorder
+	if hph.witness != nil {
+		if witnessRec, err = hph.startWitnessRecording(); err != nil {
+			return nil, fmt.Errorf("witness recording: %w", err)
 		}
+		defer hph.stopWitnessRecording(witnessRec)
+	}
 
-		if hph.trace {
-			fmt.Printf("\n%d/%d) plainKey [%x] hashedKey [%x] currentKey [%x]\n", ki+1, updatesCount, plainKey, hashedKey, hph.currentKey[:hph.currentKeyLen])
+	if hph.parallel {
+		var onKey func(plainKey []byte)
+		if witnessRec != nil {
+			onKey = func(plainKey []byte) { witnessRec.updated[string(plainKey)] = struct{}{} }
 		}
-		// Keep folding until the currentKey is the prefix of the key we modify
-		for hph.needFolding(hashedKey) {
-			if err := hph.fold(); err != nil {
-				return fmt.Errorf("fold: %w", err)
-			}
+		if ki, err = hph.processParallel(ctx, updates, onKey); err != nil {
+			return nil, fmt.Errorf("parallel processing failed: %w", err)
 		}
-		// Now unfold until we step on an empty cell
-		for unfolding := hph.needUnfolding(hashedKey); unfolding > 0; unfolding = hph.needUnfolding(hashedKey) {
-			if err := hph.unfold(hashedKey, unfolding); err != nil {
-				return fmt.Errorf("unfold: %w", err)
+	} else {
+		err = updates.HashSort(ctx, func(hashedKey, plainKey []byte, stateUpdate *Update) error {
+			select {
+			case <-logEvery.C:
+				dbg.ReadMemStats(&m)
+				log.Info(fmt.Sprintf("[%s][agg] computing trie", logPrefix),
+					"progress", fmt.Sprintf("%s/%s", common.PrettyCounter(ki), common.PrettyCounter(updatesCount)),
+					"alloc", common.ByteCount(m.Alloc), "sys", common.ByteCount(m.Sys))
+
+			default:
 			}
-		}
 
-		if stateUpdate == nil {
-			// Update the cell
-			if len(plainKey) == hph.accountKeyLen {
-				update, err = hph.ctx.Account(plainKey)
-				if err != nil {
-					return fmt.Errorf("GetAccount for key %x failed: %w", plainKey, err)
-				}
-			} else {
-				update, err = hph.ctx.Storage(plainKey)
-				if err != nil {
-					return fmt.Errorf("GetStorage for key %x failed: %w", plainKey, err)
-				}
+			if hph.trace {
+				fmt.Printf("\n%d/%d) plainKey [%x] hashedKey [%x] currentKey [%x]\n", ki+1, updatesCount, plainKey, hashedKey, hph.currentKey[:hph.currentKeyLen])
 			}
-		} else {
-			if update == nil {
-				update = stateUpdate
-			} else {
-				update.Reset()
-				update.Merge(stateUpdate)
+			if witnessRec != nil {
+				witnessRec.updated[string(plainKey)] = struct{}{}
 			}
+			if update, err = hph.followAndUpdate(hashedKey, plainKey, stateUpdate, update); err != nil {
+				return err
+			}
+			ki++
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("hash sort failed: %w", err)
 		}
-		hph.updateCell(plainKey, hashedKey, update)
-
-		mxTrieProcessedKeys.Inc()
-		ki++
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("hash sort failed: %w", err)
 	}
 
 	// Folding everything up to the root
@@ -1639,8 +1622,62 @@ func (hph *HexPatriciaHashed) Process(ctx context.Context, updates *Updates, log
 	return rootHash, nil
 }
 
+// followAndUpdate folds and unfolds the grid along hashedKey and updates the cell of the key. In ModeUpdate `update`
+// returned by the previous call is reused for the next key.
+func (hph *HexPatriciaHashed) followAndUpdate(hashedKey, plainKey []byte, stateUpdate, update *Update) (_ *Update, err error) {
+	// Keep folding until the currentKey is the prefix of the key we modify
+	for hph.needFolding(hashedKey) {
+		if err := hph.fold(); err != nil {
+			return nil, fmt.Errorf("fold: %w", err)
+		}
+	}
+	// Now unfold until we step on an empty cell
+	for unfolding := hph.needUnfolding(hashedKey); unfolding > 0; unfolding = hph.needUnfolding(hashedKey) {
+		if err := hph.unfold(hashedKey, unfolding); err != nil {
+			return nil, fmt.Errorf("unfold: %w", err)
+		}
+	}
+
+	if stateUpdate == nil {
+		// Update the cell
+		if len(plainKey) == hph.accountKeyLen {
+			update, err = hph.ctx.Account(plainKey)
+			if err != nil {
+				return nil, fmt.Errorf("GetAccount for key %x failed: %w", plainKey, err)
+			}
+		} else {
+			update, err = hph.ctx.Storage(plainKey)
+			if err != nil {
+				return nil, fmt.Errorf("GetStorage for key %x failed: %w", plainKey, err)
+			}
+		}
+	} else {
+		if update == nil {
+			update = stateUpdate
+		} else {
+			update.Reset()
+			update.Merge(stateUpdate)
+		}
+	}
+	hph.updateCell(plainKey, hashedKey, update)
+
+	mxTrieProcessedKeys.Inc()
+	return update, nil
+}
+
 func (hph *HexPatriciaHashed) SetTrace(trace bool) { hph.trace = trace }
 
+// SetHasher replaces hash function used for key derivation and node hashing (keccak256 by default). Branches computed
+// by different hashers are not compatible. Proofs must be verified by VerifyProof with the same hasher, witnesses are
+// verified by VerifyWitness with keccak256 only.
+func (hph *HexPatriciaHashed) SetHasher(h Hasher) {
+	if h == nil {
+		h = KeccakHasher
+	}
+	hph.hasher, hph.keccak, hph.keccak2 = h, h.New(), h.New()
+	hph.emptyRootHash = EmptyRoot(h)
+}
+
 func (hph *HexPatriciaHashed) Variant() TrieVariant { return VariantHexPatriciaTrie }
 
 // Reset allows HexPatriciaHashed instance to be reused for the new commitment calculation
@@ -2104,6 +2141,9 @@ func decodeKey(key, buf []byte) []byte {
 	return buf
 }
 
+// HexToCompactedKey returns compacted form of nibbles path, as it is used for keys of branch nodes.
+func HexToCompactedKey(nibbles []byte) []byte { return hexToCompact(nibbles) }
+
 func CompactedKeyToHex(compact []byte) []byte {
 	if len(compact) == 0 {
 		return compact
@@ -0,0 +1,208 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+)
+
+// Parallel mode of Process: updates are partitioned by the first nibble of hashed key and each of 16 subtries of the
+// root branch is unfolded, updated and folded by its own HexPatriciaHashed. Then subtrie cells are put back into the
+// root row and it's folded as usual. Subtries are disjoint, so branch updates are the same as in sequential mode.
+// Parallel mode is used only when the root is a branch node (trie has more than one key and no common prefix),
+// otherwise updates are processed sequentially.
+
+// parallelMinUpdates - fewer updates are processed sequentially, goroutines are not worth it
+const parallelMinUpdates = 64
+
+// SetParallel enables parallel mode of Process. PatriciaContext is still called only from the goroutine which
+// called Process (see servedPatriciaContext) - hashing is what runs in parallel.
+func (hph *HexPatriciaHashed) SetParallel(parallel bool) { hph.parallel = parallel }
+
+// servedPatriciaContext is a thread-safe PatriciaContext of a subtrie: calls are sent to the goroutine which
+// called Process and executed there one by one. Contexts backed by db transactions (like SharedDomains) can't be
+// used from other goroutines or even threads.
+type servedPatriciaContext struct {
+	ctx   PatriciaContext
+	calls chan<- func()
+	done  chan struct{}
+}
+
+func (sc *servedPatriciaContext) call(fn func()) {
+	sc.calls <- func() {
+		fn()
+		sc.done <- struct{}{}
+	}
+	<-sc.done
+}
+
+func (sc *servedPatriciaContext) Branch(prefix []byte) (data []byte, step uint64, err error) {
+	sc.call(func() { data, step, err = sc.ctx.Branch(prefix) })
+	return data, step, err
+}
+
+func (sc *servedPatriciaContext) PutBranch(prefix []byte, data []byte, prevData []byte, prevStep uint64) (err error) {
+	sc.call(func() { err = sc.ctx.PutBranch(prefix, data, prevData, prevStep) })
+	return err
+}
+
+func (sc *servedPatriciaContext) Account(plainKey []byte) (u *Update, err error) {
+	sc.call(func() { u, err = sc.ctx.Account(plainKey) })
+	return u, err
+}
+
+func (sc *servedPatriciaContext) Storage(plainKey []byte) (u *Update, err error) {
+	sc.call(func() { u, err = sc.ctx.Storage(plainKey) })
+	return u, err
+}
+
+type keyUpdate struct {
+	hashedKey, plainKey []byte
+	update              *Update // nil in ModeDirect
+}
+
+// processParallel applies updates to the trie, leaving only the root row unfolded. Returns number of processed keys.
+func (hph *HexPatriciaHashed) processParallel(ctx context.Context, updates *Updates, onKey func(plainKey []byte)) (ki uint64, err error) {
+	var subtries [16][]keyUpdate
+	err = updates.HashSort(ctx, func(hashedKey, plainKey []byte, stateUpdate *Update) error {
+		ku := keyUpdate{hashedKey: common.Copy(hashedKey), plainKey: common.Copy(plainKey)}
+		if stateUpdate != nil {
+			u := *stateUpdate
+			ku.update = &u
+		}
+		subtries[hashedKey[0]] = append(subtries[hashedKey[0]], ku)
+		if onKey != nil {
+			onKey(plainKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var firstKey []byte
+	var total int
+	for i := range subtries {
+		if firstKey == nil && len(subtries[i]) > 0 {
+			firstKey = subtries[i][0].hashedKey
+		}
+		total += len(subtries[i])
+	}
+	if firstKey == nil {
+		return 0, nil
+	}
+	// unfold root, the same way as sequential mode does for the first key
+	if hph.activeRows == 0 && hph.root.hashedExtLen == 0 {
+		if unfolding := hph.needUnfolding(firstKey); unfolding > 0 {
+			if err := hph.unfold(firstKey, unfolding); err != nil {
+				return 0, fmt.Errorf("unfold: %w", err)
+			}
+		}
+	}
+
+	if hph.activeRows != 1 || hph.depths[0] != 1 || hph.currentKeyLen != 0 || total < parallelMinUpdates {
+		// root is not a branch or there is not much to do: process sequentially
+		var update *Update
+		for i := range subtries {
+			for _, ku := range subtries[i] {
+				if update, err = hph.followAndUpdate(ku.hashedKey, ku.plainKey, ku.update, update); err != nil {
+					return ki, err
+				}
+				ki++
+			}
+		}
+		return ki, nil
+	}
+
+	calls := make(chan func())
+	var children [16]*HexPatriciaHashed
+	g, gctx := errgroup.WithContext(ctx)
+	for nibble := range subtries {
+		if len(subtries[nibble]) == 0 {
+			continue
+		}
+		child := hph.subtrie(&servedPatriciaContext{ctx: hph.ctx, calls: calls, done: make(chan struct{}, 1)})
+		children[nibble] = child
+		keys := subtries[nibble]
+		g.Go(func() error {
+			var update *Update
+			var err error
+			for _, ku := range keys {
+				select {
+				case <-gctx.Done():
+					return gctx.Err()
+				default:
+				}
+				if update, err = child.followAndUpdate(ku.hashedKey, ku.plainKey, ku.update, update); err != nil {
+					return err
+				}
+			}
+			for child.activeRows > 1 {
+				if err := child.fold(); err != nil {
+					return fmt.Errorf("fold: %w", err)
+				}
+			}
+			return nil
+		})
+	}
+	finished := make(chan error, 1)
+	go func() { finished <- g.Wait() }()
+	for serving := true; serving; {
+		select {
+		case call := <-calls:
+			call()
+		case err = <-finished:
+			serving = false
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for nibble, child := range children {
+		if child == nil {
+			continue
+		}
+		bit := uint16(1) << nibble
+		hph.grid[0][nibble] = child.grid[0][nibble]
+		hph.touchMap[0] = hph.touchMap[0]&^bit | child.touchMap[0]&bit
+		hph.afterMap[0] = hph.afterMap[0]&^bit | child.afterMap[0]&bit
+		ki += uint64(len(subtries[nibble]))
+	}
+	return ki, nil
+}
+
+// subtrie returns trie positioned at the unfolded root row, the same as hph
+func (hph *HexPatriciaHashed) subtrie(ctx PatriciaContext) *HexPatriciaHashed {
+	child := NewHexPatriciaHashed(hph.accountKeyLen, ctx, hph.branchEncoder.tmpdir)
+	child.SetHasher(hph.hasher)
+	child.trace = hph.trace
+	child.root = hph.root
+	child.rootChecked, child.rootTouched, child.rootPresent = hph.rootChecked, hph.rootTouched, hph.rootPresent
+	child.activeRows, child.currentKeyLen = hph.activeRows, hph.currentKeyLen
+	child.grid[0] = hph.grid[0]
+	child.depths[0] = hph.depths[0]
+	child.branchBefore[0] = hph.branchBefore[0]
+	child.touchMap[0], child.afterMap[0] = hph.touchMap[0], hph.afterMap[0]
+	child.depthsToTxNum = hph.depthsToTxNum
+	return child
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+func Test_HexPatriciaHashed_ProcessParallel(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	addr := func(i int) string { return fmt.Sprintf("%040x", i) }
+	loc := func(i int) string { return fmt.Sprintf("%064x", i) }
+
+	blocks := []*UpdateBuilder{NewUpdateBuilder(), NewUpdateBuilder(), NewUpdateBuilder(), NewUpdateBuilder()}
+	for i := 0; i < 300; i++ {
+		blocks[0].Balance(addr(i), uint64(i+1)).Nonce(addr(i), uint64(i))
+	}
+	for i := 0; i < 50; i++ {
+		blocks[0].Storage(addr(7), loc(i), fmt.Sprintf("%04x", i+1))
+		blocks[0].Storage(addr(8), loc(i), fmt.Sprintf("%04x", i+1))
+	}
+	for i := 0; i < 300; i += 3 {
+		blocks[1].Balance(addr(i), uint64(i+1000))
+	}
+	for i := 300; i < 400; i++ {
+		blocks[1].Nonce(addr(i), 1)
+	}
+	for i := 0; i < 50; i += 2 {
+		blocks[1].Storage(addr(7), loc(i), "ff")
+		blocks[1].DeleteStorage(addr(8), loc(i))
+	}
+	for i := 0; i < 400; i += 5 {
+		blocks[2].Delete(addr(i))
+	}
+	blocks[2].Balance(addr(1), 1) // too few updates for parallel processing
+	blocks[3].Balance(addr(2), 2)
+
+	msSeq, msPar := NewMockState(t), NewMockState(t)
+	seq := NewHexPatriciaHashed(length.Addr, msSeq, msSeq.TempDir())
+	par := NewHexPatriciaHashed(length.Addr, msPar, msPar.TempDir())
+	par.SetParallel(true)
+
+	for i, b := range blocks {
+		plainKeys, updates := b.Build()
+		require.NoError(t, msSeq.applyPlainUpdates(plainKeys, updates))
+		require.NoError(t, msPar.applyPlainUpdates(plainKeys, updates))
+
+		for _, mode := range []Mode{ModeDirect, ModeUpdate} {
+			if mode == ModeUpdate && i < len(blocks)-1 {
+				continue
+			}
+			updsSeq := WrapKeyUpdates(t, mode, seq.hashAndNibblizeKey, plainKeys, updates)
+			rootSeq, err := seq.Process(ctx, updsSeq, "")
+			require.NoError(t, err)
+			updsSeq.Close()
+
+			updsPar := WrapKeyUpdates(t, mode, par.hashAndNibblizeKey, plainKeys, updates)
+			rootPar, err := par.Process(ctx, updsPar, "")
+			require.NoError(t, err)
+			updsPar.Close()
+
+			require.Equal(t, rootSeq, rootPar, "block %d", i)
+			require.Equal(t, msSeq.cm, msPar.cm, "block %d", i)
+		}
+	}
+
+	// parallel trie state is the same: it can be restored and continued sequentially
+	state, err := par.EncodeCurrentState(nil)
+	require.NoError(t, err)
+	restored := NewHexPatriciaHashed(length.Addr, msPar, msPar.TempDir())
+	require.NoError(t, restored.SetState(state))
+	rootPar, err := restored.RootHash()
+	require.NoError(t, err)
+	rootSeq, err := seq.RootHash()
+	require.NoError(t, err)
+	require.Equal(t, rootSeq, rootPar)
+}
@@ -0,0 +1,511 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/holiman/uint256"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/rlp"
+)
+
+// Merkle proofs in eth_getProof format: each proof is a list of RLP-encoded trie nodes on the path from the root
+// down to the leaf of the key. Nodes embedded into their parent (shorter than 32 bytes) are not listed separately.
+// If key is absent, proof ends with the node where the path diverges (or with the branch node having empty slot for the key).
+
+var ErrInvalidProof = errors.New("invalid merkle proof")
+
+// AccountProof - proof of account and some of its storage slots
+type AccountProof struct {
+	Address      []byte
+	AccountProof [][]byte
+	Nonce        uint64
+	Balance      uint256.Int
+	CodeHash     [length.Hash]byte
+	StorageHash  [length.Hash]byte
+	StorageProof []StorageProof
+}
+
+// StorageProof - proof of storage slot within account storage trie
+type StorageProof struct {
+	Key   []byte // storage location, without account address
+	Value []byte // empty if slot is not present
+	Proof [][]byte
+}
+
+// ProveAccount unfolds the trie along hashed key of account plainKey and collects nodes from the root to the account leaf,
+// then does the same within account storage trie for each of storageKeys (storage locations without address).
+// Trie root must be set up before (by Process or SetState). Branch nodes are read through PatriciaContext.Branch,
+// leaves values - through PatriciaContext.Account/Storage. Trie state is not modified.
+func (hph *HexPatriciaHashed) ProveAccount(plainKey []byte, storageKeys [][]byte) (*AccountProof, error) {
+	if len(plainKey) != hph.accountKeyLen {
+		return nil, fmt.Errorf("prove account: key %x length %d, expected %d", plainKey, len(plainKey), hph.accountKeyLen)
+	}
+	p := &AccountProof{Address: common.Copy(plainKey), CodeHash: EmptyCodeHashArray}
+	copy(p.StorageHash[:], hph.emptyRootHash)
+
+	hashedKey := make([]byte, 128) // account nibbles followed by storage location nibbles
+	if err := hashKey(hph.keccak, plainKey, hashedKey, 0); err != nil {
+		return nil, err
+	}
+
+	root := hph.root
+	leaf, proof, err := hph.proveKey(&root, 0, hashedKey[:64], false)
+	if err != nil {
+		return nil, fmt.Errorf("prove account %x: %w", plainKey, err)
+	}
+	p.AccountProof = proof
+	if leaf == nil || !bytes.Equal(leaf.accountAddr[:leaf.accountAddrLen], plainKey) {
+		// account is absent, so is its storage
+		for _, loc := range storageKeys {
+			p.StorageProof = append(p.StorageProof, StorageProof{Key: common.Copy(loc)})
+		}
+		return p, nil
+	}
+	p.Nonce = leaf.Nonce
+	p.Balance.Set(&leaf.Balance)
+	p.CodeHash = leaf.CodeHash
+
+	storageRoot := storageRootCell(leaf)
+	storageRef, err := hph.computeCellHash(storageRoot.copy(), 64, nil)
+	if err != nil {
+		return nil, err
+	}
+	copy(p.StorageHash[:], storageRef[1:])
+
+	for _, loc := range storageKeys {
+		sp := StorageProof{Key: common.Copy(loc)}
+		if err := hashKey(hph.keccak, loc, hashedKey[64:], 0); err != nil {
+			return nil, err
+		}
+		leaf, proof, err := hph.proveKey(storageRoot.copy(), 64, hashedKey, true)
+		if err != nil {
+			return nil, fmt.Errorf("prove storage %x of %x: %w", loc, plainKey, err)
+		}
+		sp.Proof = proof
+		if leaf != nil && bytes.Equal(leaf.storageAddr[hph.accountKeyLen:leaf.storageAddrLen], loc) {
+			sp.Value = common.Copy(leaf.Storage[:leaf.StorageLen])
+		}
+		p.StorageProof = append(p.StorageProof, sp)
+	}
+	return p, nil
+}
+
+// proveKey walks down the trie from cell c (located at depth) along hashedKey and collects proof nodes.
+// Returns leaf found at the end of the path (it may belong to another key - then it proves absence)
+// or nil if the path ends with empty slot.
+func (hph *HexPatriciaHashed) proveKey(c *cell, depth int, hashedKey []byte, storage bool) (leaf *cell, proof [][]byte, err error) {
+	if err = hph.loadCellValues(c); err != nil {
+		return nil, nil, err
+	}
+	ref, err := hph.computeCellHash(c.copy(), depth, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref = common.Copy(ref)
+
+	addNode := func(node, ref []byte) error {
+		if len(ref) == length.Hash+1 && ref[0] == 0x80+length.Hash {
+			if h := hashOf(hph.hasher, node); !bytes.Equal(h, ref[1:]) {
+				return fmt.Errorf("node %x at depth %d has hash %x, expected %x", node, depth, h, ref[1:])
+			}
+			proof = append(proof, node)
+			return nil
+		}
+		if !bytes.Equal(node, ref) { // embedded into parent node
+			return fmt.Errorf("node %x at depth %d doesn't match embedded reference %x", node, depth, ref)
+		}
+		return nil
+	}
+
+	for {
+		if (storage && c.storageAddrLen > 0) || (!storage && c.accountAddrLen > 0) {
+			node, err := hph.leafNode(c, depth, storage)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = addNode(node, ref); err != nil {
+				return nil, nil, err
+			}
+			return c, proof, nil
+		}
+		if c.hashLen == 0 {
+			return nil, proof, nil // empty (sub)trie
+		}
+		if c.extLen > 0 {
+			ext := c.extension[:c.extLen]
+			if err = addNode(rlpEncodeList(rlpEncodeString(hexToCompact(ext)), rlpEncodeString(c.hash[:c.hashLen])), ref); err != nil {
+				return nil, nil, err
+			}
+			if !bytes.HasPrefix(hashedKey[depth:], ext) {
+				return nil, proof, nil
+			}
+			depth += c.extLen
+			ref = append([]byte{0x80 + length.Hash}, c.hash[:c.hashLen]...)
+		}
+
+		row, refs, err := hph.proofBranchRow(hashedKey[:depth], depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		items := make([][]byte, 0, 17)
+		for i := range refs {
+			if refs[i] == nil {
+				items = append(items, []byte{0x80})
+				continue
+			}
+			items = append(items, refs[i])
+		}
+		if err = addNode(rlpEncodeList(append(items, []byte{0x80})...), ref); err != nil {
+			return nil, nil, err
+		}
+		if depth >= len(hashedKey) {
+			return nil, nil, fmt.Errorf("branch node below key length at depth %d", depth)
+		}
+		nibble := hashedKey[depth]
+		if row[nibble] == nil {
+			return nil, proof, nil
+		}
+		c, ref = row[nibble], refs[nibble]
+		depth++
+	}
+}
+
+// proofBranchRow reads branch node by its prefix and returns its cells (with values loaded) and their references
+func (hph *HexPatriciaHashed) proofBranchRow(prefix []byte, depth int) (row [16]*cell, refs [16][]byte, err error) {
+	branchData, _, err := hph.ctx.Branch(hexToCompact(prefix))
+	if err != nil {
+		return row, refs, err
+	}
+	if len(branchData) < 4 {
+		return row, refs, fmt.Errorf("branch node at prefix [%x] is missing", prefix)
+	}
+	branchData = branchData[2:] // skip touch map
+	bitmap := binary.BigEndian.Uint16(branchData[0:])
+	pos := 2
+	for bitset := bitmap; bitset != 0; {
+		bit := bitset & -bitset
+		nibble := bits.TrailingZeros16(bit)
+		c := new(cell)
+		c.reset()
+		fieldBits := branchData[pos]
+		pos++
+		if pos, err = c.fillFromFields(branchData, pos, cellFields(fieldBits)); err != nil {
+			return row, refs, fmt.Errorf("prefix [%x] branchData[%x]: %w", prefix, branchData, err)
+		}
+		if err = hph.loadCellValues(c); err != nil {
+			return row, refs, err
+		}
+		ref, err := hph.computeCellHash(c.copy(), depth, nil)
+		if err != nil {
+			return row, refs, err
+		}
+		row[nibble], refs[nibble] = c, common.Copy(ref)
+		bitset ^= bit
+	}
+	return row, refs, nil
+}
+
+// loadCellValues reads account and storage values of the leaf cell, drops memoized state hash so it's recomputed from values
+func (hph *HexPatriciaHashed) loadCellValues(c *cell) error {
+	c.stateHashLen = 0
+	if c.accountAddrLen > 0 && !c.loaded.account() {
+		upd, err := hph.ctx.Account(c.accountAddr[:c.accountAddrLen])
+		if err != nil {
+			return fmt.Errorf("failed to get account: %w", err)
+		}
+		c.setFromUpdate(upd)
+		c.loaded = c.loaded.addFlag(cellLoadAccount)
+	}
+	if c.storageAddrLen > 0 && !c.loaded.storage() {
+		upd, err := hph.ctx.Storage(c.storageAddr[:c.storageAddrLen])
+		if err != nil {
+			return fmt.Errorf("failed to get storage: %w", err)
+		}
+		c.setFromUpdate(upd)
+		c.loaded = c.loaded.addFlag(cellLoadStorage)
+	}
+	return nil
+}
+
+// leafNode returns RLP-encoded leaf node of account or storage cell located at depth
+func (hph *HexPatriciaHashed) leafNode(c *cell, depth int, storage bool) ([]byte, error) {
+	var key [65]byte
+	var keyLen int
+	if storage {
+		if err := hashKey(hph.keccak, c.storageAddr[hph.accountKeyLen:c.storageAddrLen], key[:], depth-64); err != nil {
+			return nil, err
+		}
+		keyLen = 128 - depth
+		key[keyLen] = 16 // terminator
+		return rlpEncodeList(rlpEncodeString(hexToCompact(key[:keyLen+1])), rlpEncodeString(rlpEncodeString(c.Storage[:c.StorageLen]))), nil
+	}
+
+	storageRef, err := hph.computeCellHash(storageRootCell(c), 64, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := hashKey(hph.keccak, c.accountAddr[:c.accountAddrLen], key[:], depth); err != nil {
+		return nil, err
+	}
+	keyLen = 64 - depth
+	key[keyLen] = 16 // terminator
+	var valBuf [128]byte
+	valLen := c.accountForHashing(valBuf[:], *(*[length.Hash]byte)(storageRef[1:]))
+	return rlpEncodeList(rlpEncodeString(hexToCompact(key[:keyLen+1])), rlpEncodeString(valBuf[:valLen])), nil
+}
+
+// storageRootCell returns cell representing root of the storage trie of account cell, located at depth 64.
+// Follows the same priority as computeCellHash does for storage root of account.
+func storageRootCell(c *cell) *cell {
+	s := new(cell)
+	s.reset()
+	if c.storageAddrLen > 0 {
+		s.storageAddrLen = c.storageAddrLen
+		copy(s.storageAddr[:], c.storageAddr[:c.storageAddrLen])
+		s.StorageLen = c.StorageLen
+		copy(s.Storage[:], c.Storage[:c.StorageLen])
+		s.loaded = c.loaded
+		return s
+	}
+	s.extLen = c.extLen
+	copy(s.extension[:], c.extension[:c.extLen])
+	s.hashLen = c.hashLen
+	copy(s.hash[:], c.hash[:c.hashLen])
+	return s
+}
+
+func (cell *cell) copy() *cell {
+	c := *cell
+	return &c
+}
+
+// VerifyProof checks merkle proof of hashedKey (hash of plain key) against rootHash. Nodes are hashed by `h` - hasher
+// of trie which produced proof, nil means KeccakHasher.
+// Returns value stored in the leaf or nil if proof proves absence of the key.
+func VerifyProof(h Hasher, rootHash, hashedKey []byte, proof [][]byte) ([]byte, error) {
+	if h == nil {
+		h = KeccakHasher
+	}
+	if len(proof) == 0 {
+		if bytes.Equal(rootHash, EmptyRoot(h)) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: empty proof for root %x", ErrInvalidProof, rootHash)
+	}
+	key := make([]byte, 0, len(hashedKey)*2)
+	for _, b := range hashedKey {
+		key = append(key, b>>4, b&0xf)
+	}
+
+	var next int
+	done := func(value []byte) ([]byte, error) {
+		if next != len(proof) {
+			return nil, fmt.Errorf("%w: %d unused nodes", ErrInvalidProof, len(proof)-next)
+		}
+		return value, nil
+	}
+
+	var node []byte
+	wantHash := rootHash
+	hashState, nodeHash := h.New(), make([]byte, length.Hash)
+	for {
+		if wantHash != nil {
+			if next >= len(proof) {
+				return nil, fmt.Errorf("%w: missing node %x", ErrInvalidProof, wantHash)
+			}
+			node = proof[next]
+			next++
+			hashState.Reset()
+			hashState.Write(node)
+			hashState.Read(nodeHash) //nolint:errcheck
+			if !bytes.Equal(nodeHash, wantHash) {
+				return nil, fmt.Errorf("%w: node %d hash %x, expected %x", ErrInvalidProof, next-1, nodeHash, wantHash)
+			}
+		}
+		items, err := rlpDecodeListItems(node)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+		}
+
+		var ref []byte
+		switch len(items) {
+		case 17: // branch
+			if len(key) == 0 {
+				return nil, fmt.Errorf("%w: branch node below key length", ErrInvalidProof)
+			}
+			ref, key = items[key[0]], key[1:]
+		case 2: // leaf or extension
+			path, err := rlpStringPayload(items[0])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+			}
+			nibbles := CompactedKeyToHex(path)
+			if hasTerm(nibbles) {
+				if !bytes.Equal(nibbles[:len(nibbles)-1], key) {
+					return done(nil)
+				}
+				value, err := rlpStringPayload(items[1])
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+				}
+				return done(value)
+			}
+			if !bytes.HasPrefix(key, nibbles) {
+				return done(nil)
+			}
+			ref, key = items[1], key[len(nibbles):]
+		default:
+			return nil, fmt.Errorf("%w: node with %d items", ErrInvalidProof, len(items))
+		}
+
+		_, refLen, isList, err := rlp.Prefix(ref, 0)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("%w: %w", ErrInvalidProof, err)
+		case isList: // embedded node
+			node, wantHash = ref, nil
+		case refLen == 0:
+			return done(nil)
+		case refLen == length.Hash:
+			node, wantHash = nil, ref[1:]
+		default:
+			return nil, fmt.Errorf("%w: reference of length %d", ErrInvalidProof, refLen)
+		}
+	}
+}
+
+// VerifyAccountProof checks account proof and all its storage proofs against state rootHash. `h` - hasher of trie
+// (see HexPatriciaHashed.SetHasher), nil means KeccakHasher.
+func VerifyAccountProof(h Hasher, rootHash []byte, p *AccountProof) error {
+	if h == nil {
+		h = KeccakHasher
+	}
+	value, err := VerifyProof(h, rootHash, hashOf(h, p.Address), p.AccountProof)
+	if err != nil {
+		return fmt.Errorf("account %x: %w", p.Address, err)
+	}
+	if value == nil {
+		if p.Nonce != 0 || !p.Balance.IsZero() || p.CodeHash != EmptyCodeHashArray || !bytes.Equal(p.StorageHash[:], EmptyRoot(h)) {
+			return fmt.Errorf("%w: account %x is absent, but proof has non-empty fields", ErrInvalidProof, p.Address)
+		}
+	} else if err = verifyAccountValue(value, p); err != nil {
+		return fmt.Errorf("account %x: %w", p.Address, err)
+	}
+
+	for _, sp := range p.StorageProof {
+		value, err := VerifyProof(h, p.StorageHash[:], hashOf(h, sp.Key), sp.Proof)
+		if err != nil {
+			return fmt.Errorf("storage %x of %x: %w", sp.Key, p.Address, err)
+		}
+		if value != nil {
+			if value, err = rlpStringPayload(value); err != nil {
+				return fmt.Errorf("%w: storage %x of %x: %w", ErrInvalidProof, sp.Key, p.Address, err)
+			}
+		}
+		if !bytes.Equal(value, sp.Value) {
+			return fmt.Errorf("%w: storage %x of %x is %x, proof has %x", ErrInvalidProof, sp.Key, p.Address, value, sp.Value)
+		}
+	}
+	return nil
+}
+
+// verifyAccountValue compares RLP-encoded account [nonce, balance, storageRoot, codeHash] with proof fields
+func verifyAccountValue(value []byte, p *AccountProof) error {
+	pos, _, err := rlp.List(value, 0)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+	var nonce uint64
+	var balance uint256.Int
+	var storageHash, codeHash [length.Hash]byte
+	if pos, nonce, err = rlp.U64(value, pos); err != nil {
+		return fmt.Errorf("%w: nonce: %w", ErrInvalidProof, err)
+	}
+	if pos, err = rlp.U256(value, pos, &balance); err != nil {
+		return fmt.Errorf("%w: balance: %w", ErrInvalidProof, err)
+	}
+	if pos, err = rlp.ParseHash(value, pos, storageHash[:]); err != nil {
+		return fmt.Errorf("%w: storage hash: %w", ErrInvalidProof, err)
+	}
+	if _, err = rlp.ParseHash(value, pos, codeHash[:]); err != nil {
+		return fmt.Errorf("%w: code hash: %w", ErrInvalidProof, err)
+	}
+	if nonce != p.Nonce || !balance.Eq(&p.Balance) || storageHash != p.StorageHash || codeHash != p.CodeHash {
+		return fmt.Errorf("%w: proven account (nonce=%d balance=%s storageHash=%x codeHash=%x) doesn't match proof fields",
+			ErrInvalidProof, nonce, balance.String(), storageHash, codeHash)
+	}
+	return nil
+}
+
+func rlpEncodeString(s []byte) []byte {
+	buf := make([]byte, max(rlp.StringLen(s), 9))
+	return buf[:rlp.EncodeString(s, buf)]
+}
+
+// rlpEncodeList wraps already encoded items into RLP list
+func rlpEncodeList(items ...[]byte) []byte {
+	var dataLen int
+	for _, item := range items {
+		dataLen += len(item)
+	}
+	var prefix [10]byte
+	buf := make([]byte, 0, rlp.ListPrefixLen(dataLen)+dataLen)
+	buf = append(buf, prefix[:rlp.EncodeListPrefix(dataLen, prefix[:])]...)
+	for _, item := range items {
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+// rlpDecodeListItems returns encoded items of RLP list
+func rlpDecodeListItems(enc []byte) (items [][]byte, err error) {
+	pos, dataLen, err := rlp.List(enc, 0)
+	if err != nil {
+		return nil, err
+	}
+	if pos+dataLen != len(enc) {
+		return nil, fmt.Errorf("%d trailing bytes after list", len(enc)-pos-dataLen)
+	}
+	for pos < len(enc) {
+		dataPos, itemLen, _, err := rlp.Prefix(enc, pos)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, enc[pos:dataPos+itemLen])
+		pos = dataPos + itemLen
+	}
+	return items, nil
+}
+
+func rlpStringPayload(enc []byte) ([]byte, error) {
+	pos, dataLen, err := rlp.String(enc, 0)
+	if err != nil {
+		return nil, err
+	}
+	if pos+dataLen != len(enc) {
+		return nil, fmt.Errorf("%d trailing bytes after string", len(enc)-pos-dataLen)
+	}
+	return enc[pos : pos+dataLen], nil
+}
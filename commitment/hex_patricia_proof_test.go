@@ -0,0 +1,160 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+func Test_HexPatriciaHashed_ProveAccount(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ms := NewMockState(t)
+	hph := NewHexPatriciaHashed(length.Addr, ms, ms.TempDir())
+	addr := func(i int) string { return fmt.Sprintf("%040x", i) }
+	loc := func(i int) string { return fmt.Sprintf("%064x", i) }
+
+	builder := NewUpdateBuilder()
+	for i := 0; i < 40; i++ {
+		builder.Balance(addr(i), uint64(i+1)).Nonce(addr(i), uint64(i))
+	}
+	builder.CodeHash(addr(3), "aaaaaaaaaaf7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a870")
+	for i := 0; i < 20; i++ {
+		builder.Storage(addr(5), loc(i), fmt.Sprintf("%04x", i+1))
+	}
+	builder.Storage(addr(7), loc(1), "0707") // single storage slot
+	builder.Storage(addr(9), loc(1), "01")   // single byte value is encoded without rlp prefix
+	builder.Storage(addr(9), loc(2), "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+	plainKeys, updates := builder.Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+
+	upds := WrapKeyUpdates(t, ModeDirect, hph.hashAndNibblizeKey, plainKeys, updates)
+	defer upds.Close()
+	rootHash, err := hph.Process(ctx, upds, "")
+	require.NoError(t, err)
+
+	prove := func(t *testing.T, a int, locs ...int) *AccountProof {
+		t.Helper()
+		var storageKeys [][]byte
+		for _, l := range locs {
+			storageKeys = append(storageKeys, decodeHex(loc(l)))
+		}
+		p, err := hph.ProveAccount(decodeHex(addr(a)), storageKeys)
+		require.NoError(t, err)
+		require.NoError(t, VerifyAccountProof(nil, rootHash, p))
+		return p
+	}
+
+	t.Run("accounts", func(t *testing.T) {
+		for i := 0; i < 40; i++ {
+			p := prove(t, i)
+			require.NotEmpty(t, p.AccountProof)
+			require.EqualValues(t, i, p.Nonce)
+			require.EqualValues(t, i+1, p.Balance.Uint64())
+		}
+		p := prove(t, 3)
+		require.Equal(t, "aaaaaaaaaaf7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a870", hex.EncodeToString(p.CodeHash[:]))
+		require.Equal(t, EmptyRootHash, p.StorageHash[:])
+	})
+
+	t.Run("storage", func(t *testing.T) {
+		p := prove(t, 5, 0, 7, 19, 0xee)
+		require.NotEqual(t, EmptyRootHash, p.StorageHash[:])
+		require.Equal(t, decodeHex("0001"), p.StorageProof[0].Value)
+		require.Equal(t, decodeHex("0008"), p.StorageProof[1].Value)
+		require.Equal(t, decodeHex("0014"), p.StorageProof[2].Value)
+		require.Empty(t, p.StorageProof[3].Value)
+		require.NotEmpty(t, p.StorageProof[3].Proof)
+
+		p = prove(t, 7, 1, 2)
+		require.Equal(t, decodeHex("0707"), p.StorageProof[0].Value)
+		require.Len(t, p.StorageProof[0].Proof, 1)
+		require.Empty(t, p.StorageProof[1].Value)
+
+		p = prove(t, 9, 1, 2)
+		require.Equal(t, decodeHex("01"), p.StorageProof[0].Value)
+		require.Len(t, p.StorageProof[1].Value, 32)
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		p := prove(t, 0xf0, 1)
+		require.NotEmpty(t, p.AccountProof)
+		require.Zero(t, p.Nonce)
+		require.True(t, p.Balance.IsZero())
+		require.Empty(t, p.StorageProof[0].Value)
+		require.Empty(t, p.StorageProof[0].Proof)
+	})
+
+	t.Run("restored state", func(t *testing.T) {
+		state, err := hph.EncodeCurrentState(nil)
+		require.NoError(t, err)
+		restored := NewHexPatriciaHashed(length.Addr, ms, ms.TempDir())
+		require.NoError(t, restored.SetState(state))
+		p, err := restored.ProveAccount(decodeHex(addr(5)), [][]byte{decodeHex(loc(3))})
+		require.NoError(t, err)
+		require.NoError(t, VerifyAccountProof(nil, rootHash, p))
+		require.Equal(t, decodeHex("0004"), p.StorageProof[0].Value)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		p := prove(t, 5, 3)
+
+		p.Balance.SetUint64(100)
+		require.ErrorIs(t, VerifyAccountProof(nil, rootHash, p), ErrInvalidProof)
+		p.Balance.SetUint64(6)
+
+		p.StorageProof[0].Value = decodeHex("0005")
+		require.ErrorIs(t, VerifyAccountProof(nil, rootHash, p), ErrInvalidProof)
+		p.StorageProof[0].Value = decodeHex("0004")
+		require.NoError(t, VerifyAccountProof(nil, rootHash, p))
+
+		last := p.AccountProof[len(p.AccountProof)-1]
+		last[len(last)-1]++
+		require.ErrorIs(t, VerifyAccountProof(nil, rootHash, p), ErrInvalidProof)
+		last[len(last)-1]--
+
+		p.AccountProof = p.AccountProof[:len(p.AccountProof)-1]
+		require.ErrorIs(t, VerifyAccountProof(nil, rootHash, p), ErrInvalidProof)
+	})
+}
+
+func Test_HexPatriciaHashed_ProveEmptyTrie(t *testing.T) {
+	t.Parallel()
+
+	ms := NewMockState(t)
+	hph := NewHexPatriciaHashed(1, ms, ms.TempDir())
+	rootHash, err := hph.RootHash()
+	require.NoError(t, err)
+	require.Equal(t, EmptyRootHash, rootHash)
+
+	p, err := hph.ProveAccount(decodeHex("01"), [][]byte{decodeHex("02")})
+	require.NoError(t, err)
+	require.Empty(t, p.AccountProof)
+	require.NoError(t, VerifyAccountProof(nil, rootHash, p))
+
+	value, err := VerifyProof(nil, rootHash, hashOf(KeccakHasher, decodeHex("01")), [][]byte{decodeHex("c0")})
+	require.ErrorIs(t, err, ErrInvalidProof)
+	require.Nil(t, value)
+}
@@ -0,0 +1,350 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+// Execution witness: everything HexPatriciaHashed reads during commitment computation of a block - trie state,
+// branch nodes and leaf values - as they were before the block. Together with post-state values of keys updated
+// by the block it's enough to recompute post-state root without access to the state (see VerifyWitness).
+//
+// Witness also keeps pre-state of accounts, storage and code touched by the block if owner of PatriciaContext
+// provides them (SharedDomainsCommitmentContext does) - these are inputs for stateless execution.
+//
+// Encoded witness format (all lengths and counts are uvarints, entries of each section are sorted by key):
+//
+//	version byte (witnessVersion)
+//	len(State) State                                   - trie state, HexPatriciaHashed.EncodeCurrentState
+//	count [len(prefix) prefix len(data) data]...       - branches by compacted prefix, empty data for absent branch
+//	count [len(plainKey) plainKey Update.Encode]...    - accounts
+//	count [len(plainKey) plainKey Update.Encode]...    - storage
+//	count [len(plainKey) plainKey len(code) code]...   - code of accounts
+
+var ErrIncompleteWitness = errors.New("witness is incomplete")
+
+const witnessVersion = 1
+
+type Witness struct {
+	State    []byte             // trie state before the first recorded Process
+	Branches map[string][]byte  // compacted prefix -> branch data before it was updated
+	Accounts map[string]*Update // plainKey -> account, DeleteUpdate if account is absent
+	Storage  map[string]*Update // plainKey -> storage, DeleteUpdate if slot is empty
+	Code     map[string][]byte  // account plainKey -> code
+
+	written map[string]struct{} // branches updated since recording started: their further reads are not pre-state
+}
+
+func NewWitness() *Witness {
+	return &Witness{
+		Branches: make(map[string][]byte),
+		Accounts: make(map[string]*Update),
+		Storage:  make(map[string]*Update),
+		Code:     make(map[string][]byte),
+		written:  make(map[string]struct{}),
+	}
+}
+
+// SetWitness enables witness recording mode: each Process call records into w branches and values it reads.
+// Witness may span several Process calls (e.g. commitment computed for each transaction of the block). nil disables recording.
+func (hph *HexPatriciaHashed) SetWitness(w *Witness) { hph.witness = w }
+
+// witnessRecorder wraps PatriciaContext for the time of Process and records first reads of each key into witness
+type witnessRecorder struct {
+	PatriciaContext
+	w *Witness
+
+	recorded map[string]struct{} // values recorded by this Process
+	updated  map[string]struct{} // keys updated by this Process
+}
+
+func (hph *HexPatriciaHashed) startWitnessRecording() (*witnessRecorder, error) {
+	rec := &witnessRecorder{PatriciaContext: hph.ctx, w: hph.witness, recorded: map[string]struct{}{}, updated: map[string]struct{}{}}
+	hph.ctx = rec
+	if rec.w.State != nil {
+		return rec, nil
+	}
+	state, err := hph.EncodeCurrentState(nil)
+	if err != nil {
+		return nil, err
+	}
+	rec.w.State = state
+	// values of the root leaf are loaded into the trie by SetState
+	if hph.root.accountAddrLen > 0 {
+		if _, err := rec.Account(hph.root.accountAddr[:hph.root.accountAddrLen]); err != nil {
+			return nil, err
+		}
+	}
+	if hph.root.storageAddrLen > 0 {
+		if _, err := rec.Storage(hph.root.storageAddr[:hph.root.storageAddrLen]); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// stopWitnessRecording restores original context. Values of updated keys read by the trie through context could
+// be post-state, so they are dropped - only values put by context owner stay.
+func (hph *HexPatriciaHashed) stopWitnessRecording(rec *witnessRecorder) {
+	hph.ctx = rec.PatriciaContext
+	for k := range rec.updated {
+		if _, ok := rec.recorded[k]; !ok {
+			continue
+		}
+		delete(rec.w.Accounts, k)
+		delete(rec.w.Storage, k)
+	}
+}
+
+func (rec *witnessRecorder) Branch(prefix []byte) ([]byte, uint64, error) {
+	data, step, err := rec.PatriciaContext.Branch(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := rec.w.written[string(prefix)]; !ok {
+		if _, ok := rec.w.Branches[string(prefix)]; !ok {
+			rec.w.Branches[string(prefix)] = common.Copy(data)
+		}
+	}
+	return data, step, nil
+}
+
+func (rec *witnessRecorder) PutBranch(prefix []byte, data []byte, prevData []byte, prevStep uint64) error {
+	rec.w.written[string(prefix)] = struct{}{}
+	return rec.PatriciaContext.PutBranch(prefix, data, prevData, prevStep)
+}
+
+func (rec *witnessRecorder) Account(plainKey []byte) (*Update, error) {
+	u, err := rec.PatriciaContext.Account(plainKey)
+	if err != nil {
+		return nil, err
+	}
+	rec.record(rec.w.Accounts, plainKey, u)
+	return u, nil
+}
+
+func (rec *witnessRecorder) Storage(plainKey []byte) (*Update, error) {
+	u, err := rec.PatriciaContext.Storage(plainKey)
+	if err != nil {
+		return nil, err
+	}
+	rec.record(rec.w.Storage, plainKey, u)
+	return u, nil
+}
+
+func (rec *witnessRecorder) record(values map[string]*Update, plainKey []byte, u *Update) {
+	if _, ok := values[string(plainKey)]; ok {
+		return
+	}
+	cp := *u
+	values[string(plainKey)] = &cp
+	rec.recorded[string(plainKey)] = struct{}{}
+}
+
+// witnessContext serves PatriciaContext reads from witness and post-state updates, branch updates are kept in memory
+type witnessContext struct {
+	w        *Witness
+	updates  map[string]*Update
+	branches map[string][]byte
+}
+
+func (wc *witnessContext) Branch(prefix []byte) ([]byte, uint64, error) {
+	if data, ok := wc.branches[string(prefix)]; ok {
+		return data, 0, nil
+	}
+	data, ok := wc.w.Branches[string(prefix)]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: branch [%x] is missing", ErrIncompleteWitness, prefix)
+	}
+	if len(data) == 0 {
+		return nil, 0, nil
+	}
+	return data, 0, nil
+}
+
+func (wc *witnessContext) PutBranch(prefix []byte, data []byte, prevData []byte, prevStep uint64) error {
+	wc.branches[string(prefix)] = common.Copy(data)
+	return nil
+}
+
+func (wc *witnessContext) Account(plainKey []byte) (*Update, error) {
+	return wc.value(wc.w.Accounts, plainKey)
+}
+
+func (wc *witnessContext) Storage(plainKey []byte) (*Update, error) {
+	return wc.value(wc.w.Storage, plainKey)
+}
+
+func (wc *witnessContext) value(values map[string]*Update, plainKey []byte) (*Update, error) {
+	u, ok := wc.updates[string(plainKey)]
+	if !ok {
+		if u, ok = values[string(plainKey)]; !ok {
+			return nil, fmt.Errorf("%w: value of %x is missing", ErrIncompleteWitness, plainKey)
+		}
+	}
+	cp := *u
+	return &cp, nil
+}
+
+// VerifyWitness recomputes root hash of the trie after applying `updates` to the pre-state described by witness.
+// `updates` are post-state values of keys updated since witness recording started (plainKey -> value as
+// PatriciaContext.Account/Storage returns it, with DeleteUpdate flag for deleted keys).
+// Nothing but witness and updates is used: ErrIncompleteWitness is returned if trie needs anything else.
+func VerifyWitness(ctx context.Context, w *Witness, updates map[string]*Update, tmpdir string) (rootHash []byte, err error) {
+	wc := &witnessContext{w: w, updates: updates, branches: make(map[string][]byte)}
+	hph := NewHexPatriciaHashed(length.Addr, wc, tmpdir)
+	if err := hph.SetState(w.State); err != nil {
+		return nil, fmt.Errorf("witness state: %w", err)
+	}
+	if len(updates) == 0 {
+		return hph.RootHash()
+	}
+
+	upds := NewUpdates(ModeDirect, tmpdir, hph.hashAndNibblizeKey)
+	defer upds.Close()
+	for k := range updates {
+		upds.TouchPlainKey([]byte(k), nil, nil)
+	}
+	return hph.Process(ctx, upds, "witness")
+}
+
+// Encode serializes witness, see format description above
+func (w *Witness) Encode() []byte {
+	var numBuf [binary.MaxVarintLen64]byte
+	buf := []byte{witnessVersion}
+	appendBytes := func(b []byte) {
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+	}
+	appendBytes(w.State)
+
+	buf = binary.AppendUvarint(buf, uint64(len(w.Branches)))
+	for _, k := range sortedKeys(w.Branches) {
+		appendBytes([]byte(k))
+		appendBytes(w.Branches[k])
+	}
+	for _, values := range []map[string]*Update{w.Accounts, w.Storage} {
+		buf = binary.AppendUvarint(buf, uint64(len(values)))
+		for _, k := range sortedKeys(values) {
+			appendBytes([]byte(k))
+			buf = values[k].Encode(buf, numBuf[:])
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(w.Code)))
+	for _, k := range sortedKeys(w.Code) {
+		appendBytes([]byte(k))
+		appendBytes(w.Code[k])
+	}
+	return buf
+}
+
+func DecodeWitness(buf []byte) (*Witness, error) {
+	if len(buf) == 0 || buf[0] != witnessVersion {
+		return nil, errors.New("decode witness: unknown version")
+	}
+	w, pos := NewWitness(), 1
+	readUint := func() (uint64, error) {
+		v, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("decode witness: bad uvarint at %d", pos)
+		}
+		pos += n
+		return v, nil
+	}
+	readBytes := func() ([]byte, error) {
+		l, err := readUint()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(buf)-pos) < l {
+			return nil, fmt.Errorf("decode witness: buffer too small at %d", pos)
+		}
+		b := common.Copy(buf[pos : pos+int(l)])
+		pos += int(l)
+		return b, nil
+	}
+
+	var err error
+	if w.State, err = readBytes(); err != nil {
+		return nil, err
+	}
+	if len(w.State) == 0 {
+		w.State = nil // nothing was recorded, trie is empty
+	}
+	count, err := readUint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		k, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if w.Branches[string(k)], err = readBytes(); err != nil {
+			return nil, err
+		}
+	}
+	for _, values := range []map[string]*Update{w.Accounts, w.Storage} {
+		if count, err = readUint(); err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			k, err := readBytes()
+			if err != nil {
+				return nil, err
+			}
+			u := new(Update)
+			if pos, err = u.Decode(buf, pos); err != nil {
+				return nil, fmt.Errorf("decode witness: %w", err)
+			}
+			values[string(k)] = u
+		}
+	}
+	if count, err = readUint(); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < count; i++ {
+		k, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if w.Code[string(k)], err = readBytes(); err != nil {
+			return nil, err
+		}
+	}
+	if pos != len(buf) {
+		return nil, fmt.Errorf("decode witness: %d trailing bytes", len(buf)-pos)
+	}
+	return w, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+func Test_HexPatriciaHashed_Witness(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ms := NewMockState(t)
+	hph := NewHexPatriciaHashed(length.Addr, ms, ms.TempDir())
+	addr := func(i int) string { return fmt.Sprintf("%040x", i) }
+	loc := func(i int) string { return fmt.Sprintf("%064x", i) }
+
+	builder := NewUpdateBuilder()
+	for i := 0; i < 30; i++ {
+		builder.Balance(addr(i), uint64(i+1)).Nonce(addr(i), uint64(i))
+	}
+	for i := 0; i < 10; i++ {
+		builder.Storage(addr(5), loc(i), fmt.Sprintf("%04x", i+1))
+		builder.Storage(addr(6), loc(i), fmt.Sprintf("%04x", i+1))
+	}
+	plainKeys, updates := builder.Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+	upds := WrapKeyUpdates(t, ModeDirect, hph.hashAndNibblizeKey, plainKeys, updates)
+	_, err := hph.Process(ctx, upds, "")
+	require.NoError(t, err)
+	upds.Close()
+
+	// block: changes some accounts and storage, creates new ones and deletes others
+	plainKeys, updates = NewUpdateBuilder().
+		Balance(addr(1), 100).
+		Nonce(addr(7), 77).
+		Balance(addr(40), 40).
+		Storage(addr(5), loc(3), "0303").
+		Storage(addr(5), loc(20), "2020").
+		DeleteStorage(addr(6), loc(4)).
+		Delete(addr(9)).
+		Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+
+	w := NewWitness()
+	hph.SetWitness(w)
+	upds = WrapKeyUpdates(t, ModeDirect, hph.hashAndNibblizeKey, plainKeys, updates)
+	defer upds.Close()
+	rootHash, err := hph.Process(ctx, upds, "")
+	require.NoError(t, err)
+	hph.SetWitness(nil)
+
+	require.NotEmpty(t, w.State)
+	require.NotEmpty(t, w.Branches)
+	for _, k := range plainKeys {
+		require.NotContains(t, w.Accounts, string(k), "post-state of updated key")
+		require.NotContains(t, w.Storage, string(k), "post-state of updated key")
+	}
+
+	post := make(map[string]*Update)
+	for _, k := range plainKeys {
+		var u *Update
+		if len(k) == length.Addr {
+			u, err = ms.Account(k)
+		} else {
+			u, err = ms.Storage(k)
+		}
+		require.NoError(t, err)
+		post[string(k)] = u
+	}
+
+	decoded, err := DecodeWitness(w.Encode())
+	require.NoError(t, err)
+	require.Equal(t, w.State, decoded.State)
+	require.Equal(t, len(w.Branches), len(decoded.Branches))
+	require.Equal(t, len(w.Accounts), len(decoded.Accounts))
+	require.Equal(t, len(w.Storage), len(decoded.Storage))
+
+	statelessRoot, err := VerifyWitness(ctx, decoded, post, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, rootHash, statelessRoot)
+
+	t.Run("incomplete", func(t *testing.T) {
+		for prefix := range decoded.Branches {
+			delete(decoded.Branches, prefix)
+			break
+		}
+		_, err := VerifyWitness(ctx, decoded, post, t.TempDir())
+		require.ErrorIs(t, err, ErrIncompleteWitness)
+	})
+
+	t.Run("wrong update", func(t *testing.T) {
+		wrong := make(map[string]*Update)
+		for k, u := range post {
+			wrong[k] = u
+		}
+		u := *post[string(decodeHex(addr(1)))]
+		u.Balance.SetUint64(101)
+		wrong[string(decodeHex(addr(1)))] = &u
+
+		statelessRoot, err := VerifyWitness(ctx, w, wrong, t.TempDir())
+		require.NoError(t, err)
+		require.NotEqual(t, rootHash, statelessRoot)
+	})
+}
+
+func Test_HexPatriciaHashed_WitnessEmptyTrie(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ms := NewMockState(t)
+	hph := NewHexPatriciaHashed(length.Addr, ms, ms.TempDir())
+
+	plainKeys, updates := NewUpdateBuilder().
+		Balance(fmt.Sprintf("%040x", 1), 1).
+		Balance(fmt.Sprintf("%040x", 2), 2).
+		Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+
+	w := NewWitness()
+	hph.SetWitness(w)
+	upds := WrapKeyUpdates(t, ModeDirect, hph.hashAndNibblizeKey, plainKeys, updates)
+	defer upds.Close()
+	rootHash, err := hph.Process(ctx, upds, "")
+	require.NoError(t, err)
+
+	post := make(map[string]*Update)
+	for _, k := range plainKeys {
+		post[string(k)], err = ms.Account(k)
+		require.NoError(t, err)
+	}
+	decoded, err := DecodeWitness(w.Encode())
+	require.NoError(t, err)
+	statelessRoot, err := VerifyWitness(ctx, decoded, post, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, rootHash, statelessRoot)
+}
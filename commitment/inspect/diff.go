@@ -0,0 +1,119 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package inspect
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// NodeDiff is a branch node which differs in two trie states.
+type NodeDiff struct {
+	Path   Nibbles `json:"path"`
+	Before *Node   `json:"before,omitempty"` // nil if node was absent
+	After  *Node   `json:"after,omitempty"`  // nil if node is deleted
+	// Changed is a bitmap of nibbles which cells differ, see commitment.BranchData.DiffCells
+	Changed uint16 `json:"changed"`
+}
+
+func (d *NodeDiff) String() string {
+	switch {
+	case d.Before == nil:
+		return fmt.Sprintf("+ [%s] created\n%s", d.Path, d.After)
+	case d.After == nil:
+		return fmt.Sprintf("- [%s] deleted\n%s", d.Path, d.Before)
+	default:
+		return fmt.Sprintf("~ [%s] changed cells %016b\nbefore: %safter:  %s", d.Path, d.Changed, d.Before, d.After)
+	}
+}
+
+// Diff compares branch nodes under nibble `prefix` of two trie states (e.g. read as of two txNums) and calls fn for
+// each node which differs, parents before children. Subtries which hashes are equal are not visited.
+func Diff(before, after Reader, prefix []byte, fn func(d *NodeDiff) error) error {
+	return diff(before, after, nil, prefix, fn)
+}
+
+func diff(before, after Reader, path []byte, prefix []byte, fn func(d *NodeDiff) error) error {
+	nb, err := ReadNode(before, path)
+	if err != nil {
+		return err
+	}
+	na, err := ReadNode(after, path)
+	if err != nil {
+		return err
+	}
+	if nb == nil && na == nil {
+		return nil
+	}
+	if nb != nil && na != nil && bytes.Equal(nb.data, na.data) {
+		return nil // the same hashes of all children
+	}
+
+	d := &NodeDiff{Path: bytes.Clone(path), Before: nb, After: na, Changed: 0xffff}
+	if nb != nil && na != nil {
+		if d.Changed, err = nb.data.DiffCells(na.data); err != nil {
+			return err
+		}
+	}
+	if d.Changed != 0 && bytes.HasPrefix(path, prefix) {
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+
+	// children which hashes differ in two states
+	hashes := make(map[string][2][]byte)
+	collect := func(n *Node, side int) {
+		if n == nil {
+			return
+		}
+		for i := range n.Cells {
+			cp, _ := n.childPath(&n.Cells[i])
+			if cp == nil || !inScope(cp, prefix) {
+				continue
+			}
+			h := hashes[string(cp)]
+			h[side] = n.Cells[i].Hash
+			hashes[string(cp)] = h
+		}
+	}
+	collect(nb, 0)
+	collect(na, 1)
+	children := make([]string, 0, len(hashes))
+	for cp, h := range hashes {
+		if !bytes.Equal(h[0], h[1]) {
+			children = append(children, cp)
+		}
+	}
+	slices.Sort(children)
+	for _, cp := range children {
+		if err := diff(before, after, []byte(cp), prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintDiff writes branch nodes under nibble `prefix` which differ in two trie states in human-readable form.
+func PrintDiff(w io.Writer, before, after Reader, prefix []byte) error {
+	return Diff(before, after, prefix, func(d *NodeDiff) error {
+		_, err := io.WriteString(w, d.String())
+		return err
+	})
+}
@@ -0,0 +1,255 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+// Package inspect explores branch nodes of hex patricia trie stored in CommitmentDomain: walks the trie under
+// nibble prefix, prints or exports branches as JSON, collects per-depth statistics and diffs two trie states.
+package inspect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/common/hexutility"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/crypto"
+)
+
+// Reader reads branch nodes of CommitmentDomain by compacted nibble path, the same way commitment.PatriciaContext
+// does (state.SharedDomainsCommitmentContext implements it).
+type Reader interface {
+	Branch(prefix []byte) ([]byte, uint64, error)
+}
+
+// Node is a decoded branch node.
+type Node struct {
+	Path     Nibbles          `json:"path"`
+	Key      hexutility.Bytes `json:"key"` // compacted path, key of the node in CommitmentDomain
+	Size     int              `json:"size"`
+	TouchMap uint16           `json:"touchMap"`
+	AfterMap uint16           `json:"afterMap"`
+	Cells    []Cell           `json:"cells"`
+
+	data commitment.BranchData
+}
+
+// Cell is a child of branch node.
+type Cell struct {
+	Nibble      int              `json:"nibble"`
+	Extension   Nibbles          `json:"extension,omitempty"`
+	AccountAddr hexutility.Bytes `json:"accountAddr,omitempty"`
+	StorageAddr hexutility.Bytes `json:"storageAddr,omitempty"`
+	Hash        hexutility.Bytes `json:"hash,omitempty"`
+	LeafHash    hexutility.Bytes `json:"leafHash,omitempty"`
+	// Child is a path of branch node the cell refers to, nil if cell is a leaf
+	Child Nibbles `json:"child,omitempty"`
+}
+
+// Nibbles is a path in the trie, one nibble per byte, printed as hex digits.
+type Nibbles []byte
+
+func (n Nibbles) String() string {
+	var sb strings.Builder
+	for _, nib := range n {
+		fmt.Fprintf(&sb, "%x", nib)
+	}
+	return sb.String()
+}
+
+func (n Nibbles) MarshalText() ([]byte, error) { return []byte(n.String()), nil }
+
+func (n *Nibbles) UnmarshalText(text []byte) error {
+	res := make(Nibbles, len(text))
+	for i, c := range text {
+		v, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil {
+			return fmt.Errorf("invalid nibble %q: %w", c, err)
+		}
+		res[i] = byte(v)
+	}
+	*n = res
+	return nil
+}
+
+// Depth returns depth of the node in the trie (nibbles count). Storage tries start at depth 64.
+func (n *Node) Depth() int { return len(n.Path) }
+
+func (n *Node) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%s] key=%x size=%d touchMap=%016b afterMap=%016b\n", n.Path, []byte(n.Key), n.Size, n.TouchMap, n.AfterMap)
+	for _, c := range n.Cells {
+		fmt.Fprintf(&sb, "  %x =>", c.Nibble)
+		if len(c.Extension) > 0 {
+			fmt.Fprintf(&sb, " ext=%s", c.Extension)
+		}
+		if len(c.AccountAddr) > 0 {
+			fmt.Fprintf(&sb, " account=%x", []byte(c.AccountAddr))
+		}
+		if len(c.StorageAddr) > 0 {
+			fmt.Fprintf(&sb, " storage=%x", []byte(c.StorageAddr))
+		}
+		if len(c.Hash) > 0 {
+			fmt.Fprintf(&sb, " hash=%x", []byte(c.Hash))
+		}
+		if len(c.LeafHash) > 0 {
+			fmt.Fprintf(&sb, " leafHash=%x", []byte(c.LeafHash))
+		}
+		if c.Child != nil {
+			fmt.Fprintf(&sb, " -> [%s]", c.Child)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// ReadNode reads and decodes branch node at nibble path, returns nil if there is no such node.
+func ReadNode(r Reader, path []byte) (*Node, error) {
+	key := commitment.HexToCompactedKey(path)
+	data, _, err := r.Branch(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	touchMap, afterMap, cells, err := commitment.BranchData(data).Cells()
+	if err != nil {
+		return nil, fmt.Errorf("branch [%x]: %w", path, err)
+	}
+	n := &Node{Path: bytes.Clone(path), Key: key, Size: len(data), TouchMap: touchMap, AfterMap: afterMap, data: data}
+	n.Cells = make([]Cell, len(cells))
+	for i, c := range cells {
+		n.Cells[i] = Cell{Nibble: c.Nibble, Extension: c.Extension, AccountAddr: c.AccountAddr, StorageAddr: c.StorageAddr,
+			Hash: c.Hash, LeafHash: c.LeafHash}
+	}
+	return n, nil
+}
+
+// childPath returns path of branch node cell refers to. Branch is required to exist if cell is a hash of
+// subtrie, while account cell with storage may refer to a single storage leaf, then there is no branch.
+func (n *Node) childPath(c *Cell) (path []byte, required bool) {
+	switch {
+	case len(c.StorageAddr) > 0 || len(c.Hash) == 0:
+		return nil, false
+	case len(c.AccountAddr) > 0:
+		// storage trie of the account starts right after its hashed key
+		hashed := crypto.Keccak256(c.AccountAddr)
+		path = make([]byte, 0, 2*length.Hash+len(c.Extension))
+		for _, b := range hashed {
+			path = append(path, b>>4, b&0xf)
+		}
+		return append(path, c.Extension...), false
+	default:
+		path = append(append(bytes.Clone(n.Path), byte(c.Nibble)), c.Extension...)
+		return path, true
+	}
+}
+
+// inScope reports whether subtrie at path has nodes under prefix
+func inScope(path, prefix []byte) bool {
+	return bytes.HasPrefix(path, prefix) || bytes.HasPrefix(prefix, path)
+}
+
+// Walk visits branch nodes which paths start with nibble `prefix` in depth-first order: node first, then its
+// children by nibble. Cell.Child is set for cells which refer to existing branch node.
+func Walk(r Reader, prefix []byte, fn func(n *Node) error) error {
+	return walk(r, nil, true, prefix, fn)
+}
+
+func walk(r Reader, path []byte, required bool, prefix []byte, fn func(n *Node) error) error {
+	n, err := ReadNode(r, path)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		if required && len(path) > 0 {
+			return fmt.Errorf("branch [%x] referenced by parent is not found", path)
+		}
+		return nil
+	}
+	children := make([][]byte, len(n.Cells))
+	for i := range n.Cells {
+		cp, req := n.childPath(&n.Cells[i])
+		if cp == nil || !inScope(cp, prefix) {
+			continue
+		}
+		if !req {
+			// check if storage trie has branch
+			data, _, err := r.Branch(commitment.HexToCompactedKey(cp))
+			if err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				continue
+			}
+		}
+		n.Cells[i].Child, children[i] = cp, cp
+	}
+	if bytes.HasPrefix(path, prefix) {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	for _, cp := range children {
+		if cp == nil {
+			continue
+		}
+		if err := walk(r, cp, true, prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print writes branch nodes under nibble `prefix` in human-readable form, indented by depth.
+func Print(w io.Writer, r Reader, prefix []byte) error {
+	return Walk(r, prefix, func(n *Node) error {
+		indent := strings.Repeat("  ", n.Depth())
+		for _, line := range strings.Split(strings.TrimSuffix(n.String(), "\n"), "\n") {
+			if _, err := fmt.Fprintf(w, "%s%s\n", indent, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteJSON writes branch nodes under nibble `prefix` as JSON array, nodes are written one by one as they are read.
+func WriteJSON(w io.Writer, r Reader, prefix []byte) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	sep := ""
+	if err := Walk(r, prefix, func(n *Node) error {
+		b, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "%s\n%s", sep, b); err != nil {
+			return err
+		}
+		sep = ","
+		return nil
+	}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
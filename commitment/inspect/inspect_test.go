@@ -0,0 +1,204 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+// testState keeps branches and values in memory
+type testState struct {
+	branches map[string][]byte
+	values   map[string]*commitment.Update
+}
+
+func (s *testState) Branch(prefix []byte) ([]byte, uint64, error) {
+	return s.branches[string(prefix)], 0, nil
+}
+
+func (s *testState) PutBranch(prefix []byte, data []byte, prevData []byte, prevStep uint64) error {
+	s.branches[string(prefix)] = common.Copy(data)
+	return nil
+}
+
+func (s *testState) Account(plainKey []byte) (*commitment.Update, error) {
+	if u, ok := s.values[string(plainKey)]; ok {
+		return u, nil
+	}
+	return &commitment.Update{Flags: commitment.DeleteUpdate}, nil
+}
+
+func (s *testState) Storage(plainKey []byte) (*commitment.Update, error) { return s.Account(plainKey) }
+
+func (s *testState) snapshot() *testState {
+	return &testState{branches: maps.Clone(s.branches), values: s.values}
+}
+
+// apply sets balance of accounts `from`..`to` and their storage slots, then computes commitment
+func (s *testState) apply(t *testing.T, from, to int, balance uint64, slots int) {
+	t.Helper()
+	trie, updates := commitment.InitializeTrieAndUpdates(commitment.VariantHexPatriciaTrie, commitment.ModeDirect, t.TempDir(), nil)
+	defer updates.Close()
+	trie.ResetContext(s)
+	for i := from; i < to; i++ {
+		addr := testAddr(i)
+		u := &commitment.Update{Flags: commitment.BalanceUpdate | commitment.NonceUpdate, Nonce: 1}
+		u.Balance.SetUint64(balance)
+		copy(u.CodeHash[:], commitment.EmptyCodeHash)
+		s.values[string(addr)] = u
+		updates.TouchPlainKey(addr, nil, nil)
+		for l := 0; l < slots; l++ {
+			key := append(common.Copy(addr), make([]byte, length.Hash)...)
+			binary.BigEndian.PutUint32(key[length.Addr+length.Hash-4:], uint32(l))
+			su := &commitment.Update{Flags: commitment.StorageUpdate, StorageLen: 8}
+			binary.BigEndian.PutUint64(su.Storage[:], balance+uint64(l)+1)
+			s.values[string(key)] = su
+			updates.TouchPlainKey(key, nil, nil)
+		}
+	}
+	_, err := trie.Process(context.Background(), updates, "")
+	require.NoError(t, err)
+}
+
+func testAddr(i int) []byte {
+	addr := make([]byte, length.Addr)
+	binary.BigEndian.PutUint32(addr, uint32(i)*2654435761)
+	return addr
+}
+
+func storedBranches(s *testState) map[string][]byte {
+	res := make(map[string][]byte)
+	for k, v := range s.branches {
+		if len(v) > 0 && k != "state" {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+
+	s := &testState{branches: make(map[string][]byte), values: make(map[string]*commitment.Update)}
+	s.apply(t, 0, 200, 1, 0)
+	s.apply(t, 0, 10, 2, 20) // accounts with storage tries
+
+	// every stored branch is reachable from the root
+	visited := make(map[string]struct{})
+	var storageNodes int
+	require.NoError(t, Walk(s, nil, func(n *Node) error {
+		require.Equal(t, commitment.HexToCompactedKey(n.Path), []byte(n.Key))
+		require.NotEmpty(t, n.Cells)
+		visited[string(n.Key)] = struct{}{}
+		if n.Depth() >= 64 {
+			storageNodes++
+		}
+		for _, c := range n.Cells {
+			if c.Child != nil {
+				require.Contains(t, s.branches, string(commitment.HexToCompactedKey(c.Child)))
+			}
+		}
+		return nil
+	}))
+	require.Equal(t, len(storedBranches(s)), len(visited))
+	require.NotZero(t, storageNodes)
+
+	// prefix limits the subtrie
+	prefix := []byte{0x5}
+	var underPrefix int
+	require.NoError(t, Walk(s, prefix, func(n *Node) error {
+		require.True(t, bytes.HasPrefix(n.Path, prefix), "path %s", n.Path)
+		underPrefix++
+		return nil
+	}))
+	require.NotZero(t, underPrefix)
+	require.Less(t, underPrefix, len(visited))
+
+	var sb strings.Builder
+	require.NoError(t, Print(&sb, s, prefix))
+	require.Equal(t, underPrefix, strings.Count(sb.String(), "afterMap="))
+
+	sb.Reset()
+	require.NoError(t, WriteJSON(&sb, s, nil))
+	var exported []Node
+	require.NoError(t, json.Unmarshal([]byte(sb.String()), &exported))
+	require.Len(t, exported, len(visited))
+
+	stat, err := CollectStat(s, nil)
+	require.NoError(t, err)
+	total := stat.Total()
+	require.EqualValues(t, len(visited), total.BranchCount)
+	require.EqualValues(t, 200, total.APKCount)
+	require.EqualValues(t, 0, stat.Depths()[0])
+	require.NotZero(t, total.MinCellSize)
+	require.GreaterOrEqual(t, total.MaxCellSize, total.MinCellSize)
+	sb.Reset()
+	require.NoError(t, stat.Print(&sb))
+	require.Contains(t, sb.String(), "total")
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	s := &testState{branches: make(map[string][]byte), values: make(map[string]*commitment.Update)}
+	s.apply(t, 0, 200, 1, 0)
+	s.apply(t, 0, 4, 1, 10)
+	before := s.snapshot()
+	s.apply(t, 100, 103, 2, 3)
+
+	changed := make(map[string]struct{})
+	for k, v := range storedBranches(s) {
+		if !bytes.Equal(before.branches[k], v) {
+			changed[k] = struct{}{}
+		}
+	}
+	require.NotEmpty(t, changed)
+
+	var diffs, created int
+	require.NoError(t, Diff(before, s, nil, func(d *NodeDiff) error {
+		require.Contains(t, changed, string(commitment.HexToCompactedKey(d.Path)))
+		require.NotNil(t, d.After)
+		if d.Before == nil {
+			created++
+		}
+		diffs++
+		return nil
+	}))
+	require.NotZero(t, diffs)
+	require.NotZero(t, created) // new storage tries
+
+	var sb strings.Builder
+	require.NoError(t, PrintDiff(&sb, s, before, nil))
+	require.Contains(t, sb.String(), "deleted")
+
+	require.NoError(t, Diff(s, s, nil, func(d *NodeDiff) error {
+		t.Fatalf("unexpected diff of the same state: %s", d)
+		return nil
+	}))
+}
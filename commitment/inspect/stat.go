@@ -0,0 +1,83 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package inspect
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+)
+
+// DepthStat is statistics of branch nodes at some depth, see commitment.BranchStat.
+type DepthStat map[int]*commitment.BranchStat
+
+// CollectStat walks branch nodes under nibble `prefix` and collects their statistics by depth.
+func CollectStat(r Reader, prefix []byte) (DepthStat, error) {
+	stat := make(DepthStat)
+	err := Walk(r, prefix, func(n *Node) error {
+		bs := commitment.DecodeBranchAndCollectStat(n.Key, n.data, commitment.VariantHexPatriciaTrie)
+		if bs == nil {
+			return fmt.Errorf("branch [%s]: failed to collect stat", n.Path)
+		}
+		if stat[n.Depth()] == nil {
+			stat[n.Depth()] = &commitment.BranchStat{Depth: uint64(n.Depth()), MinCellSize: bs.MinCellSize}
+		}
+		stat[n.Depth()].Collect(bs)
+		return nil
+	})
+	return stat, err
+}
+
+// Total returns statistics of all depths.
+func (s DepthStat) Total() *commitment.BranchStat {
+	total := &commitment.BranchStat{}
+	for i, d := range s.Depths() {
+		if i == 0 {
+			total.MinCellSize = s[d].MinCellSize
+		}
+		total.Collect(s[d])
+	}
+	return total
+}
+
+// Depths returns depths having branch nodes in ascending order.
+func (s DepthStat) Depths() []int {
+	depths := make([]int, 0, len(s))
+	for d := range s {
+		depths = append(depths, d)
+	}
+	slices.Sort(depths)
+	return depths
+}
+
+// Print writes statistics as a table, one row per depth.
+func (s DepthStat) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "depth\tbranches\tkeys\tvalues\tcells\tmin cell\tmax cell\taccounts\tstorage\thashes\textensions\tleaf hashes\t")
+	row := func(depth string, bs *commitment.BranchStat) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", depth, bs.BranchCount, bs.KeySize, bs.ValSize,
+			bs.CellCount, bs.MinCellSize, bs.MaxCellSize, bs.APKCount, bs.SPKCount, bs.HashCount, bs.ExtCount, bs.LeafHashCount)
+	}
+	for _, d := range s.Depths() {
+		row(fmt.Sprintf("%d", d), s[d])
+	}
+	row("total", s.Total())
+	return tw.Flush()
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/bandersnatch"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+)
+
+// Pedersen vector commitments used by Verkle trees: commitment to vector v is sum(v[i]*G[i]), where G are 256
+// generators of Banderwagon group (prime order quotient of Bandersnatch curve, points (x, y) and (-x, -y) are equal)
+// and v[i] are elements of Bandersnatch scalar field. Generators are derived from a public seed the same way as in
+// go-ipa ("eth_verkle_oct_2021" CRS), so nobody knows discrete logs between them.
+//
+// Commitments are only updated (C' = C + (v'[i]-v[i])*G[i]), so there is no need in multi-scalar multiplication.
+// Opening proofs (IPA) are not needed to compute state root and are not implemented.
+
+const (
+	verkleWidth   = 256
+	verkleCRSSeed = "eth_verkle_oct_2021"
+)
+
+var (
+	verkleCRSOnce sync.Once
+	verkleCRS     [verkleWidth]bandersnatch.PointAffine
+	verkleOrder   big.Int // order of Banderwagon group, modulus of scalar field
+)
+
+func verkleGenerators() *[verkleWidth]bandersnatch.PointAffine {
+	verkleCRSOnce.Do(func() {
+		curve := bandersnatch.GetEdwardsCurve()
+		verkleOrder.Set(&curve.Order)
+
+		var buf [8]byte
+		for i, found := uint64(0), 0; found < verkleWidth; i++ {
+			h := sha256.New()
+			h.Write([]byte(verkleCRSSeed))
+			binary.BigEndian.PutUint64(buf[:], i)
+			h.Write(buf[:])
+
+			var x fr.Element
+			x.SetBytes(h.Sum(nil))
+			if p, ok := banderwagonFromX(&x); ok {
+				verkleCRS[found] = p
+				found++
+			}
+		}
+	})
+	return &verkleCRS
+}
+
+// banderwagonFromX returns point of Banderwagon group with given x and lexicographically largest y.
+func banderwagonFromX(x *fr.Element) (p bandersnatch.PointAffine, ok bool) {
+	curve := bandersnatch.GetEdwardsCurve()
+	var one, x2, num, den, y fr.Element
+	one.SetOne()
+	x2.Square(x)
+
+	// subgroup check: 1 - a*x^2 must be a square
+	num.Mul(&x2, &curve.A)
+	num.Sub(&one, &num)
+	if num.Legendre() != 1 {
+		return p, false
+	}
+	// y^2 = (1 - a*x^2) / (1 - d*x^2)
+	den.Mul(&x2, &curve.D)
+	den.Sub(&one, &den)
+	num.Div(&num, &den)
+	if y.Sqrt(&num) == nil {
+		return p, false
+	}
+	if !y.LexicographicallyLargest() {
+		y.Neg(&y)
+	}
+	p.X.Set(x)
+	p.Y.Set(&y)
+	return p, true
+}
+
+// verkleAddScaled sets c = c + s*G[i], s is taken modulo group order.
+func verkleAddScaled(c *bandersnatch.PointAffine, i int, s *big.Int) {
+	gens := verkleGenerators()
+	if s.Sign() == 0 {
+		return
+	}
+	var sm big.Int
+	sm.Mod(s, &verkleOrder)
+	var term bandersnatch.PointAffine
+	term.ScalarMultiplication(&gens[i], &sm)
+	c.Add(c, &term)
+}
+
+// verkleIdentity returns neutral element of the group.
+func verkleIdentity() (p bandersnatch.PointAffine) {
+	p.Y.SetOne()
+	return p
+}
+
+// verkleCommit returns commitment to vector v, len(v) <= verkleWidth.
+func verkleCommit(v []*big.Int) bandersnatch.PointAffine {
+	c := verkleIdentity()
+	for i := range v {
+		if v[i] != nil {
+			verkleAddScaled(&c, i, v[i])
+		}
+	}
+	return c
+}
+
+// verkleMapToScalar maps commitment to element of scalar field: x/y reduced modulo group order. Result is the same
+// for P and -P, identity maps to zero.
+func verkleMapToScalar(p *bandersnatch.PointAffine) *big.Int {
+	verkleGenerators()
+	var xy fr.Element
+	xy.Div(&p.X, &p.Y)
+	var res big.Int
+	xy.BigInt(&res)
+	return res.Mod(&res, &verkleOrder)
+}
+
+// verkleScalarBytes returns little-endian 32 bytes of scalar (go-verkle HashPointToBytes encoding).
+func verkleScalarBytes(s *big.Int) (res [32]byte) {
+	s.FillBytes(res[:])
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+// verkleScalarFromLE interprets little-endian bytes as integer.
+func verkleScalarFromLE(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// verkleSerializePoint returns compressed encoding of Banderwagon element: x*sign(y) big-endian. Root hash of
+// Verkle trie is serialized root commitment.
+func verkleSerializePoint(p *bandersnatch.PointAffine) []byte {
+	x := p.X
+	if !p.Y.LexicographicallyLargest() {
+		x.Neg(&x)
+	}
+	b := x.Bytes()
+	return b[:]
+}
+
+const verklePointLen = 2 * fr.Bytes
+
+// verkleEncodePoint appends uncompressed affine point, it can be decoded without square root computation.
+func verkleEncodePoint(buf []byte, p *bandersnatch.PointAffine) []byte {
+	x, y := p.X.Bytes(), p.Y.Bytes()
+	buf = append(buf, x[:]...)
+	return append(buf, y[:]...)
+}
+
+func verkleDecodePoint(buf []byte) (p bandersnatch.PointAffine, err error) {
+	if len(buf) < verklePointLen {
+		return p, fmt.Errorf("verkle point: too short %d", len(buf))
+	}
+	if err := p.X.SetBytesCanonical(buf[:fr.Bytes]); err != nil {
+		return p, fmt.Errorf("verkle point x: %w", err)
+	}
+	if err := p.Y.SetBytesCanonical(buf[fr.Bytes:verklePointLen]); err != nil {
+		return p, fmt.Errorf("verkle point y: %w", err)
+	}
+	if !p.IsOnCurve() {
+		return p, fmt.Errorf("verkle point is not on curve: %x", buf[:verklePointLen])
+	}
+	return p, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/holiman/uint256"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+)
+
+// Tree keys of EIP-6800: account header (basic data, code hash, first 64 storage slots and first 128 code chunks)
+// shares one stem, the rest of storage slots and code chunks are grouped by 256 under other stems.
+
+const (
+	verkleStemLen = 31
+
+	verkleBasicDataLeafKey     = 0
+	verkleCodeHashLeafKey      = 1
+	verkleHeaderStorageOffset  = 64
+	verkleCodeOffset           = 128
+	verkleMaxCodeChunkPushData = 31
+)
+
+// verkleMainStorageOffset = 256^31
+var verkleMainStorageOffset = new(big.Int).Lsh(big.NewInt(1), 8*verkleStemLen)
+
+// VerkleTreeKey returns key of EIP-6800 tree: pedersen_hash(address32 ++ treeIndex)[:31] ++ subIndex.
+func VerkleTreeKey(addr []byte, treeIndex *uint256.Int, subIndex byte) []byte {
+	var input [64]byte
+	copy(input[32-len(addr):32], addr)
+	idx := treeIndex.Bytes32() // big-endian, tree index is encoded as little-endian
+	for i := range idx {
+		input[32+i] = idx[31-i]
+	}
+
+	// input is interpreted as 16-byte little-endian integers, preceded by domain separator 2 + 256*len(input)
+	v := make([]*big.Int, 1+len(input)/16)
+	v[0] = big.NewInt(2 + 256*int64(len(input)))
+	for i := 0; i < len(input)/16; i++ {
+		v[i+1] = verkleScalarFromLE(input[i*16 : (i+1)*16])
+	}
+	c := verkleCommit(v)
+	h := verkleScalarBytes(verkleMapToScalar(&c))
+
+	key := make([]byte, verkleStemLen+1)
+	copy(key, h[:verkleStemLen])
+	key[verkleStemLen] = subIndex
+	return key
+}
+
+// VerkleAccountHeaderKey returns tree key of account leaf (basic data, code hash) with given sub index.
+func VerkleAccountHeaderKey(addr []byte, subIndex byte) []byte {
+	return VerkleTreeKey(addr, new(uint256.Int), subIndex)
+}
+
+// VerkleStorageKey returns tree key of storage slot `slot` (32 bytes big-endian) of account `addr`.
+func VerkleStorageKey(addr, slot []byte) []byte {
+	pos := new(big.Int).SetBytes(slot)
+	if pos.Cmp(big.NewInt(verkleCodeOffset-verkleHeaderStorageOffset)) < 0 {
+		pos.Add(pos, big.NewInt(verkleHeaderStorageOffset))
+	} else {
+		pos.Add(pos, verkleMainStorageOffset)
+	}
+	return verkleKeyAtPosition(addr, pos)
+}
+
+// VerkleCodeChunkKey returns tree key of code chunk with given number.
+func VerkleCodeChunkKey(addr []byte, chunk uint64) []byte {
+	return verkleKeyAtPosition(addr, new(big.Int).SetUint64(verkleCodeOffset+chunk))
+}
+
+func verkleKeyAtPosition(addr []byte, pos *big.Int) []byte {
+	subIndex := byte(pos.Uint64())
+	treeIndex, _ := uint256.FromBig(new(big.Int).Rsh(pos, 8))
+	return VerkleTreeKey(addr, treeIndex, subIndex)
+}
+
+// verkleBasicData packs basic data leaf: version (1 byte), reserved (4 bytes), code size (3 bytes),
+// nonce (8 bytes) and balance (16 bytes), all big-endian.
+func verkleBasicData(nonce uint64, balance *uint256.Int, codeSize uint64) []byte {
+	v := make([]byte, 32)
+	v[5], v[6], v[7] = byte(codeSize>>16), byte(codeSize>>8), byte(codeSize)
+	binary.BigEndian.PutUint64(v[8:16], nonce)
+	b := balance.Bytes32()
+	copy(v[16:], b[16:])
+	return v
+}
+
+func verkleBasicDataCodeSize(v []byte) uint64 {
+	if len(v) < 8 {
+		return 0
+	}
+	return uint64(v[5])<<16 | uint64(v[6])<<8 | uint64(v[7])
+}
+
+// VerkleChunkifyCode splits code into 32-byte chunks: number of leading bytes which are push data followed by
+// 31 bytes of code, the last chunk is zero padded.
+func VerkleChunkifyCode(code []byte) [][]byte {
+	const (
+		push1  = 0x60
+		push32 = 0x7f
+	)
+	n := (len(code) + verkleMaxCodeChunkPushData - 1) / verkleMaxCodeChunkPushData
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		chunks[i] = make([]byte, length.Hash)
+		copy(chunks[i][1:], code[i*verkleMaxCodeChunkPushData:])
+	}
+	for pos := 0; pos < len(code); {
+		op := code[pos]
+		pos++
+		if op < push1 || op > push32 {
+			continue
+		}
+		end := pos + int(op-push1) + 1
+		// chunks starting inside push data tell how many of their bytes are push data
+		for c := (pos + verkleMaxCodeChunkPushData - 1) / verkleMaxCodeChunkPushData; c < n && c*verkleMaxCodeChunkPushData < end; c++ {
+			chunks[c][0] = byte(min(end-c*verkleMaxCodeChunkPushData, verkleMaxCodeChunkPushData))
+		}
+		pos = end
+	}
+	return chunks
+}
@@ -0,0 +1,856 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/bandersnatch"
+	"github.com/holiman/uint256"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+// VerkleTrie is an experimental commitment variant: Verkle tree of EIP-6800 with Pedersen commitments over
+// Banderwagon (see verkle_crypto.go). Width of internal nodes is 256, 32-byte tree keys are split into 31-byte stem
+// and suffix. All values of a stem are kept in one leaf node, leaf is placed at the shallowest depth where its stem
+// is unique, so tree shape (and root) depends only on the state, not on order of updates.
+//
+// Nodes are stored in CommitmentDomain via PatriciaContext.PutBranch. Each node is split into header and up to 16
+// groups of 16 children (values), so records stay small (values of CommitmentDomain table are limited) and only
+// changed groups are rewritten:
+//
+//	'i' ++ path      -> commitment (64 bytes) ++ bitmap of non-empty groups (2 bytes)
+//	'I' ++ path ++ g -> bitmap of children (2 bytes) ++ children:
+//	                    kind (1 byte) ++ child commitment mapped to scalar (32 bytes LE) [++ stem (31 bytes) for leaves]
+//	'l' ++ stem      -> commitment, C1, C2 (64 bytes each) ++ bitmap of non-empty groups (2 bytes)
+//	'L' ++ stem ++ g -> bitmap of values (2 bytes) ++ values (32 bytes each)
+//
+// Uncompressed points are stored to avoid square roots on decoding. Root hash is serialized root commitment.
+// Contract code is committed by chunks, so context must implement PatriciaCodeContext if state has contracts.
+type VerkleTrie struct {
+	ctx   PatriciaContext
+	trace bool
+
+	root      bandersnatch.PointAffine // commitment of the root node
+	rootKnown bool                     // otherwise root is read from context
+
+	// nodes touched by current Process, written back at the end of it
+	internals map[string]*verkleInternalNode
+	leaves    map[string]*verkleLeafNode
+	writes    map[string]map[byte][]byte // stem -> suffix -> new value, nil deletes value
+	stems     map[string][]byte          // address ++ tree index -> stem
+}
+
+func NewVerkleTrie(ctx PatriciaContext) *VerkleTrie {
+	return &VerkleTrie{ctx: ctx}
+}
+
+const (
+	verkleInternalNodePrefix  = 'i'
+	verkleInternalGroupPrefix = 'I'
+	verkleLeafNodePrefix      = 'l'
+	verkleLeafGroupPrefix     = 'L'
+
+	verkleGroupWidth = 16
+	verkleGroups     = verkleWidth / verkleGroupWidth
+)
+
+type verkleNodeKind byte
+
+const (
+	verkleEmpty verkleNodeKind = iota
+	verkleInternal
+	verkleLeaf
+)
+
+type verkleChild struct {
+	kind   verkleNodeKind
+	stem   []byte   // leaf only
+	scalar *big.Int // child commitment mapped to scalar field, nil for empty child
+}
+
+// verkleNodeRecord tracks stored parts of the node: header (part 0) and groups (part 1+g)
+type verkleNodeRecord struct {
+	prev     [1 + verkleGroups][]byte // as stored before Process, nil if part didn't exist
+	prevStep [1 + verkleGroups]uint64
+	dirty    [1 + verkleGroups]bool
+	deleted  bool
+}
+
+func (rec *verkleNodeRecord) touch(slot int) {
+	rec.dirty[0], rec.dirty[1+slot/verkleGroupWidth] = true, true
+}
+
+// touchAll marks all parts as updated, stored groups which became empty are deleted
+func (rec *verkleNodeRecord) touchAll() {
+	for i := range rec.dirty {
+		rec.dirty[i] = true
+	}
+}
+
+func (rec *verkleNodeRecord) record() *verkleNodeRecord { return rec }
+
+// verkleNode is a node stored by parts
+type verkleNode interface {
+	record() *verkleNodeRecord
+	key(part int) []byte
+	encode(part int) []byte // nil for empty group
+	decodeHeader(buf []byte) (groups uint16, err error)
+	decodeGroup(g int, buf []byte) error
+}
+
+type verkleInternalNode struct {
+	verkleNodeRecord
+	path       []byte
+	commitment bandersnatch.PointAffine
+	children   [verkleWidth]verkleChild
+}
+
+type verkleLeafNode struct {
+	verkleNodeRecord
+	stem      []byte
+	c, c1, c2 bandersnatch.PointAffine
+	values    [verkleWidth][]byte
+}
+
+func (t *VerkleTrie) SetTrace(trace bool) { t.trace = trace }
+
+func (t *VerkleTrie) Variant() TrieVariant { return VariantVerkleTrie }
+
+// Reset drops root known in memory, it will be read from context.
+func (t *VerkleTrie) Reset() { t.rootKnown = false }
+
+func (t *VerkleTrie) ResetContext(ctx PatriciaContext) { t.ctx = ctx }
+
+func (t *VerkleTrie) RootHash() ([]byte, error) {
+	if !t.rootKnown {
+		t.root = verkleIdentity()
+		if t.ctx != nil {
+			data, _, err := t.ctx.Branch([]byte{verkleInternalNodePrefix})
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > 0 {
+				if t.root, err = verkleDecodePoint(data); err != nil {
+					return nil, fmt.Errorf("verkle root: %w", err)
+				}
+			}
+		}
+		t.rootKnown = true
+	}
+	return verkleSerializePoint(&t.root), nil
+}
+
+// EncodeCurrentState returns root commitment, the rest of the trie is in CommitmentDomain.
+func (t *VerkleTrie) EncodeCurrentState(buf []byte) ([]byte, error) {
+	if _, err := t.RootHash(); err != nil {
+		return nil, err
+	}
+	return verkleEncodePoint(buf, &t.root), nil
+}
+
+// SetState restores root commitment encoded by EncodeCurrentState, empty state makes trie to read root from context.
+func (t *VerkleTrie) SetState(buf []byte) error {
+	if len(buf) == 0 {
+		t.Reset()
+		return nil
+	}
+	root, err := verkleDecodePoint(buf)
+	if err != nil {
+		return fmt.Errorf("verkle state: %w", err)
+	}
+	t.root, t.rootKnown = root, true
+	return nil
+}
+
+func (t *VerkleTrie) Process(ctx context.Context, updates *Updates, logPrefix string) (rootHash []byte, err error) {
+	var (
+		ki           uint64
+		updatesCount = updates.Size()
+		start        = time.Now()
+		logEvery     = time.NewTicker(20 * time.Second)
+	)
+	defer logEvery.Stop()
+
+	t.internals = make(map[string]*verkleInternalNode)
+	t.leaves = make(map[string]*verkleLeafNode)
+	t.writes = make(map[string]map[byte][]byte)
+	t.stems = make(map[string][]byte)
+	defer func() { t.internals, t.leaves, t.writes, t.stems = nil, nil, nil, nil }()
+
+	var processErr error // HashSort doesn't return errors of ModeUpdate callback
+	err = updates.HashSort(ctx, func(hashedKey, plainKey []byte, stateUpdate *Update) (err error) {
+		defer func() {
+			if err != nil {
+				processErr = err
+			}
+		}()
+		select {
+		case <-logEvery.C:
+			log.Info(fmt.Sprintf("[%s][agg] computing verkle trie", logPrefix),
+				"progress", fmt.Sprintf("%s/%s", common.PrettyCounter(ki), common.PrettyCounter(updatesCount)))
+		default:
+		}
+		if t.trace {
+			fmt.Printf("%d/%d) plainKey [%x]\n", ki+1, updatesCount, plainKey)
+		}
+		update := stateUpdate
+		if len(plainKey) == length.Addr {
+			if update == nil {
+				if update, err = t.ctx.Account(plainKey); err != nil {
+					return fmt.Errorf("GetAccount for key %x failed: %w", plainKey, err)
+				}
+			}
+			err = t.updateAccount(plainKey, update)
+		} else {
+			if update == nil {
+				if update, err = t.ctx.Storage(plainKey); err != nil {
+					return fmt.Errorf("GetStorage for key %x failed: %w", plainKey, err)
+				}
+			}
+			err = t.updateStorage(plainKey, update)
+		}
+		if err != nil {
+			return err
+		}
+		ki++
+		mxTrieProcessedKeys.Inc()
+		return nil
+	})
+	if err == nil {
+		err = processErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hash sort failed: %w", err)
+	}
+
+	root, err := t.internalNode(nil)
+	if err != nil {
+		return nil, err
+	}
+	stems := make([]string, 0, len(t.writes))
+	for stem := range t.writes {
+		stems = append(stems, stem)
+	}
+	slices.Sort(stems)
+	if err := t.applyInternal(root, stems); err != nil {
+		return nil, err
+	}
+	root.deleted = root.childrenCount() == 0 // root is never collapsed
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	t.root, t.rootKnown = root.commitment, true
+
+	rootHash, err = t.RootHash()
+	if err != nil {
+		return nil, err
+	}
+	if t.trace {
+		fmt.Printf("verkle root %x updates %d\n", rootHash, updatesCount)
+	}
+	log.Debug(fmt.Sprintf("[%s][agg] verkle commitment", logPrefix), "processed", common.PrettyCounter(ki),
+		"stems", len(stems), "took", time.Since(start))
+	return rootHash, nil
+}
+
+func (t *VerkleTrie) write(key, value []byte) {
+	stem := string(key[:verkleStemLen])
+	w, ok := t.writes[stem]
+	if !ok {
+		w = make(map[byte][]byte)
+		t.writes[stem] = w
+	}
+	w[key[verkleStemLen]] = value
+}
+
+// stem of tree index which is small enough to fit uint64 (header and code chunks)
+func (t *VerkleTrie) stem(addr []byte, treeIndex uint64) []byte {
+	k := string(addr) + string(uint256.NewInt(treeIndex).Bytes())
+	stem, ok := t.stems[k]
+	if !ok {
+		stem = VerkleTreeKey(addr, uint256.NewInt(treeIndex), 0)[:verkleStemLen]
+		t.stems[k] = stem
+	}
+	return stem
+}
+
+func (t *VerkleTrie) codeChunkKey(addr []byte, chunk uint64) []byte {
+	pos := verkleCodeOffset + chunk
+	return append(common.Copy(t.stem(addr, pos/verkleWidth)), byte(pos%verkleWidth))
+}
+
+// PatriciaCodeContext is implemented by contexts which provide contract code. It's required by tries which commit
+// to the code itself, not only to its hash (VerkleTrie).
+type PatriciaCodeContext interface {
+	Code(plainKey []byte) ([]byte, error)
+}
+
+func (t *VerkleTrie) updateAccount(addr []byte, u *Update) error {
+	header := t.stem(addr, 0)
+	stored, err := t.findLeaf(header)
+	if err != nil {
+		return err
+	}
+	var storedCodeHash []byte
+	var storedCodeSize uint64
+	if stored != nil {
+		storedCodeHash = stored.values[verkleCodeHashLeafKey]
+		storedCodeSize = verkleBasicDataCodeSize(stored.values[verkleBasicDataLeafKey])
+	}
+	storedChunks := (storedCodeSize + verkleMaxCodeChunkPushData - 1) / verkleMaxCodeChunkPushData
+
+	if u.Flags&DeleteUpdate != 0 {
+		t.write(append(common.Copy(header), verkleBasicDataLeafKey), nil)
+		t.write(append(common.Copy(header), verkleCodeHashLeafKey), nil)
+		for i := uint64(0); i < storedChunks; i++ {
+			t.write(t.codeChunkKey(addr, i), nil)
+		}
+		return nil
+	}
+
+	codeHash := u.CodeHash[:]
+	if u.CodeHash == [length.Hash]byte{} {
+		codeHash = EmptyCodeHash
+	}
+	codeSize := storedCodeSize
+	if !bytes.Equal(codeHash, storedCodeHash) {
+		var code []byte
+		if !bytes.Equal(codeHash, EmptyCodeHash) {
+			cc, ok := t.ctx.(PatriciaCodeContext)
+			if !ok {
+				return fmt.Errorf("code of account %x is required by verkle trie, but context %T doesn't provide it", addr, t.ctx)
+			}
+			if code, err = cc.Code(addr); err != nil {
+				return fmt.Errorf("GetCode for key %x failed: %w", addr, err)
+			}
+		}
+		chunks := VerkleChunkifyCode(code)
+		for i, chunk := range chunks {
+			t.write(t.codeChunkKey(addr, uint64(i)), chunk)
+		}
+		for i := uint64(len(chunks)); i < storedChunks; i++ {
+			t.write(t.codeChunkKey(addr, i), nil)
+		}
+		codeSize = uint64(len(code))
+	}
+	t.write(append(common.Copy(header), verkleBasicDataLeafKey), verkleBasicData(u.Nonce, &u.Balance, codeSize))
+	t.write(append(common.Copy(header), verkleCodeHashLeafKey), common.Copy(codeHash))
+	return nil
+}
+
+func (t *VerkleTrie) updateStorage(plainKey []byte, u *Update) error {
+	if len(plainKey) != length.Addr+length.Hash {
+		return fmt.Errorf("verkle trie: unexpected storage key length %d: %x", len(plainKey), plainKey)
+	}
+	key := VerkleStorageKey(plainKey[:length.Addr], plainKey[length.Addr:])
+	if u.Flags&DeleteUpdate != 0 || u.StorageLen == 0 {
+		t.write(key, nil)
+		return nil
+	}
+	v := make([]byte, length.Hash)
+	copy(v[length.Hash-u.StorageLen:], u.Storage[:u.StorageLen])
+	t.write(key, v)
+	return nil
+}
+
+// findLeaf returns leaf node of the stem as it's stored, nil if there is no such stem.
+func (t *VerkleTrie) findLeaf(stem []byte) (*verkleLeafNode, error) {
+	n, err := t.internalNode(nil)
+	if err != nil {
+		return nil, err
+	}
+	for depth := 0; depth < verkleStemLen; depth++ {
+		child := n.children[stem[depth]]
+		switch child.kind {
+		case verkleEmpty:
+			return nil, nil
+		case verkleLeaf:
+			if !bytes.Equal(child.stem, stem) {
+				return nil, nil
+			}
+			return t.leafNode(stem)
+		}
+		if n, err = t.internalNode(stem[:depth+1]); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("verkle trie: internal node at depth %d of stem %x", verkleStemLen, stem)
+}
+
+// applyInternal applies writes of sorted stems (all of them have prefix n.path) to children of n.
+func (t *VerkleTrie) applyInternal(n *verkleInternalNode, stems []string) error {
+	depth := len(n.path)
+	for len(stems) > 0 {
+		idx := stems[0][depth]
+		end := 1
+		for end < len(stems) && stems[end][depth] == idx {
+			end++
+		}
+		group := stems[:end]
+		stems = stems[end:]
+
+		old := n.children[idx]
+		updated, err := t.applyChild(append(common.Copy(n.path), idx), old, group)
+		if err != nil {
+			return err
+		}
+		delta := new(big.Int)
+		if updated.scalar != nil {
+			delta.Set(updated.scalar)
+		}
+		if old.scalar != nil {
+			delta.Sub(delta, old.scalar)
+		}
+		verkleAddScaled(&n.commitment, int(idx), delta)
+		n.children[idx] = updated
+		n.touch(int(idx))
+	}
+	return nil
+}
+
+func (t *VerkleTrie) applyChild(path []byte, old verkleChild, stems []string) (verkleChild, error) {
+	switch old.kind {
+	case verkleEmpty:
+		if len(stems) == 1 {
+			leaf := t.newLeafNode([]byte(stems[0]))
+			return t.applyLeaf(leaf, t.writes[stems[0]]), nil
+		}
+		n := t.newInternalNode(path)
+		if err := t.applyInternal(n, stems); err != nil {
+			return verkleChild{}, err
+		}
+		return t.normalize(n), nil
+	case verkleLeaf:
+		if len(stems) == 1 && stems[0] == string(old.stem) {
+			leaf, err := t.leafNode(old.stem)
+			if err != nil {
+				return verkleChild{}, err
+			}
+			return t.applyLeaf(leaf, t.writes[stems[0]]), nil
+		}
+		// stem is not unique anymore: push leaf one level down
+		n := t.newInternalNode(path)
+		idx := old.stem[len(path)]
+		n.children[idx] = old
+		n.touch(int(idx))
+		verkleAddScaled(&n.commitment, int(idx), old.scalar)
+		if err := t.applyInternal(n, stems); err != nil {
+			return verkleChild{}, err
+		}
+		return t.normalize(n), nil
+	case verkleInternal:
+		n, err := t.internalNode(path)
+		if err != nil {
+			return verkleChild{}, err
+		}
+		if err := t.applyInternal(n, stems); err != nil {
+			return verkleChild{}, err
+		}
+		return t.normalize(n), nil
+	default:
+		return verkleChild{}, fmt.Errorf("verkle trie: unknown node kind %d at [%x]", old.kind, path)
+	}
+}
+
+// normalize deletes internal node which has no children or single leaf child (which takes place of the node).
+func (t *VerkleTrie) normalize(n *verkleInternalNode) verkleChild {
+	var last verkleChild
+	for _, c := range n.children {
+		if c.kind != verkleEmpty {
+			last = c
+		}
+	}
+	switch count := n.childrenCount(); {
+	case count == 0:
+		n.deleted = true
+		return verkleChild{}
+	case count == 1 && last.kind == verkleLeaf:
+		n.deleted = true
+		return last
+	default:
+		n.deleted = false
+		return verkleChild{kind: verkleInternal, scalar: verkleMapToScalar(&n.commitment)}
+	}
+}
+
+func (n *verkleInternalNode) childrenCount() (count int) {
+	for _, c := range n.children {
+		if c.kind != verkleEmpty {
+			count++
+		}
+	}
+	return count
+}
+
+var verkleLeafMarker = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// verkleLeafScalars splits 32-byte value into two scalars: lower 16 bytes with presence marker 2^128 and upper ones.
+func verkleLeafScalars(v []byte) (lo, hi *big.Int) {
+	if v == nil {
+		return new(big.Int), new(big.Int)
+	}
+	lo = verkleScalarFromLE(v[:16])
+	return lo.Add(lo, verkleLeafMarker), verkleScalarFromLE(v[16:])
+}
+
+func (t *VerkleTrie) applyLeaf(leaf *verkleLeafNode, writes map[byte][]byte) verkleChild {
+	c1Scalar, c2Scalar := verkleMapToScalar(&leaf.c1), verkleMapToScalar(&leaf.c2)
+	var changed bool
+	for suffix, v := range writes {
+		old := leaf.values[suffix]
+		if bytes.Equal(old, v) && (old == nil) == (v == nil) {
+			continue
+		}
+		c := &leaf.c1
+		if suffix >= verkleWidth/2 {
+			c = &leaf.c2
+		}
+		i := 2 * (int(suffix) % (verkleWidth / 2))
+		oldLo, oldHi := verkleLeafScalars(old)
+		lo, hi := verkleLeafScalars(v)
+		verkleAddScaled(c, i, lo.Sub(lo, oldLo))
+		verkleAddScaled(c, i+1, hi.Sub(hi, oldHi))
+		leaf.values[suffix] = v
+		leaf.touch(int(suffix))
+		changed = true
+	}
+	if changed {
+		c1, c2 := verkleMapToScalar(&leaf.c1), verkleMapToScalar(&leaf.c2)
+		verkleAddScaled(&leaf.c, 2, c1.Sub(c1, c1Scalar))
+		verkleAddScaled(&leaf.c, 3, c2.Sub(c2, c2Scalar))
+	}
+	for _, v := range leaf.values {
+		if v != nil {
+			leaf.deleted = false
+			return verkleChild{kind: verkleLeaf, stem: leaf.stem, scalar: verkleMapToScalar(&leaf.c)}
+		}
+	}
+	leaf.deleted = true
+	return verkleChild{}
+}
+
+func (t *VerkleTrie) newInternalNode(path []byte) *verkleInternalNode {
+	n, ok := t.internals[string(path)]
+	if !ok {
+		n = &verkleInternalNode{path: path}
+		t.internals[string(path)] = n
+	}
+	// node could be deleted by previous Process or earlier, start from scratch
+	n.commitment = verkleIdentity()
+	n.children = [verkleWidth]verkleChild{}
+	n.touchAll()
+	return n
+}
+
+func (t *VerkleTrie) newLeafNode(stem []byte) *verkleLeafNode {
+	leaf, ok := t.leaves[string(stem)]
+	if !ok {
+		leaf = &verkleLeafNode{stem: stem}
+		t.leaves[string(stem)] = leaf
+	}
+	leaf.c, leaf.c1, leaf.c2 = verkleIdentity(), verkleIdentity(), verkleIdentity()
+	leaf.values = [verkleWidth][]byte{}
+	verkleAddScaled(&leaf.c, 0, big.NewInt(1))
+	verkleAddScaled(&leaf.c, 1, verkleScalarFromLE(stem))
+	leaf.touchAll()
+	return leaf
+}
+
+func (t *VerkleTrie) internalNode(path []byte) (*verkleInternalNode, error) {
+	if n, ok := t.internals[string(path)]; ok {
+		return n, nil
+	}
+	n := &verkleInternalNode{path: common.Copy(path), commitment: verkleIdentity()}
+	if _, err := t.load(n); err != nil {
+		return nil, fmt.Errorf("verkle internal node [%x]: %w", path, err)
+	}
+	t.internals[string(path)] = n
+	return n, nil
+}
+
+func (t *VerkleTrie) leafNode(stem []byte) (*verkleLeafNode, error) {
+	if leaf, ok := t.leaves[string(stem)]; ok {
+		return leaf, nil
+	}
+	leaf := &verkleLeafNode{stem: common.Copy(stem)}
+	found, err := t.load(leaf)
+	if err != nil {
+		return nil, fmt.Errorf("verkle leaf node [%x]: %w", stem, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("verkle leaf node [%x] not found", stem)
+	}
+	t.leaves[string(stem)] = leaf
+	return leaf, nil
+}
+
+// load reads header of the node and its non-empty groups
+func (t *VerkleTrie) load(n verkleNode) (found bool, err error) {
+	rec := n.record()
+	data, step, err := t.ctx.Branch(n.key(0))
+	if err != nil || len(data) == 0 {
+		return false, err
+	}
+	rec.prev[0], rec.prevStep[0] = common.Copy(data), step
+	groups, err := n.decodeHeader(data)
+	if err != nil {
+		return false, fmt.Errorf("header: %w", err)
+	}
+	for g := 0; g < verkleGroups; g++ {
+		if groups&(1<<g) == 0 {
+			continue
+		}
+		data, step, err := t.ctx.Branch(n.key(1 + g))
+		if err != nil {
+			return false, err
+		}
+		if len(data) == 0 {
+			return false, fmt.Errorf("group %d not found", g)
+		}
+		rec.prev[1+g], rec.prevStep[1+g] = common.Copy(data), step
+		if err := n.decodeGroup(g, data); err != nil {
+			return false, fmt.Errorf("group %d: %w", g, err)
+		}
+	}
+	return true, nil
+}
+
+// flush writes updated parts of nodes to context in order of their keys.
+func (t *VerkleTrie) flush() error {
+	put := func(n verkleNode) error {
+		rec := n.record()
+		for part := range rec.dirty {
+			var data []byte
+			switch {
+			case rec.deleted:
+				// delete all stored parts
+			case rec.dirty[part]:
+				data = n.encode(part)
+			default:
+				continue
+			}
+			if data == nil && rec.prev[part] == nil {
+				continue // never existed
+			}
+			key := n.key(part)
+			if t.trace {
+				fmt.Printf("verkle PutBranch [%x] %d bytes\n", key, len(data))
+			}
+			mxTrieBranchesUpdated.Inc()
+			if err := t.ctx.PutBranch(key, data, rec.prev[part], rec.prevStep[part]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	paths := make([]string, 0, len(t.internals))
+	for p := range t.internals {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		if err := put(t.internals[p]); err != nil {
+			return err
+		}
+	}
+	stems := make([]string, 0, len(t.leaves))
+	for s := range t.leaves {
+		stems = append(stems, s)
+	}
+	slices.Sort(stems)
+	for _, s := range stems {
+		if err := put(t.leaves[s]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errVerkleNodeTooShort = errors.New("too short")
+
+func verkleNodeKey(prefix byte, id []byte, part int) []byte {
+	key := append([]byte{prefix}, id...)
+	if part > 0 {
+		key = append(key, byte(part-1))
+	}
+	return key
+}
+
+// verkleGroupsBitmap returns bitmap of groups which have at least one non-empty slot
+func verkleGroupsBitmap(nonEmpty func(slot int) bool) (bitmap uint16) {
+	for i := 0; i < verkleWidth; i++ {
+		if nonEmpty(i) {
+			bitmap |= 1 << (i / verkleGroupWidth)
+		}
+	}
+	return bitmap
+}
+
+// encodeGroup appends bitmap of non-empty slots of the group and encoded slots, returns nil for empty group
+func verkleEncodeGroup(g int, nonEmpty func(slot int) bool, encode func(buf []byte, slot int) []byte) []byte {
+	var bitmap uint16
+	for i := 0; i < verkleGroupWidth; i++ {
+		if nonEmpty(g*verkleGroupWidth + i) {
+			bitmap |= 1 << i
+		}
+	}
+	if bitmap == 0 {
+		return nil
+	}
+	buf := binary.BigEndian.AppendUint16(nil, bitmap)
+	for i := 0; i < verkleGroupWidth; i++ {
+		if bitmap&(1<<i) != 0 {
+			buf = encode(buf, g*verkleGroupWidth+i)
+		}
+	}
+	return buf
+}
+
+func verkleDecodeGroup(g int, buf []byte, decode func(buf []byte, slot int) (int, error)) error {
+	if len(buf) < 2 {
+		return errVerkleNodeTooShort
+	}
+	bitmap := binary.BigEndian.Uint16(buf)
+	pos := 2
+	for i := 0; i < verkleGroupWidth; i++ {
+		if bitmap&(1<<i) == 0 {
+			continue
+		}
+		n, err := decode(buf[pos:], g*verkleGroupWidth+i)
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	if pos != len(buf) {
+		return fmt.Errorf("%d bytes left", len(buf)-pos)
+	}
+	return nil
+}
+
+func (n *verkleInternalNode) key(part int) []byte {
+	if part == 0 {
+		return verkleNodeKey(verkleInternalNodePrefix, n.path, part)
+	}
+	return verkleNodeKey(verkleInternalGroupPrefix, n.path, part)
+}
+
+func (n *verkleInternalNode) nonEmpty(slot int) bool { return n.children[slot].kind != verkleEmpty }
+
+func (n *verkleInternalNode) encode(part int) []byte {
+	if part == 0 {
+		buf := verkleEncodePoint(make([]byte, 0, verklePointLen+2), &n.commitment)
+		return binary.BigEndian.AppendUint16(buf, verkleGroupsBitmap(n.nonEmpty))
+	}
+	return verkleEncodeGroup(part-1, n.nonEmpty, func(buf []byte, slot int) []byte {
+		c := n.children[slot]
+		s := verkleScalarBytes(c.scalar)
+		buf = append(buf, byte(c.kind))
+		buf = append(buf, s[:]...)
+		if c.kind == verkleLeaf {
+			buf = append(buf, c.stem...)
+		}
+		return buf
+	})
+}
+
+func (n *verkleInternalNode) decodeHeader(buf []byte) (groups uint16, err error) {
+	if len(buf) != verklePointLen+2 {
+		return 0, fmt.Errorf("unexpected length %d", len(buf))
+	}
+	if n.commitment, err = verkleDecodePoint(buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf[verklePointLen:]), nil
+}
+
+func (n *verkleInternalNode) decodeGroup(g int, buf []byte) error {
+	return verkleDecodeGroup(g, buf, func(buf []byte, slot int) (int, error) {
+		if len(buf) < 1+32 {
+			return 0, errVerkleNodeTooShort
+		}
+		c := verkleChild{kind: verkleNodeKind(buf[0]), scalar: verkleScalarFromLE(buf[1:33])}
+		switch c.kind {
+		case verkleInternal:
+		case verkleLeaf:
+			if len(buf) < 33+verkleStemLen {
+				return 0, errVerkleNodeTooShort
+			}
+			c.stem = common.Copy(buf[33 : 33+verkleStemLen])
+		default:
+			return 0, fmt.Errorf("unknown child kind %d", c.kind)
+		}
+		n.children[slot] = c
+		return 33 + len(c.stem), nil
+	})
+}
+
+func (leaf *verkleLeafNode) key(part int) []byte {
+	if part == 0 {
+		return verkleNodeKey(verkleLeafNodePrefix, leaf.stem, part)
+	}
+	return verkleNodeKey(verkleLeafGroupPrefix, leaf.stem, part)
+}
+
+func (leaf *verkleLeafNode) nonEmpty(slot int) bool { return leaf.values[slot] != nil }
+
+func (leaf *verkleLeafNode) encode(part int) []byte {
+	if part == 0 {
+		buf := make([]byte, 0, 3*verklePointLen+2)
+		buf = verkleEncodePoint(buf, &leaf.c)
+		buf = verkleEncodePoint(buf, &leaf.c1)
+		buf = verkleEncodePoint(buf, &leaf.c2)
+		return binary.BigEndian.AppendUint16(buf, verkleGroupsBitmap(leaf.nonEmpty))
+	}
+	return verkleEncodeGroup(part-1, leaf.nonEmpty, func(buf []byte, slot int) []byte {
+		return append(buf, leaf.values[slot]...)
+	})
+}
+
+func (leaf *verkleLeafNode) decodeHeader(buf []byte) (groups uint16, err error) {
+	if len(buf) != 3*verklePointLen+2 {
+		return 0, fmt.Errorf("unexpected length %d", len(buf))
+	}
+	for i, p := range []*bandersnatch.PointAffine{&leaf.c, &leaf.c1, &leaf.c2} {
+		if *p, err = verkleDecodePoint(buf[i*verklePointLen:]); err != nil {
+			return 0, err
+		}
+	}
+	return binary.BigEndian.Uint16(buf[3*verklePointLen:]), nil
+}
+
+func (leaf *verkleLeafNode) decodeGroup(g int, buf []byte) error {
+	return verkleDecodeGroup(g, buf, func(buf []byte, slot int) (int, error) {
+		if len(buf) < length.Hash {
+			return 0, errVerkleNodeTooShort
+		}
+		leaf.values[slot] = common.Copy(buf[:length.Hash])
+		return length.Hash, nil
+	})
+}
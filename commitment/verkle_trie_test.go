@@ -0,0 +1,350 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package commitment
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/bandersnatch"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+)
+
+func TestVerkleGenerators(t *testing.T) {
+	t.Parallel()
+
+	gens := verkleGenerators()
+	seen := make(map[string]struct{})
+	for i := range gens {
+		require.True(t, gens[i].IsOnCurve(), "generator %d", i)
+		p, ok := banderwagonFromX(&gens[i].X)
+		require.True(t, ok, "generator %d is not in the subgroup", i)
+		require.True(t, p.Equal(&gens[i]))
+		seen[string(verkleSerializePoint(&gens[i]))] = struct{}{}
+	}
+	require.Len(t, seen, verkleWidth)
+
+	// (x, y) and (-x, -y) are the same element of Banderwagon
+	var neg = gens[7]
+	neg.X.Neg(&neg.X)
+	neg.Y.Neg(&neg.Y)
+	require.True(t, neg.IsOnCurve())
+	require.Equal(t, verkleSerializePoint(&gens[7]), verkleSerializePoint(&neg))
+	require.Equal(t, verkleMapToScalar(&gens[7]), verkleMapToScalar(&neg))
+
+	id := verkleIdentity()
+	require.Zero(t, verkleMapToScalar(&id).Sign())
+	require.Equal(t, make([]byte, 32), verkleSerializePoint(&id))
+
+	// known answers of go-ipa (TestCRSGeneration) and go-verkle (TestGroupToField)
+	require.Equal(t, "01587ad1336675eb912550ec2a28eb8923b824b490dd2ba82e48f14590a298a0", hex.EncodeToString(verkleSerializePoint(&gens[0])))
+	require.Equal(t, "3de2be346b539395b0c0de56a5ccca54a317f1b5c80107b0802af9a62276a4d8", hex.EncodeToString(verkleSerializePoint(&gens[255])))
+	h := sha256.New()
+	for i := range gens {
+		h.Write(verkleSerializePoint(&gens[i]))
+	}
+	require.Equal(t, "1fcaea10bf24f750200e06fa473c76ff0468007291fa548e2d99f09ba9256fdb", hex.EncodeToString(h.Sum(nil)))
+	base := bandersnatch.GetEdwardsCurve().Base
+	scalar := verkleScalarBytes(verkleMapToScalar(&base))
+	require.Equal(t, "d1e7de2aaea9603d5bc6c208d319596376556ecd8336671ba7670c2139772d14", hex.EncodeToString(scalar[:]))
+}
+
+func TestVerkleTreeKey(t *testing.T) {
+	t.Parallel()
+
+	addr := common.FromHex("0x71562b71999873db5b286df957af199ec94617f7")
+	slot := func(i uint64) []byte { s := uint256.NewInt(i).Bytes32(); return s[:] }
+	stem := func(key []byte) []byte { require.Len(t, key, verkleStemLen+1); return key[:verkleStemLen] }
+
+	header := VerkleAccountHeaderKey(addr, verkleBasicDataLeafKey)
+	require.Equal(t, byte(verkleBasicDataLeafKey), header[verkleStemLen])
+	require.Equal(t, append(stem(header), verkleCodeHashLeafKey), VerkleAccountHeaderKey(addr, verkleCodeHashLeafKey))
+
+	// first 64 slots and first 128 code chunks are in the header
+	require.Equal(t, append(stem(header), verkleHeaderStorageOffset+5), VerkleStorageKey(addr, slot(5)))
+	require.Equal(t, append(stem(header), verkleCodeOffset+127), VerkleCodeChunkKey(addr, 127))
+
+	mainSlot := VerkleStorageKey(addr, slot(64))
+	require.NotEqual(t, stem(header), stem(mainSlot))
+	require.Equal(t, byte(64), mainSlot[verkleStemLen])
+	require.Equal(t, append(stem(mainSlot), 65), VerkleStorageKey(addr, slot(65)))
+	require.NotEqual(t, stem(mainSlot), stem(VerkleStorageKey(addr, slot(256+64))))
+
+	chunk := VerkleCodeChunkKey(addr, 128)
+	require.Equal(t, byte(0), chunk[verkleStemLen])
+	require.Equal(t, stem(VerkleTreeKey(addr, uint256.NewInt(1), 0)), stem(chunk))
+
+	other := VerkleAccountHeaderKey(common.FromHex("0x71562b71999873db5b286df957af199ec94617f8"), 0)
+	require.NotEqual(t, stem(header), stem(other))
+
+	// known answers computed by go-verkle commitment (same as get_tree_key of EIP-6800)
+	for _, tc := range []struct {
+		addr      string
+		treeIndex *uint256.Int
+		subIndex  byte
+		key       string
+	}{
+		{"0x71562b71999873db5b286df957af199ec94617f7", uint256.NewInt(0), 0, "1540dfad7755b40be0768c6aa0a5096fbf0215e0e8cf354dd928a17834646600"},
+		{"0x71562b71999873db5b286df957af199ec94617f7", uint256.NewInt(1), 0, "ae1a2cf26c0967cbb5334d8a99cace67ba7a9e194daa4c3e8eef537e7c265b00"},
+		{"0x71562b71999873db5b286df957af199ec94617f7", new(uint256.Int).AddUint64(new(uint256.Int).Lsh(uint256.NewInt(1), 64), 3), 0xfe, "d7c8caab62e0378f9e96fd831b1d810cf18338268d7dec79fd78ca89163224fe"},
+		{"0x0000000000000000000000000000000000000000", uint256.NewInt(0), 0, "1a100684fd68185060405f3f160e4bb6e034194336b547bdae323f888d533200"},
+	} {
+		require.Equal(t, tc.key, hex.EncodeToString(VerkleTreeKey(common.FromHex(tc.addr), tc.treeIndex, tc.subIndex)), "%s %d", tc.addr, tc.treeIndex)
+	}
+}
+
+func TestVerkleChunkifyCode(t *testing.T) {
+	t.Parallel()
+
+	require.Empty(t, VerkleChunkifyCode(nil))
+
+	// PUSH1 01, 28 JUMPDESTs, PUSH4 with data in the second chunk
+	code := append([]byte{0x60, 0x01}, bytes.Repeat([]byte{0x5b}, 28)...)
+	code = append(code, 0x63, 0xa1, 0xa2, 0xa3, 0xa4)
+	chunks := VerkleChunkifyCode(code)
+	require.Len(t, chunks, 2)
+	require.Equal(t, append([]byte{0}, code[:31]...), chunks[0])
+	require.Equal(t, append([]byte{4, 0xa1, 0xa2, 0xa3, 0xa4}, make([]byte, 27)...), chunks[1])
+
+	// PUSH32 covers the whole second chunk and 2 bytes of the third one
+	code = append([]byte{0x7f}, bytes.Repeat([]byte{0xee}, 32)...)
+	code = append(code, bytes.Repeat([]byte{0x00}, 40)...)
+	chunks = VerkleChunkifyCode(code)
+	require.Len(t, chunks, 3)
+	require.Equal(t, byte(0), chunks[0][0])
+	require.Equal(t, byte(2), chunks[1][0])
+	require.Equal(t, byte(0), chunks[2][0])
+}
+
+type verkleCodeMockState struct {
+	*MockState
+	code map[string][]byte
+}
+
+func (ms *verkleCodeMockState) Code(plainKey []byte) ([]byte, error) {
+	return ms.code[string(plainKey)], nil
+}
+
+func (ms *verkleCodeMockState) setCode(ub *UpdateBuilder, addr string, code []byte) {
+	ms.code[string(decodeHex(addr))] = code
+	h := sha3.NewLegacyKeccak256()
+	h.Write(code)
+	ub.CodeHash(addr, fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+func verkleProcess(t *testing.T, ms *MockState, trie *VerkleTrie, ub *UpdateBuilder) []byte {
+	t.Helper()
+	plainKeys, updates := ub.Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+	upds := WrapKeyUpdates(t, ModeDirect, keyHasherNoop, plainKeys, updates)
+	defer upds.Close()
+	root, err := trie.Process(context.Background(), upds, "")
+	require.NoError(t, err)
+	return root
+}
+
+func TestVerkleTrie_RootDependsOnlyOnState(t *testing.T) {
+	t.Parallel()
+
+	addr := func(i int) string { return fmt.Sprintf("%040x", uint64(i)*0x9e3779b97f4a7c15) }
+	loc := func(i int) string { return fmt.Sprintf("%064x", i) }
+
+	type account struct {
+		balance, nonce uint64
+		storage        map[int]string
+	}
+	model := make(map[int]*account)
+	set := func(ub *UpdateBuilder, i int, balance, nonce uint64) {
+		if model[i] == nil {
+			model[i] = &account{storage: make(map[int]string)}
+		}
+		model[i].balance, model[i].nonce = balance, nonce
+		ub.Balance(addr(i), balance).Nonce(addr(i), nonce)
+	}
+	store := func(ub *UpdateBuilder, i, slot int, v string) {
+		model[i].storage[slot] = v
+		ub.Storage(addr(i), loc(slot), v)
+	}
+	deleteAccount := func(ub *UpdateBuilder, i int) {
+		for slot := range model[i].storage {
+			ub.DeleteStorage(addr(i), loc(slot))
+		}
+		delete(model, i)
+		ub.Delete(addr(i))
+	}
+	fromScratch := func() []byte {
+		ms := NewMockState(t)
+		ub := NewUpdateBuilder()
+		for i, a := range model {
+			ub.Balance(addr(i), a.balance).Nonce(addr(i), a.nonce)
+			for slot, v := range a.storage {
+				ub.Storage(addr(i), loc(slot), v)
+			}
+		}
+		return verkleProcess(t, ms, NewVerkleTrie(ms), ub)
+	}
+
+	ms := NewMockState(t)
+	trie := NewVerkleTrie(ms)
+	ub := NewUpdateBuilder()
+	for i := 0; i < 30; i++ {
+		set(ub, i, uint64(i+1), uint64(i))
+	}
+	for i := 0; i < 10; i++ {
+		store(ub, 3, i, fmt.Sprintf("%04x", i+1))      // header storage
+		store(ub, 4, 1000+i, fmt.Sprintf("%04x", i+1)) // main storage
+	}
+	root := verkleProcess(t, ms, trie, ub)
+	require.Equal(t, fromScratch(), root)
+
+	ub = NewUpdateBuilder()
+	for i := 30; i < 40; i++ {
+		set(ub, i, uint64(i+1), 1)
+	}
+	set(ub, 1, 100, 1)
+	store(ub, 3, 2, "ffff")
+	store(ub, 4, 70000, "01")
+	ub.DeleteStorage(addr(4), loc(1003))
+	delete(model[4].storage, 1003)
+	deleteAccount(ub, 7)
+	root = verkleProcess(t, ms, trie, ub)
+	require.Equal(t, fromScratch(), root)
+
+	// restored trie reads the rest of it from context
+	state, err := trie.EncodeCurrentState(nil)
+	require.NoError(t, err)
+	restored := NewVerkleTrie(ms)
+	require.NoError(t, restored.SetState(state))
+	rh, err := restored.RootHash()
+	require.NoError(t, err)
+	require.Equal(t, root, rh)
+	restored.Reset()
+	rh, err = restored.RootHash()
+	require.NoError(t, err)
+	require.Equal(t, root, rh)
+
+	ub = NewUpdateBuilder()
+	set(ub, 2, 200, 2)
+	root = verkleProcess(t, ms, restored, ub)
+	require.Equal(t, fromScratch(), root)
+
+	// deleting everything leaves no nodes
+	ub = NewUpdateBuilder()
+	for i := range model {
+		deleteAccount(ub, i)
+	}
+	root = verkleProcess(t, ms, restored, ub)
+	require.Equal(t, make([]byte, 32), root)
+	for k, v := range ms.cm {
+		require.Empty(t, v, "node [%x] is not deleted", k)
+	}
+}
+
+// TestVerkleTrie_KnownRoots - roots computed by go-verkle for the same keys and values
+func TestVerkleTrie_KnownRoots(t *testing.T) {
+	t.Parallel()
+
+	addr := "71562b71999873db5b286df957af199ec94617f7"
+	ms := NewMockState(t)
+	root, err := NewVerkleTrie(ms).RootHash()
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 32), root)
+
+	// one value: storage slot 5 is in account header stem
+	ms = NewMockState(t)
+	root = verkleProcess(t, ms, NewVerkleTrie(ms), NewUpdateBuilder().Storage(addr, fmt.Sprintf("%064x", 5), "0102"))
+	require.Equal(t, "331a1bcc7732e6ce3fee03a900142a6243b30bea65750dedc58eed367ebe7bf9", hex.EncodeToString(root))
+
+	// one leaf with basic data and empty code hash
+	ms = NewMockState(t)
+	root = verkleProcess(t, ms, NewVerkleTrie(ms), NewUpdateBuilder().Balance(addr, 100).Nonce(addr, 7))
+	require.Equal(t, "3500bf22d745a1f520a4b228f239b556cd4cb27b4f7f33a3529aaa4b65ac37bc", hex.EncodeToString(root))
+}
+
+func TestVerkleTrie_ModeUpdate(t *testing.T) {
+	t.Parallel()
+
+	ub := NewUpdateBuilder()
+	for i := 0; i < 20; i++ {
+		addr := fmt.Sprintf("%040x", i+1)
+		ub.Balance(addr, uint64(i)).Nonce(addr, uint64(i)).Storage(addr, fmt.Sprintf("%064x", i), "aa")
+	}
+	plainKeys, updates := ub.Build()
+
+	ms := NewMockState(t)
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+	direct := WrapKeyUpdates(t, ModeDirect, keyHasherNoop, plainKeys, updates)
+	defer direct.Close()
+	expected, err := NewVerkleTrie(ms).Process(context.Background(), direct, "")
+	require.NoError(t, err)
+
+	ms2 := NewMockState(t)
+	upds := WrapKeyUpdates(t, ModeUpdate, keyHasherNoop, plainKeys, updates)
+	defer upds.Close()
+	root, err := NewVerkleTrie(ms2).Process(context.Background(), upds, "")
+	require.NoError(t, err)
+	require.Equal(t, expected, root)
+	require.NotEqual(t, make([]byte, 32), root)
+}
+
+func TestVerkleTrie_Code(t *testing.T) {
+	t.Parallel()
+
+	addr := fmt.Sprintf("%040x", 0xc0de)
+	bigCode := bytes.Repeat([]byte{0x5b}, 31*200) // chunks outside of header stem
+	smallCode := []byte{0x60, 0x01, 0x60, 0x02, 0x01}
+
+	ms := &verkleCodeMockState{MockState: NewMockState(t), code: make(map[string][]byte)}
+	trie := NewVerkleTrie(ms)
+	ub := NewUpdateBuilder().Balance(addr, 1).Balance(fmt.Sprintf("%040x", 1), 1)
+	ms.setCode(ub, addr, bigCode)
+	verkleProcess(t, ms.MockState, trie, ub)
+
+	ub = NewUpdateBuilder().Balance(addr, 2)
+	ms.setCode(ub, addr, smallCode)
+	root := verkleProcess(t, ms.MockState, trie, ub)
+
+	scratch := &verkleCodeMockState{MockState: NewMockState(t), code: make(map[string][]byte)}
+	ub = NewUpdateBuilder().Balance(addr, 2).Balance(fmt.Sprintf("%040x", 1), 1)
+	scratch.setCode(ub, addr, smallCode)
+	require.Equal(t, verkleProcess(t, scratch.MockState, NewVerkleTrie(scratch), ub), root)
+
+	stem := VerkleAccountHeaderKey(decodeHex(addr), 0)[:verkleStemLen]
+	trie.ctx, trie.leaves = ms, make(map[string]*verkleLeafNode)
+	header, err := trie.leafNode(stem)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(smallCode)), verkleBasicDataCodeSize(header.values[verkleBasicDataLeafKey]))
+	require.Equal(t, VerkleChunkifyCode(smallCode)[0], header.values[verkleCodeOffset])
+	require.Nil(t, header.values[verkleCodeOffset+1])
+
+	// code is required to commit to it
+	noCode := NewMockState(t)
+	plainKeys, updates := NewUpdateBuilder().CodeHash(addr, fmt.Sprintf("%064x", 1)).Build()
+	require.NoError(t, noCode.applyPlainUpdates(plainKeys, updates))
+	upds := WrapKeyUpdates(t, ModeDirect, keyHasherNoop, plainKeys, updates)
+	defer upds.Close()
+	_, err = NewVerkleTrie(noCode).Process(context.Background(), upds, "")
+	require.ErrorContains(t, err, "doesn't provide it")
+}
@@ -43,6 +43,50 @@ func (m *MockKVClient) EXPECT() *MockKVClientMockRecorder {
 	return m.recorder
 }
 
+// DomainDiff mocks base method.
+func (m *MockKVClient) DomainDiff(ctx context.Context, in *DomainDiffReq, opts ...grpc.CallOption) (*DomainDiffReply, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, in}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "DomainDiff", varargs...)
+	ret0, _ := ret[0].(*DomainDiffReply)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DomainDiff indicates an expected call of DomainDiff.
+func (mr *MockKVClientMockRecorder) DomainDiff(ctx, in any, opts ...any) *MockKVClientDomainDiffCall {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, in}, opts...)
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DomainDiff", reflect.TypeOf((*MockKVClient)(nil).DomainDiff), varargs...)
+	return &MockKVClientDomainDiffCall{Call: call}
+}
+
+// MockKVClientDomainDiffCall wrap *gomock.Call
+type MockKVClientDomainDiffCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockKVClientDomainDiffCall) Return(arg0 *DomainDiffReply, arg1 error) *MockKVClientDomainDiffCall {
+	c.Call = c.Call.Return(arg0, arg1)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockKVClientDomainDiffCall) Do(f func(context.Context, *DomainDiffReq, ...grpc.CallOption) (*DomainDiffReply, error)) *MockKVClientDomainDiffCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockKVClientDomainDiffCall) DoAndReturn(f func(context.Context, *DomainDiffReq, ...grpc.CallOption) (*DomainDiffReply, error)) *MockKVClientDomainDiffCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
 // DomainGet mocks base method.
 func (m *MockKVClient) DomainGet(ctx context.Context, in *DomainGetReq, opts ...grpc.CallOption) (*DomainGetReply, error) {
 	m.ctrl.T.Helper()
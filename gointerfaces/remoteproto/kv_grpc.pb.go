@@ -31,6 +31,7 @@ const (
 	KV_IndexRange_FullMethodName   = "/remote.KV/IndexRange"
 	KV_HistoryRange_FullMethodName = "/remote.KV/HistoryRange"
 	KV_DomainRange_FullMethodName  = "/remote.KV/DomainRange"
+	KV_DomainDiff_FullMethodName   = "/remote.KV/DomainDiff"
 )
 
 // KVClient is the client API for KV service.
@@ -61,6 +62,8 @@ type KVClient interface {
 	IndexRange(ctx context.Context, in *IndexRangeReq, opts ...grpc.CallOption) (*IndexRangeReply, error)
 	HistoryRange(ctx context.Context, in *HistoryRangeReq, opts ...grpc.CallOption) (*Pairs, error)
 	DomainRange(ctx context.Context, in *DomainRangeReq, opts ...grpc.CallOption) (*Pairs, error)
+	// DomainDiff returns keys changed in [from_ts, to_ts) with their values before and after the range
+	DomainDiff(ctx context.Context, in *DomainDiffReq, opts ...grpc.CallOption) (*DomainDiffReply, error)
 }
 
 type kVClient struct {
@@ -216,6 +219,16 @@ func (c *kVClient) DomainRange(ctx context.Context, in *DomainRangeReq, opts ...
 	return out, nil
 }
 
+func (c *kVClient) DomainDiff(ctx context.Context, in *DomainDiffReq, opts ...grpc.CallOption) (*DomainDiffReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DomainDiffReply)
+	err := c.cc.Invoke(ctx, KV_DomainDiff_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // KVServer is the server API for KV service.
 // All implementations must embed UnimplementedKVServer
 // for forward compatibility
@@ -244,6 +257,8 @@ type KVServer interface {
 	IndexRange(context.Context, *IndexRangeReq) (*IndexRangeReply, error)
 	HistoryRange(context.Context, *HistoryRangeReq) (*Pairs, error)
 	DomainRange(context.Context, *DomainRangeReq) (*Pairs, error)
+	// DomainDiff returns keys changed in [from_ts, to_ts) with their values before and after the range
+	DomainDiff(context.Context, *DomainDiffReq) (*DomainDiffReply, error)
 	mustEmbedUnimplementedKVServer()
 }
 
@@ -281,6 +296,9 @@ func (UnimplementedKVServer) HistoryRange(context.Context, *HistoryRangeReq) (*P
 func (UnimplementedKVServer) DomainRange(context.Context, *DomainRangeReq) (*Pairs, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DomainRange not implemented")
 }
+func (UnimplementedKVServer) DomainDiff(context.Context, *DomainDiffReq) (*DomainDiffReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DomainDiff not implemented")
+}
 func (UnimplementedKVServer) mustEmbedUnimplementedKVServer() {}
 
 // UnsafeKVServer may be embedded to opt out of forward compatibility for this service.
@@ -485,6 +503,24 @@ func _KV_DomainRange_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _KV_DomainDiff_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DomainDiffReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVServer).DomainDiff(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KV_DomainDiff_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVServer).DomainDiff(ctx, req.(*DomainDiffReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // KV_ServiceDesc is the grpc.ServiceDesc for KV service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -524,6 +560,10 @@ var KV_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DomainRange",
 			Handler:    _KV_DomainRange_Handler,
 		},
+		{
+			MethodName: "DomainDiff",
+			Handler:    _KV_DomainDiff_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
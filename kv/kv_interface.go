@@ -541,6 +541,12 @@ type TemporalTx interface {
 	// HistoryRange - producing "state patch" - sorted list of keys updated at [fromTs,toTs) with their most-recent value.
 	//   no duplicates
 	HistoryRange(name History, fromTs, toTs int, asc order.By, limit int) (it stream.KV, err error)
+
+	// DomainDiff - producing "state diff" - sorted list of keys updated at [fromTs,toTs) with their values as-of `fromTs` and as-of `toTs`.
+	//   no duplicates. keys reverted to original value inside range are skipped.
+	//   `len(before) == 0` means key-creation, `len(after) == 0` means key-deletion
+	//   fromKey=nil means StartOfTable
+	DomainDiff(name Domain, fromKey []byte, fromTs, toTs uint64, limit int) (it stream.KVV, err error)
 }
 
 type TemporalRwTx interface {
@@ -754,6 +754,11 @@ func (m *MemoryMutation) HistoryRange(name kv.History, fromTs, toTs int, asc ord
 	//return m.db.(kv.TemporalTx).HistoryRange(name, fromTs, toTs, asc, limit)
 }
 
+func (m *MemoryMutation) DomainDiff(name kv.Domain, fromKey []byte, fromTs, toTs uint64, limit int) (it stream.KVV, err error) {
+	panic("not supported")
+	//return m.db.(kv.TemporalTx).DomainDiff(name, fromKey, fromTs, toTs, limit)
+}
+
 func (m *MemoryMutation) DomainRange(name kv.Domain, fromKey, toKey []byte, ts uint64, asc order.By, limit int) (it stream.KV, err error) {
 	panic("not supported")
 	//return m.db.(kv.TemporalTx).DomainRange(name, fromKey, toKey, ts, asc, limit)
@@ -0,0 +1,244 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package rawtemporaldb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+// ReceiptDomain stores few fixed keys - every txn overwrites them at it's own txNum,
+// then `DomainGetAsOf(key, txNum+1)` returns value produced by txn `txNum`.
+// Values are cumulative inside block: reader restores per-txn values by diff with previous txn.
+var (
+	CumulativeGasUsedInBlockKey     = []byte{0x0}
+	CumulativeBlobGasUsedInBlockKey = []byte{0x1}
+	LogIndexAfterTxKey              = []byte{0x2} // amount of logs in block after txn
+
+	// TxStatusAndLogsKey - opt-in extension of format, written only by AppendStatusAndLogs. See encodeStatusAndLogs.
+	// Stores full logs (address, topics, data): grows domain by size of logs, but allows to serve receipts and
+	// `eth_getLogs` without re-execution of blocks. Txns without it have ReceiptStatusUnknown and no Logs.
+	TxStatusAndLogsKey = []byte{0x3}
+)
+
+var (
+	ErrCorruptedReceipt = errors.New("corrupted receipt value")
+	ErrLogsNotStored    = errors.New("logs of txn are not stored in ReceiptDomain, see AppendStatusAndLogs")
+)
+
+const (
+	ReceiptStatusFailed     = uint8(0)
+	ReceiptStatusSuccessful = uint8(1)
+	ReceiptStatusUnknown    = uint8(0xff) // TxStatusAndLogsKey is not written for txn
+)
+
+type Log struct {
+	Address common.Address
+	Topics  []common.Hash
+	Data    []byte
+
+	// derived fields: filled by reader
+	BlockNum uint64
+	TxNum    uint64
+	TxIndex  int
+	Index    uint32 // index of log in block
+}
+
+type Receipt struct {
+	Status                uint8
+	CumulativeGasUsed     uint64
+	CumulativeBlobGasUsed uint64
+	Logs                  []*Log
+
+	// derived fields: filled by reader
+	BlockNum      uint64
+	TxNum         uint64
+	TxIndex       int
+	GasUsed       uint64
+	BlobGasUsed   uint64
+	FirstLogIndex uint32 // index of first log of txn in block
+	LogsCount     uint32 // known even if Logs are not stored
+}
+
+// ReceiptsWriter - SharedDomains implements it
+type ReceiptsWriter interface {
+	kv.TemporalPutDel
+	IndexAdd(table kv.InvertedIdx, key []byte) error
+	TxNum() uint64
+}
+
+// AppendReceipt - must be called after execution of every non-system txn, when writer's txNum is set to txNum of this txn.
+// `r.CumulativeGasUsed`, `r.CumulativeBlobGasUsed` and `r.FirstLogIndex` are block-level values. Also adds logs to `LogAddrIdx` and `LogTopicIdx`.
+func AppendReceipt(w ReceiptsWriter, r *Receipt) error {
+	if err := w.DomainPut(kv.ReceiptDomain, CumulativeGasUsedInBlockKey, nil, binary.AppendUvarint(nil, r.CumulativeGasUsed), nil, 0); err != nil {
+		return err
+	}
+	if err := w.DomainPut(kv.ReceiptDomain, CumulativeBlobGasUsedInBlockKey, nil, binary.AppendUvarint(nil, r.CumulativeBlobGasUsed), nil, 0); err != nil {
+		return err
+	}
+	logIndexAfterTx := uint64(r.FirstLogIndex) + uint64(len(r.Logs))
+	if err := w.DomainPut(kv.ReceiptDomain, LogIndexAfterTxKey, nil, binary.AppendUvarint(nil, logIndexAfterTx), nil, 0); err != nil {
+		return err
+	}
+	for _, l := range r.Logs {
+		if err := w.IndexAdd(kv.LogAddrIdx, l.Address[:]); err != nil {
+			return err
+		}
+		for i := range l.Topics {
+			if err := w.IndexAdd(kv.LogTopicIdx, l.Topics[i][:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AppendStatusAndLogs - opt-in: stores `r.Status` and `r.Logs` of txn, see TxStatusAndLogsKey. Must be called with
+// AppendReceipt, when writer's txNum is set to txNum of this txn.
+func AppendStatusAndLogs(w ReceiptsWriter, r *Receipt) error {
+	return w.DomainPut(kv.ReceiptDomain, TxStatusAndLogsKey, nil, encodeStatusAndLogs(w.TxNum(), r.Status, r.Logs), nil, 0)
+}
+
+// ReceiptAsOf - block-level values produced by txns before `txNum`
+func ReceiptAsOf(tx kv.TemporalTx, txNum uint64) (cumGasUsed, cumBlobGasUsed uint64, logIndexAfterTx uint32, err error) {
+	if cumGasUsed, err = uvarintAsOf(tx, CumulativeGasUsedInBlockKey, txNum); err != nil {
+		return 0, 0, 0, err
+	}
+	if cumBlobGasUsed, err = uvarintAsOf(tx, CumulativeBlobGasUsedInBlockKey, txNum); err != nil {
+		return 0, 0, 0, err
+	}
+	logIdx, err := uvarintAsOf(tx, LogIndexAfterTxKey, txNum)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return cumGasUsed, cumBlobGasUsed, uint32(logIdx), nil
+}
+
+// StatusAndLogsOf - status and logs of txn `txNum`. Derived fields of logs are not filled.
+// Returns ReceiptStatusUnknown if they were not stored for this txn.
+func StatusAndLogsOf(tx kv.TemporalTx, txNum uint64) (status uint8, logs []*Log, err error) {
+	v, ok, err := tx.DomainGetAsOf(kv.ReceiptDomain, TxStatusAndLogsKey, nil, txNum+1)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !ok || len(v) == 0 {
+		return ReceiptStatusUnknown, nil, nil
+	}
+	writtenBy, status, logs, err := decodeStatusAndLogs(v)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w, txNum=%d", err, txNum)
+	}
+	if writtenBy != txNum { // value of some previous txn: this one was written without it
+		return ReceiptStatusUnknown, nil, nil
+	}
+	return status, logs, nil
+}
+
+func uvarintAsOf(tx kv.TemporalTx, key []byte, txNum uint64) (uint64, error) {
+	v, ok, err := tx.DomainGetAsOf(kv.ReceiptDomain, key, nil, txNum)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || len(v) == 0 {
+		return 0, nil
+	}
+	n, read := binary.Uvarint(v)
+	if read <= 0 {
+		return 0, fmt.Errorf("%w: key=%x, txNum=%d", ErrCorruptedReceipt, key, txNum)
+	}
+	return n, nil
+}
+
+// encodeStatusAndLogs format:
+//
+//	[uvarint txNum][status byte][uvarint logs amount]
+//	per log: [address][uvarint topics amount][topics][uvarint data len][data]
+//
+// txNum: reader of value "as of" txn must distinguish it from value of previous txn
+func encodeStatusAndLogs(txNum uint64, status uint8, logs []*Log) []byte {
+	size := 2*binary.MaxVarintLen64 + 1
+	for _, l := range logs {
+		size += length.Addr + 2*binary.MaxVarintLen64 + len(l.Topics)*length.Hash + len(l.Data)
+	}
+	v := make([]byte, 0, size)
+	v = binary.AppendUvarint(v, txNum)
+	v = append(v, status)
+	v = binary.AppendUvarint(v, uint64(len(logs)))
+	for _, l := range logs {
+		v = append(v, l.Address[:]...)
+		v = binary.AppendUvarint(v, uint64(len(l.Topics)))
+		for i := range l.Topics {
+			v = append(v, l.Topics[i][:]...)
+		}
+		v = binary.AppendUvarint(v, uint64(len(l.Data)))
+		v = append(v, l.Data...)
+	}
+	return v
+}
+
+func decodeStatusAndLogs(v []byte) (txNum uint64, status uint8, logs []*Log, err error) {
+	txNum, n := binary.Uvarint(v)
+	if n <= 0 || len(v) == n {
+		return 0, 0, nil, fmt.Errorf("%w: status and logs header", ErrCorruptedReceipt)
+	}
+	v = v[n:]
+	status, v = v[0], v[1:]
+	amount, n := binary.Uvarint(v)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("%w: logs amount", ErrCorruptedReceipt)
+	}
+	v = v[n:]
+	if amount > uint64(len(v)) { // every log takes more than 1 byte
+		return 0, 0, nil, fmt.Errorf("%w: logs amount %d", ErrCorruptedReceipt, amount)
+	}
+	logs = make([]*Log, 0, amount)
+	for i := uint64(0); i < amount; i++ {
+		if len(v) < length.Addr {
+			return 0, 0, nil, fmt.Errorf("%w: log %d address", ErrCorruptedReceipt, i)
+		}
+		l := &Log{Address: common.BytesToAddress(v[:length.Addr])}
+		v = v[length.Addr:]
+
+		topics, n := binary.Uvarint(v)
+		if n <= 0 || topics > uint64(len(v[n:])/length.Hash) {
+			return 0, 0, nil, fmt.Errorf("%w: log %d topics", ErrCorruptedReceipt, i)
+		}
+		v = v[n:]
+		l.Topics = make([]common.Hash, topics)
+		for j := range l.Topics {
+			l.Topics[j] = common.BytesToHash(v[:length.Hash])
+			v = v[length.Hash:]
+		}
+
+		dataLen, n := binary.Uvarint(v)
+		if n <= 0 || dataLen > uint64(len(v[n:])) {
+			return 0, 0, nil, fmt.Errorf("%w: log %d data", ErrCorruptedReceipt, i)
+		}
+		v = v[n:]
+		if dataLen > 0 {
+			l.Data = common.Copy(v[:dataLen])
+		}
+		v = v[dataLen:]
+		logs = append(logs, l)
+	}
+	return txNum, status, logs, nil
+}
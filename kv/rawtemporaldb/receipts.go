@@ -0,0 +1,402 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package rawtemporaldb
+
+import (
+	"fmt"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/rawdbv3"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/stream"
+)
+
+// ReceiptsReader - typed access to ReceiptDomain. Uses `txNumsReader` for blockNum<->txNum mapping.
+// System txns (first and last txNum of block) have no receipts and skipped.
+type ReceiptsReader struct {
+	txNumsReader rawdbv3.TxNumsReader
+}
+
+func NewReceiptsReader(txNumsReader rawdbv3.TxNumsReader) *ReceiptsReader {
+	return &ReceiptsReader{txNumsReader: txNumsReader}
+}
+
+// ReceiptByTxNum - returns `nil` for system txns
+func (r *ReceiptsReader) ReceiptByTxNum(tx kv.TemporalTx, txNum uint64) (*Receipt, error) {
+	ok, blockNum, err := r.txNumsReader.FindBlockNum(tx, txNum)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	minTxNum, err := r.txNumsReader.Min(tx, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	maxTxNum, err := r.txNumsReader.Max(tx, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	if txNum == minTxNum || txNum == maxTxNum {
+		return nil, nil
+	}
+	return readReceipt(tx, blockNum, txNum, int(txNum-minTxNum-1))
+}
+
+// BlockReceipts - receipts of all non-system txns of block, ordered by txIndex
+func (r *ReceiptsReader) BlockReceipts(tx kv.TemporalTx, blockNum uint64) ([]*Receipt, error) {
+	it, err := r.Receipts(tx, blockNum, blockNum, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var receipts []*Receipt
+	for it.HasNext() {
+		receipt, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+// Receipts - stream of receipts of blocks [fromBlock, toBlock]. Limit -1 means Unlimited.
+func (r *ReceiptsReader) Receipts(tx kv.TemporalTx, fromBlock, toBlock uint64, limit int) (stream.Uno[*Receipt], error) {
+	if fromBlock > toBlock {
+		return stream.Array[*Receipt](nil), nil
+	}
+	fromTxNum, err := r.txNumsReader.Min(tx, fromBlock)
+	if err != nil {
+		return nil, err
+	}
+	toTxNum, err := r.txNumsReader.Max(tx, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	if toTxNum < fromTxNum { // toBlock is not in db yet
+		_, toTxNum, err = r.txNumsReader.Last(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	it := rawdbv3.TxNums2BlockNums(tx, r.txNumsReader, stream.Range[uint64](fromTxNum, toTxNum+1), order.Asc)
+	return &ReceiptsIter{tx: tx, it: it, limit: limit}, nil
+}
+
+// ReceiptsIter - implements stream.Uno[*Receipt]
+type ReceiptsIter struct {
+	tx    kv.TemporalTx
+	it    *rawdbv3.MapTxNum2BlockNumIter
+	limit int
+
+	next *Receipt
+	err  error
+}
+
+func (it *ReceiptsIter) advance() {
+	it.next = nil
+	if it.limit == 0 {
+		return
+	}
+	for it.it.HasNext() {
+		txNum, blockNum, txIndex, isFinalTxn, _, err := it.it.Next()
+		if err != nil {
+			it.err = err
+			return
+		}
+		if txIndex == -1 || isFinalTxn {
+			continue
+		}
+		it.next, it.err = readReceipt(it.tx, blockNum, txNum, txIndex)
+		it.limit--
+		return
+	}
+}
+
+func (it *ReceiptsIter) HasNext() bool {
+	if it.next == nil && it.err == nil {
+		it.advance()
+	}
+	return it.next != nil || it.err != nil
+}
+
+func (it *ReceiptsIter) Next() (*Receipt, error) {
+	it.HasNext()
+	next, err := it.next, it.err
+	it.next, it.err = nil, nil
+	return next, err
+}
+
+func (it *ReceiptsIter) Close() { it.it.Close() }
+
+func readReceipt(tx kv.TemporalTx, blockNum, txNum uint64, txIndex int) (*Receipt, error) {
+	var prevGas, prevBlobGas uint64
+	var firstLogIndex uint32
+	if txIndex > 0 { // cumulative values are reset on block start
+		var err error
+		prevGas, prevBlobGas, firstLogIndex, err = ReceiptAsOf(tx, txNum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	gas, blobGas, logIndexAfterTx, err := ReceiptAsOf(tx, txNum+1)
+	if err != nil {
+		return nil, err
+	}
+	status, logs, err := StatusAndLogsOf(tx, txNum)
+	if err != nil {
+		return nil, err
+	}
+	if gas < prevGas || blobGas < prevBlobGas || logIndexAfterTx < firstLogIndex ||
+		(status != ReceiptStatusUnknown && logIndexAfterTx != firstLogIndex+uint32(len(logs))) {
+		return nil, fmt.Errorf("%w: blockNum=%d, txNum=%d", ErrCorruptedReceipt, blockNum, txNum)
+	}
+	for i, l := range logs {
+		l.BlockNum, l.TxNum, l.TxIndex, l.Index = blockNum, txNum, txIndex, firstLogIndex+uint32(i)
+	}
+	return &Receipt{
+		Status:                status,
+		CumulativeGasUsed:     gas,
+		CumulativeBlobGasUsed: blobGas,
+		Logs:                  logs,
+
+		BlockNum:      blockNum,
+		TxNum:         txNum,
+		TxIndex:       txIndex,
+		GasUsed:       gas - prevGas,
+		BlobGasUsed:   blobGas - prevBlobGas,
+		FirstLogIndex: firstLogIndex,
+		LogsCount:     logIndexAfterTx - firstLogIndex,
+	}, nil
+}
+
+// LogFilter - `eth_getLogs` semantic:
+//   - Addresses: log must be emitted by any of them. Empty means any address.
+//   - Topics[i]: log's topic at position `i` must be any of `Topics[i]`. Empty means any topic.
+type LogFilter struct {
+	FromBlock, ToBlock uint64 // inclusive
+	Addresses          []common.Address
+	Topics             [][]common.Hash
+
+	// After - pagination: skip logs up to (and including) this one. Use `LogsIter.Cursor()` of previous page.
+	After *LogCursor
+}
+
+type LogCursor struct {
+	TxNum uint64
+	Index uint32 // log index in block
+}
+
+func (f *LogFilter) match(l *Log) bool {
+	if len(f.Addresses) > 0 && !containsAddress(f.Addresses, l.Address) {
+		return false
+	}
+	if len(f.Topics) > len(l.Topics) {
+		return false
+	}
+	for i, sub := range f.Topics {
+		if len(sub) > 0 && !containsHash(sub, l.Topics[i]) {
+			return false
+		}
+	}
+	if f.After != nil && l.TxNum == f.After.TxNum && l.Index <= f.After.Index {
+		return false
+	}
+	return true
+}
+
+func containsAddress(list []common.Address, a common.Address) bool {
+	for i := range list {
+		if list[i] == a {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHash(list []common.Hash, h common.Hash) bool {
+	for i := range list {
+		if list[i] == h {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs - stream of logs matching filter, ordered by (blockNum, logIndex). Limit -1 means Unlimited.
+// Candidate txns are selected by `LogAddrIdx` and `LogTopicIdx`: union inside one position, intersection between positions.
+func (r *ReceiptsReader) Logs(tx kv.TemporalTx, f *LogFilter, limit int) (*LogsIter, error) {
+	if f.FromBlock > f.ToBlock {
+		return &LogsIter{filter: f, limit: 0}, nil
+	}
+	fromTxNum, err := r.txNumsReader.Min(tx, f.FromBlock)
+	if err != nil {
+		return nil, err
+	}
+	toTxNum, err := r.txNumsReader.Max(tx, f.ToBlock)
+	if err != nil {
+		return nil, err
+	}
+	if toTxNum < fromTxNum {
+		_, toTxNum, err = r.txNumsReader.Last(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.After != nil && f.After.TxNum > fromTxNum {
+		fromTxNum = f.After.TxNum
+	}
+	toTxNum++ // exclusive
+	if fromTxNum >= toTxNum {
+		return &LogsIter{filter: f, limit: 0}, nil
+	}
+
+	txNums, err := logsTxNums(tx, f, fromTxNum, toTxNum)
+	if err != nil {
+		return nil, err
+	}
+	it := rawdbv3.TxNums2BlockNums(tx, r.txNumsReader, txNums, order.Asc)
+	return &LogsIter{tx: tx, it: it, filter: f, limit: limit}, nil
+}
+
+func logsTxNums(tx kv.TemporalTx, f *LogFilter, fromTxNum, toTxNum uint64) (stream.U64, error) {
+	var res stream.U64
+	union := func(name kv.InvertedIdx, keys [][]byte) error {
+		var u stream.U64
+		for _, k := range keys {
+			it, err := tx.IndexRange(name, k, int(fromTxNum), int(toTxNum), order.Asc, kv.Unlim)
+			if err != nil {
+				return err
+			}
+			if u == nil {
+				u = it
+				continue
+			}
+			u = stream.Union[uint64](u, it, order.Asc, kv.Unlim)
+		}
+		if res == nil {
+			res = u
+			return nil
+		}
+		res = stream.Intersect[uint64](res, u, kv.Unlim)
+		return nil
+	}
+
+	if len(f.Addresses) > 0 {
+		keys := make([][]byte, len(f.Addresses))
+		for i := range f.Addresses {
+			keys[i] = f.Addresses[i][:]
+		}
+		if err := union(kv.LogAddrIdx, keys); err != nil {
+			return nil, err
+		}
+	}
+	for _, sub := range f.Topics {
+		if len(sub) == 0 {
+			continue
+		}
+		keys := make([][]byte, len(sub))
+		for i := range sub {
+			keys[i] = sub[i][:]
+		}
+		if err := union(kv.LogTopicIdx, keys); err != nil {
+			return nil, err
+		}
+	}
+	if res == nil {
+		return stream.Range[uint64](fromTxNum, toTxNum), nil
+	}
+	return res, nil
+}
+
+// LogsIter - implements stream.Uno[*Log]
+type LogsIter struct {
+	tx     kv.TemporalTx
+	it     *rawdbv3.MapTxNum2BlockNumIter
+	filter *LogFilter
+	limit  int
+
+	pending []*Log
+	cursor  *LogCursor
+	err     error
+}
+
+func (it *LogsIter) advance() {
+	for len(it.pending) == 0 && it.it != nil && it.it.HasNext() {
+		txNum, blockNum, txIndex, isFinalTxn, _, err := it.it.Next()
+		if err != nil {
+			it.err = err
+			return
+		}
+		if txIndex == -1 || isFinalTxn {
+			continue
+		}
+		receipt, err := readReceipt(it.tx, blockNum, txNum, txIndex)
+		if err != nil {
+			it.err = err
+			return
+		}
+		if receipt.Status == ReceiptStatusUnknown && receipt.LogsCount > 0 {
+			it.err = fmt.Errorf("%w: blockNum=%d, txNum=%d", ErrLogsNotStored, blockNum, txNum)
+			return
+		}
+		for _, l := range receipt.Logs {
+			if it.filter.match(l) {
+				it.pending = append(it.pending, l)
+			}
+		}
+	}
+}
+
+func (it *LogsIter) HasNext() bool {
+	if it.err != nil {
+		return true
+	}
+	if it.limit == 0 {
+		return false
+	}
+	it.advance()
+	return len(it.pending) > 0 || it.err != nil
+}
+
+func (it *LogsIter) Next() (*Log, error) {
+	if !it.HasNext() {
+		return nil, nil
+	}
+	if it.err != nil {
+		err := it.err
+		it.err, it.limit = nil, 0
+		return nil, err
+	}
+	l := it.pending[0]
+	it.pending = it.pending[1:]
+	it.limit--
+	it.cursor = &LogCursor{TxNum: l.TxNum, Index: l.Index}
+	return l, nil
+}
+
+// Cursor - position of last returned log. Pass it as `LogFilter.After` to get next page.
+func (it *LogsIter) Cursor() *LogCursor { return it.cursor }
+
+func (it *LogsIter) Close() {
+	if it.it != nil {
+		it.it.Close()
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package rawtemporaldb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/rawdbv3"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/temporal/temporaltest"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/state"
+)
+
+func TestReceiptsAndLogs(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	ctx := context.Background()
+	db, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+
+	addr1, addr2 := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	topic1, topic2, topic3 := common.HexToHash("0x0a"), common.HexToHash("0x0b"), common.HexToHash("0x0c")
+
+	type txn struct {
+		gas, blobGas uint64
+		status       uint8
+		logs         []*Log
+		legacy       bool // written without AppendStatusAndLogs
+	}
+	// block -> txns. every block also has 2 system txns: first and last txNum of block
+	blocks := [][]txn{
+		{
+			{gas: 21_000, status: ReceiptStatusSuccessful, logs: []*Log{{Address: addr1, Topics: []common.Hash{topic1, topic2}, Data: []byte{1}}}},
+			{gas: 50_000, status: ReceiptStatusFailed},
+		},
+		{}, // empty block
+		{
+			{gas: 30_000, blobGas: 131072, status: ReceiptStatusSuccessful, logs: []*Log{
+				{Address: addr2, Topics: []common.Hash{topic2}},
+				{Address: addr1, Topics: []common.Hash{topic3, topic1}, Data: []byte{2, 3}},
+			}},
+			{gas: 21_000, status: ReceiptStatusSuccessful},
+			{gas: 40_000, status: ReceiptStatusSuccessful, logs: []*Log{{Address: addr1, Topics: []common.Hash{topic1}}}},
+		},
+		{
+			{gas: 21_000, status: ReceiptStatusSuccessful, legacy: true},
+			{gas: 25_000, status: ReceiptStatusSuccessful, legacy: true, logs: []*Log{{Address: addr2, Topics: []common.Hash{topic3}}}},
+		},
+	}
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer rwTx.Rollback()
+	domains, err := state.NewSharedDomains(rwTx, log.New())
+	require.NoError(err)
+	defer domains.Close()
+
+	txNum := uint64(0)
+	for blockNum, txns := range blocks {
+		txNum++ // block-begin system txn
+		var cumGas, cumBlobGas uint64
+		var logIndex uint32
+		for _, txn := range txns {
+			domains.SetTxNum(txNum)
+			cumGas += txn.gas
+			cumBlobGas += txn.blobGas
+			r := &Receipt{Status: txn.status, CumulativeGasUsed: cumGas, CumulativeBlobGasUsed: cumBlobGas, FirstLogIndex: logIndex, Logs: txn.logs}
+			require.NoError(AppendReceipt(domains, r))
+			if !txn.legacy {
+				require.NoError(AppendStatusAndLogs(domains, r))
+			}
+			logIndex += uint32(len(txn.logs))
+			txNum++
+		}
+		require.NoError(rawdbv3.TxNums.Append(rwTx, uint64(blockNum), txNum)) // block-end system txn
+		txNum++
+	}
+	require.NoError(domains.Flush(ctx, rwTx))
+	domains.Close()
+	require.NoError(rwTx.Commit())
+
+	tx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	ttx := tx.(kv.TemporalTx)
+	reader := NewReceiptsReader(rawdbv3.TxNums)
+
+	for blockNum, txns := range blocks {
+		receipts, err := reader.BlockReceipts(ttx, uint64(blockNum))
+		require.NoError(err)
+		require.Len(receipts, len(txns))
+		var cumGas uint64
+		var logIndex uint32
+		for i, r := range receipts {
+			cumGas += txns[i].gas
+			require.Equal(uint64(blockNum), r.BlockNum)
+			require.Equal(i, r.TxIndex)
+			require.Equal(uint32(len(txns[i].logs)), r.LogsCount)
+			if txns[i].legacy {
+				require.Equal(ReceiptStatusUnknown, r.Status)
+				require.Nil(r.Logs)
+				logIndex += r.LogsCount
+				continue
+			}
+			require.Equal(txns[i].status, r.Status)
+			require.Equal(txns[i].gas, r.GasUsed)
+			require.Equal(txns[i].blobGas, r.BlobGasUsed)
+			require.Equal(cumGas, r.CumulativeGasUsed)
+			require.Equal(logIndex, r.FirstLogIndex)
+			require.Len(r.Logs, len(txns[i].logs))
+			for j, l := range r.Logs {
+				require.Equal(txns[i].logs[j].Address, l.Address)
+				require.Equal(txns[i].logs[j].Topics, l.Topics)
+				require.Equal(txns[i].logs[j].Data, l.Data)
+				require.Equal(logIndex+uint32(j), l.Index)
+				require.Equal(r.TxNum, l.TxNum)
+			}
+			logIndex += uint32(len(r.Logs))
+
+			byTxNum, err := reader.ReceiptByTxNum(ttx, r.TxNum)
+			require.NoError(err)
+			require.Equal(r, byTxNum)
+		}
+	}
+
+	// system txns
+	r, err := reader.ReceiptByTxNum(ttx, 0)
+	require.NoError(err)
+	require.Nil(r)
+	r, err = reader.ReceiptByTxNum(ttx, 3)
+	require.NoError(err)
+	require.Nil(r)
+
+	it, err := reader.Receipts(ttx, 0, 2, 4)
+	require.NoError(err)
+	var txIndices []int
+	for it.HasNext() {
+		r, err := it.Next()
+		require.NoError(err)
+		txIndices = append(txIndices, r.TxIndex)
+	}
+	it.Close()
+	require.Equal([]int{0, 1, 0, 1}, txIndices)
+
+	type logPos struct {
+		blockNum uint64
+		index    uint32
+	}
+	getLogs := func(f *LogFilter, limit int) (res []logPos, cursor *LogCursor) {
+		t.Helper()
+		it, err := reader.Logs(ttx, f, limit)
+		require.NoError(err)
+		defer it.Close()
+		for it.HasNext() {
+			l, err := it.Next()
+			require.NoError(err)
+			res = append(res, logPos{l.BlockNum, l.Index})
+		}
+		return res, it.Cursor()
+	}
+
+	all, _ := getLogs(&LogFilter{FromBlock: 0, ToBlock: 2}, kv.Unlim)
+	require.Equal([]logPos{{0, 0}, {2, 0}, {2, 1}, {2, 2}}, all)
+
+	res, _ := getLogs(&LogFilter{FromBlock: 0, ToBlock: 2, Addresses: []common.Address{addr1}}, kv.Unlim)
+	require.Equal([]logPos{{0, 0}, {2, 1}, {2, 2}}, res)
+
+	// topics are position-sensitive: index doesn't know position, reader must check it
+	res, _ = getLogs(&LogFilter{FromBlock: 0, ToBlock: 2, Topics: [][]common.Hash{{topic1}}}, kv.Unlim)
+	require.Equal([]logPos{{0, 0}, {2, 2}}, res)
+	res, _ = getLogs(&LogFilter{FromBlock: 0, ToBlock: 2, Topics: [][]common.Hash{{}, {topic1, topic2}}}, kv.Unlim)
+	require.Equal([]logPos{{0, 0}, {2, 1}}, res)
+	res, _ = getLogs(&LogFilter{FromBlock: 0, ToBlock: 2, Addresses: []common.Address{addr2}, Topics: [][]common.Hash{{topic1}}}, kv.Unlim)
+	require.Empty(res)
+	res, _ = getLogs(&LogFilter{FromBlock: 1, ToBlock: 2, Addresses: []common.Address{addr1, addr2}}, kv.Unlim)
+	require.Equal([]logPos{{2, 0}, {2, 1}, {2, 2}}, res)
+
+	// pagination
+	var pages []logPos
+	f := &LogFilter{FromBlock: 0, ToBlock: 2}
+	for {
+		page, cursor := getLogs(f, 1)
+		if len(page) == 0 {
+			break
+		}
+		require.Len(page, 1)
+		pages = append(pages, page...)
+		f.After = cursor
+	}
+	require.Equal(all, pages)
+
+	// logs of legacy txns are indexed, but not stored
+	it2, err := reader.Logs(ttx, &LogFilter{FromBlock: 3, ToBlock: 3}, kv.Unlim)
+	require.NoError(err)
+	defer it2.Close()
+	for it2.HasNext() {
+		_, err = it2.Next()
+		if err != nil {
+			break
+		}
+	}
+	require.ErrorIs(err, ErrLogsNotStored)
+}
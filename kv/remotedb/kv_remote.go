@@ -666,6 +666,15 @@ func (tx *tx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limi
 		return reply.Keys, reply.Values, reply.NextPageToken, nil
 	}), nil
 }
+func (tx *tx) DomainDiff(name kv.Domain, fromKey []byte, fromTs, toTs uint64, limit int) (it stream.KVV, err error) {
+	return stream.PaginateKVV(func(pageToken string) (keys, before, after [][]byte, nextPageToken string, err error) {
+		reply, err := tx.db.remoteKV.DomainDiff(tx.ctx, &remote.DomainDiffReq{TxId: tx.id, Table: name.String(), FromKey: fromKey, FromTs: fromTs, ToTs: toTs, Limit: int64(limit), PageToken: pageToken})
+		if err != nil {
+			return nil, nil, nil, "", err
+		}
+		return reply.Keys, reply.Before, reply.After, reply.NextPageToken, nil
+	}), nil
+}
 
 func (tx *tx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int) (timestamps stream.U64, err error) {
 	return stream.PaginateU64(func(pageToken string) (arr []uint64, nextPageToken string, err error) {
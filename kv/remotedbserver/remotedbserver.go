@@ -63,7 +63,8 @@ const MaxTxTTL = 60 * time.Second
 // 6.0.0 - Blocks now have system-txs - in the begin/end of block
 // 6.1.0 - Add methods Range, IndexRange, HistorySeek, HistoryRange
 // 6.2.0 - Add HistoryFiles to reply of Snapshots() method
-var KvServiceAPIVersion = &types.VersionReply{Major: 7, Minor: 0, Patch: 0}
+// 7.1.0 - Add DomainDiff method
+var KvServiceAPIVersion = &types.VersionReply{Major: 7, Minor: 1, Patch: 0}
 
 type KvServer struct {
 	remote.UnimplementedKVServer // must be embedded to have forward compatible implementations.
@@ -653,6 +654,61 @@ func (s *KvServer) HistoryRange(_ context.Context, req *remote.HistoryRangeReq)
 	return reply, nil
 }
 
+func (s *KvServer) DomainDiff(_ context.Context, req *remote.DomainDiffReq) (*remote.DomainDiffReply, error) {
+	domainName, err := kv.String2Domain(req.Table)
+	if err != nil {
+		return nil, err
+	}
+	reply := &remote.DomainDiffReply{}
+	fromKey, limit := req.FromKey, int(req.Limit)
+	if limit <= 0 {
+		limit = -1
+	}
+	if req.PageToken != "" {
+		var pagination remote.PairsPagination
+		if err := unmarshalPagination(req.PageToken, &pagination); err != nil {
+			return nil, err
+		}
+		fromKey, limit = pagination.NextKey, int(pagination.Limit)
+	}
+	if req.PageSize <= 0 || req.PageSize > PageSizeLimit {
+		req.PageSize = PageSizeLimit
+	}
+
+	if err := s.with(req.TxId, func(tx kv.Tx) error {
+		ttx, ok := tx.(kv.TemporalTx)
+		if !ok {
+			return errors.New("server DB doesn't implement kv.Temporal interface")
+		}
+		it, err := ttx.DomainDiff(domainName, fromKey, req.FromTs, req.ToTs, -1)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for limit != 0 && it.HasNext() {
+			k, before, after, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if len(reply.Keys) == int(req.PageSize) {
+				reply.NextPageToken, err = marshalPagination(&remote.PairsPagination{NextKey: k, Limit: int64(limit)})
+				if err != nil {
+					return err
+				}
+				break
+			}
+			reply.Keys = append(reply.Keys, bytesCopy(k))
+			reply.Before = append(reply.Before, bytesCopy(before))
+			reply.After = append(reply.After, bytesCopy(after))
+			limit--
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
 func (s *KvServer) DomainRange(_ context.Context, req *remote.DomainRangeReq) (*remote.Pairs, error) {
 	domainName, err := kv.String2Domain(req.Table)
 	if err != nil {
@@ -17,6 +17,7 @@
 package remotedbserver
 
 import (
+	"bytes"
 	"context"
 	"runtime"
 	"testing"
@@ -25,9 +26,14 @@ import (
 	"go.uber.org/mock/gomock"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	remote "github.com/Tangui-Bitfly/erigon-lib/gointerfaces/remoteproto"
 	"github.com/Tangui-Bitfly/erigon-lib/kv"
 	"github.com/Tangui-Bitfly/erigon-lib/kv/memdb"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/temporal/temporaltest"
 	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/state"
 )
 
 func TestKvServer_renew(t *testing.T) {
@@ -139,3 +145,65 @@ func TestKVServerSnapshotsReturnsEmptyIfNoBlockSnapshots(t *testing.T) {
 	require.Empty(t, reply.BlocksFiles)
 	require.Empty(t, reply.HistoryFiles)
 }
+
+func TestKvServer_DomainDiffPagination(t *testing.T) {
+	require, ctx := require.New(t), context.Background()
+	db, _ := temporaltest.NewTestDB(t, datadir.New(t.TempDir()))
+
+	const keysAmount = 10
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer rwTx.Rollback()
+	domains, err := state.NewSharedDomains(rwTx, log.New())
+	require.NoError(err)
+	defer domains.Close()
+	addr := make([]byte, length.Addr)
+	for i := 0; i < keysAmount; i++ {
+		domains.SetTxNum(uint64(i + 1))
+		loc := make([]byte, length.Hash)
+		loc[length.Hash-1] = byte(i)
+		require.NoError(domains.DomainPut(kv.StorageDomain, addr, loc, []byte{byte(i + 1)}, nil, 0))
+	}
+	require.NoError(domains.Flush(ctx, rwTx))
+	domains.Close()
+	require.NoError(rwTx.Commit())
+
+	s := NewKvServer(ctx, db, nil, nil, nil, log.New())
+	id, err := s.begin(ctx)
+	require.NoError(err)
+	defer s.rollback(id)
+
+	readAll := func(fromKey []byte, limit int64) (keys [][]byte, pages int) {
+		req := &remote.DomainDiffReq{TxId: id, Table: kv.StorageDomain.String(), FromKey: fromKey, FromTs: 0, ToTs: keysAmount + 1, Limit: limit, PageSize: 3}
+		for {
+			reply, err := s.DomainDiff(ctx, req)
+			require.NoError(err)
+			require.LessOrEqual(len(reply.Keys), int(req.PageSize))
+			require.Len(reply.Before, len(reply.Keys))
+			require.Len(reply.After, len(reply.Keys))
+			keys = append(keys, reply.Keys...)
+			pages++
+			if reply.NextPageToken == "" {
+				return keys, pages
+			}
+			req.PageToken = reply.NextPageToken
+		}
+	}
+
+	keys, pages := readAll(nil, -1)
+	require.Len(keys, keysAmount)
+	require.Equal(4, pages)
+	for i := 1; i < len(keys); i++ {
+		require.Negative(bytes.Compare(keys[i-1], keys[i]))
+	}
+	noLimit, _ := readAll(nil, 0)
+	require.Equal(keys, noLimit)
+
+	fromKey, pages := readAll(keys[4], -1)
+	require.Equal(keys[4:], fromKey)
+	require.Equal(2, pages)
+
+	keys, pages = readAll(nil, 5)
+	require.Len(keys, 5)
+	require.Equal(2, pages)
+}
@@ -447,3 +447,39 @@ func (it *PaginatedDuo[K, V]) Next() (k K, v V, err error) {
 	it.i++
 	return k, v, nil
 }
+
+type PaginatedTrio[K, V1, V2 any] struct {
+	keys          []K
+	values1       []V1
+	values2       []V2
+	i             int
+	err           error
+	nextPage      NextPageTrio[K, V1, V2]
+	nextPageToken string
+	initialized   bool
+}
+
+func PaginateTrio[K, V1, V2 any](f NextPageTrio[K, V1, V2]) *PaginatedTrio[K, V1, V2] {
+	return &PaginatedTrio[K, V1, V2]{nextPage: f}
+}
+func (it *PaginatedTrio[K, V1, V2]) HasNext() bool {
+	if it.err != nil || it.i < len(it.keys) {
+		return true
+	}
+	if it.initialized && it.nextPageToken == "" {
+		return false
+	}
+	it.initialized = true
+	it.i = 0
+	it.keys, it.values1, it.values2, it.nextPageToken, it.err = it.nextPage(it.nextPageToken)
+	return it.err != nil || it.i < len(it.keys)
+}
+func (it *PaginatedTrio[K, V1, V2]) Close() {}
+func (it *PaginatedTrio[K, V1, V2]) Next() (k K, v1 V1, v2 V2, err error) {
+	if it.err != nil {
+		return k, v1, v2, it.err
+	}
+	k, v1, v2 = it.keys[it.i], it.values1[it.i], it.values2[it.i]
+	it.i++
+	return k, v1, v2, nil
+}
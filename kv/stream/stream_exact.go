@@ -25,12 +25,14 @@ type (
 	U64 Uno[uint64]
 	KV  Duo[[]byte, []byte]          // key,  value
 	KVS Trio[[]byte, []byte, uint64] // key, value, step
+	KVV Trio[[]byte, []byte, []byte] // key, value before, value after
 )
 
 var (
 	EmptyU64 = &Empty[uint64]{}
 	EmptyKV  = &EmptyDuo[[]byte, []byte]{}
 	EmptyKVS = &EmptyTrio[[]byte, []byte, uint64]{}
+	EmptyKVV = &EmptyTrio[[]byte, []byte, []byte]{}
 )
 
 func FilterU64(it U64, filter func(k uint64) bool) *Filtered[uint64] {
@@ -42,6 +44,9 @@ func FilterKV(it KV, filter func(k, v []byte) bool) *FilteredDuo[[]byte, []byte]
 
 func ToArrayU64(s U64) ([]uint64, error)         { return ToArray[uint64](s) }
 func ToArrayKV(s KV) ([][]byte, [][]byte, error) { return ToArrayDuo[[]byte, []byte](s) }
+func ToArrayKVV(s KVV) ([][]byte, [][]byte, [][]byte, error) {
+	return ToArrayTrio[[]byte, []byte, []byte](s)
+}
 
 func ToArrU64Must(s U64) []uint64 {
 	arr, err := ToArray[uint64](s)
@@ -67,8 +72,9 @@ func TransformKV(it KV, transform func(k, v []byte) ([]byte, []byte, error)) *Tr
 
 // internal types
 type (
-	NextPageUno[T any]    func(pageToken string) (arr []T, nextPageToken string, err error)
-	NextPageDuo[K, V any] func(pageToken string) (keys []K, values []V, nextPageToken string, err error)
+	NextPageUno[T any]          func(pageToken string) (arr []T, nextPageToken string, err error)
+	NextPageDuo[K, V any]       func(pageToken string) (keys []K, values []V, nextPageToken string, err error)
+	NextPageTrio[K, V1, V2 any] func(pageToken string) (keys []K, values1 []V1, values2 []V2, nextPageToken string, err error)
 )
 
 func PaginateKV(f NextPageDuo[[]byte, []byte]) *PaginatedDuo[[]byte, []byte] {
@@ -77,6 +83,9 @@ func PaginateKV(f NextPageDuo[[]byte, []byte]) *PaginatedDuo[[]byte, []byte] {
 func PaginateU64(f NextPageUno[uint64]) *Paginated[uint64] {
 	return Paginate[uint64](f)
 }
+func PaginateKVV(f NextPageTrio[[]byte, []byte, []byte]) *PaginatedTrio[[]byte, []byte, []byte] {
+	return PaginateTrio[[]byte, []byte, []byte](f)
+}
 
 type TransformKV2U64Iter[K, V []byte] struct {
 	it        KV
@@ -46,6 +46,19 @@ func ToArrayDuo[K, V any](s Duo[K, V]) (keys []K, values []V, err error) {
 	return keys, values, nil
 }
 
+func ToArrayTrio[K, V1, V2 any](s Trio[K, V1, V2]) (keys []K, values1 []V1, values2 []V2, err error) {
+	for s.HasNext() {
+		k, v1, v2, err := s.Next()
+		if err != nil {
+			return keys, values1, values2, err
+		}
+		keys = append(keys, k)
+		values1 = append(values1, v1)
+		values2 = append(values2, v2)
+	}
+	return keys, values1, values2, nil
+}
+
 func ExpectEqualU64(tb testing.TB, s1, s2 Uno[uint64]) {
 	tb.Helper()
 	ExpectEqual[uint64](tb, s1, s2)
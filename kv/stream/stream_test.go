@@ -350,6 +350,31 @@ func TestPaginatedDual(t *testing.T) {
 	})
 }
 
+func TestPaginatedTrio(t *testing.T) {
+	i := 0
+	s1 := stream.PaginateKVV(func(pageToken string) (keys, before, after [][]byte, nextPageToken string, err error) {
+		i++
+		switch i {
+		case 1:
+			return [][]byte{{1}, {2}}, [][]byte{{1}, {}}, [][]byte{{}, {2}}, "test", nil
+		case 2:
+			return [][]byte{{3}}, [][]byte{{3}}, [][]byte{{4}}, "", nil
+		case 3:
+			panic("must not happen")
+		}
+		return
+	})
+	keys, before, after, err := stream.ToArrayKVV(s1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1}, {2}, {3}}, keys)
+	require.Equal(t, [][]byte{{1}, {}, {3}}, before)
+	require.Equal(t, [][]byte{{}, {2}, {4}}, after)
+
+	//idempotency
+	require.False(t, s1.HasNext())
+	require.False(t, s1.HasNext())
+}
+
 func TestFiler(t *testing.T) {
 	createKVIter := func() stream.KV {
 		i := 0
@@ -159,8 +159,11 @@ type Tx struct {
 	filesTx          *state.AggregatorRoTx
 	resourcesToClose []kv.Closer
 	ctx              context.Context
+	deepUnwound      bool // files detached by deep unwind must be removed after commit or restored after rollback
 }
 
+var _ state.DeepUnwindTx = (*Tx)(nil)
+
 func (tx *Tx) ForceReopenAggCtx() {
 	tx.filesTx.Close()
 	tx.filesTx = tx.Agg().BeginFilesRo()
@@ -170,6 +173,10 @@ func (tx *Tx) WarmupDB(force bool) error { return tx.MdbxTx.WarmupDB(force) }
 func (tx *Tx) LockDBInRam() error        { return tx.MdbxTx.LockDBInRam() }
 func (tx *Tx) AggTx() any                { return tx.filesTx }
 func (tx *Tx) Agg() *state.Aggregator    { return tx.db.agg }
+func (tx *Tx) DeepUnwound() {
+	tx.deepUnwound = true
+	tx.ForceReopenAggCtx()
+}
 func (tx *Tx) Rollback() {
 	tx.autoClose()
 	if tx.MdbxTx == nil { // invariant: it's safe to call Commit/Rollback multiple times
@@ -178,6 +185,9 @@ func (tx *Tx) Rollback() {
 	mdbxTx := tx.MdbxTx
 	tx.MdbxTx = nil
 	mdbxTx.Rollback()
+	if tx.deepUnwound {
+		tx.db.agg.DeepUnwindRolledBack()
+	}
 }
 func (tx *Tx) autoClose() {
 	for _, closer := range tx.resourcesToClose {
@@ -192,7 +202,16 @@ func (tx *Tx) Commit() error {
 	}
 	mdbxTx := tx.MdbxTx
 	tx.MdbxTx = nil
-	return mdbxTx.Commit()
+	if !tx.deepUnwound {
+		return mdbxTx.Commit()
+	}
+	// files detached by deep unwind inside of this tx can be removed only if DB changes are committed
+	if err := mdbxTx.Commit(); err != nil {
+		tx.db.agg.DeepUnwindRolledBack()
+		return err
+	}
+	tx.db.agg.DeepUnwindCommitted()
+	return nil
 }
 
 func (tx *Tx) DomainRange(name kv.Domain, fromKey, toKey []byte, asOfTs uint64, asc order.By, limit int) (stream.KV, error) {
@@ -242,3 +261,12 @@ func (tx *Tx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limi
 	tx.resourcesToClose = append(tx.resourcesToClose, it)
 	return it, nil
 }
+
+func (tx *Tx) DomainDiff(name kv.Domain, fromKey []byte, fromTs, toTs uint64, limit int) (stream.KVV, error) {
+	it, err := tx.filesTx.DomainDiff(tx.MdbxTx, name, fromKey, fromTs, toTs, limit)
+	if err != nil {
+		return nil, err
+	}
+	tx.resourcesToClose = append(tx.resourcesToClose, it)
+	return it, nil
+}
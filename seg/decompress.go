@@ -579,11 +579,16 @@ type Getter struct {
 	dataP       uint64
 	dataBit     int // Value 0..7 - position of the bit
 	trace       bool
+	readBytes   uint64 // see ReadBytes
 }
 
 func (g *Getter) Trace(t bool)     { g.trace = t }
 func (g *Getter) FileName() string { return g.fName }
 
+// ReadBytes - total length of words decompressed (or read, if uncompressed) by this getter: by Next* and Match*
+// methods. Skip doesn't decompress word.
+func (g *Getter) ReadBytes() uint64 { return g.readBytes }
+
 func (g *Getter) nextPos(clean bool) (pos uint64) {
 	defer func() {
 		if rec := recover(); rec != nil {
@@ -717,6 +722,7 @@ func (g *Getter) Next(buf []byte) ([]byte, uint64) {
 		}
 		return buf, g.dataP
 	}
+	g.readBytes += wordLen
 
 	bufOffset := len(buf)
 	if len(buf)+int(wordLen) > cap(buf) {
@@ -779,6 +785,7 @@ func (g *Getter) NextUncompressed() ([]byte, uint64) {
 		}
 		return g.data[g.dataP:g.dataP], g.dataP
 	}
+	g.readBytes += wordLen
 	g.nextPos(false)
 	if g.dataBit > 0 {
 		g.dataP++
@@ -866,6 +873,7 @@ func (g *Getter) MatchPrefix(prefix []byte) bool {
 		}
 		return prefixLen == int(wordLen)
 	}
+	g.readBytes += uint64(prefixLen)
 
 	var bufPos int
 	// In the first pass, we only check patterns
@@ -947,6 +955,7 @@ func (g *Getter) MatchCmp(buf []byte) int {
 		return 0
 	}
 
+	g.readBytes += wordLen
 	decoded := make([]byte, wordLen)
 	var bufPos int
 	// In the first pass, we only check patterns
@@ -1007,6 +1016,7 @@ func (g *Getter) MatchPrefixUncompressed(prefix []byte) bool {
 	}
 
 	g.nextPos(true)
+	g.readBytes += min(wordLen, uint64(prefixLen))
 
 	return bytes.HasPrefix(g.data[g.dataP:g.dataP+wordLen], prefix)
 }
@@ -1028,6 +1038,7 @@ func (g *Getter) MatchCmpUncompressed(buf []byte) int {
 	}
 
 	g.nextPos(true)
+	g.readBytes += wordLen
 
 	return bytes.Compare(buf, g.data[g.dataP:g.dataP+wordLen])
 }
@@ -1048,6 +1059,7 @@ func (g *Getter) FastNext(buf []byte) ([]byte, uint64) {
 		}
 		return buf[:wordLen], g.dataP
 	}
+	g.readBytes += wordLen
 	bufPos := 0 // Tracking position in buf where to insert part of the word
 	lastUncovered := 0
 
@@ -82,6 +82,34 @@ func TestDecompressSkip(t *testing.T) {
 	}
 }
 
+func TestDecompressReadBytes(t *testing.T) {
+	d := prepareLoremDict(t)
+	defer d.Close()
+	g := d.MakeGetter()
+	var expected uint64
+	for i := 0; g.HasNext(); i++ {
+		w := fmt.Sprintf("%s %d", loremStrings[i], i)
+		switch i % 3 {
+		case 0:
+			g.Skip()
+		case 1:
+			word, _ := g.Next(nil)
+			expected += uint64(len(word))
+		case 2:
+			if g.MatchCmp([]byte(w)) != 0 {
+				t.Errorf("expected match with %s", w)
+			}
+			expected += uint64(len(w))
+		}
+		if g.ReadBytes() != expected {
+			t.Fatalf("word %d: expected %d read bytes, got %d", i, expected, g.ReadBytes())
+		}
+	}
+	if expected == 0 {
+		t.Fatal("nothing read")
+	}
+}
+
 func TestDecompressMatchOK(t *testing.T) {
 	d := prepareLoremDict(t)
 	defer d.Close()
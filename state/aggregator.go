@@ -38,6 +38,7 @@ import (
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
 	common2 "github.com/Tangui-Bitfly/erigon-lib/common"
 	"github.com/Tangui-Bitfly/erigon-lib/common/background"
 	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
@@ -57,6 +58,9 @@ type Aggregator struct {
 	d               [kv.DomainLen]*Domain
 	iis             [kv.StandaloneIdxLen]*InvertedIndex
 	dirs            datadir.Dirs
+	tiers           *storageTiers
+	io              *IOScheduler
+	retention       atomic.Pointer[Retention]
 	tmpdir          string
 	aggregationStep uint64
 
@@ -69,6 +73,9 @@ type Aggregator struct {
 	mergeWorkers           int // usually 1
 
 	commitmentValuesTransform bool // enables squeezing commitment values in CommitmentDomain
+	keepCommitmentHistory     bool // SharedDomains writes CommitmentDomain history, required for historical proofs
+	commitmentVariant         commitment.TrieVariant
+	commitmentHasher          commitment.Hasher
 
 	// To keep DB small - need move data to small files ASAP.
 	// It means goroutine which creating small files - can't be locked by merge or indexing.
@@ -93,6 +100,14 @@ type Aggregator struct {
 	ctxAutoIncrement atomic.Uint64
 
 	produce bool
+
+	follower  bool        // read-only Aggregator over datadir of another process, see NewFollowerAggregator
+	following atomic.Bool // follower is watching snapshot dirs
+
+	mergePins  mergePins // ranges which must not be merged, see PinMergeRange
+	mergeStats mergeStats
+
+	deepUnwound []deepUnwoundFile // detached by deepUnwind, protected by dirtyFilesLock
 }
 
 type OnFreezeFunc func(frozenFileNames []string)
@@ -113,6 +128,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 		ctxCancel:              ctxCancel,
 		onFreeze:               func(frozenFileNames []string) {},
 		dirs:                   dirs,
+		io:                     NewIOScheduler(),
 		tmpdir:                 tmpdir,
 		aggregationStep:        aggregationStep,
 		db:                     db,
@@ -123,11 +139,14 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 		mergeWorkers:           1,
 
 		commitmentValuesTransform: AggregatorSqueezeCommitmentValues,
+		commitmentVariant:         commitment.VariantHexPatriciaTrie,
+		commitmentHasher:          commitment.KeccakHasher,
 
 		produce: true,
 	}
+	a.tiers = newStorageTiers(dirs.Snap)
 	commitmentFileMustExist := func(fromStep, toStep uint64) bool {
-		fPath := filepath.Join(dirs.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kv", kv.CommitmentDomain, fromStep, toStep))
+		fPath := a.tiers.resolve(filepath.Join(dirs.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kv", kv.CommitmentDomain, fromStep, toStep)))
 		exists, err := dir.FileExist(fPath)
 		if err != nil {
 			panic(err)
@@ -156,7 +175,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 
 	cfg := domainCfg{
 		hist: histCfg{
-			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
+			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db, tiers: a.tiers},
 			withLocalityIndex: false, withExistenceIndex: false, compression: seg.CompressNone, historyLargeValues: false,
 		},
 		restrictSubsetFileDeletions: a.commitmentValuesTransform,
@@ -166,7 +185,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	}
 	cfg = domainCfg{
 		hist: histCfg{
-			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
+			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db, tiers: a.tiers},
 			withLocalityIndex: false, withExistenceIndex: false, compression: seg.CompressNone, historyLargeValues: false,
 		},
 		restrictSubsetFileDeletions: a.commitmentValuesTransform,
@@ -177,7 +196,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	}
 	cfg = domainCfg{
 		hist: histCfg{
-			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
+			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db, tiers: a.tiers},
 			withLocalityIndex: false, withExistenceIndex: false, historyLargeValues: true,
 			compression: seg.CompressKeys | seg.CompressVals,
 		},
@@ -189,7 +208,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	}
 	cfg = domainCfg{
 		hist: histCfg{
-			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
+			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db, tiers: a.tiers},
 			withLocalityIndex: false, withExistenceIndex: false, compression: seg.CompressNone, historyLargeValues: false,
 			snapshotsDisabled: true,
 		},
@@ -202,7 +221,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	}
 	cfg = domainCfg{
 		hist: histCfg{
-			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db},
+			iiCfg:             iiCfg{salt: salt, dirs: dirs, db: db, tiers: a.tiers},
 			withLocalityIndex: false, withExistenceIndex: false,
 			compression: seg.CompressNone, historyLargeValues: false,
 		},
@@ -223,6 +242,9 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	if err := a.registerII(kv.TracesToIdxPos, salt, dirs, db, aggregationStep, kv.FileTracesToIdx, kv.TblTracesToKeys, kv.TblTracesToIdx, logger); err != nil {
 		return nil, err
 	}
+	if err := a.loadCompressionSettings(); err != nil {
+		return nil, err
+	}
 	a.KeepRecentTxnsOfHistoriesWithDisabledSnapshots(100_000) // ~1k blocks of history
 	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
 
@@ -278,7 +300,7 @@ func getStateIndicesSalt(baseDir string) (salt *uint32, err error) {
 }
 
 func (a *Aggregator) registerII(idx kv.InvertedIdxPos, salt *uint32, dirs datadir.Dirs, db kv.RoDB, aggregationStep uint64, filenameBase, indexKeysTable, indexTable string, logger log.Logger) error {
-	idxCfg := iiCfg{salt: salt, dirs: dirs, db: db}
+	idxCfg := iiCfg{salt: salt, dirs: dirs, db: db, tiers: a.tiers}
 	var err error
 	a.iis[idx], err = NewInvertedIndex(idxCfg, aggregationStep, filenameBase, indexKeysTable, indexTable, nil, logger)
 	if err != nil {
@@ -298,6 +320,12 @@ func (a *Aggregator) DisableFsync() {
 }
 
 func (a *Aggregator) OpenFolder() error {
+	if a.follower {
+		return a.follow()
+	}
+	if err := a.recoverCompressionSwap(); err != nil {
+		return err
+	}
 	if err := a.openFolder(); err != nil {
 		return err
 	}
@@ -379,8 +407,54 @@ func (a *Aggregator) EnableHistory(name kv.Domain) *Aggregator {
 	return a
 }
 
+// KeepCommitmentHistory - SharedDomains discards CommitmentDomain history by default. Keeping it allows to build
+// Merkle proofs of past states (see SharedDomains.AccountProofAsOf). History is kept only in DB and pruned as any other
+// history without files (see KeepRecentTxnsOfHistoriesWithDisabledSnapshots).
+func (a *Aggregator) KeepCommitmentHistory(keep bool) *Aggregator {
+	a.keepCommitmentHistory = keep
+	a.d[kv.CommitmentDomain].historyDisabled = !keep
+	return a
+}
+
+// SetCommitmentVariant - trie used by SharedDomains to compute state root. VariantVerkleTrie is experimental: its
+// nodes are stored in CommitmentDomain as is, so squeezing of commitment values is disabled, and proofs, witnesses and
+// verification of commitment are not supported. Variant can't be changed for existing CommitmentDomain.
+func (a *Aggregator) SetCommitmentVariant(variant commitment.TrieVariant) *Aggregator {
+	a.commitmentVariant = variant
+	if variant != commitment.VariantHexPatriciaTrie {
+		a.commitmentValuesTransform = false
+		a.d[kv.CommitmentDomain].replaceKeysInValues = false
+	}
+	return a
+}
+
+// SetCommitmentHasher - hash function of patricia trie used by SharedDomains (keccak256 by default), e.g.
+// commitment.PoseidonHasher for zk-friendly state root. Hasher can't be changed for existing CommitmentDomain.
+func (a *Aggregator) SetCommitmentHasher(h commitment.Hasher) *Aggregator {
+	a.commitmentHasher = h
+	return a
+}
+
+// SetFileReadCache - cache of lookups in domain files shared by all transactions (disabled by default). Same cache
+// can be used by many Aggregators. Must be called before BeginFilesRo.
+func (a *Aggregator) SetFileReadCache(c *FileReadCache) *Aggregator {
+	for _, d := range a.d {
+		d.fileReadCache = c
+	}
+	return a
+}
+
 func (a *Aggregator) HasBackgroundFilesBuild() bool { return a.ps.Has() }
-func (a *Aggregator) BackgroundProgress() string    { return a.ps.String() }
+func (a *Aggregator) BackgroundProgress() string {
+	progress, io := a.ps.String(), a.io.String()
+	if progress == "" || io == "" {
+		return progress + io
+	}
+	return progress + "; " + io
+}
+
+// IOScheduler - IO budget, priorities and pause/resume of background files building and merging
+func (a *Aggregator) IOScheduler() *IOScheduler { return a.io }
 
 func (ac *AggregatorRoTx) Files() []string {
 	var res []string
@@ -461,6 +535,11 @@ func (a *Aggregator) BuildOptionalMissedIndices(ctx context.Context, workers int
 }
 
 func (ac *AggregatorRoTx) buildOptionalMissedIndices(ctx context.Context, workers int) error {
+	if ac.a.follower {
+		return ErrFollowerAggregator
+	}
+	ctx, iot := ac.a.io.begin(ctx, IOPriorityBackground, math.MaxUint64, "optional indices")
+	defer ac.a.io.end(iot)
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(workers)
 	ps := background.NewProgressSet()
@@ -474,6 +553,9 @@ func (ac *AggregatorRoTx) buildOptionalMissedIndices(ctx context.Context, worker
 }
 
 func (a *Aggregator) BuildMissedIndices(ctx context.Context, workers int) error {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
 	startIndexingTime := time.Now()
 	{
 		ps := background.NewProgressSet()
@@ -596,6 +678,9 @@ func (sf AggV3StaticFiles) CleanupOnError() {
 func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 	a.logger.Debug("[agg] collate and build", "step", step, "collate_workers", a.collateAndBuildWorkers, "merge_workers", a.mergeWorkers, "compress_workers", a.d[kv.AccountsDomain].compressCfg.Workers)
 
+	ctx, iot := a.io.begin(ctx, IOPriorityBuild, a.StepSize(), fmt.Sprintf("step %d", step))
+	defer a.io.end(iot)
+
 	var (
 		logEvery      = time.NewTicker(time.Second * 30)
 		txFrom        = a.FirstTxNumOfStep(step)
@@ -650,6 +735,10 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 				sf.CleanupOnError()
 				return err
 			}
+			if err := iot.accountFiles(ctx, sf.filePaths()); err != nil {
+				sf.CleanupOnError()
+				return err
+			}
 
 			dd, err := kv.String2Domain(d.filenameBase)
 			if err != nil {
@@ -688,6 +777,10 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 				sf.CleanupOnError()
 				return err
 			}
+			if err := iot.accountFiles(ctx, sf.filePaths()); err != nil {
+				sf.CleanupOnError()
+				return err
+			}
 
 			switch ii.indexKeysTable {
 			case kv.TblLogTopicsKeys:
@@ -717,6 +810,9 @@ func (a *Aggregator) buildFiles(ctx context.Context, step uint64) error {
 }
 
 func (a *Aggregator) BuildFiles(toTxNum uint64) (err error) {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
 	finished := a.BuildFilesInBackground(toTxNum)
 	if !(a.buildingFiles.Load() || a.mergingFiles.Load() || a.buildingOptionalIndices.Load()) {
 		return nil
@@ -747,6 +843,9 @@ Loop:
 
 // [from, to)
 func (a *Aggregator) BuildFiles2(ctx context.Context, fromStep, toStep uint64) error {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
 	if ok := a.buildingFiles.CompareAndSwap(false, true); !ok {
 		return nil
 	}
@@ -784,45 +883,48 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context, toTxNum uint64) (somethi
 
 	aggTx := a.BeginFilesRo()
 	defer aggTx.Close()
-	mxRunningMerges.Inc()
-	defer mxRunningMerges.Dec()
 
-	closeAll := true
 	maxSpan := StepsInColdFile * a.StepSize()
 	r := aggTx.findMergeRange(toTxNum, maxSpan)
 	if !r.any() {
 		return false, nil
 	}
+	return true, a.mergeRanges(ctx, aggTx, r)
+}
+
+// mergeRanges - merges files of `r` and makes result visible. If merge failed (or cancelled): input files stay visible
+// and open, because `aggTx` may be not the only reader of them.
+func (a *Aggregator) mergeRanges(ctx context.Context, aggTx *AggregatorRoTx, r RangesV3) error {
+	mxRunningMerges.Inc()
+	defer mxRunningMerges.Dec()
+
+	ctx, iot := a.io.begin(ctx, IOPriorityMerge, r.maxSpan(), r.String())
+	defer a.io.end(iot)
 
 	outs, err := aggTx.staticFilesInRange(r)
-	defer func() {
-		if closeAll {
-			outs.Close()
-		}
-	}()
 	if err != nil {
-		return false, err
+		return err
 	}
 
+	start := time.Now()
 	in, err := aggTx.mergeFiles(ctx, outs, r)
 	if err != nil {
-		return true, err
+		return err
 	}
-	defer func() {
-		if closeAll {
-			in.Close()
-		}
-	}()
+	written := in.filePaths()
+	a.mergeStats.add(outs, in, time.Since(start))
 	a.integrateMergedDirtyFiles(outs, in)
 	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
 	a.cleanAfterMerge(in)
 
 	a.onFreeze(in.FrozenList())
-	closeAll = false
-	return true, nil
+	return iot.accountFiles(ctx, written)
 }
 
 func (a *Aggregator) MergeLoop(ctx context.Context) error {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
 	for {
 		somethingMerged, err := a.mergeLoopStep(ctx, a.visibleFilesMinimaxTxNum.Load())
 		if err != nil {
@@ -860,6 +962,17 @@ func (ac *AggregatorRoTx) minimaxTxNumInDomainFiles() uint64 {
 	return m
 }
 
+// maxTxNumInFiles - end of most advanced files of domains and indices
+func (ac *AggregatorRoTx) maxTxNumInFiles() (m uint64) {
+	for _, d := range ac.d {
+		m = max(m, d.files.EndTxNum(), d.ht.files.EndTxNum(), d.ht.iit.files.EndTxNum())
+	}
+	for _, ii := range ac.iis {
+		m = max(m, ii.files.EndTxNum())
+	}
+	return m
+}
+
 func (ac *AggregatorRoTx) CanPrune(tx kv.Tx, untilTx uint64) bool {
 	if dbg.NoPrune() {
 		return false
@@ -1196,6 +1309,9 @@ func (ac *AggregatorRoTx) PruneCommitHistory(ctx context.Context, tx kv.RwTx, lo
 }
 
 func (ac *AggregatorRoTx) Prune(ctx context.Context, tx kv.RwTx, limit uint64, logEvery *time.Ticker) (*AggregatorPruneStat, error) {
+	if ac.a.follower {
+		return nil, ErrFollowerAggregator
+	}
 	defer mxPruneTookAgg.ObserveDuration(time.Now())
 
 	if limit == 0 {
@@ -1241,6 +1357,9 @@ func (ac *AggregatorRoTx) Prune(ctx context.Context, tx kv.RwTx, limit uint64, l
 		aggStat.Indices[ac.iis[i].ii.filenameBase] = stats[i]
 	}
 
+	if _, err := ac.PruneRetention(ctx, tx, limit, logEvery); err != nil {
+		return aggStat, err
+	}
 	return aggStat, nil
 }
 
@@ -1366,6 +1485,11 @@ func (a *Aggregator) recalcVisibleFiles(toTxNum uint64) {
 
 	a.visibleFilesLock.Lock()
 	defer a.visibleFilesLock.Unlock()
+	a.recalcVisibleFilesLocked(toTxNum)
+}
+
+// recalcVisibleFilesLocked - must be called under `visibleFilesLock`
+func (a *Aggregator) recalcVisibleFilesLocked(toTxNum uint64) {
 	for _, d := range a.d {
 		if d == nil {
 			continue
@@ -1408,6 +1532,23 @@ func (r RangesV3) String() string {
 	return strings.Join(ss, ", ")
 }
 
+// maxSpan - size of the biggest merge in txNums
+func (r RangesV3) maxSpan() (span uint64) {
+	for _, d := range r.domain {
+		for _, mr := range []MergeRange{d.values, d.history.history, d.history.index} {
+			if mr.needMerge {
+				span = max(span, mr.to-mr.from)
+			}
+		}
+	}
+	for _, ii := range r.invertedIndex {
+		if ii != nil && ii.needMerge {
+			span = max(span, ii.to-ii.from)
+		}
+	}
+	return span
+}
+
 func (r RangesV3) any() bool {
 	for _, d := range r.domain {
 		if d.any() {
@@ -1438,6 +1579,7 @@ func (ac *AggregatorRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) RangesV3 {
 	}
 	for id, d := range ac.d {
 		r.domain[id] = d.findMergeRange(maxEndTxNum, maxSpan)
+		ac.a.mergePins.exclude(&r.domain[id].values, &r.domain[id].history.history, &r.domain[id].history.index)
 	}
 
 	if ac.a.commitmentValuesTransform && r.domain[kv.CommitmentDomain].values.needMerge {
@@ -1472,6 +1614,7 @@ func (ac *AggregatorRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) RangesV3 {
 	}
 	for id, ii := range ac.iis {
 		r.invertedIndex[id] = ii.findMergeRange(maxEndTxNum, maxSpan)
+		ac.a.mergePins.exclude(r.invertedIndex[id])
 	}
 
 	//log.Info(fmt.Sprintf("findMergeRange(%d, %d)=%s\n", maxEndTxNum/ac.a.aggregationStep, maxSpan/ac.a.aggregationStep, r))
@@ -1615,7 +1758,7 @@ func (a *Aggregator) SetProduceMod(produce bool) {
 func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 	fin := make(chan struct{})
 
-	if !a.produce {
+	if !a.produce || a.follower {
 		close(fin)
 		return fin
 	}
@@ -1689,6 +1832,7 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 		go func() {
 			defer a.wg.Done()
 			defer a.mergingFiles.Store(false)
+			defer a.migrateStorageTiersAfterMerge(a.ctx) // after `fin`: don't block BuildFiles by slow copy
 
 			//TODO: merge must have own semphore
 
@@ -1762,25 +1906,51 @@ func (ac *AggregatorRoTx) HistorySeek(name kv.History, key []byte, ts uint64, tx
 }
 
 func (ac *AggregatorRoTx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limit int, tx kv.Tx) (it stream.KV, err error) {
-	//TODO: aggTx to store array of histories
-	var domainName kv.Domain
+	domainName, err := historyDomain(name)
+	if err != nil {
+		return nil, err
+	}
+	hr, err := ac.d[domainName].ht.HistoryRange(fromTs, toTs, asc, limit, tx)
+	if err != nil {
+		return nil, err
+	}
+	return stream.WrapKV(hr), nil
+}
+
+// HistoryRangeParallel - same as HistoryRange (Asc only), but values in files are decompressed by `workers` goroutines
+func (ac *AggregatorRoTx) HistoryRangeParallel(ctx context.Context, name kv.History, fromTs, toTs int, limit, workers int, tx kv.Tx) (it stream.KV, err error) {
+	domainName, err := historyDomain(name)
+	if err != nil {
+		return nil, err
+	}
+	hr, err := ac.d[domainName].ht.HistoryRangeParallel(ctx, fromTs, toTs, limit, workers, tx)
+	if err != nil {
+		return nil, err
+	}
+	return stream.WrapKV(hr), nil
+}
+
+// HistoryScanFrozen - unordered scan of history files only (no recent part from db). `f` is called concurrently by `workers` goroutines
+func (ac *AggregatorRoTx) HistoryScanFrozen(ctx context.Context, name kv.History, fromTs, toTs int, workers int, f func(k, v []byte) error) error {
+	domainName, err := historyDomain(name)
+	if err != nil {
+		return err
+	}
+	return ac.d[domainName].ht.ScanChangedFrozen(ctx, fromTs, toTs, workers, f)
+}
 
+func historyDomain(name kv.History) (kv.Domain, error) {
+	//TODO: aggTx to store array of histories
 	switch name {
 	case kv.AccountsHistory:
-		domainName = kv.AccountsDomain
+		return kv.AccountsDomain, nil
 	case kv.StorageHistory:
-		domainName = kv.StorageDomain
+		return kv.StorageDomain, nil
 	case kv.CodeHistory:
-		domainName = kv.CodeDomain
+		return kv.CodeDomain, nil
 	default:
-		return nil, fmt.Errorf("unexpected history name: %s", name)
+		return 0, fmt.Errorf("unexpected history name: %s", name)
 	}
-
-	hr, err := ac.d[domainName].ht.HistoryRange(fromTs, toTs, asc, limit, tx)
-	if err != nil {
-		return nil, err
-	}
-	return stream.WrapKV(hr), nil
 }
 
 func (ac *AggregatorRoTx) KeyCountInDomainRange(d kv.Domain, start, end uint64) (totalKeys uint64) {
@@ -1847,6 +2017,9 @@ func (ac *AggregatorRoTx) DomainRange(ctx context.Context, tx kv.Tx, domain kv.D
 func (ac *AggregatorRoTx) DomainRangeLatest(tx kv.Tx, domain kv.Domain, from, to []byte, limit int) (stream.KV, error) {
 	return ac.d[domain].DomainRangeLatest(tx, from, to, limit)
 }
+func (ac *AggregatorRoTx) DomainDiff(tx kv.Tx, domain kv.Domain, fromKey []byte, fromTxNum, toTxNum uint64, limit int) (stream.KVV, error) {
+	return ac.d[domain].DomainDiff(fromKey, fromTxNum, toTxNum, limit, tx)
+}
 func (ac *AggregatorRoTx) DomainGetAsOfFile(name kv.Domain, key []byte, ts uint64) (v []byte, ok bool, err error) {
 	return ac.d[name].GetAsOfFile(key, ts)
 }
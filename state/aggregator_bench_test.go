@@ -36,6 +36,8 @@ import (
 	"github.com/Tangui-Bitfly/erigon-lib/common/length"
 	"github.com/Tangui-Bitfly/erigon-lib/kv"
 	"github.com/Tangui-Bitfly/erigon-lib/kv/mdbx"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/stream"
 	"github.com/Tangui-Bitfly/erigon-lib/recsplit"
 	"github.com/Tangui-Bitfly/erigon-lib/seg"
 )
@@ -62,6 +64,32 @@ type txWithCtx struct {
 func WrapTxWithCtx(tx kv.Tx, ctx *AggregatorRoTx) *txWithCtx { return &txWithCtx{Tx: tx, ac: ctx} }
 func (tx *txWithCtx) AggTx() any                             { return tx.ac }
 
+// txWithCtx implements kv.TemporalTx the same way as temporal.Tx does
+var _ kv.TemporalTx = (*txWithCtx)(nil)
+
+func (tx *txWithCtx) DomainGet(name kv.Domain, k, k2 []byte) (v []byte, step uint64, err error) {
+	v, step, _, err = tx.ac.GetLatest(name, k, k2, tx.Tx)
+	return v, step, err
+}
+func (tx *txWithCtx) DomainGetAsOf(name kv.Domain, k, k2 []byte, ts uint64) (v []byte, ok bool, err error) {
+	return tx.ac.DomainGetAsOf(tx.Tx, name, append(common.Copy(k), k2...), ts)
+}
+func (tx *txWithCtx) HistorySeek(name kv.History, k []byte, ts uint64) (v []byte, ok bool, err error) {
+	return tx.ac.HistorySeek(name, k, ts, tx.Tx)
+}
+func (tx *txWithCtx) IndexRange(name kv.InvertedIdx, k []byte, fromTs, toTs int, asc order.By, limit int) (stream.U64, error) {
+	return tx.ac.IndexRange(name, k, fromTs, toTs, asc, limit, tx.Tx)
+}
+func (tx *txWithCtx) DomainRange(name kv.Domain, fromKey, toKey []byte, ts uint64, asc order.By, limit int) (stream.KV, error) {
+	return tx.ac.DomainRange(context.Background(), tx.Tx, name, fromKey, toKey, ts, asc, limit)
+}
+func (tx *txWithCtx) HistoryRange(name kv.History, fromTs, toTs int, asc order.By, limit int) (stream.KV, error) {
+	return tx.ac.HistoryRange(name, fromTs, toTs, asc, limit, tx.Tx)
+}
+func (tx *txWithCtx) DomainDiff(name kv.Domain, fromKey []byte, fromTs, toTs uint64, limit int) (stream.KVV, error) {
+	return tx.ac.DomainDiff(tx.Tx, name, fromKey, fromTs, toTs, limit)
+}
+
 func BenchmarkAggregator_Processing(b *testing.B) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
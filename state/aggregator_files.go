@@ -101,6 +101,22 @@ func (mf MergedFilesV3) FrozenList() (frozen []string) {
 	}
 	return frozen
 }
+func (mf MergedFilesV3) filePaths() (paths []string) {
+	for id := range mf.d {
+		for _, item := range []*filesItem{mf.d[id], mf.dHist[id], mf.dIdx[id]} {
+			if item != nil {
+				paths = append(paths, item.filePaths()...)
+			}
+		}
+	}
+	for _, item := range mf.iis {
+		if item != nil {
+			paths = append(paths, item.filePaths()...)
+		}
+	}
+	return paths
+}
+
 func (mf MergedFilesV3) Close() {
 	clist := make([]*filesItem, 0, kv.DomainLen+4)
 	for id := range mf.d {
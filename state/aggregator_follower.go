@@ -0,0 +1,219 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+// Follower mode:
+//   - datadir is owned by another process (writer), follower (for example RPCDaemon) only reads files produced by writer
+//   - follower watches snapshot dirs (inotify if available) and also re-scans them every FollowerPollInterval
+//   - new file becomes visible once its accessors are complete (writer creates them by atomic rename)
+//   - file which disappeared from disk (merged, pruned by retention) is removed from visible files, but closed only
+//     after all AggregatorRoTx which use it are closed
+//   - follower never writes or deletes files: building, merging, indexing, pruning and deep
+//     unwind return ErrFollowerAggregator
+
+var ErrFollowerAggregator = errors.New("aggregator is a read-only follower")
+
+// FollowerPollInterval - how often follower re-scans snapshot dirs. It's the only way to notice new files if file
+// system notifications are not available.
+var FollowerPollInterval = 10 * time.Second
+
+// followerDebounce - writer creates data file and its accessors one by one: re-scan after short quiet period
+const followerDebounce = 200 * time.Millisecond
+
+// NewFollowerAggregator - read-only Aggregator over datadir of another process. Call OpenFolder to open files
+// and start watching snapshot dirs, watching stops on Close.
+func NewFollowerAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint64, db kv.RoDB, logger log.Logger) (*Aggregator, error) {
+	// NewAggregator creates salt of indices if it doesn't exist - follower must use salt of writer
+	exists, err := dir.FileExist(filepath.Join(dirs.Snap, "salt-state.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("NewFollowerAggregator: salt-state.txt not found in %s, datadir is not initialized by writer", dirs.Snap)
+	}
+	a, err := NewAggregator(ctx, dirs, aggregationStep, db, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.follower = true
+	return a, nil
+}
+
+func (a *Aggregator) IsFollower() bool { return a.follower }
+
+// follow - opens files and starts watching snapshot dirs (once)
+func (a *Aggregator) follow() error {
+	if err := a.reloadFolder(); err != nil {
+		return err
+	}
+	if a.following.CompareAndSwap(false, true) {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.followLoop()
+		}()
+	}
+	return nil
+}
+
+func (a *Aggregator) followLoop() {
+	var events <-chan struct{}
+	w, err := newDirWatcher(a.followedDirs())
+	if err != nil {
+		a.logger.Debug("[snapshots] follower: file system notifications are not available, polling", "err", err)
+	} else {
+		defer w.Close()
+		events = w.Events()
+	}
+
+	poll := time.NewTicker(FollowerPollInterval)
+	defer poll.Stop()
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-events:
+			debounce = time.After(followerDebounce)
+			continue
+		case <-debounce:
+		case <-poll.C:
+		}
+		debounce = nil
+		if err := a.reloadFolder(); err != nil {
+			a.logger.Warn("[snapshots] follower: reload files", "err", err)
+		}
+	}
+}
+
+// followedDirs - dirs where writer creates, renames or removes files
+func (a *Aggregator) followedDirs() []string {
+	dirs := []string{a.dirs.SnapDomain, a.dirs.SnapHistory, a.dirs.SnapIdx, a.dirs.SnapAccessors}
+	if a.tiers.enabled() {
+		for i := range a.tiers.tiers {
+			for _, fastDir := range []string{a.dirs.SnapDomain, a.dirs.SnapHistory, a.dirs.SnapIdx} {
+				tierDir, err := a.tiers.tierPath(i, fastDir)
+				if err != nil {
+					a.logger.Warn("[snapshots] follower: skip tier dir", "err", err)
+					continue
+				}
+				dirs = append(dirs, tierDir)
+			}
+		}
+	}
+	return dirs
+}
+
+// reloadFolder - like openFolder, but files which disappeared from disk are not closed immediately:
+// they are hidden from new readers first, then released (see releaseFile)
+func (a *Aggregator) reloadFolder() error {
+	a.dirtyFilesLock.Lock()
+	var gone []*filesItem
+	for _, d := range a.d {
+		g, err := d.reloadFolder()
+		if err != nil {
+			a.dirtyFilesLock.Unlock()
+			return fmt.Errorf("reloadFolder: %w", err)
+		}
+		gone = append(gone, g...)
+	}
+	for _, ii := range a.iis {
+		g, err := ii.reloadFolder()
+		if err != nil {
+			a.dirtyFilesLock.Unlock()
+			return fmt.Errorf("reloadFolder: %w", err)
+		}
+		gone = append(gone, g...)
+	}
+	a.dirtyFilesLock.Unlock()
+
+	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
+	for _, item := range gone {
+		releaseFile(item)
+	}
+	return nil
+}
+
+// releaseFile - closes file removed from `dirtyFiles` and from visible files, when last reader of it is closed.
+// File stays on disk.
+func releaseFile(item *filesItem) {
+	item.keepOnDisk.Store(true)
+	item.canDelete.Store(true)
+	if item.refcount.Load() == 0 {
+		item.closeFilesAndRemove()
+	}
+}
+
+func (d *Domain) reloadFolder() (gone []*filesItem, err error) {
+	idxFiles, histFiles, domainFiles, err := d.fileNamesOnDisk()
+	if err != nil {
+		return nil, fmt.Errorf("Domain(%s).reloadFolder: %w", d.filenameBase, err)
+	}
+	if gone, err = d.History.reloadList(idxFiles, histFiles); err != nil {
+		return nil, err
+	}
+	// no protectFromHistoryFilesAheadOfDomainFiles: writer builds history files before domain files, visible files
+	// are limited by minimax txNum of all domains anyway
+	gone = append(gone, detachWhatNotInList(d.dirtyFiles, domainFiles)...)
+	d.scanDirtyFiles(domainFiles)
+	if err := d.openDirtyFiles(); err != nil {
+		return nil, fmt.Errorf("Domain(%s).reloadFolder: %w", d.filenameBase, err)
+	}
+	return gone, nil
+}
+
+func (h *History) reloadList(idxFiles, histNames []string) (gone []*filesItem, err error) {
+	if gone, err = h.InvertedIndex.reloadList(idxFiles); err != nil {
+		return nil, err
+	}
+	gone = append(gone, detachWhatNotInList(h.dirtyFiles, histNames)...)
+	h.scanDirtyFiles(histNames)
+	if err := h.openDirtyFiles(); err != nil {
+		return nil, fmt.Errorf("History(%s).reloadList: %w", h.filenameBase, err)
+	}
+	return gone, nil
+}
+
+func (ii *InvertedIndex) reloadFolder() (gone []*filesItem, err error) {
+	idxFiles, _, _, err := ii.fileNamesOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	return ii.reloadList(idxFiles)
+}
+
+func (ii *InvertedIndex) reloadList(fNames []string) (gone []*filesItem, err error) {
+	gone = detachWhatNotInList(ii.dirtyFiles, fNames)
+	ii.scanDirtyFiles(fNames)
+	if err := ii.openDirtyFiles(); err != nil {
+		return nil, fmt.Errorf("InvertedIndex(%s).reloadList: %w", ii.filenameBase, err)
+	}
+	return gone, nil
+}
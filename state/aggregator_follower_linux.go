@@ -0,0 +1,96 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+)
+
+// dirWatcher - inotify watcher of snapshot dirs. Content of events is not used: any change triggers re-scan.
+type dirWatcher struct {
+	fd     int
+	events chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+func newDirWatcher(dirs []string) (*dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init: %w", err)
+	}
+	const mask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE
+	for _, d := range dirs {
+		if exists, _ := dir.Exist(d); !exists {
+			continue
+		}
+		if _, err := unix.InotifyAddWatch(fd, d, mask); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("inotify_add_watch %s: %w", d, err)
+		}
+	}
+	w := &dirWatcher{fd: fd, events: make(chan struct{}, 1), quit: make(chan struct{}), done: make(chan struct{})}
+	go w.loop()
+	return w, nil
+}
+
+func (w *dirWatcher) Events() <-chan struct{} { return w.events }
+
+func (w *dirWatcher) loop() {
+	defer close(w.done)
+	buf := make([]byte, 16*1024)
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
+		n, err := unix.Poll(fds, 100)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return // follower still polls dirs
+		}
+		if n == 0 {
+			continue
+		}
+		for { // drain
+			if _, err := unix.Read(w.fd, buf); err != nil {
+				break
+			}
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *dirWatcher) Close() {
+	close(w.quit)
+	<-w.done
+	unix.Close(w.fd)
+}
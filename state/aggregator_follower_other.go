@@ -0,0 +1,31 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package state
+
+import "errors"
+
+// dirWatcher - file system notifications are not implemented on this platform, follower polls dirs
+type dirWatcher struct{}
+
+func newDirWatcher(dirs []string) (*dirWatcher, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func (w *dirWatcher) Events() <-chan struct{} { return nil }
+func (w *dirWatcher) Close()                  {}
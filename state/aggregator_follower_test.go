@@ -0,0 +1,135 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestAggregator_Follower(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 10)
+
+	write := func(fromTxNum, toTxNum uint64) {
+		t.Helper()
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		for txNum := fromTxNum; txNum < toTxNum; txNum++ {
+			domains.SetTxNum(txNum)
+			addr := make([]byte, 20)
+			binary.BigEndian.PutUint64(addr, txNum%17)
+			buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0))
+		}
+		require.NoError(t, domains.Flush(ctx, rwTx))
+		require.NoError(t, rwTx.Commit())
+	}
+
+	write(0, 35)
+	require.NoError(t, agg.BuildFiles(35))
+
+	_, err := NewFollowerAggregator(ctx, datadir.New(t.TempDir()), 10, db, log.New())
+	require.ErrorContains(t, err, "salt-state.txt")
+
+	follower, err := NewFollowerAggregator(ctx, agg.dirs, 10, db, log.New())
+	require.NoError(t, err)
+	t.Cleanup(follower.Close)
+	require.NoError(t, follower.OpenFolder())
+	require.True(t, follower.IsFollower())
+	require.NotZero(t, follower.EndTxNumMinimax())
+	require.Equal(t, agg.EndTxNumMinimax(), follower.EndTxNumMinimax())
+	require.Equal(t, agg.Files(), follower.Files())
+
+	require.ErrorIs(t, follower.BuildFiles(35), ErrFollowerAggregator)
+	require.ErrorIs(t, follower.MergeLoop(ctx), ErrFollowerAggregator)
+	require.ErrorIs(t, follower.BuildMissedIndices(ctx, 1), ErrFollowerAggregator)
+	func() {
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := follower.BeginFilesRo()
+		defer ac.Close()
+		_, err = ac.Prune(ctx, rwTx, 0, nil)
+		require.ErrorIs(t, err, ErrFollowerAggregator)
+		_, err = ac.PruneRetention(ctx, rwTx, 0, nil)
+		require.ErrorIs(t, err, ErrFollowerAggregator)
+		_, err = ac.deepUnwind(ctx, rwTx, 0, nil)
+		require.ErrorIs(t, err, ErrFollowerAggregator)
+	}()
+
+	// reader keeps files which writer merges and removes
+	reader := follower.BeginFilesRo()
+	defer reader.Close()
+	var used []*filesItem
+	for _, f := range reader.d[kv.AccountsDomain].files {
+		used = append(used, f.src)
+	}
+	require.NotEmpty(t, used)
+
+	write(35, 85)
+	require.NoError(t, agg.BuildFiles(85))
+	require.NoError(t, follower.reloadFolder())
+	require.Equal(t, agg.EndTxNumMinimax(), follower.EndTxNumMinimax())
+	require.Equal(t, agg.Files(), follower.Files())
+
+	var released []*filesItem
+	for _, item := range used {
+		require.NotNil(t, item.decompressor, "file is closed while reader uses it")
+		if item.canDelete.Load() {
+			released = append(released, item)
+			require.True(t, item.keepOnDisk.Load())
+			_, err := os.Stat(item.decompressor.FilePath())
+			require.ErrorIs(t, err, os.ErrNotExist) // removed by writer
+			require.True(t, item.decompressor.MakeGetter().HasNext())
+		}
+	}
+	require.NotEmpty(t, released, "writer didn't merge files")
+	reader.Close()
+	for _, item := range released {
+		require.Nil(t, item.decompressor)
+	}
+
+	// follower watches dirs
+	write(85, 125)
+	require.NoError(t, agg.BuildFiles(125))
+	require.Eventually(t, func() bool {
+		return agg.EndTxNumMinimax() == follower.EndTxNumMinimax()
+	}, 2*FollowerPollInterval, 20*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return len(agg.Files()) == len(follower.Files())
+	}, 2*FollowerPollInterval, 20*time.Millisecond)
+	require.Equal(t, agg.Files(), follower.Files())
+}
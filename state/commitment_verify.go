@@ -0,0 +1,162 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"time"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+)
+
+type CommitmentVerification struct {
+	BlockNum     uint64 // block and txNum of verified commitment state
+	TxNum        uint64
+	Keys         uint64 // accounts and storage slots streamed from domains
+	StoredRoot   []byte
+	ComputedRoot []byte
+
+	// Nibbles of the first (in order of hashed keys) deepest subtree which hash differs from CommitmentDomain content,
+	// nil if all branches are the same. Empty if only root node differs.
+	DivergentPrefix []byte
+	Mismatches      uint64 // number of branches which differ from CommitmentDomain content
+}
+
+func (v *CommitmentVerification) Match() bool { return bytes.Equal(v.StoredRoot, v.ComputedRoot) }
+
+// VerifyCommitment recomputes trie root from scratch using accounts and storage domains as of the last commitment
+// state computed before `txNum` (math.MaxUint64 for the latest one) and compares it with stored root. Nothing is
+// written: keys are sorted by ETL and branches are compared with CommitmentDomain as soon as they are computed, so
+// memory usage doesn't depend on state size. Unlike Aggregator.RebuildCommitmentFiles it's read-only and can be
+// used to find out where stored commitment diverged from state.
+// Verification of not latest state requires CommitmentDomain history (see Aggregator.KeepCommitmentHistory).
+// Domains are read from DB and files, so SharedDomains must be flushed.
+func (sd *SharedDomains) VerifyCommitment(ctx context.Context, txNum uint64, logPrefix string) (*CommitmentVerification, error) {
+	sdc := NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, commitment.VariantHexPatriciaTrie)
+	defer sdc.Close()
+	blockNum, stateTxNum, ok, err := sd.restoreCommitmentStateAsOf(sdc, txNum)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("commitment state before txNum=%d is not found", txNum)
+	}
+	res := &CommitmentVerification{BlockNum: blockNum, TxNum: stateTxNum}
+
+	stored, ok := sdc.patriciaTrie.(*commitment.HexPatriciaHashed)
+	if !ok {
+		return nil, fmt.Errorf("verification is not supported by patricia trie type: %T", sdc.patriciaTrie)
+	}
+	if res.StoredRoot, err = stored.RootHash(); err != nil {
+		return nil, err
+	}
+
+	vc := &commitmentVerifyContext{sdc: sdc, res: res}
+	trie, updates := commitment.InitializeTrieAndUpdates(commitment.VariantHexPatriciaTrie, commitment.ModeDirect, sd.aggTx.a.tmpdir, sd.aggTx.a.commitmentHasher)
+	defer updates.Close()
+	trie.ResetContext(vc)
+
+	logEvery := time.NewTicker(20 * time.Second)
+	defer logEvery.Stop()
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+		it, err := sd.aggTx.DomainRange(ctx, sd.roTx, d, nil, nil, sdc.historyAsOfTxNum, order.Asc, -1)
+		if err != nil {
+			return nil, err
+		}
+		for it.HasNext() {
+			k, v, err := it.Next()
+			if err != nil {
+				it.Close()
+				return nil, err
+			}
+			if len(v) == 0 { // deleted
+				continue
+			}
+			if err := updates.TouchUniquePlainKey(k); err != nil {
+				it.Close()
+				return nil, err
+			}
+			res.Keys++
+
+			select {
+			case <-ctx.Done():
+				it.Close()
+				return nil, ctx.Err()
+			case <-logEvery.C:
+				sd.logger.Info(fmt.Sprintf("[%s] verifying commitment: collecting keys", logPrefix), "domain", d, "keys", common.PrettyCounter(res.Keys))
+			default:
+			}
+		}
+		it.Close()
+	}
+
+	if res.ComputedRoot, err = trie.Process(ctx, updates, logPrefix); err != nil {
+		return nil, err
+	}
+	if !res.Match() || res.Mismatches > 0 {
+		sd.logger.Warn(fmt.Sprintf("[%s] commitment mismatch", logPrefix), "block", res.BlockNum, "txNum", res.TxNum,
+			"stored", hex.EncodeToString(res.StoredRoot), "computed", hex.EncodeToString(res.ComputedRoot),
+			"divergentPrefix", fmt.Sprintf("%x", res.DivergentPrefix), "branchMismatches", res.Mismatches)
+	}
+	return res, nil
+}
+
+// commitmentVerifyContext is a PatriciaContext of the trie computed from scratch: there are no branches to read,
+// computed branches are compared with stored ones instead of being written.
+type commitmentVerifyContext struct {
+	sdc *SharedDomainsCommitmentContext
+	res *CommitmentVerification
+}
+
+func (vc *commitmentVerifyContext) Branch(prefix []byte) ([]byte, uint64, error) { return nil, 0, nil }
+
+func (vc *commitmentVerifyContext) PutBranch(prefix []byte, data []byte, prevData []byte, prevStep uint64) error {
+	stored, _, err := vc.sdc.Branch(prefix)
+	if err != nil {
+		return err
+	}
+	delete(vc.sdc.branches, string(prefix)) // each branch is put once, do not keep them in memory
+
+	diff, err := commitment.BranchData(data).DiffCells(stored)
+	if err != nil {
+		return fmt.Errorf("branch [%x]: %w", prefix, err)
+	}
+	if diff == 0 {
+		return nil
+	}
+	vc.res.Mismatches++
+	if vc.res.DivergentPrefix == nil {
+		// branches are computed from the deepest ones, so the first mismatch points to the deepest divergent subtree
+		vc.res.DivergentPrefix = append(commitment.CompactedKeyToHex(prefix), byte(bits.TrailingZeros16(diff)))
+	}
+	return nil
+}
+
+func (vc *commitmentVerifyContext) Account(plainKey []byte) (*commitment.Update, error) {
+	return vc.sdc.Account(plainKey)
+}
+
+func (vc *commitmentVerifyContext) Storage(plainKey []byte) (*commitment.Update, error) {
+	return vc.sdc.Storage(plainKey)
+}
@@ -0,0 +1,655 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	btree2 "github.com/tidwall/btree"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+var (
+	ErrRecompressBusy  = errors.New("can't re-compress files: files are building or merging")
+	ErrRecompressInUse = errors.New("can't re-compress files: files are used by readers")
+)
+
+// compressionSettingsFile - settings chosen by Recompress. Files of component are readable only with it's FileCompression:
+// settings must survive restart.
+const compressionSettingsFile = "compression-state.json"
+
+// CompressionSettings - how files of domain, history or inverted index are compressed.
+// Cfg can differ between files (dictionary is stored in file), but Compression must be same for all files of component.
+type CompressionSettings struct {
+	Cfg         seg.Cfg
+	Compression seg.FileCompression
+}
+
+func (s CompressionSettings) String() string {
+	return fmt.Sprintf("c=%s,dict=%d,minPattern=%d,maxPattern=%d,score=%d,sampling=%d",
+		s.Compression, s.Cfg.MaxDictPatterns, s.Cfg.MinPatternLen, s.Cfg.MaxPatternLen, s.Cfg.MinPatternScore, s.Cfg.SamplingFactor)
+}
+
+func (s CompressionSettings) same(o CompressionSettings) bool {
+	s.Cfg.Workers, o.Cfg.Workers = 0, 0
+	return s == o
+}
+
+// CompressionCandidates - dictionary sizes and pattern lengths around `base`, with all compression modes
+func CompressionCandidates(base CompressionSettings) []CompressionSettings {
+	var res []CompressionSettings
+	for _, c := range []seg.FileCompression{seg.CompressNone, seg.CompressKeys, seg.CompressVals, seg.CompressKeys | seg.CompressVals} {
+		if c == seg.CompressNone {
+			res = append(res, CompressionSettings{Cfg: base.Cfg, Compression: c}) // dictionary is not used
+			continue
+		}
+		for _, dict := range []int{base.Cfg.MaxDictPatterns / 4, base.Cfg.MaxDictPatterns, base.Cfg.MaxDictPatterns * 4} {
+			for _, minPattern := range []int{base.Cfg.MinPatternLen, base.Cfg.MinPatternLen * 2} {
+				cfg := base.Cfg
+				cfg.MaxDictPatterns, cfg.MinPatternLen = max(dict, 1), min(minPattern, cfg.MaxPatternLen)
+				res = append(res, CompressionSettings{Cfg: cfg, Compression: c})
+			}
+		}
+	}
+	return res
+}
+
+// CompressionTrial - result of compression of sample with one settings
+type CompressionTrial struct {
+	Settings       CompressionSettings
+	RawSize        uint64 // size of sampled words
+	CompressedSize uint64 // size of file produced from sample
+	CompressTook   time.Duration
+	DecodeTook     time.Duration // read of all words of sample
+}
+
+func (t CompressionTrial) Ratio() float64 {
+	if t.CompressedSize == 0 {
+		return 0
+	}
+	return float64(t.RawSize) / float64(t.CompressedSize)
+}
+
+// DecodeSpeed - bytes of raw data per second
+func (t CompressionTrial) DecodeSpeed() datasize.ByteSize {
+	if t.DecodeTook <= 0 {
+		return 0
+	}
+	return datasize.ByteSize(float64(t.RawSize) / t.DecodeTook.Seconds())
+}
+
+func (t CompressionTrial) String() string {
+	return fmt.Sprintf("%s: size=%s ratio=%.2f decode=%s/s compress=%s", t.Settings, datasize.ByteSize(t.CompressedSize).HR(), t.Ratio(), t.DecodeSpeed().HR(), t.CompressTook)
+}
+
+// CompressionReport - see Aggregator.TuneCompression
+type CompressionReport struct {
+	Name  string
+	Kind  TierFileKind
+	File  string
+	Words int // words in sample
+
+	Current CompressionTrial   // settings used now
+	Trials  []CompressionTrial // all candidates, sorted by size
+	Winner  CompressionTrial
+}
+
+func (r *CompressionReport) String() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%s.%s %s (sample: %d words, %s)\n", r.Name, r.Kind, r.File, r.Words, datasize.ByteSize(r.Current.RawSize).HR())
+	fmt.Fprintf(sb, "current: %s\n", r.Current)
+	fmt.Fprintf(sb, "winner:  %s\n", r.Winner)
+	for _, t := range r.Trials {
+		fmt.Fprintf(sb, "  %s\n", t)
+	}
+	return sb.String()
+}
+
+type CompressionTuneCfg struct {
+	Candidates []CompressionSettings // default: CompressionCandidates of current settings
+	SampleSize datasize.ByteSize     // default: 64mb
+
+	// MaxDecodeSlowdown - winner must decode not slower than current settings multiplied by it. Default: 1.25
+	MaxDecodeSlowdown float64
+}
+
+// compressionTarget - settings and files of one component
+type compressionTarget struct {
+	g           layoutGroup
+	cfg         *seg.Cfg
+	compression *seg.FileCompression
+	dirtyFiles  *btree2.BTreeG[*filesItem]
+}
+
+func (t *compressionTarget) settings() CompressionSettings {
+	return CompressionSettings{Cfg: *t.cfg, Compression: *t.compression}
+}
+
+// set - changes settings used by build, merge and readers of files, keeps number of workers.
+// must be called under `dirtyFilesLock`, and only when no reader uses files of component (see Recompress)
+func (t *compressionTarget) set(s CompressionSettings) {
+	workers := t.cfg.Workers
+	*t.cfg, *t.compression = s.Cfg, s.Compression
+	t.cfg.Workers = workers
+}
+
+func (t *compressionTarget) key() string { return t.g.name + "." + t.g.kind.String() }
+
+func (a *Aggregator) compressionTargets() (targets []*compressionTarget) {
+	groups := a.layoutGroups()
+	for _, g := range groups {
+		t := &compressionTarget{g: g}
+		for _, d := range a.d {
+			if d.filenameBase != g.name {
+				continue
+			}
+			switch g.kind {
+			case TierFileDomain:
+				t.cfg, t.compression, t.dirtyFiles = &d.compressCfg, &d.compression, d.dirtyFiles
+			case TierFileHistory:
+				t.cfg, t.compression, t.dirtyFiles = &d.History.compressCfg, &d.History.compression, d.History.dirtyFiles
+			case TierFileIdx:
+				ii := d.History.InvertedIndex
+				t.cfg, t.compression, t.dirtyFiles = &ii.compressCfg, &ii.compression, ii.dirtyFiles
+			}
+		}
+		for _, ii := range a.iis {
+			if ii.filenameBase == g.name && g.kind == TierFileIdx && !g.domain {
+				t.cfg, t.compression, t.dirtyFiles = &ii.compressCfg, &ii.compression, ii.dirtyFiles
+			}
+		}
+		if t.cfg != nil {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+func (a *Aggregator) compressionTarget(name string, kind TierFileKind) (*compressionTarget, error) {
+	for _, t := range a.compressionTargets() {
+		if t.g.name == name && t.g.kind == kind {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown files: %s.%s", name, kind)
+}
+
+// compressionTargetOfFile - component by name of it's data file: domain .kv, history .v or inverted index .ef
+func (a *Aggregator) compressionTargetOfFile(fileName string) (*compressionTarget, layoutFile, error) {
+	f, base, ok := parseLayoutFile(fileName)
+	if ok {
+		for _, t := range a.compressionTargets() {
+			if t.g.name == base && t.g.ext == f.ext {
+				return t, f, nil
+			}
+		}
+	}
+	return nil, f, fmt.Errorf("not a data file of domain, history or inverted index: %s", fileName)
+}
+
+// CompressionSettingsOf - current settings of files `name` of `kind`. Used by build and merge of new files.
+func (a *Aggregator) CompressionSettingsOf(name string, kind TierFileKind) (CompressionSettings, error) {
+	t, err := a.compressionTarget(name, kind)
+	if err != nil {
+		return CompressionSettings{}, err
+	}
+	a.dirtyFilesLock.Lock()
+	defer a.dirtyFilesLock.Unlock()
+	return t.settings(), nil
+}
+
+// TuneCompression - samples words of existing domain, history or inverted index file, compresses sample with every
+// candidate and measures size and decode time. Winner - smallest one which decodes not much slower than current settings.
+// Doesn't change anything, see Recompress.
+func (a *Aggregator) TuneCompression(ctx context.Context, fileName string, cfg CompressionTuneCfg) (*CompressionReport, error) {
+	t, _, err := a.compressionTargetOfFile(filepath.Base(fileName))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SampleSize == 0 {
+		cfg.SampleSize = 64 * datasize.MB
+	}
+	if cfg.MaxDecodeSlowdown == 0 {
+		cfg.MaxDecodeSlowdown = 1.25
+	}
+	a.dirtyFilesLock.Lock()
+	current := t.settings()
+	a.dirtyFilesLock.Unlock()
+	candidates := cfg.Candidates
+	if len(candidates) == 0 {
+		candidates = CompressionCandidates(current)
+	}
+
+	fPath := t.g.tiers.resolve(filepath.Join(t.g.dir, filepath.Base(fileName)))
+	sample, rawSize, err := sampleWords(fPath, current.Compression, uint64(cfg.SampleSize))
+	if err != nil {
+		return nil, err
+	}
+	report := &CompressionReport{Name: t.g.name, Kind: t.g.kind, File: filepath.Base(fileName), Words: len(sample)}
+	if len(sample) == 0 {
+		return report, nil
+	}
+
+	tmpDir, err := os.MkdirTemp(a.dirs.Tmp, "tune-compression")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	workers := t.cfg.Workers
+	if report.Current, err = a.compressionTrial(ctx, tmpDir, sample, rawSize, current, workers); err != nil {
+		return nil, err
+	}
+	report.Winner = report.Current
+	for _, s := range candidates {
+		trial, err := a.compressionTrial(ctx, tmpDir, sample, rawSize, s, workers)
+		if err != nil {
+			return nil, err
+		}
+		report.Trials = append(report.Trials, trial)
+	}
+	sort.SliceStable(report.Trials, func(i, j int) bool { return report.Trials[i].CompressedSize < report.Trials[j].CompressedSize })
+	maxDecode := time.Duration(float64(report.Current.DecodeTook) * cfg.MaxDecodeSlowdown)
+	for _, trial := range report.Trials {
+		if trial.DecodeTook <= maxDecode && trial.CompressedSize < report.Winner.CompressedSize {
+			report.Winner = trial
+			break
+		}
+	}
+	a.logger.Info("[snapshots] compression tuned", "file", report.File, "current", report.Current, "winner", report.Winner)
+	return report, nil
+}
+
+// sampleWords - pairs of words (key and value: compression flags depend on word position) evenly distributed over file
+func sampleWords(fPath string, compression seg.FileCompression, sampleSize uint64) (sample [][]byte, rawSize uint64, err error) {
+	d, err := seg.NewDecompressor(fPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer d.Close()
+	r := seg.NewReader(d.MakeGetter(), compression)
+
+	// estimate size of pair by first words, then take every `stride` pair
+	const estimatePairs = 256
+	var pairs, firstPairsSize uint64
+	for ; pairs < estimatePairs && r.HasNext(); pairs++ {
+		for i := 0; i < 2 && r.HasNext(); i++ {
+			w, _ := r.Next(nil)
+			firstPairsSize += uint64(len(w))
+		}
+	}
+	if pairs == 0 {
+		return nil, 0, nil
+	}
+	totalPairs := uint64(d.Count()+1) / 2
+	wantPairs := sampleSize / max(firstPairsSize/pairs, 1)
+	stride := max(totalPairs/max(wantPairs, 1), 1)
+
+	r.Reset(0)
+	for pair := uint64(0); r.HasNext() && rawSize < sampleSize; pair++ {
+		take := pair%stride == 0
+		for i := 0; i < 2 && r.HasNext(); i++ {
+			if !take {
+				r.Skip()
+				continue
+			}
+			w, _ := r.Next(nil)
+			sample = append(sample, common.Copy(w)) // uncompressed word points to mmap
+			rawSize += uint64(len(w))
+		}
+	}
+	return sample, rawSize, nil
+}
+
+func (a *Aggregator) compressionTrial(ctx context.Context, tmpDir string, sample [][]byte, rawSize uint64, s CompressionSettings, workers int) (trial CompressionTrial, err error) {
+	trial = CompressionTrial{Settings: s, RawSize: rawSize}
+	fPath := filepath.Join(tmpDir, "sample.seg")
+	defer os.Remove(fPath)
+
+	cfg := s.Cfg
+	cfg.Workers = max(workers, 1)
+	startAt := time.Now()
+	c, err := seg.NewCompressor(ctx, "tune compression", fPath, tmpDir, cfg, log.LvlTrace, a.logger)
+	if err != nil {
+		return trial, err
+	}
+	defer c.Close()
+	c.DisableFsync()
+	w := seg.NewWriter(c, s.Compression)
+	for _, word := range sample {
+		if err := w.AddWord(word); err != nil {
+			return trial, err
+		}
+	}
+	if err := c.Compress(); err != nil {
+		return trial, err
+	}
+	trial.CompressTook = time.Since(startAt)
+
+	d, err := seg.NewDecompressor(fPath)
+	if err != nil {
+		return trial, err
+	}
+	defer d.Close()
+	trial.CompressedSize = uint64(d.Size())
+
+	startAt = time.Now()
+	r := seg.NewReader(d.MakeGetter(), s.Compression)
+	i := 0
+	for r.HasNext() {
+		word, _ := r.Next(nil)
+		if i >= len(sample) || !bytes.Equal(word, sample[i]) {
+			return trial, fmt.Errorf("compression trial %s: word %d mismatch", s, i)
+		}
+		i++
+	}
+	trial.DecodeTook = time.Since(startAt)
+	if i != len(sample) {
+		return trial, fmt.Errorf("compression trial %s: read %d words of %d", s, i, len(sample))
+	}
+	return trial, nil
+}
+
+// Recompress - re-compresses files of domain, history or inverted index with settings `s` and uses `s` for future builds
+// and merges. If `files` is empty or `s.Compression` differs from current one - all files of component are re-compressed
+// (reader must know compression of file). Settings are persisted in snapshots dir and restored by NewAggregator.
+// Replacement of files is journaled there too: if it fails or process crashes - originals and old settings are restored
+// (by OpenFolder after crash). Readers decode files with compression of component - so files and settings are swapped
+// only when no reader uses re-compressed files, otherwise ErrRecompressInUse is returned. After swap files are not
+// visible until their accessors are re-built.
+func (a *Aggregator) Recompress(ctx context.Context, name string, kind TierFileKind, s CompressionSettings, files ...string) error {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
+	t, err := a.compressionTarget(name, kind)
+	if err != nil {
+		return err
+	}
+	if kind == TierFileDomain && a.commitmentValuesTransform &&
+		(name == a.d[kv.AccountsDomain].filenameBase || name == a.d[kv.StorageDomain].filenameBase) {
+		return fmt.Errorf("can't re-compress %s.%s: commitment files reference offsets in it", name, kind)
+	}
+	if !a.buildingFiles.CompareAndSwap(false, true) {
+		return ErrRecompressBusy
+	}
+	defer a.buildingFiles.Store(false)
+	if !a.mergingFiles.CompareAndSwap(false, true) {
+		return ErrRecompressBusy
+	}
+	defer a.mergingFiles.Store(false)
+
+	all := len(files) == 0 || s.Compression != *t.compression
+	selected := make(map[string]bool, len(files))
+	for _, f := range files {
+		selected[filepath.Base(f)] = false
+	}
+	var items []*filesItem
+	a.dirtyFilesLock.Lock()
+	t.dirtyFiles.Walk(func(l []*filesItem) bool {
+		for _, item := range l {
+			if item.decompressor == nil {
+				continue
+			}
+			if _, ok := selected[item.decompressor.FileName()]; ok {
+				selected[item.decompressor.FileName()] = true
+			} else if !all {
+				continue
+			}
+			items = append(items, item)
+		}
+		return true
+	})
+	a.dirtyFilesLock.Unlock()
+	for f, found := range selected {
+		if !found {
+			return fmt.Errorf("Recompress: file not found in %s.%s: %s", name, kind, f)
+		}
+	}
+
+	// compression is not stored in file: settings and files must change together. Journal swap before first rename
+	swap := &compressionSwap{Key: t.key(), Old: t.settings()}
+	for _, item := range items {
+		swap.Files = append(swap.Files, item.decompressor.FilePath())
+	}
+	defer func() {
+		for _, fPath := range swap.Files {
+			_ = os.Remove(fPath + ".recompressed") // left only on error
+		}
+	}()
+	for _, item := range items {
+		if err := a.recompressFile(ctx, t, item, s); err != nil {
+			return err
+		}
+	}
+
+	// `visibleFilesLock` doesn't allow new readers to start, refcount shows if old readers still use files
+	a.visibleFilesLock.Lock()
+	a.dirtyFilesLock.Lock()
+	for _, item := range items {
+		if item.refcount.Load() > 0 {
+			a.dirtyFilesLock.Unlock()
+			a.visibleFilesLock.Unlock()
+			return ErrRecompressInUse
+		}
+	}
+	for _, item := range items {
+		t.dirtyFiles.Delete(item)
+	}
+	a.recalcVisibleFilesLocked(a.dirtyFilesEndTxNumMinimax())
+	for _, item := range items {
+		paths := item.filePaths()
+		item.canDelete.Store(true)
+		item.closeFiles()
+		for _, fPath := range paths[1:] { // accessors depend on compression: will be re-built
+			_ = os.Remove(fPath)
+			_ = os.Remove(fPath + ".torrent")
+		}
+		_ = os.Remove(paths[0] + ".torrent")
+	}
+	t.set(s)
+	err = a.saveCompressionState(swap)
+	if err == nil {
+		err = swap.replace()
+	}
+	if err == nil {
+		swap.Done = true
+		err = a.saveCompressionState(swap)
+	}
+	if err != nil {
+		err = fmt.Errorf("Recompress: %w", err)
+		if rollbackErr := a.rollbackCompressionSwap(t, swap); rollbackErr != nil {
+			err = errors.Join(err, rollbackErr)
+		}
+	}
+	a.dirtyFilesLock.Unlock()
+	a.visibleFilesLock.Unlock()
+	a.recalcVisibleFilesMinimaxTxNum()
+	if err != nil {
+		if openErr := a.OpenFolder(); openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		return errors.Join(err, a.BuildMissedIndices(ctx, a.collateAndBuildWorkers))
+	}
+	a.logger.Info("[snapshots] re-compressed", "files", fmt.Sprintf("%s.%s", name, kind), "amount", len(items), "settings", s)
+
+	if err := a.finishCompressionSwap(swap); err != nil {
+		return err
+	}
+	if err := a.OpenFolder(); err != nil {
+		return err
+	}
+	return a.BuildMissedIndices(ctx, a.collateAndBuildWorkers)
+}
+
+// compressionState - content of compressionSettingsFile
+type compressionState struct {
+	Settings map[string]CompressionSettings `json:"settings"`
+	Swap     *compressionSwap               `json:"swap,omitempty"`
+}
+
+// compressionSwap - journal of replacement of files by Recompress. `Settings` of state already have new settings.
+// If process crashed before Done - originals are restored from backups and `Old` settings are used again.
+// After Done - only backups are left to remove.
+type compressionSwap struct {
+	Key   string              `json:"key"`
+	Old   CompressionSettings `json:"old"`
+	Files []string            `json:"files"`
+	Done  bool                `json:"done"`
+}
+
+// replace - moves original to backup, then re-compressed file in its place
+func (s *compressionSwap) replace() error {
+	for _, fPath := range s.Files {
+		if err := os.Rename(fPath, fPath+".orig"); err != nil {
+			return err
+		}
+		if err := os.Rename(fPath+".recompressed", fPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackCompressionSwap - restores originals and old settings. Files of swap must be closed.
+func (a *Aggregator) rollbackCompressionSwap(t *compressionTarget, swap *compressionSwap) error {
+	for _, fPath := range swap.Files {
+		_ = os.Remove(fPath + ".recompressed")
+		if exists, err := dir.FileExist(fPath + ".orig"); err != nil {
+			return err
+		} else if !exists {
+			continue // not replaced yet
+		}
+		if err := os.Rename(fPath+".orig", fPath); err != nil {
+			return err
+		}
+	}
+	t.set(swap.Old)
+	a.logger.Warn("[snapshots] re-compression rolled back", "files", swap.Key, "amount", len(swap.Files))
+	return a.saveCompressionState(nil)
+}
+
+func (a *Aggregator) finishCompressionSwap(swap *compressionSwap) error {
+	for _, fPath := range swap.Files {
+		if err := os.Remove(fPath + ".orig"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return a.saveCompressionState(nil)
+}
+
+// recoverCompressionSwap - completes or rolls back Recompress interrupted by crash. Called before files are opened.
+func (a *Aggregator) recoverCompressionSwap() error {
+	state, err := a.readCompressionState()
+	if err != nil || state.Swap == nil {
+		return err
+	}
+	if state.Swap.Done {
+		return a.finishCompressionSwap(state.Swap)
+	}
+	for _, t := range a.compressionTargets() {
+		if t.key() == state.Swap.Key {
+			return a.rollbackCompressionSwap(t, state.Swap)
+		}
+	}
+	return fmt.Errorf("%s: unknown files of interrupted re-compression: %s", compressionSettingsFile, state.Swap.Key)
+}
+
+// recompressFile - writes words of `item` next to it: to file with ".recompressed" suffix
+func (a *Aggregator) recompressFile(ctx context.Context, t *compressionTarget, item *filesItem, s CompressionSettings) error {
+	compression := s.Compression
+	if t.g.kind == TierFileDomain && (item.endTxNum-item.startTxNum)/a.StepSize() < DomainMinStepsToCompress {
+		compression = seg.CompressNone // same as merge does
+	}
+	cfg := s.Cfg
+	cfg.Workers = t.cfg.Workers
+	fPath := item.decompressor.FilePath() + ".recompressed"
+	c, err := seg.NewCompressor(ctx, "recompress "+t.g.name, fPath, a.dirs.Tmp, cfg, log.LvlTrace, a.logger)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	w := seg.NewWriter(c, compression)
+	if err := w.ReadFrom(seg.NewReader(item.decompressor.MakeGetter(), *t.compression)); err != nil {
+		return fmt.Errorf("Recompress %s: %w", item.decompressor.FileName(), err)
+	}
+	if err := c.Compress(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Aggregator) saveCompressionState(swap *compressionSwap) error {
+	state := compressionState{Settings: map[string]CompressionSettings{}, Swap: swap}
+	for _, t := range a.compressionTargets() {
+		s := t.settings()
+		s.Cfg.Workers = 0 // not a property of files
+		state.Settings[t.key()] = s
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return dir.WriteFileWithFsync(filepath.Join(a.dirs.Snap, compressionSettingsFile), data, os.ModePerm)
+}
+
+func (a *Aggregator) readCompressionState() (state compressionState, err error) {
+	data, err := os.ReadFile(filepath.Join(a.dirs.Snap, compressionSettingsFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("parse %s: %w", compressionSettingsFile, err)
+	}
+	return state, nil
+}
+
+// loadCompressionSettings - restores settings saved by Recompress. Settings of not finished swap are rolled back
+// by OpenFolder: old ones are used.
+func (a *Aggregator) loadCompressionSettings() error {
+	state, err := a.readCompressionState()
+	if err != nil {
+		return err
+	}
+	for _, t := range a.compressionTargets() {
+		s, ok := state.Settings[t.key()]
+		if state.Swap != nil && !state.Swap.Done && state.Swap.Key == t.key() {
+			s, ok = state.Swap.Old, true
+		}
+		if ok {
+			t.set(s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+func TestAggregatorV3_TuneAndRecompress(t *testing.T) {
+	t.Parallel()
+
+	aggStep := uint64(10)
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := aggStep * 4
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		_, err := rnd.Read(addr[:1])
+		require.NoError(t, err)
+		code := make([]byte, 64)
+		_, err = rnd.Read(code[:8])
+		require.NoError(t, err)
+		err = domains.DomainPut(kv.CodeDomain, addr, nil, code, nil, 0)
+		require.NoError(t, err)
+	}
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, agg.BuildFiles(txs))
+	require.NoError(t, agg.MergeLoop(ctx))
+
+	frozenHistory := func(agg *Aggregator) (res []string) {
+		t.Helper()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		it, err := ac.d[kv.CodeDomain].ht.iterateChangedFrozen(0, int(txs), order.Asc, -1)
+		require.NoError(t, err)
+		defer it.Close()
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(t, err)
+			res = append(res, fmt.Sprintf("%x=%x", k, v))
+		}
+		return res
+	}
+	expect := frozenHistory(agg)
+	require.NotEmpty(t, expect)
+
+	code := agg.d[kv.CodeDomain]
+	vFile := filepath.Base(code.History.vFilePath(0, 4))
+	report, err := agg.TuneCompression(ctx, vFile, CompressionTuneCfg{})
+	require.NoError(t, err)
+	require.Equal(t, vFile, report.File)
+	require.NotZero(t, report.Words)
+	require.Len(t, report.Trials, len(CompressionCandidates(report.Current.Settings)))
+	require.LessOrEqual(t, report.Winner.CompressedSize, report.Current.CompressedSize)
+	require.Contains(t, append(report.Trials, report.Current), report.Winner, report.String())
+
+	_, err = agg.TuneCompression(ctx, "v1-code.0-4.bt", CompressionTuneCfg{})
+	require.Error(t, err)
+
+	// change of compression flags: all files re-compressed
+	current, err := agg.CompressionSettingsOf("code", TierFileHistory)
+	require.NoError(t, err)
+	history := CompressionSettings{Cfg: report.Winner.Settings.Cfg, Compression: seg.CompressVals}
+
+	// reader decodes files with current settings: nothing changes until it's closed
+	reader := agg.BeginFilesRo()
+	require.ErrorIs(t, agg.Recompress(ctx, "code", TierFileHistory, history, vFile), ErrRecompressInUse)
+	unchanged, err := agg.CompressionSettingsOf("code", TierFileHistory)
+	require.NoError(t, err)
+	require.Equal(t, current, unchanged)
+	require.NoFileExists(t, filepath.Join(agg.dirs.SnapHistory, vFile+".recompressed"))
+	reader.Close()
+	require.Equal(t, expect, frozenHistory(agg))
+
+	require.NoError(t, agg.Recompress(ctx, "code", TierFileHistory, history, vFile))
+	idx := CompressionSettings{Cfg: seg.DefaultCfg, Compression: seg.CompressKeys | seg.CompressVals}
+	require.NoError(t, agg.Recompress(ctx, "code", TierFileIdx, idx))
+	require.Equal(t, expect, frozenHistory(agg))
+
+	// same compression flags: only selected file
+	dict := current
+	dict.Cfg.MaxDictPatterns = 16
+	dict.Compression = seg.CompressVals
+	require.NoError(t, agg.Recompress(ctx, "code", TierFileHistory, dict, vFile))
+	require.Equal(t, expect, frozenHistory(agg))
+	require.Error(t, agg.Recompress(ctx, "code", TierFileHistory, dict, "v1-code.100-200.v"))
+
+	layout, err := agg.DiagnoseLayout()
+	require.NoError(t, err)
+	require.True(t, layout.Empty(), layout.String())
+
+	// settings used for future builds and restored after restart
+	require.Equal(t, seg.CompressKeys|seg.CompressVals, code.History.InvertedIndex.compression)
+	agg2, err := NewAggregator(ctx, agg.dirs, aggStep, db, log.New())
+	require.NoError(t, err)
+	defer agg2.Close()
+	for _, s := range []struct {
+		kind   TierFileKind
+		expect CompressionSettings
+	}{{TierFileHistory, dict}, {TierFileIdx, idx}} {
+		restored, err := agg2.CompressionSettingsOf("code", s.kind)
+		require.NoError(t, err)
+		require.True(t, s.expect.same(restored), "%s: %s != %s", s.kind, s.expect, restored)
+	}
+	accounts, err := agg2.CompressionSettingsOf("accounts", TierFileDomain)
+	require.NoError(t, err)
+	require.Equal(t, agg.d[kv.AccountsDomain].compression, accounts.Compression)
+
+	// crash in the middle of swap of files: originals and old settings restored by OpenFolder
+	target, err := agg.compressionTarget("code", TierFileHistory)
+	require.NoError(t, err)
+	none := CompressionSettings{Cfg: dict.Cfg, Compression: seg.CompressNone}
+	crash := func(done bool) *compressionSwap {
+		t.Helper()
+		swap := &compressionSwap{Key: target.key(), Old: target.settings(), Done: done}
+		target.dirtyFiles.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				require.NoError(t, agg.recompressFile(ctx, target, item, none))
+				swap.Files = append(swap.Files, item.decompressor.FilePath())
+			}
+			return true
+		})
+		target.set(none)
+		require.NoError(t, agg.saveCompressionState(swap))
+		target.set(swap.Old)
+		replaced := swap.Files[:1]
+		if done {
+			replaced = swap.Files
+		}
+		require.NoError(t, (&compressionSwap{Files: replaced}).replace())
+		return swap
+	}
+	reopen := func(expect CompressionSettings, swap *compressionSwap) {
+		t.Helper()
+		agg3, err := NewAggregator(ctx, agg.dirs, aggStep, db, log.New())
+		require.NoError(t, err)
+		defer agg3.Close()
+		require.NoError(t, agg3.OpenFolder())
+		require.NoError(t, agg3.BuildMissedIndices(ctx, 1))
+		restored, err := agg3.CompressionSettingsOf("code", TierFileHistory)
+		require.NoError(t, err)
+		require.True(t, expect.same(restored), "%s != %s", expect, restored)
+		require.Equal(t, expect.Compression, agg3.d[kv.CodeDomain].History.compression)
+		require.Equal(t, frozenHistory(agg), frozenHistory(agg3))
+		for _, fPath := range swap.Files {
+			require.NoFileExists(t, fPath+".orig")
+			require.NoFileExists(t, fPath+".recompressed")
+		}
+		state, err := agg3.readCompressionState()
+		require.NoError(t, err)
+		require.Nil(t, state.Swap)
+	}
+	reopen(dict, crash(false))
+
+	swap := crash(true)
+	target.dirtyFiles.Walk(func(items []*filesItem) bool { // accessors are removed before swap
+		for _, item := range items {
+			require.NoError(t, os.Remove(code.History.vAccessorFilePath(item.startTxNum/aggStep, item.endTxNum/aggStep)))
+		}
+		return true
+	})
+	reopen(none, swap)
+}
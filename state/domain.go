@@ -106,6 +106,8 @@ type Domain struct {
 	valsTable string // key -> inverted_step + values (Dupsort)
 	stats     DomainStats
 	indexList idxList
+
+	fileReadCache *FileReadCache // optional, shared by all transactions
 }
 
 type domainCfg struct {
@@ -374,7 +376,7 @@ func (d *Domain) openDirtyFiles() (err error) {
 		for _, item := range items {
 			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
 			if item.decompressor == nil {
-				fPath := d.kvFilePath(fromStep, toStep)
+				fPath := d.tiers.resolve(d.kvFilePath(fromStep, toStep))
 				exists, err := dir.FileExist(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
@@ -466,30 +468,17 @@ func (d *Domain) openDirtyFiles() (err error) {
 }
 
 func (d *Domain) closeWhatNotInList(fNames []string) {
-	protectFiles := make(map[string]struct{}, len(fNames))
-	for _, f := range fNames {
-		protectFiles[f] = struct{}{}
-	}
-	var toClose []*filesItem
-	d.dirtyFiles.Walk(func(items []*filesItem) bool {
-		for _, item := range items {
-			if item.decompressor != nil {
-				if _, ok := protectFiles[item.decompressor.FileName()]; ok {
-					continue
-				}
-			}
-			toClose = append(toClose, item)
-		}
-		return true
-	})
-	for _, item := range toClose {
+	for _, item := range detachWhatNotInList(d.dirtyFiles, fNames) {
 		item.closeFiles()
-		d.dirtyFiles.Delete(item)
 	}
 }
 
 func (d *Domain) reCalcVisibleFiles(toTxNum uint64) {
+	prev := d._visible
 	d._visible = newDomainVisible(d.name, calcVisibleFiles(d.dirtyFiles, d.indexList, false, toTxNum))
+	if d.fileReadCache != nil && prev != nil {
+		d.fileReadCache.dropNotVisible(prev.files, d._visible.files)
+	}
 	d.History.reCalcVisibleFiles(toTxNum)
 }
 
@@ -506,6 +495,9 @@ func (w *domainBufferedWriter) PutWithPrev(key1, key2, val, preval []byte, prevS
 	if tracePutWithPrev != "" && tracePutWithPrev == w.h.ii.filenameBase {
 		fmt.Printf("PutWithPrev(%s, txn %d, key[%x][%x] value[%x] preval[%x])\n", w.h.ii.filenameBase, w.h.ii.txNum, key1, key2, val, preval)
 	}
+	if w.journal.active() {
+		return w.journal.deferDomainWrite(w, key1, key2, val, preval, prevStep)
+	}
 	if err := w.h.AddPrevValue(key1, key2, preval, prevStep); err != nil {
 		return err
 	}
@@ -520,6 +512,9 @@ func (w *domainBufferedWriter) DeleteWithPrev(key1, key2, prev []byte, prevStep
 	if tracePutWithPrev != "" && tracePutWithPrev == w.h.ii.filenameBase {
 		fmt.Printf("DeleteWithPrev(%s, txn %d, key[%x][%x] preval[%x])\n", w.h.ii.filenameBase, w.h.ii.txNum, key1, key2, prev)
 	}
+	if w.journal.active() {
+		return w.journal.deferDomainWrite(w, key1, key2, nil, prev, prevStep)
+	}
 	if err := w.h.AddPrevValue(key1, key2, prev, prevStep); err != nil {
 		return err
 	}
@@ -564,6 +559,7 @@ type domainBufferedWriter struct {
 	aux       []byte  // auxilary buffer for key1 + key2
 	aux2      []byte  // auxilary buffer for step + val
 	diff      *StateDiffDomain
+	journal   *sdJournal // SharedDomains checkpoints
 
 	h *historyBufferedWriter
 }
@@ -763,6 +759,7 @@ type DomainRoTx struct {
 	valsC kv.Cursor
 
 	getFromFileCache *DomainGetFromFileCache
+	fileReadCacheKey []byte
 }
 
 func domainReadMetric(name kv.Domain, level int) metrics.Summary {
@@ -805,6 +802,24 @@ func (dt *DomainRoTx) getLatestFromFile(i int, filekey []byte) (v []byte, ok boo
 	return v, true, offset, nil
 }
 
+// getLatestFromFileCached - getLatestFromFile through FileReadCache shared by all transactions (if enabled)
+func (dt *DomainRoTx) getLatestFromFileCached(i int, filekey []byte, p *FileProbe) (v []byte, ok bool, offset uint64, err error) {
+	c := dt.d.fileReadCache
+	if c == nil {
+		return dt.getLatestFromFile(i, filekey)
+	}
+	dt.fileReadCacheKey = fileReadCacheKey(dt.fileReadCacheKey, dt.name, &dt.files[i], filekey)
+	if v, ok, offset, hit := c.get(dt.name, dt.files[i].src, dt.fileReadCacheKey); hit {
+		p.cacheHit()
+		return v, ok, offset, nil
+	}
+	if v, ok, offset, err = dt.getLatestFromFile(i, filekey); err != nil {
+		return nil, false, 0, err
+	}
+	c.put(dt.files[i].src, dt.fileReadCacheKey, v, ok, offset)
+	return v, ok, offset, nil
+}
+
 func (dt *DomainRoTx) DebugKVFilesWithKey(k []byte) (res []string, err error) {
 	for i := len(dt.files) - 1; i >= 0; i-- {
 		_, ok, _, err := dt.getLatestFromFile(i, k)
@@ -906,9 +921,7 @@ func (d *Domain) collectFilesStats() (datsz, idxsz, files uint64) {
 
 func (d *Domain) BeginFilesRo() *DomainRoTx {
 	for i := 0; i < len(d._visible.files); i++ {
-		if !d._visible.files[i].src.frozen {
-			d._visible.files[i].src.refcount.Add(1)
-		}
+		d._visible.files[i].src.refcount.Add(1)
 	}
 
 	return &DomainRoTx{
@@ -1095,6 +1108,7 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 	// Don't use `d.compress` config in collate. Because collat+build must be very-very fast (to keep db small).
 	// Compress files only in `merge` which ok to be slow.
 	comp := seg.NewWriter(coll.valuesComp, seg.CompressNone)
+	iot := ioTaskFromCtx(ctx)
 
 	stepBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(stepBytes, ^step)
@@ -1146,6 +1160,9 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 			if err = comp.AddWord(v[8:]); err != nil {
 				return coll, fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, k, v[8:], err)
 			}
+			if err = iot.accountRead(ctx, len(k)+len(v)); err != nil {
+				return coll, err
+			}
 			k, v, err = valsCursor.(kv.CursorDupSort).NextNoDup()
 		}
 	}
@@ -1199,6 +1216,23 @@ func (sf StaticFiles) CleanupOnError() {
 	sf.HistoryFiles.CleanupOnError()
 }
 
+func (sf StaticFiles) filePaths() (paths []string) {
+	paths = sf.HistoryFiles.filePaths()
+	if sf.valuesDecomp != nil {
+		paths = append(paths, sf.valuesDecomp.FilePath())
+	}
+	if sf.valuesIdx != nil {
+		paths = append(paths, sf.valuesIdx.FilePath())
+	}
+	if sf.valuesBt != nil {
+		paths = append(paths, sf.valuesBt.FilePath())
+	}
+	if sf.bloom != nil {
+		paths = append(paths, sf.bloom.FilePath)
+	}
+	return paths
+}
+
 // skips history files
 func (d *Domain) buildFileRange(ctx context.Context, stepFrom, stepTo uint64, collation Collation, ps *background.ProgressSet) (StaticFiles, error) {
 	mxRunningFilesBuilding.Inc()
@@ -1670,6 +1704,12 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte, maxTxNum uint64) (v []byte, f
 	useExistenceFilter := dt.d.indexList&withExistence != 0
 	useCache := dt.name != kv.CommitmentDomain && maxTxNum == math.MaxUint64
 
+	rt := dt.ht.iit.readTrace
+	lt := rt.begin(readTraceGetFromFiles, dt.name.String(), filekey)
+	if lt != nil {
+		defer func() { rt.end(lt, found && err == nil) }()
+	}
+
 	hi, _ := dt.ht.iit.hashKey(filekey)
 	if useCache && dt.getFromFileCache == nil {
 		dt.getFromFileCache = dt.visible.newGetFromFileCache()
@@ -1677,6 +1717,9 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte, maxTxNum uint64) (v []byte, f
 	if dt.getFromFileCache != nil && maxTxNum == math.MaxUint64 {
 		cv, ok := dt.getFromFileCache.Get(hi)
 		if ok {
+			if lt != nil {
+				lt.Cache = "tx"
+			}
 			if !cv.exists {
 				return nil, true, dt.files[cv.lvl].startTxNum, dt.files[cv.lvl].endTxNum, nil
 			}
@@ -1693,9 +1736,12 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte, maxTxNum uint64) (v []byte, f
 			continue
 		}
 		// fmt.Printf("getFromFiles: lim=%d %d %d %d %d\n", maxTxNum, dt.files[i].startTxNum, dt.files[i].endTxNum, dt.files[i].startTxNum/dt.d.aggregationStep, dt.files[i].endTxNum/dt.d.aggregationStep)
+		filter := ""
 		if useExistenceFilter {
 			if dt.files[i].src.existence != nil {
+				filter = "present"
 				if !dt.files[i].src.existence.ContainsHash(hi) {
+					lt.filterSkip(&dt.files[i])
 					if traceGetLatest == dt.name {
 						fmt.Printf("GetLatest(%s, %x) -> existence index %s -> false\n", dt.d.filenameBase, filekey, dt.files[i].src.existence.FileName)
 					}
@@ -1712,11 +1758,16 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte, maxTxNum uint64) (v []byte, f
 			}
 		}
 
+		var p *FileProbe
+		if lt != nil {
+			p = lt.probe(&dt.files[i], dt.statelessGetter(i), filter)
+		}
 		var offset uint64
-		v, found, offset, err = dt.getLatestFromFile(i, filekey)
+		v, found, offset, err = dt.getLatestFromFileCached(i, filekey, p)
 		if err != nil {
 			return nil, false, 0, 0, err
 		}
+		p.done(found)
 		if !found {
 			if traceGetLatest == dt.name {
 				fmt.Printf("GetLatest(%s, %x) -> not found in file %s\n", dt.name.String(), filekey, dt.files[i].src.decompressor.FileName())
@@ -1796,7 +1847,7 @@ func (dt *DomainRoTx) Close() {
 	dt.files = nil
 	for i := range files {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -1986,6 +2037,33 @@ func (dt *DomainRoTx) DomainRangeLatest(roTx kv.Tx, fromKey, toKey []byte, limit
 	return s, nil
 }
 
+// DomainDiff - stream of keys changed in [fromTxNum, toTxNum) with their values as-of `fromTxNum` and as-of `toTxNum`.
+// Keys which were changed and then reverted to original value inside the range - are skipped.
+// Empty `before` means key was created in range, empty `after` means key was deleted in range.
+// Keys before `fromKey` are skipped without lookup of their values (nil means from first key).
+func (dt *DomainRoTx) DomainDiff(fromKey []byte, fromTxNum, toTxNum uint64, limit int, roTx kv.Tx) (stream.KVV, error) {
+	if fromTxNum >= toTxNum {
+		return stream.EmptyKVV, nil
+	}
+	// unlike `HistoryRange`: files must have priority over db - they have older values of same key
+	itOnFiles, err := dt.ht.iterateChangedFrozen(int(fromTxNum), int(toTxNum), order.Asc, -1)
+	if err != nil {
+		return nil, err
+	}
+	itOnDB, err := dt.ht.iterateChangedRecent(int(fromTxNum), int(toTxNum), order.Asc, -1, roTx)
+	if err != nil {
+		itOnFiles.Close()
+		return nil, err
+	}
+	changed := stream.MergeKVS(stream.WrapKVS(itOnFiles), stream.WrapKV(itOnDB), -1)
+	s := &DomainDiffIter{dt: dt, roTx: roTx, changed: changed, fromKey: fromKey, toTxNum: toTxNum, limit: limit}
+	if err := s.advance(); err != nil {
+		s.Close() //it's responsibility of constructor (our) to close resource on error
+		return nil, err
+	}
+	return s, nil
+}
+
 // CanPruneUntil returns true if domain OR history tables can be pruned until txNum
 func (dt *DomainRoTx) CanPruneUntil(tx kv.Tx, untilTx uint64) bool {
 	canDomain, _ := dt.canPruneDomainTables(tx, untilTx)
@@ -2402,6 +2480,89 @@ func (hi *DomainLatestIterFile) Next() ([]byte, []byte, error) {
 	return hi.kBackup, hi.vBackup, nil
 }
 
+// DomainDiffIter - joins changed keys of history (values before range) with `GetAsOf` (values after range).
+// Both parts read files and db, `GetAsOf` uses same files/db cursors of DomainRoTx.
+type DomainDiffIter struct {
+	dt      *DomainRoTx
+	roTx    kv.Tx
+	changed stream.KVS
+	fromKey []byte
+	toTxNum uint64
+	limit   int
+
+	nextKey, nextBefore, nextAfter []byte
+	lastChangedKey                 []byte
+	hasNext                        bool
+
+	k, before, after, kBackup, beforeBackup, afterBackup []byte
+	err                                                  error
+}
+
+func (hi *DomainDiffIter) Close() {
+	if hi.changed != nil {
+		hi.changed.Close()
+	}
+}
+
+func (hi *DomainDiffIter) advance() error {
+	hi.hasNext = false
+	for hi.changed.HasNext() {
+		k, before, _, err := hi.changed.Next()
+		if err != nil {
+			return err
+		}
+		if hi.fromKey != nil && bytes.Compare(k, hi.fromKey) < 0 {
+			continue
+		}
+		if hi.lastChangedKey != nil && bytes.Equal(k, hi.lastChangedKey) { // same key in files and db
+			continue
+		}
+		hi.lastChangedKey = append(hi.lastChangedKey[:0], k...)
+
+		after, _, err := hi.dt.GetAsOf(k, hi.toTxNum, hi.roTx)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+		hi.nextKey = append(hi.nextKey[:0], k...)
+		hi.nextBefore = append(hi.nextBefore[:0], before...)
+		hi.nextAfter = append(hi.nextAfter[:0], after...)
+		hi.hasNext = true
+		return nil
+	}
+	return nil
+}
+
+func (hi *DomainDiffIter) HasNext() bool {
+	if hi.err != nil { // always true, then .Next() call will return this error
+		return true
+	}
+	if hi.limit == 0 { // limit reached
+		return false
+	}
+	return hi.hasNext
+}
+
+func (hi *DomainDiffIter) Next() ([]byte, []byte, []byte, error) {
+	if hi.err != nil {
+		return nil, nil, nil, hi.err
+	}
+	hi.limit--
+	hi.k = append(hi.k[:0], hi.nextKey...)
+	hi.before = append(hi.before[:0], hi.nextBefore...)
+	hi.after = append(hi.after[:0], hi.nextAfter...)
+
+	// Satisfy stream.Trio Invariant 2
+	hi.k, hi.kBackup, hi.before, hi.beforeBackup, hi.after, hi.afterBackup = hi.kBackup, hi.k, hi.beforeBackup, hi.before, hi.afterBackup, hi.after
+	if err := hi.advance(); err != nil {
+		hi.err = err
+		return nil, nil, nil, err
+	}
+	return hi.kBackup, hi.beforeBackup, hi.afterBackup, nil
+}
+
 func (d *Domain) stepsRangeInDBAsStr(tx kv.Tx) string {
 	a1, a2 := d.History.InvertedIndex.stepsRangeInDB(tx)
 	//ad1, ad2 := d.stepsRangeInDB(tx)
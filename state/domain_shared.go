@@ -102,6 +102,10 @@ type SharedDomains struct {
 
 	currentChangesAccumulator *StateChangeSet
 	pastChangesAccumulator    map[string]*StateChangeSet
+
+	journal *sdJournal // see Checkpoint
+
+	ownAggTx *AggregatorRoTx // opened by deepUnwind, AggregatorRoTx of `roTx` sees detached files
 }
 
 type HasAggTx interface {
@@ -116,23 +120,28 @@ func NewSharedDomains(tx kv.Tx, logger log.Logger) (*SharedDomains, error) {
 	sd := &SharedDomains{
 		logger:  logger,
 		storage: btree2.NewMap[string, dataWithPrevStep](128),
+		journal: &sdJournal{},
 		//trace:   true,
 	}
 	sd.SetTx(tx)
 
-	sd.aggTx.a.DiscardHistory(kv.CommitmentDomain)
+	if !sd.aggTx.a.keepCommitmentHistory {
+		sd.aggTx.a.DiscardHistory(kv.CommitmentDomain)
+	}
 
 	for id, ii := range sd.aggTx.iis {
 		sd.iiWriters[id] = ii.NewWriter()
+		sd.iiWriters[id].journal = sd.journal
 	}
 
 	for id, d := range sd.aggTx.d {
 		sd.domains[id] = map[string]dataWithPrevStep{}
 		sd.domainWriters[id] = d.NewWriter()
+		sd.domainWriters[id].journal = sd.journal
 	}
 
 	sd.SetTxNum(0)
-	sd.sdCtx = NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, commitment.VariantHexPatriciaTrie)
+	sd.sdCtx = NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, sd.aggTx.a.commitmentVariant)
 
 	if _, err := sd.SeekCommitment(context.Background(), tx); err != nil {
 		return nil, err
@@ -210,34 +219,41 @@ func (sd *SharedDomains) Unwind(ctx context.Context, rwTx kv.RwTx, blockUnwindTo
 	return sd.Flush(ctx, rwTx)
 }
 
-func (sd *SharedDomains) rebuildCommitment(ctx context.Context, roTx kv.Tx, blockNum uint64) ([]byte, error) {
-	it, err := sd.aggTx.HistoryRange(kv.AccountsHistory, int(sd.TxNum()), math.MaxInt64, order.Asc, -1, roTx)
+// touchChangedKeys - marks for commitment all accounts and storage changed since `fromTxNum`
+func (sd *SharedDomains) touchChangedKeys(roTx kv.Tx, fromTxNum uint64) error {
+	it, err := sd.aggTx.HistoryRange(kv.AccountsHistory, int(fromTxNum), math.MaxInt64, order.Asc, -1, roTx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer it.Close()
 	for it.HasNext() {
 		k, _, err := it.Next()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		sd.sdCtx.TouchKey(kv.AccountsDomain, string(k), nil)
 	}
 
-	it, err = sd.aggTx.HistoryRange(kv.StorageHistory, int(sd.TxNum()), math.MaxInt64, order.Asc, -1, roTx)
+	it, err = sd.aggTx.HistoryRange(kv.StorageHistory, int(fromTxNum), math.MaxInt64, order.Asc, -1, roTx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer it.Close()
 
 	for it.HasNext() {
 		k, _, err := it.Next()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		sd.sdCtx.TouchKey(kv.StorageDomain, string(k), nil)
 	}
+	return nil
+}
 
+func (sd *SharedDomains) rebuildCommitment(ctx context.Context, roTx kv.Tx, blockNum uint64) ([]byte, error) {
+	if err := sd.touchChangedKeys(roTx, sd.TxNum()); err != nil {
+		return nil, err
+	}
 	sd.sdCtx.Reset()
 	return sd.ComputeCommitment(ctx, true, blockNum, "rebuild commit")
 }
@@ -357,7 +373,7 @@ func (sd *SharedDomains) SeekCommitment(ctx context.Context, tx kv.Tx) (txsFromB
 	if err != nil {
 		return 0, err
 	}
-	if bytes.Equal(newRh, commitment.EmptyRootHash) {
+	if bytes.Equal(newRh, commitment.EmptyRoot(sd.aggTx.a.commitmentHasher)) {
 		sd.SetBlockNum(0)
 		sd.SetTxNum(0)
 		return 0, nil
@@ -373,6 +389,9 @@ func (sd *SharedDomains) SeekCommitment(ctx context.Context, tx kv.Tx) (txsFromB
 func (sd *SharedDomains) ClearRam(resetCommitment bool) {
 	//sd.muMaps.Lock()
 	//defer sd.muMaps.Unlock()
+	if err := sd.releaseCheckpoints(); err != nil {
+		sd.logger.Warn("ClearRam: release checkpoints", "err", err)
+	}
 	for i := range sd.domains {
 		sd.domains[i] = map[string]dataWithPrevStep{}
 	}
@@ -389,6 +408,15 @@ func (sd *SharedDomains) put(domain kv.Domain, key string, val []byte) {
 	// disable mutex - because work on parallel execution postponed after E3 release.
 	//sd.muMaps.Lock()
 	valWithPrevStep := dataWithPrevStep{data: val, prevStep: sd.txNum / sd.aggTx.a.StepSize()}
+	if sd.journal.active() {
+		e := sdJournalEntry{kind: journalMapPut, domain: domain, key: key, estSize: sd.estSize}
+		if domain == kv.StorageDomain {
+			e.prev, e.existed = sd.storage.Get(key)
+		} else {
+			e.prev, e.existed = sd.domains[domain][key]
+		}
+		sd.journal.entries = append(sd.journal.entries, e)
+	}
 	if domain == kv.StorageDomain {
 		if old, ok := sd.storage.Set(key, valWithPrevStep); ok {
 			sd.estSize += len(val) - len(old.data)
@@ -604,6 +632,9 @@ func (sd *SharedDomains) ReadsValid(readLists map[string]*KvList) bool {
 
 func (sd *SharedDomains) updateAccountData(addr []byte, account, prevAccount []byte, prevStep uint64) error {
 	addrS := string(addr)
+	if err := sd.sdCtx.recordPreState(kv.AccountsDomain, addrS, prevAccount); err != nil {
+		return err
+	}
 	sd.sdCtx.TouchKey(kv.AccountsDomain, addrS, account)
 	sd.put(kv.AccountsDomain, addrS, account)
 	return sd.domainWriters[kv.AccountsDomain].PutWithPrev(addr, nil, account, prevAccount, prevStep)
@@ -611,6 +642,9 @@ func (sd *SharedDomains) updateAccountData(addr []byte, account, prevAccount []b
 
 func (sd *SharedDomains) updateAccountCode(addr, code, prevCode []byte, prevStep uint64) error {
 	addrS := string(addr)
+	if err := sd.sdCtx.recordPreState(kv.CodeDomain, addrS, prevCode); err != nil {
+		return err
+	}
 	sd.sdCtx.TouchKey(kv.CodeDomain, addrS, code)
 	sd.put(kv.CodeDomain, addrS, code)
 	if len(code) == 0 {
@@ -635,6 +669,9 @@ func (sd *SharedDomains) deleteAccount(addr, prev []byte, prevStep uint64) error
 		return err
 	}
 
+	if err := sd.sdCtx.recordPreState(kv.AccountsDomain, addrS, prev); err != nil {
+		return err
+	}
 	sd.sdCtx.TouchKey(kv.AccountsDomain, addrS, nil)
 	sd.put(kv.AccountsDomain, addrS, nil)
 	if err := sd.domainWriters[kv.AccountsDomain].DeleteWithPrev(addr, nil, prev, prevStep); err != nil {
@@ -651,6 +688,9 @@ func (sd *SharedDomains) writeAccountStorage(addr, loc []byte, value, preVal []b
 		composite = append(append(composite, addr...), loc...)
 	}
 	compositeS := string(composite)
+	if err := sd.sdCtx.recordPreState(kv.StorageDomain, compositeS, preVal); err != nil {
+		return err
+	}
 	sd.sdCtx.TouchKey(kv.StorageDomain, compositeS, value)
 	sd.put(kv.StorageDomain, compositeS, value)
 	return sd.domainWriters[kv.StorageDomain].PutWithPrev(composite, nil, value, preVal, prevStep)
@@ -663,6 +703,9 @@ func (sd *SharedDomains) delAccountStorage(addr, loc []byte, preVal []byte, prev
 		composite = append(append(composite, addr...), loc...)
 	}
 	compositeS := string(composite)
+	if err := sd.sdCtx.recordPreState(kv.StorageDomain, compositeS, preVal); err != nil {
+		return err
+	}
 	sd.sdCtx.TouchKey(kv.StorageDomain, compositeS, nil)
 	sd.put(kv.StorageDomain, compositeS, nil)
 	return sd.domainWriters[kv.StorageDomain].DeleteWithPrev(composite, nil, preVal, prevStep)
@@ -689,6 +732,10 @@ func (sd *SharedDomains) SetTx(tx kv.Tx) {
 		panic("tx is nil")
 	}
 	sd.roTx = tx
+	if sd.ownAggTx != nil {
+		sd.ownAggTx.Close()
+		sd.ownAggTx = nil
+	}
 
 	casted, ok := tx.(HasAggTx)
 	if !ok {
@@ -731,7 +778,18 @@ func (sd *SharedDomains) SetTrace(b bool) {
 	sd.trace = b
 }
 
+// SetParallelCommitment - commitment computation updates subtries of the root concurrently, result is the same as
+// in sequential mode. Worth it for large blocks only.
+func (sd *SharedDomains) SetParallelCommitment(parallel bool) {
+	if hph, ok := sd.sdCtx.patriciaTrie.(*commitment.HexPatriciaHashed); ok {
+		hph.SetParallel(parallel)
+	}
+}
+
 func (sd *SharedDomains) ComputeCommitment(ctx context.Context, saveStateAfter bool, blockNum uint64, logPrefix string) (rootHash []byte, err error) {
+	if err = sd.releaseCheckpoints(); err != nil {
+		return nil, err
+	}
 	rootHash, err = sd.sdCtx.ComputeCommitment(ctx, saveStateAfter, blockNum, logPrefix)
 	return
 }
@@ -894,6 +952,10 @@ func (sd *SharedDomains) Close() {
 	if sd.sdCtx != nil {
 		sd.sdCtx.Close()
 	}
+	if sd.ownAggTx != nil {
+		sd.ownAggTx.Close()
+		sd.ownAggTx = nil
+	}
 }
 
 func (sd *SharedDomains) Flush(ctx context.Context, tx kv.RwTx) error {
@@ -1110,6 +1172,8 @@ type SharedDomainsCommitmentContext struct {
 	justRestored  atomic.Bool
 
 	limitReadAsOfTxNum uint64
+	historyAsOfTxNum   uint64              // if set, branches and values are read as of this txNum (see AccountProofAsOf)
+	witness            *commitment.Witness // if set, commitment computation and state updates are recorded (see SetWitness)
 }
 
 func (sdc *SharedDomainsCommitmentContext) SetLimitReadAsOfTxNum(txNum uint64) {
@@ -1124,7 +1188,7 @@ func NewSharedDomainsCommitmentContext(sd *SharedDomains, mode commitment.Mode,
 		keccak:        sha3.NewLegacyKeccak256().(cryptozerocopy.KeccakState),
 	}
 
-	ctx.patriciaTrie, ctx.updates = commitment.InitializeTrieAndUpdates(trieVariant, mode, sd.aggTx.a.tmpdir)
+	ctx.patriciaTrie, ctx.updates = commitment.InitializeTrieAndUpdates(trieVariant, mode, sd.aggTx.a.tmpdir, sd.aggTx.a.commitmentHasher)
 	ctx.patriciaTrie.ResetContext(ctx)
 	return ctx
 }
@@ -1151,6 +1215,21 @@ func (sdc *SharedDomainsCommitmentContext) Branch(pref []byte) ([]byte, uint64,
 		return cached.data, cached.step, nil
 	}
 
+	if sdc.historyAsOfTxNum > 0 {
+		// history is never stored in files, so values there are not transformed
+		v, ok, err := sdc.sharedDomains.aggTx.d[kv.CommitmentDomain].ht.HistorySeek(pref, sdc.historyAsOfTxNum, sdc.sharedDomains.roTx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Branch failed: %w", err)
+		}
+		if ok {
+			sdc.branches[string(pref)] = cachedBranch{data: v}
+			if len(v) == 0 {
+				return nil, 0, nil
+			}
+			return v, 0, nil
+		}
+	}
+
 	v, step, err := sdc.sharedDomains.LatestCommitment(pref)
 	if err != nil {
 		return nil, 0, fmt.Errorf("Branch failed: %w", err)
@@ -1178,33 +1257,12 @@ func (sdc *SharedDomainsCommitmentContext) PutBranch(prefix []byte, data []byte,
 }
 
 func (sdc *SharedDomainsCommitmentContext) Account(plainKey []byte) (u *commitment.Update, err error) {
-	var encAccount []byte
-	if sdc.limitReadAsOfTxNum == 0 {
-		encAccount, _, err = sdc.sharedDomains.DomainGet(kv.AccountsDomain, plainKey, nil)
-		if err != nil {
-			return nil, fmt.Errorf("GetAccount failed: %w", err)
-		}
-	} else {
-		encAccount, _, err = sdc.sharedDomains.domainGetAsOfFile(kv.AccountsDomain, plainKey, nil, sdc.limitReadAsOfTxNum)
-		if err != nil {
-			return nil, fmt.Errorf("GetAccount failed: %w", err)
-		}
+	encAccount, err := sdc.readDomain(kv.AccountsDomain, plainKey)
+	if err != nil {
+		return nil, fmt.Errorf("GetAccount failed: %w", err)
 	}
 
-	u = new(commitment.Update)
-	u.Reset()
-
-	if len(encAccount) > 0 {
-		nonce, balance, chash := types.DecodeAccountBytesV3(encAccount)
-		u.Flags |= commitment.NonceUpdate
-		u.Nonce = nonce
-		u.Flags |= commitment.BalanceUpdate
-		u.Balance.Set(balance)
-		if len(chash) > 0 {
-			u.Flags |= commitment.CodeUpdate
-			copy(u.CodeHash[:], chash)
-		}
-	}
+	u = accountUpdate(encAccount)
 	if u.CodeHash == commitment.EmptyCodeHashArray {
 		if len(encAccount) == 0 {
 			u.Flags = commitment.DeleteUpdate
@@ -1212,12 +1270,7 @@ func (sdc *SharedDomainsCommitmentContext) Account(plainKey []byte) (u *commitme
 		return u, nil
 	}
 
-	var code []byte
-	if sdc.limitReadAsOfTxNum == 0 {
-		code, _, err = sdc.sharedDomains.DomainGet(kv.CodeDomain, plainKey, nil)
-	} else {
-		code, _, err = sdc.sharedDomains.domainGetAsOfFile(kv.CodeDomain, plainKey, nil, sdc.limitReadAsOfTxNum)
-	}
+	code, err := sdc.readDomain(kv.CodeDomain, plainKey)
 	if err != nil {
 		return nil, fmt.Errorf("GetAccount/Code: failed to read latest code: %w", err)
 	}
@@ -1238,14 +1291,27 @@ func (sdc *SharedDomainsCommitmentContext) Account(plainKey []byte) (u *commitme
 	return u, nil
 }
 
+func accountUpdate(encAccount []byte) *commitment.Update {
+	u := new(commitment.Update)
+	u.Reset()
+
+	if len(encAccount) > 0 {
+		nonce, balance, chash := types.DecodeAccountBytesV3(encAccount)
+		u.Flags |= commitment.NonceUpdate
+		u.Nonce = nonce
+		u.Flags |= commitment.BalanceUpdate
+		u.Balance.Set(balance)
+		if len(chash) > 0 {
+			u.Flags |= commitment.CodeUpdate
+			copy(u.CodeHash[:], chash)
+		}
+	}
+	return u
+}
+
 func (sdc *SharedDomainsCommitmentContext) Storage(plainKey []byte) (u *commitment.Update, err error) {
 	// Look in the summary table first
-	var enc []byte
-	if sdc.limitReadAsOfTxNum == 0 {
-		enc, _, err = sdc.sharedDomains.DomainGet(kv.StorageDomain, plainKey, nil)
-	} else {
-		enc, _, err = sdc.sharedDomains.domainGetAsOfFile(kv.StorageDomain, plainKey, nil, sdc.limitReadAsOfTxNum)
-	}
+	enc, err := sdc.readDomain(kv.StorageDomain, plainKey)
 	if err != nil {
 		return nil, err
 	}
@@ -1260,6 +1326,27 @@ func (sdc *SharedDomainsCommitmentContext) Storage(plainKey []byte) (u *commitme
 	return u, nil
 }
 
+// Code is used by tries which commit to contract code itself (see commitment.PatriciaCodeContext)
+func (sdc *SharedDomainsCommitmentContext) Code(plainKey []byte) ([]byte, error) {
+	code, err := sdc.readDomain(kv.CodeDomain, plainKey)
+	if err != nil {
+		return nil, fmt.Errorf("GetCode failed: %w", err)
+	}
+	return code, nil
+}
+
+func (sdc *SharedDomainsCommitmentContext) readDomain(d kv.Domain, plainKey []byte) (v []byte, err error) {
+	switch {
+	case sdc.historyAsOfTxNum > 0:
+		v, _, err = sdc.sharedDomains.aggTx.d[d].GetAsOf(plainKey, sdc.historyAsOfTxNum, sdc.sharedDomains.roTx)
+	case sdc.limitReadAsOfTxNum > 0:
+		v, _, err = sdc.sharedDomains.domainGetAsOfFile(d, plainKey, nil, sdc.limitReadAsOfTxNum)
+	default:
+		v, _, err = sdc.sharedDomains.DomainGet(d, plainKey, nil)
+	}
+	return v, err
+}
+
 func (sdc *SharedDomainsCommitmentContext) Reset() {
 	if !sdc.justRestored.Load() {
 		sdc.patriciaTrie.Reset()
@@ -1373,6 +1460,11 @@ func (sdc *SharedDomainsCommitmentContext) encodeCommitmentState(blockNum, txNum
 		if err != nil {
 			return nil, err
 		}
+	case *commitment.VerkleTrie:
+		state, err = trie.EncodeCurrentState(nil)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("unsupported state storing for patricia trie type: %T", sdc.patriciaTrie)
 	}
@@ -1402,8 +1494,8 @@ func (sdc *SharedDomainsCommitmentContext) LatestCommitmentState() (blockNum, tx
 	if dbg.DiscardCommitment() {
 		return 0, 0, nil, nil
 	}
-	if sdc.patriciaTrie.Variant() != commitment.VariantHexPatriciaTrie {
-		return 0, 0, nil, fmt.Errorf("state storing is only supported hex patricia trie")
+	if v := sdc.patriciaTrie.Variant(); v != commitment.VariantHexPatriciaTrie && v != commitment.VariantVerkleTrie {
+		return 0, 0, nil, fmt.Errorf("state storing is not supported for %s trie", v)
 	}
 	state, _, err = sdc.Branch(keyCommitmentState)
 	if err != nil {
@@ -1439,20 +1531,25 @@ func (sdc *SharedDomainsCommitmentContext) restorePatriciaState(value []byte) (u
 		}
 		// nil value is acceptable for SetState and will reset trie
 	}
-	if hext, ok := sdc.patriciaTrie.(*commitment.HexPatriciaHashed); ok {
-		if err := hext.SetState(cs.trieState); err != nil {
+	switch trie := sdc.patriciaTrie.(type) {
+	case *commitment.HexPatriciaHashed:
+		if err := trie.SetState(cs.trieState); err != nil {
 			return 0, 0, fmt.Errorf("failed restore state : %w", err)
 		}
-		sdc.justRestored.Store(true) // to prevent double reset
-		if sdc.sharedDomains.trace {
-			rootHash, err := hext.RootHash()
-			if err != nil {
-				return 0, 0, fmt.Errorf("failed to get root hash after state restore: %w", err)
-			}
-			fmt.Printf("[commitment] restored state: block=%d txn=%d rootHash=%x\n", cs.blockNum, cs.txNum, rootHash)
+	case *commitment.VerkleTrie:
+		if err := trie.SetState(cs.trieState); err != nil {
+			return 0, 0, fmt.Errorf("failed restore state : %w", err)
 		}
-	} else {
-		return 0, 0, errors.New("state storing is only supported hex patricia trie")
+	default:
+		return 0, 0, errors.New("state storing is only supported hex patricia and verkle tries")
+	}
+	sdc.justRestored.Store(true) // to prevent double reset
+	if sdc.sharedDomains.trace {
+		rootHash, err := sdc.patriciaTrie.RootHash()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to get root hash after state restore: %w", err)
+		}
+		fmt.Printf("[commitment] restored state: block=%d txn=%d rootHash=%x\n", cs.blockNum, cs.txNum, rootHash)
 	}
 	return cs.blockNum, cs.txNum, nil
 }
@@ -0,0 +1,202 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"fmt"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+// sdJournal - undo-log of SharedDomains. Used only while at least one checkpoint is open - no overhead otherwise.
+//   - in-memory maps and changeset updates are applied immediately and journaled
+//   - writes to domain/index writers are deferred: etl collectors are append-only. Applied when last checkpoint is released.
+type sdJournal struct {
+	entries     []sdJournalEntry
+	checkpoints []sdCheckpoint
+}
+
+type sdCheckpoint struct {
+	pos        int // position in `entries`
+	updatesPos int // position in commitment updates journal
+}
+
+type sdJournalKind uint8
+
+const (
+	journalMapPut      sdJournalKind = iota // SharedDomains.put
+	journalDomainWrite                      // deferred domainBufferedWriter.PutWithPrev/DeleteWithPrev
+	journalIndexAdd                         // deferred invertedIndexBufferedWriter.Add
+)
+
+type sdJournalEntry struct {
+	kind sdJournalKind
+
+	// journalMapPut
+	domain  kv.Domain
+	key     string
+	prev    dataWithPrevStep
+	existed bool
+	estSize int
+
+	// journalDomainWrite, journalIndexAdd
+	dw                   *domainBufferedWriter
+	iw                   *invertedIndexBufferedWriter
+	txNum                uint64
+	k1, k2, val, prevVal []byte
+	prevStep             uint64
+
+	// changeset update made by journalDomainWrite: keys added to StateDiffDomain
+	diff                   *StateDiffDomain
+	diffKey, diffValsKey   string
+	diffKeyNew, diffValNew bool
+}
+
+func (j *sdJournal) active() bool { return j != nil && len(j.checkpoints) > 0 }
+
+func (j *sdJournal) deferDomainWrite(w *domainBufferedWriter, key1, key2, val, prevVal []byte, prevStep uint64) error {
+	e := sdJournalEntry{kind: journalDomainWrite, dw: w, txNum: w.h.ii.txNum,
+		k1: common.Copy(key1), k2: common.Copy(key2), val: common.Copy(val), prevVal: common.Copy(prevVal), prevStep: prevStep}
+	if w.diff != nil {
+		key := string(key1) + string(key2)
+		valsKey := key + string(w.stepBytes[:])
+		_, keyExists := w.diff.keys[key]
+		_, valExists := w.diff.prevValues[valsKey]
+		w.diff.DomainUpdate(key1, key2, prevVal, w.stepBytes[:], prevStep)
+		e.diff, e.diffKey, e.diffValsKey, e.diffKeyNew, e.diffValNew = w.diff, key, valsKey, !keyExists, !valExists
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+func (j *sdJournal) deferIndexAdd(w *invertedIndexBufferedWriter, key []byte) error {
+	j.entries = append(j.entries, sdJournalEntry{kind: journalIndexAdd, iw: w, txNum: w.txNum, k1: common.Copy(key)})
+	return nil
+}
+
+// Checkpoint - saves state of in-memory changes. Returns id for RevertTo. Checkpoints can be nested.
+// Until last checkpoint is reverted or released, writes are buffered in journal.
+// Flush and ComputeCommitment release all checkpoints: commitment computation can't be reverted.
+func (sd *SharedDomains) Checkpoint() int {
+	j := sd.journal
+	j.checkpoints = append(j.checkpoints, sdCheckpoint{pos: len(j.entries), updatesPos: sd.sdCtx.updates.Checkpoint()})
+	return len(j.checkpoints) - 1
+}
+
+// RevertTo - undoes all changes made after checkpoint `id`: in-memory domain values, index additions,
+// commitment touched keys and changeset accumulator. Checkpoint `id` and all later checkpoints are removed.
+func (sd *SharedDomains) RevertTo(id int) error {
+	j := sd.journal
+	if id < 0 || id >= len(j.checkpoints) {
+		return fmt.Errorf("RevertTo: unknown checkpoint %d, have %d", id, len(j.checkpoints))
+	}
+	cp := j.checkpoints[id]
+	for i := len(j.entries) - 1; i >= cp.pos; i-- {
+		e := &j.entries[i]
+		switch e.kind {
+		case journalMapPut:
+			sd.undoPut(e)
+		case journalDomainWrite:
+			if e.diff != nil {
+				if e.diffKeyNew {
+					delete(e.diff.keys, e.diffKey)
+				}
+				if e.diffValNew {
+					delete(e.diff.prevValues, e.diffValsKey)
+				}
+				e.diff.prevValsSlice = nil
+			}
+		}
+		j.entries[i] = sdJournalEntry{} // release memory
+	}
+	j.entries = j.entries[:cp.pos]
+	sd.sdCtx.updates.RevertTo(cp.updatesPos)
+	j.checkpoints = j.checkpoints[:id]
+	if len(j.checkpoints) == 0 {
+		return sd.applyJournal()
+	}
+	return nil
+}
+
+// ReleaseCheckpoint - keeps changes made after checkpoint `id`, but removes checkpoint `id` and all later checkpoints.
+func (sd *SharedDomains) ReleaseCheckpoint(id int) error {
+	j := sd.journal
+	if id < 0 || id >= len(j.checkpoints) {
+		return fmt.Errorf("ReleaseCheckpoint: unknown checkpoint %d, have %d", id, len(j.checkpoints))
+	}
+	j.checkpoints = j.checkpoints[:id]
+	if len(j.checkpoints) == 0 {
+		return sd.applyJournal()
+	}
+	return nil
+}
+
+// releaseCheckpoints - removes all checkpoints, keeps changes
+func (sd *SharedDomains) releaseCheckpoints() error {
+	if !sd.journal.active() {
+		return nil
+	}
+	return sd.ReleaseCheckpoint(0)
+}
+
+func (sd *SharedDomains) undoPut(e *sdJournalEntry) {
+	sd.estSize = e.estSize
+	if e.domain == kv.StorageDomain {
+		if e.existed {
+			sd.storage.Set(e.key, e.prev)
+		} else {
+			sd.storage.Delete(e.key)
+		}
+		return
+	}
+	if e.existed {
+		sd.domains[e.domain][e.key] = e.prev
+	} else {
+		delete(sd.domains[e.domain], e.key)
+	}
+}
+
+// applyJournal - moves deferred writes to writers. Must be called when no checkpoints are open.
+func (sd *SharedDomains) applyJournal() error {
+	j := sd.journal
+	defer func() {
+		clear(j.entries)
+		j.entries = j.entries[:0]
+	}()
+	sd.sdCtx.updates.ReleaseJournal()
+	for i := range j.entries {
+		e := &j.entries[i]
+		switch e.kind {
+		case journalDomainWrite:
+			e.dw.SetTxNum(e.txNum)
+			if err := e.dw.h.AddPrevValue(e.k1, e.k2, e.prevVal, e.prevStep); err != nil {
+				return err
+			}
+			if err := e.dw.addValue(e.k1, e.k2, e.val); err != nil {
+				return err
+			}
+		case journalIndexAdd:
+			e.iw.SetTxNum(e.txNum)
+			if err := e.iw.Add(e.k1); err != nil {
+				return err
+			}
+		}
+	}
+	sd.SetTxNum(sd.txNum)
+	return nil
+}
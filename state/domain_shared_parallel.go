@@ -0,0 +1,826 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+// Block-STM (https://arxiv.org/abs/2203.06871) on top of SharedDomains:
+//   - every transaction of block is executed optimistically in parallel, against multi-version memory
+//   - every execution (incarnation) records versions of values it read
+//   - after execution read-set is validated: if some lower transaction re-wrote the value - transaction is re-executed
+//   - reading value of lower transaction which is being re-executed (estimate) - suspends transaction until dependency is executed
+//   - when all transactions are executed and validated - writes are applied to SharedDomains in block order
+//
+// Result is the same as sequential execution of block.
+
+// ReadDependencyError - transaction read value of lower transaction which is going to be re-executed.
+// Execution function must return this error (can be wrapped) as is: transaction will be re-executed after dependency.
+type ReadDependencyError struct {
+	TxIndex, BlockingTxIndex int
+}
+
+func (e *ReadDependencyError) Error() string {
+	return fmt.Sprintf("tx %d depends on tx %d which is being re-executed", e.TxIndex, e.BlockingTxIndex)
+}
+
+var ErrParallelUnsupported = errors.New("not supported by parallel execution")
+
+// mvStorageVersion - version of value read from SharedDomains (not written by any transaction of block)
+const mvStorageVersion = -1
+
+type mvKey struct {
+	domain kv.Domain
+	key    string
+}
+
+type mvVersion struct {
+	txIdx, incarnation int
+}
+
+type mvEntry struct {
+	incarnation int
+	estimate    bool // transaction is being re-executed: value likely will change
+	val         []byte
+	deleted     bool
+}
+
+type mvRead struct {
+	key     mvKey
+	version mvVersion
+}
+
+// mvPrefixRead - set of existing keys with given prefix, observed by DomainDelPrefix
+type mvPrefixRead struct {
+	domain kv.Domain
+	prefix string
+	keys   []string // sorted
+}
+
+// mvMemory - multi-version memory: for every key - values written by every transaction of block
+type mvMemory struct {
+	lock sync.RWMutex
+	data map[mvKey]map[int]*mvEntry // key -> txIdx -> entry
+
+	lastWrites [][]mvKey // keys written by last incarnation of transaction
+	lastReads  [][]mvRead
+	lastPrefix [][]mvPrefixRead
+}
+
+func newMVMemory(txCount int) *mvMemory {
+	return &mvMemory{
+		data:       map[mvKey]map[int]*mvEntry{},
+		lastWrites: make([][]mvKey, txCount),
+		lastReads:  make([][]mvRead, txCount),
+		lastPrefix: make([][]mvPrefixRead, txCount),
+	}
+}
+
+// read - value written by highest transaction below `txIdx`. found=false - value must be read from storage.
+func (m *mvMemory) read(k mvKey, txIdx int) (e mvEntry, version mvVersion, found bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.readLocked(k, txIdx)
+}
+
+func (m *mvMemory) readLocked(k mvKey, txIdx int) (e mvEntry, version mvVersion, found bool) {
+	best := -1
+	for writer := range m.data[k] {
+		if writer < txIdx && writer > best {
+			best = writer
+		}
+	}
+	if best < 0 {
+		return e, mvVersion{txIdx: mvStorageVersion}, false
+	}
+	e = *m.data[k][best] // copy: entry is modified by convertWritesToEstimates
+	return e, mvVersion{txIdx: best, incarnation: e.incarnation}, true
+}
+
+// record - saves output of incarnation. Returns true if incarnation wrote to a key which previous incarnation didn't write:
+// then all higher transactions must be re-validated.
+func (m *mvMemory) record(txIdx, incarnation int, reads []mvRead, prefixReads []mvPrefixRead, writes *mvWriteSet) (wroteNewKey bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	written := make(map[mvKey]struct{}, len(writes.order))
+	for _, k := range writes.order {
+		w := writes.m[k]
+		written[k] = struct{}{}
+		cell, ok := m.data[k]
+		if !ok {
+			cell = map[int]*mvEntry{}
+			m.data[k] = cell
+		}
+		if _, ok := cell[txIdx]; !ok {
+			wroteNewKey = true
+		}
+		cell[txIdx] = &mvEntry{incarnation: incarnation, val: w.val, deleted: w.deleted}
+	}
+	for _, k := range m.lastWrites[txIdx] {
+		if _, ok := written[k]; !ok {
+			delete(m.data[k], txIdx)
+		}
+	}
+	m.lastWrites[txIdx] = writes.order
+	m.lastReads[txIdx] = reads
+	m.lastPrefix[txIdx] = prefixReads
+	return wroteNewKey
+}
+
+// convertWritesToEstimates - transaction is aborted: readers of its values must wait for re-execution
+func (m *mvMemory) convertWritesToEstimates(txIdx int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, k := range m.lastWrites[txIdx] {
+		if e, ok := m.data[k][txIdx]; ok {
+			e.estimate = true
+		}
+	}
+}
+
+// validateReadSet - are values read by last incarnation of transaction still the same
+func (m *mvMemory) validateReadSet(txIdx int, storageKeys func(domain kv.Domain, prefix string) ([]string, error)) (bool, error) {
+	m.lock.RLock()
+	for _, r := range m.lastReads[txIdx] {
+		e, version, found := m.readLocked(r.key, txIdx)
+		if found && e.estimate {
+			m.lock.RUnlock()
+			return false, nil
+		}
+		if version != r.version {
+			m.lock.RUnlock()
+			return false, nil
+		}
+	}
+	prefixReads := m.lastPrefix[txIdx]
+	m.lock.RUnlock()
+
+	for _, r := range prefixReads {
+		keys, blocking, err := m.prefixKeys(r.domain, r.prefix, txIdx, storageKeys)
+		if err != nil {
+			return false, err
+		}
+		if blocking >= 0 || len(keys) != len(r.keys) {
+			return false, nil
+		}
+		for i := range keys {
+			if keys[i] != r.keys[i] {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// prefixKeys - sorted existing keys with prefix, as seen by transaction `txIdx`.
+// blocking >= 0 - one of keys is estimate of transaction `blocking`
+func (m *mvMemory) prefixKeys(domain kv.Domain, prefix string, txIdx int, storageKeys func(domain kv.Domain, prefix string) ([]string, error)) (keys []string, blocking int, err error) {
+	base, err := storageKeys(domain, prefix)
+	if err != nil {
+		return nil, -1, err
+	}
+	live := make(map[string]bool, len(base))
+	for _, k := range base {
+		live[k] = true
+	}
+
+	m.lock.RLock()
+	for k := range m.data {
+		if k.domain != domain || !strings.HasPrefix(k.key, prefix) {
+			continue
+		}
+		e, version, found := m.readLocked(k, txIdx)
+		if !found {
+			continue
+		}
+		if e.estimate {
+			m.lock.RUnlock()
+			return nil, version.txIdx, nil
+		}
+		live[k.key] = !e.deleted
+	}
+	m.lock.RUnlock()
+
+	keys = make([]string, 0, len(live))
+	for k, ok := range live {
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, -1, nil
+}
+
+type mvWrite struct {
+	val     []byte
+	deleted bool
+}
+
+// mvWriteSet - writes of one incarnation, in order of appearance
+type mvWriteSet struct {
+	m     map[mvKey]mvWrite
+	order []mvKey
+}
+
+func (w *mvWriteSet) set(k mvKey, v mvWrite) {
+	if _, ok := w.m[k]; !ok {
+		w.order = append(w.order, k)
+	}
+	w.m[k] = v
+}
+
+type mvIndexAdd struct {
+	table kv.InvertedIdx
+	key   []byte
+}
+
+// VersionedTx - view of state for one execution (incarnation) of transaction.
+// Records read-set and buffers writes. Not thread-safe: used by one goroutine.
+type VersionedTx struct {
+	b           *BlockSTM
+	txIdx       int
+	incarnation int
+
+	reads       []mvRead
+	prefixReads []mvPrefixRead
+	writes      mvWriteSet
+	indices     []mvIndexAdd
+}
+
+func (tx *VersionedTx) TxIndex() int     { return tx.txIdx }
+func (tx *VersionedTx) Incarnation() int { return tx.incarnation }
+func (tx *VersionedTx) TxNum() uint64    { return tx.b.txNums[tx.txIdx] }
+
+// DomainGet - latest value of key as seen by this transaction: own writes, then writes of lower transactions, then SharedDomains.
+// Returns *ReadDependencyError if value is being re-written by lower transaction.
+func (tx *VersionedTx) DomainGet(domain kv.Domain, k1, k2 []byte) (v []byte, step uint64, err error) {
+	if domain == kv.CommitmentDomain {
+		return nil, 0, fmt.Errorf("DomainGet %s: %w", domain, ErrParallelUnsupported)
+	}
+	k := mvKey{domain: domain, key: string(k1) + string(k2)}
+	if w, ok := tx.writes.m[k]; ok {
+		return w.val, 0, nil
+	}
+	e, version, found := tx.b.mv.read(k, tx.txIdx)
+	if found {
+		if e.estimate {
+			return nil, 0, &ReadDependencyError{TxIndex: tx.txIdx, BlockingTxIndex: version.txIdx}
+		}
+		tx.reads = append(tx.reads, mvRead{key: k, version: version})
+		if e.deleted {
+			return nil, 0, nil
+		}
+		return e.val, 0, nil
+	}
+	v, step, err = tx.b.storageGet(k)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx.reads = append(tx.reads, mvRead{key: k, version: version})
+	return v, step, nil
+}
+
+// DomainPut - buffers write. Previous value is not needed: it's read from SharedDomains on Commit.
+func (tx *VersionedTx) DomainPut(domain kv.Domain, k1, k2 []byte, val []byte) error {
+	if val == nil {
+		return fmt.Errorf("DomainPut: %s, trying to put nil value. not allowed", domain)
+	}
+	if domain == kv.CommitmentDomain {
+		return fmt.Errorf("DomainPut %s: %w", domain, ErrParallelUnsupported)
+	}
+	tx.writes.set(mvKey{domain: domain, key: string(k1) + string(k2)}, mvWrite{val: bytes.Clone(val)})
+	return nil
+}
+
+// DomainDel - same as SharedDomains.DomainDel: deletion of account also deletes it's code and storage
+func (tx *VersionedTx) DomainDel(domain kv.Domain, k1, k2 []byte) error {
+	switch domain {
+	case kv.CommitmentDomain:
+		return fmt.Errorf("DomainDel %s: %w", domain, ErrParallelUnsupported)
+	case kv.AccountsDomain:
+		if err := tx.DomainDelPrefix(kv.StorageDomain, k1); err != nil {
+			return err
+		}
+		if err := tx.DomainDel(kv.CodeDomain, k1, nil); err != nil {
+			return err
+		}
+	}
+	tx.writes.set(mvKey{domain: domain, key: string(k1) + string(k2)}, mvWrite{deleted: true})
+	return nil
+}
+
+// DomainDelPrefix - deletes all storage keys with prefix. Set of deleted keys is part of read-set.
+func (tx *VersionedTx) DomainDelPrefix(domain kv.Domain, prefix []byte) error {
+	if domain != kv.StorageDomain {
+		return errors.New("DomainDelPrefix: not supported")
+	}
+	keys, blocking, err := tx.b.mv.prefixKeys(domain, string(prefix), tx.txIdx, tx.b.storageKeys)
+	if err != nil {
+		return err
+	}
+	if blocking >= 0 {
+		return &ReadDependencyError{TxIndex: tx.txIdx, BlockingTxIndex: blocking}
+	}
+	tx.prefixReads = append(tx.prefixReads, mvPrefixRead{domain: domain, prefix: string(prefix), keys: keys})
+	for _, k := range keys {
+		tx.writes.set(mvKey{domain: domain, key: k}, mvWrite{deleted: true})
+	}
+	// own writes are not visible to other transactions yet
+	for _, k := range tx.writes.order {
+		if k.domain == domain && strings.HasPrefix(k.key, string(prefix)) {
+			tx.writes.set(k, mvWrite{deleted: true})
+		}
+	}
+	return nil
+}
+
+// IndexAdd - indices are write-only: applied on Commit
+func (tx *VersionedTx) IndexAdd(table kv.InvertedIdx, key []byte) error {
+	tx.indices = append(tx.indices, mvIndexAdd{table: table, key: bytes.Clone(key)})
+	return nil
+}
+
+type stmStatus uint8
+
+const (
+	stmReadyToExecute stmStatus = iota
+	stmExecuting
+	stmExecuted
+	stmAborting
+)
+
+type stmTxStatus struct {
+	lock         sync.Mutex
+	incarnation  int
+	status       stmStatus
+	dependencies []int // transactions waiting for this one
+}
+
+type stmTaskKind uint8
+
+const (
+	stmNoTask stmTaskKind = iota
+	stmExecutionTask
+	stmValidationTask
+)
+
+type stmTask struct {
+	kind        stmTaskKind
+	txIdx       int
+	incarnation int
+}
+
+// stmScheduler - collaborative scheduler of Block-STM: execution and validation tasks are served in order of txIdx
+type stmScheduler struct {
+	n             int64
+	executionIdx  atomic.Int64
+	validationIdx atomic.Int64
+	decreaseCnt   atomic.Int64
+	activeTasks   atomic.Int64
+	done          atomic.Bool
+	txs           []stmTxStatus
+}
+
+func newSTMScheduler(n int) *stmScheduler {
+	return &stmScheduler{n: int64(n), txs: make([]stmTxStatus, n)}
+}
+
+func (s *stmScheduler) decreaseExecutionIdx(target int64) {
+	for {
+		cur := s.executionIdx.Load()
+		if cur <= target || s.executionIdx.CompareAndSwap(cur, target) {
+			break
+		}
+	}
+	s.decreaseCnt.Add(1)
+}
+
+func (s *stmScheduler) decreaseValidationIdx(target int64) {
+	for {
+		cur := s.validationIdx.Load()
+		if cur <= target || s.validationIdx.CompareAndSwap(cur, target) {
+			break
+		}
+	}
+	s.decreaseCnt.Add(1)
+}
+
+func (s *stmScheduler) checkDone() {
+	observed := s.decreaseCnt.Load()
+	if min(s.executionIdx.Load(), s.validationIdx.Load()) >= s.n && s.activeTasks.Load() == 0 && observed == s.decreaseCnt.Load() {
+		s.done.Store(true)
+	}
+}
+
+// tryIncarnate - caller must decrement activeTasks if false is returned
+func (s *stmScheduler) tryIncarnate(txIdx int64) (incarnation int, ok bool) {
+	if txIdx >= s.n {
+		return 0, false
+	}
+	st := &s.txs[txIdx]
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.status != stmReadyToExecute {
+		return 0, false
+	}
+	st.status = stmExecuting
+	return st.incarnation, true
+}
+
+func (s *stmScheduler) nextVersionToExecute() stmTask {
+	if s.executionIdx.Load() >= s.n {
+		s.checkDone()
+		return stmTask{}
+	}
+	s.activeTasks.Add(1)
+	idx := s.executionIdx.Add(1) - 1
+	if incarnation, ok := s.tryIncarnate(idx); ok {
+		return stmTask{kind: stmExecutionTask, txIdx: int(idx), incarnation: incarnation}
+	}
+	s.activeTasks.Add(-1)
+	return stmTask{}
+}
+
+func (s *stmScheduler) nextVersionToValidate() stmTask {
+	if s.validationIdx.Load() >= s.n {
+		s.checkDone()
+		return stmTask{}
+	}
+	s.activeTasks.Add(1)
+	idx := s.validationIdx.Add(1) - 1
+	if idx < s.n {
+		st := &s.txs[idx]
+		st.lock.Lock()
+		if st.status == stmExecuted {
+			incarnation := st.incarnation
+			st.lock.Unlock()
+			return stmTask{kind: stmValidationTask, txIdx: int(idx), incarnation: incarnation}
+		}
+		st.lock.Unlock()
+	}
+	s.activeTasks.Add(-1)
+	return stmTask{}
+}
+
+func (s *stmScheduler) nextTask() stmTask {
+	if s.validationIdx.Load() < s.executionIdx.Load() {
+		return s.nextVersionToValidate()
+	}
+	return s.nextVersionToExecute()
+}
+
+// addDependency - suspends `txIdx` until `blocking` is executed. false - `blocking` already executed: re-execute immediately.
+func (s *stmScheduler) addDependency(txIdx, blocking int) bool {
+	b := &s.txs[blocking]
+	b.lock.Lock()
+	if b.status == stmExecuted {
+		b.lock.Unlock()
+		return false
+	}
+	st := &s.txs[txIdx]
+	st.lock.Lock()
+	st.status = stmAborting
+	st.lock.Unlock()
+	b.dependencies = append(b.dependencies, txIdx)
+	b.lock.Unlock()
+	s.activeTasks.Add(-1)
+	return true
+}
+
+func (s *stmScheduler) setReadyStatus(txIdx int) {
+	st := &s.txs[txIdx]
+	st.lock.Lock()
+	st.incarnation++
+	st.status = stmReadyToExecute
+	st.lock.Unlock()
+}
+
+func (s *stmScheduler) finishExecution(txIdx, incarnation int, wroteNewKey bool) stmTask {
+	st := &s.txs[txIdx]
+	st.lock.Lock()
+	st.status = stmExecuted
+	deps := st.dependencies
+	st.dependencies = nil
+	st.lock.Unlock()
+
+	if len(deps) > 0 {
+		minDep := deps[0]
+		for _, dep := range deps {
+			s.setReadyStatus(dep)
+			minDep = min(minDep, dep)
+		}
+		s.decreaseExecutionIdx(int64(minDep))
+	}
+	if s.validationIdx.Load() > int64(txIdx) {
+		if !wroteNewKey {
+			return stmTask{kind: stmValidationTask, txIdx: txIdx, incarnation: incarnation}
+		}
+		s.decreaseValidationIdx(int64(txIdx))
+	}
+	s.activeTasks.Add(-1)
+	return stmTask{}
+}
+
+func (s *stmScheduler) tryValidationAbort(txIdx, incarnation int) bool {
+	st := &s.txs[txIdx]
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.incarnation == incarnation && st.status == stmExecuted {
+		st.status = stmAborting
+		return true
+	}
+	return false
+}
+
+func (s *stmScheduler) finishValidation(txIdx int, aborted bool) stmTask {
+	if aborted {
+		s.setReadyStatus(txIdx)
+		s.decreaseValidationIdx(int64(txIdx) + 1)
+		if s.executionIdx.Load() > int64(txIdx) {
+			if incarnation, ok := s.tryIncarnate(int64(txIdx)); ok {
+				return stmTask{kind: stmExecutionTask, txIdx: txIdx, incarnation: incarnation}
+			}
+		}
+	}
+	s.activeTasks.Add(-1)
+	return stmTask{}
+}
+
+// stmOutput - output of last incarnation of transaction
+type stmOutput struct {
+	writes  mvWriteSet
+	indices []mvIndexAdd
+	err     error
+}
+
+type BlockSTMStats struct {
+	Executions, Validations, Aborts, Dependencies uint64
+}
+
+func (s BlockSTMStats) String() string {
+	return fmt.Sprintf("executions=%d, validations=%d, aborts=%d, dependencies=%d", s.Executions, s.Validations, s.Aborts, s.Dependencies)
+}
+
+// BlockSTM - parallel execution of one block on top of SharedDomains. Usage:
+//
+//	b := NewBlockSTM(sd, txNums, workers)
+//	err := b.Execute(ctx, func(ctx context.Context, tx *VersionedTx) error { ... })
+//	err = b.Commit() // applies writes to `sd` in block order
+type BlockSTM struct {
+	sd      *SharedDomains
+	txNums  []uint64
+	workers int
+
+	mv      *mvMemory
+	sched   *stmScheduler
+	outputs []stmOutput
+
+	// SharedDomains and its kv.Tx are not thread-safe (and MDBX RwTx is bound to OS thread): storage reads are
+	// served by goroutine which called Execute. SharedDomains is not modified until Commit - cache is valid during whole execution.
+	storageReqs     chan storageReq
+	storageLock     sync.RWMutex
+	storageCache    map[mvKey]storageValue
+	storagePrefixes map[mvKey][]string
+
+	executions, validations, aborts, dependencies atomic.Uint64
+	executed                                      bool
+}
+
+type storageValue struct {
+	v    []byte
+	step uint64
+}
+
+type storageReq struct {
+	k      mvKey
+	prefix bool
+	done   chan error
+}
+
+// NewBlockSTM - txNums[i] is txNum of i-th transaction of block
+func NewBlockSTM(sd *SharedDomains, txNums []uint64, workers int) *BlockSTM {
+	return &BlockSTM{
+		sd:              sd,
+		txNums:          txNums,
+		workers:         max(workers, 1),
+		mv:              newMVMemory(len(txNums)),
+		sched:           newSTMScheduler(len(txNums)),
+		outputs:         make([]stmOutput, len(txNums)),
+		storageReqs:     make(chan storageReq),
+		storageCache:    map[mvKey]storageValue{},
+		storagePrefixes: map[mvKey][]string{},
+	}
+}
+
+func (b *BlockSTM) storageGet(k mvKey) ([]byte, uint64, error) {
+	b.storageLock.RLock()
+	v, ok := b.storageCache[k]
+	b.storageLock.RUnlock()
+	if !ok {
+		if err := b.storageRequest(storageReq{k: k}); err != nil {
+			return nil, 0, err
+		}
+		b.storageLock.RLock()
+		v = b.storageCache[k]
+		b.storageLock.RUnlock()
+	}
+	return v.v, v.step, nil
+}
+
+func (b *BlockSTM) storageKeys(domain kv.Domain, prefix string) ([]string, error) {
+	pk := mvKey{domain: domain, key: prefix}
+	b.storageLock.RLock()
+	keys, ok := b.storagePrefixes[pk]
+	b.storageLock.RUnlock()
+	if !ok {
+		if err := b.storageRequest(storageReq{k: pk, prefix: true}); err != nil {
+			return nil, err
+		}
+		b.storageLock.RLock()
+		keys = b.storagePrefixes[pk]
+		b.storageLock.RUnlock()
+	}
+	return keys, nil
+}
+
+// storageRequest - executes read on goroutine which owns kv.Tx. Result is stored in cache.
+func (b *BlockSTM) storageRequest(req storageReq) error {
+	req.done = make(chan error, 1)
+	b.storageReqs <- req
+	return <-req.done
+}
+
+func (b *BlockSTM) serveStorage(req storageReq) error {
+	if !req.prefix {
+		v, step, err := b.sd.DomainGet(req.k.domain, []byte(req.k.key), nil)
+		if err != nil {
+			return err
+		}
+		b.storageLock.Lock()
+		b.storageCache[req.k] = storageValue{v: bytes.Clone(v), step: step}
+		b.storageLock.Unlock()
+		return nil
+	}
+	var keys []string
+	if err := b.sd.IterateStoragePrefix([]byte(req.k.key), func(k, v []byte, step uint64) error {
+		if len(v) > 0 {
+			keys = append(keys, string(k))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	b.storageLock.Lock()
+	b.storagePrefixes[req.k] = keys
+	b.storageLock.Unlock()
+	return nil
+}
+
+// Execute - runs `exec` for every transaction (maybe several times) until results are consistent.
+// `exec` must be deterministic, must read/write state only via `tx` and must return *ReadDependencyError as is.
+// Must be called from goroutine which owns kv.Tx of SharedDomains.
+// Error returned by final incarnation of transaction is returned by Commit.
+func (b *BlockSTM) Execute(ctx context.Context, exec func(ctx context.Context, tx *VersionedTx) error) error {
+	if b.executed {
+		return errors.New("BlockSTM: Execute called twice")
+	}
+	b.executed = true
+	if len(b.txNums) == 0 {
+		return nil
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < b.workers; i++ {
+		g.Go(func() error {
+			var task stmTask
+			for !b.sched.done.Load() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				var err error
+				switch task.kind {
+				case stmExecutionTask:
+					task, err = b.execute(ctx, task, exec)
+				case stmValidationTask:
+					task, err = b.validate(task)
+				default:
+					if task = b.sched.nextTask(); task.kind == stmNoTask {
+						runtime.Gosched()
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	workersDone := make(chan struct{})
+	go func() {
+		defer close(workersDone)
+		_ = g.Wait()
+	}()
+	for {
+		select {
+		case req := <-b.storageReqs:
+			req.done <- b.serveStorage(req)
+		case <-workersDone:
+			return g.Wait()
+		}
+	}
+}
+
+func (b *BlockSTM) execute(ctx context.Context, task stmTask, exec func(ctx context.Context, tx *VersionedTx) error) (stmTask, error) {
+	b.executions.Add(1)
+	tx := &VersionedTx{b: b, txIdx: task.txIdx, incarnation: task.incarnation, writes: mvWriteSet{m: map[mvKey]mvWrite{}}}
+	err := exec(ctx, tx)
+	var dep *ReadDependencyError
+	if errors.As(err, &dep) {
+		b.dependencies.Add(1)
+		if b.sched.addDependency(task.txIdx, dep.BlockingTxIndex) {
+			return stmTask{}, nil
+		}
+		return task, nil // dependency already resolved: re-execute same incarnation
+	}
+	if err != nil && ctx.Err() != nil {
+		return stmTask{}, ctx.Err()
+	}
+	wroteNewKey := b.mv.record(task.txIdx, task.incarnation, tx.reads, tx.prefixReads, &tx.writes)
+	b.outputs[task.txIdx] = stmOutput{writes: tx.writes, indices: tx.indices, err: err}
+	return b.sched.finishExecution(task.txIdx, task.incarnation, wroteNewKey), nil
+}
+
+func (b *BlockSTM) validate(task stmTask) (stmTask, error) {
+	b.validations.Add(1)
+	valid, err := b.mv.validateReadSet(task.txIdx, b.storageKeys)
+	if err != nil {
+		return stmTask{}, err
+	}
+	aborted := !valid && b.sched.tryValidationAbort(task.txIdx, task.incarnation)
+	if aborted {
+		b.aborts.Add(1)
+		b.mv.convertWritesToEstimates(task.txIdx)
+	}
+	return b.sched.finishValidation(task.txIdx, aborted), nil
+}
+
+func (b *BlockSTM) Stats() BlockSTMStats {
+	return BlockSTMStats{Executions: b.executions.Load(), Validations: b.validations.Load(), Aborts: b.aborts.Load(), Dependencies: b.dependencies.Load()}
+}
+
+// Commit - applies writes of all transactions to SharedDomains in block order
+func (b *BlockSTM) Commit() error {
+	if !b.sched.done.Load() && len(b.txNums) > 0 {
+		return errors.New("BlockSTM: Commit before successful Execute")
+	}
+	for txIdx, out := range b.outputs {
+		if out.err != nil {
+			return fmt.Errorf("tx %d (txNum=%d): %w", txIdx, b.txNums[txIdx], out.err)
+		}
+		b.sd.SetTxNum(b.txNums[txIdx])
+		for _, k := range out.writes.order {
+			w := out.writes.m[k]
+			var err error
+			if w.deleted {
+				err = b.sd.DomainDel(k.domain, []byte(k.key), nil, nil, 0)
+			} else {
+				err = b.sd.DomainPut(k.domain, []byte(k.key), nil, w.val, nil, 0)
+			}
+			if err != nil {
+				return fmt.Errorf("tx %d (txNum=%d): %w", txIdx, b.txNums[txIdx], err)
+			}
+		}
+		for _, idx := range out.indices {
+			if err := b.sd.IndexAdd(idx.table, idx.key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
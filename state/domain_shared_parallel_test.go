@@ -0,0 +1,168 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+func storageKey(addr, loc byte) []byte {
+	k := make([]byte, length.Addr+length.Hash)
+	k[0], k[length.Addr] = addr, loc
+	return k
+}
+
+func TestBlockSTM_DeterministicResult(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 16)
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	counter := storageKey(1, 1)
+	u64 := func(v []byte) uint64 {
+		if len(v) == 0 {
+			return 0
+		}
+		return binary.BigEndian.Uint64(v)
+	}
+	enc := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+	// every tx increments shared counter, every 3rd writes own key, every 5th reads key of previous tx
+	const txCount = 200
+	txNums := make([]uint64, txCount)
+	for i := range txNums {
+		txNums[i] = uint64(i + 1)
+	}
+	b := NewBlockSTM(domains, txNums, 8)
+	err = b.Execute(ctx, func(ctx context.Context, tx *VersionedTx) error {
+		i := tx.TxIndex()
+		v, _, err := tx.DomainGet(kv.StorageDomain, counter, nil)
+		if err != nil {
+			return err
+		}
+		if err := tx.DomainPut(kv.StorageDomain, counter, nil, enc(u64(v)+1)); err != nil {
+			return err
+		}
+		if i%3 == 0 {
+			if err := tx.DomainPut(kv.StorageDomain, storageKey(2, byte(i)), nil, enc(uint64(i))); err != nil {
+				return err
+			}
+		}
+		if i%5 == 0 && i > 0 {
+			prev, _, err := tx.DomainGet(kv.StorageDomain, storageKey(2, byte(i-1)), nil)
+			if err != nil {
+				return err
+			}
+			return tx.DomainPut(kv.StorageDomain, storageKey(3, byte(i)), nil, enc(u64(prev)+u64(v)))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+	require.GreaterOrEqual(t, b.Stats().Executions, uint64(txCount))
+
+	get := func(k []byte) uint64 {
+		v, _, err := domains.DomainGet(kv.StorageDomain, k, nil)
+		require.NoError(t, err)
+		return u64(v)
+	}
+	require.Equal(t, uint64(txCount), get(counter))
+	for i := 0; i < txCount; i++ {
+		if i%3 == 0 {
+			require.Equal(t, uint64(i), get(storageKey(2, byte(i))))
+		}
+		if i%5 == 0 && i > 0 {
+			var prev uint64
+			if (i-1)%3 == 0 {
+				prev = uint64(i - 1)
+			}
+			require.Equal(t, prev+uint64(i), get(storageKey(3, byte(i))), i) // counter before tx i is i
+		}
+	}
+}
+
+func TestBlockSTM_DelPrefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 16)
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	domains.SetTxNum(1)
+	require.NoError(t, domains.DomainPut(kv.StorageDomain, storageKey(1, 0), nil, []byte{1}, nil, 0))
+
+	b := NewBlockSTM(domains, []uint64{2, 3, 4, 5}, 4)
+	err = b.Execute(ctx, func(ctx context.Context, tx *VersionedTx) error {
+		switch tx.TxIndex() {
+		case 0:
+			return tx.DomainPut(kv.StorageDomain, storageKey(1, 1), nil, []byte{2})
+		case 1:
+			return tx.DomainPut(kv.StorageDomain, storageKey(1, 2), nil, []byte{3})
+		case 2:
+			return tx.DomainDelPrefix(kv.StorageDomain, storageKey(1, 0)[:length.Addr])
+		default:
+			v, _, err := tx.DomainGet(kv.StorageDomain, storageKey(1, 1), nil)
+			if err != nil {
+				return err
+			}
+			if v != nil {
+				return tx.DomainPut(kv.StorageDomain, storageKey(1, 3), nil, []byte{4})
+			}
+			return tx.DomainPut(kv.StorageDomain, storageKey(1, 4), nil, []byte{5})
+		}
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+
+	var keys [][]byte
+	require.NoError(t, domains.IterateStoragePrefix(storageKey(1, 0)[:length.Addr], func(k, v []byte, step uint64) error {
+		if len(v) > 0 {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	}))
+	require.Equal(t, [][]byte{storageKey(1, 4)}, keys)
+
+	b = NewBlockSTM(domains, []uint64{6}, 1)
+	require.NoError(t, b.Execute(ctx, func(ctx context.Context, tx *VersionedTx) error {
+		return tx.DomainPut(kv.CommitmentDomain, []byte{1}, nil, []byte{1})
+	}))
+	require.ErrorIs(t, b.Commit(), ErrParallelUnsupported)
+}
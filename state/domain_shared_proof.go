@@ -0,0 +1,108 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+var ErrCommitmentHistoryDisabled = errors.New("commitment history is disabled")
+
+// AccountProofAsOf returns Merkle proof (as eth_getProof does) of account `addr` and its `storageKeys` for the state
+// as of `txNum` (before execution of `txNum`, same as DomainGetAsOf) and root hash the proof is built against.
+// Proof is built for the last commitment state computed before `txNum`; if commitment has been computed since then,
+// CommitmentDomain history is required (see Aggregator.KeepCommitmentHistory).
+// Branches and values are read from DB and files, so SharedDomains must be flushed.
+func (sd *SharedDomains) AccountProofAsOf(addr []byte, storageKeys [][]byte, txNum uint64) (proof *commitment.AccountProof, rootHash []byte, err error) {
+	sdc := NewSharedDomainsCommitmentContext(sd, commitment.ModeUpdate, commitment.VariantHexPatriciaTrie)
+	defer sdc.Close()
+	if _, _, _, err = sd.restoreCommitmentStateAsOf(sdc, txNum); err != nil {
+		return nil, nil, err
+	}
+	hph, ok := sdc.patriciaTrie.(*commitment.HexPatriciaHashed)
+	if !ok {
+		return nil, nil, fmt.Errorf("proofs are not supported by patricia trie type: %T", sdc.patriciaTrie)
+	}
+	if rootHash, err = hph.RootHash(); err != nil {
+		return nil, nil, err
+	}
+	if proof, err = hph.ProveAccount(addr, storageKeys); err != nil {
+		return nil, nil, err
+	}
+	return proof, rootHash, nil
+}
+
+// CommitmentReaderAsOf returns reader of CommitmentDomain branches (see commitment/inspect) as they were right after
+// the last commitment state computed before `txNum` (math.MaxUint64 for the latest one). As for AccountProofAsOf,
+// CommitmentDomain history is required for past states. Returned context should be closed after use.
+func (sd *SharedDomains) CommitmentReaderAsOf(txNum uint64) (*SharedDomainsCommitmentContext, error) {
+	sdc := NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, commitment.VariantHexPatriciaTrie)
+	if _, _, _, err := sd.restoreCommitmentStateAsOf(sdc, txNum); err != nil {
+		sdc.Close()
+		return nil, err
+	}
+	return sdc, nil
+}
+
+// restoreCommitmentStateAsOf sets trie of sdc to the last commitment state computed before `txNum` (math.MaxUint64 for
+// the latest one). Branches and values are read as they were right after that commitment computation, so
+// CommitmentDomain history is required if commitment has been computed since then. ok is false if there is no
+// commitment state, then trie is left empty.
+func (sd *SharedDomains) restoreCommitmentStateAsOf(sdc *SharedDomainsCommitmentContext, txNum uint64) (blockNum, stateTxNum uint64, ok bool, err error) {
+	if v := sd.aggTx.a.commitmentVariant; v != sdc.patriciaTrie.Variant() {
+		return 0, 0, false, fmt.Errorf("commitment is computed by %s trie, %s is not supported", v, sdc.patriciaTrie.Variant())
+	}
+	_, latestTxNum, _, err := sd.sdCtx.LatestCommitmentState()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if txNum <= latestTxNum {
+		if err := sd.aggTx.commitmentHistoryAvailableFrom(sd.roTx, txNum); err != nil {
+			return 0, 0, false, err
+		}
+		sdc.historyAsOfTxNum = txNum
+	}
+	blockNum, stateTxNum, state, err := sdc.LatestCommitmentState()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if len(state) == 0 {
+		return 0, 0, false, nil
+	}
+
+	sdc.historyAsOfTxNum = stateTxNum + 1
+	sdc.ResetBranchCache()
+	if _, _, err = sdc.restorePatriciaState(state); err != nil {
+		return 0, 0, false, err
+	}
+	return blockNum, stateTxNum, true, nil
+}
+
+func (ac *AggregatorRoTx) commitmentHistoryAvailableFrom(tx kv.Tx, txNum uint64) error {
+	cd := ac.d[kv.CommitmentDomain]
+	if cd.d.historyDisabled {
+		return fmt.Errorf("%w: can't read state as of txNum=%d", ErrCommitmentHistoryDisabled, txNum)
+	}
+	if minTxNum := cd.ht.iit.ii.minTxNumInDB(tx); minTxNum >= txNum {
+		return fmt.Errorf("commitment history in db starts at txNum=%d, need %d: %w", minTxNum, txNum, ErrHistoryPruned)
+	}
+	return nil
+}
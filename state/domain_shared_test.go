@@ -17,9 +17,11 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
 	"testing"
 	"time"
@@ -27,7 +29,11 @@ import (
 	"github.com/holiman/uint256"
 	"github.com/stretchr/testify/require"
 
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/commitment/inspect"
+	"github.com/Tangui-Bitfly/erigon-lib/crypto"
 	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
 	"github.com/Tangui-Bitfly/erigon-lib/kv/rawdbv3"
 	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
 
@@ -522,3 +528,916 @@ func TestSharedDomain_StorageIter(t *testing.T) {
 	domains.Close()
 	ac.Close()
 }
+
+func TestSharedDomain_CheckpointRevert(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	addr := make([]byte, length.Addr)
+	addr[0] = 1
+	loc1, loc2 := make([]byte, length.Hash), make([]byte, length.Hash)
+	loc2[0] = 1
+	acc := func(nonce uint64) []byte { return types.EncodeAccountBytesV3(nonce, uint256.NewInt(nonce), nil, 0) }
+
+	// writes kept after reverts must give same state as if reverted writes never happened
+	run := func(withReverts bool) (root []byte) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		changeset := &StateChangeSet{}
+		domains.SetChangesetAccumulator(changeset)
+
+		domains.SetTxNum(1)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, acc(1), nil, 0))
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc1, []byte{1}, nil, 0))
+
+		if withReverts {
+			cp0 := domains.Checkpoint()
+			domains.SetTxNum(2)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, acc(2), nil, 0))
+			require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, loc2, []byte{2}, nil, 0))
+			require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, addr))
+
+			cp1 := domains.Checkpoint()
+			domains.SetTxNum(3)
+			require.NoError(t, domains.DomainDel(kv.StorageDomain, addr, loc1, nil, 0))
+			require.NoError(t, domains.RevertTo(cp1))
+
+			v, _, err := domains.DomainGet(kv.StorageDomain, addr, loc1)
+			require.NoError(t, err)
+			require.Equal(t, []byte{1}, v)
+			v, _, err = domains.DomainGet(kv.AccountsDomain, addr, nil)
+			require.NoError(t, err)
+			require.Equal(t, acc(2), v)
+
+			require.NoError(t, domains.RevertTo(cp0))
+			require.Error(t, domains.RevertTo(cp0))
+			v, _, err = domains.DomainGet(kv.StorageDomain, addr, loc2)
+			require.NoError(t, err)
+			require.Nil(t, v)
+		}
+
+		cp := domains.Checkpoint()
+		domains.SetTxNum(3)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, acc(3), nil, 0))
+		require.NoError(t, domains.ReleaseCheckpoint(cp))
+
+		diff := changeset.Diffs[kv.StorageDomain].GetDiffSet()
+		require.Len(t, diff, 1)
+
+		root, err = domains.ComputeCommitment(ctx, true, 1, "")
+		require.NoError(t, err)
+		require.NoError(t, domains.Flush(ctx, rwTx))
+
+		ac.Close()
+		ac = agg.BeginFilesRo()
+		v, ok, err := ac.HistorySeek(kv.AccountsHistory, addr, 3, rwTx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, acc(1), v)
+		it, err := ac.IndexRange(kv.LogAddrIdx, addr, 0, -1, order.Asc, -1, rwTx)
+		require.NoError(t, err)
+		require.False(t, it.HasNext())
+		return root
+	}
+	require.Equal(t, run(false), run(true))
+}
+
+func TestSharedDomain_DeepUnwind(t *testing.T) {
+	t.Parallel()
+
+	stepSize := uint64(10)
+	db, agg := testDbAndAggregatorv3(t, stepSize)
+	ctx := context.Background()
+
+	maxTx := 6*stepSize + 5
+	unwindTo := uint64(47)
+	addrs := 5
+	addr := func(i int) []byte { a := make([]byte, length.Addr); a[0] = byte(i + 1); return a }
+	loc := make([]byte, length.Hash)
+
+	// state after each tx: key -> value
+	expected := make([]map[string][]byte, maxTx)
+	write := func(domains *SharedDomains, fromTx, toTx uint64, salt uint64) {
+		state := map[string][]byte{}
+		if fromTx > 0 {
+			for k, v := range expected[fromTx-1] {
+				state[k] = v
+			}
+		}
+		for txNum := fromTx; txNum < toTx; txNum++ {
+			domains.SetTxNum(txNum)
+			a := addr(int(txNum) % addrs)
+			pv, step, err := domains.DomainGet(kv.AccountsDomain, a, nil)
+			require.NoError(t, err)
+			v := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum*salt), nil, 0)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, a, nil, v, pv, step))
+			state[string(a)] = v
+
+			pv, step, err = domains.DomainGet(kv.StorageDomain, a, loc)
+			require.NoError(t, err)
+			if txNum%7 == 0 {
+				require.NoError(t, domains.DomainDel(kv.StorageDomain, a, loc, pv, step))
+				delete(state, string(a)+string(loc))
+			} else {
+				v := []byte{byte(txNum), byte(salt)}
+				require.NoError(t, domains.DomainPut(kv.StorageDomain, a, loc, v, pv, step))
+				state[string(a)+string(loc)] = v
+			}
+
+			_, err = domains.ComputeCommitment(ctx, true, domains.BlockNum(), "")
+			require.NoError(t, err)
+			expected[txNum] = map[string][]byte{}
+			for k, v := range state {
+				expected[txNum][k] = v
+			}
+		}
+	}
+	check := func(domains *SharedDomains, txNum uint64) {
+		for i := 0; i < addrs; i++ {
+			a := addr(i)
+			v, _, err := domains.DomainGet(kv.AccountsDomain, a, nil)
+			require.NoError(t, err)
+			require.Equal(t, expected[txNum][string(a)], v, "account %d", i)
+			v, _, err = domains.DomainGet(kv.StorageDomain, a, loc)
+			require.NoError(t, err)
+			if exp, ok := expected[txNum][string(a)+string(loc)]; ok {
+				require.Equal(t, exp, v, "storage %d", i)
+			} else {
+				require.Empty(t, v, "storage %d", i)
+			}
+		}
+		require.Equal(t, txNum, domains.TxNum())
+	}
+	buildFiles := func() {
+		require.NoError(t, agg.BuildFiles(maxTx))
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		_, err := ac.PruneSmallBatchesDb(ctx, time.Hour, db)
+		require.NoError(t, err)
+	}
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	write(domains, 0, maxTx, 1)
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	buildFiles()
+
+	// rolled back unwind: files are not deleted and visible again
+	unwindTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	dTx := &deepUnwindTestTx{RwTx: unwindTx, agg: agg}
+	defer dTx.Rollback()
+	ac = agg.BeginFilesRo()
+	maxTxNumInFiles := ac.maxTxNumInFiles()
+	lastFile := ac.d[kv.AccountsDomain].files[len(ac.d[kv.AccountsDomain].files)-1].src.decompressor.FilePath()
+	domains, err = NewSharedDomains(WrapTxWithCtx(dTx, ac), log.New())
+	require.NoError(t, err)
+	require.NoError(t, domains.DeepUnwind(ctx, dTx, 0, unwindTo))
+	require.ErrorIs(t, domains.DeepUnwind(ctx, dTx, 0, unwindTo), ErrDeepUnwindBusy)
+	domains.Close()
+	ac.Close()
+	require.FileExists(t, lastFile)
+	dTx.Rollback()
+	require.FileExists(t, lastFile)
+	require.False(t, agg.buildingFiles.Load(), "build of files must be enabled again")
+	require.False(t, agg.mergingFiles.Load(), "merge of files must be enabled again")
+
+	// unwind below frozen files: no diffsets, only history
+	unwindTx, err = db.BeginRw(ctx)
+	require.NoError(t, err)
+	dTx = &deepUnwindTestTx{RwTx: unwindTx, agg: agg}
+	defer dTx.Rollback()
+	ac = agg.BeginFilesRo()
+	require.Equal(t, maxTxNumInFiles, ac.maxTxNumInFiles())
+	require.Greater(t, ac.maxTxNumInFiles(), unwindTo)
+	truncateTo, ok := ac.CanDeepUnwindTo(dTx, unwindTo)
+	require.True(t, ok)
+	require.LessOrEqual(t, truncateTo, unwindTo/stepSize*stepSize)
+	domains, err = NewSharedDomains(WrapTxWithCtx(dTx, ac), log.New())
+	require.NoError(t, err)
+	check(domains, maxTx-1)
+	require.NoError(t, domains.DeepUnwind(ctx, dTx, 0, unwindTo))
+	domains.Close()
+	ac.Close()
+	require.FileExists(t, lastFile)
+	require.NoError(t, dTx.Commit())
+	require.NoFileExists(t, lastFile)
+	require.False(t, agg.buildingFiles.Load())
+
+	rwTx, err = db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac = agg.BeginFilesRo()
+	require.Equal(t, truncateTo, ac.maxTxNumInFiles())
+	domains, err = NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	check(domains, unwindTo-1)
+	for txNum := uint64(0); txNum < unwindTo; txNum += 3 {
+		a := addr(int(txNum) % addrs)
+		v, _, err := ac.DomainGetAsOf(rwTx, kv.AccountsDomain, a, txNum+1)
+		require.NoError(t, err)
+		require.Equal(t, expected[txNum][string(a)], v, "txNum %d", txNum)
+	}
+	it, err := ac.IndexRange(kv.AccountsHistoryIdx, addr(0), int(truncateTo), -1, order.Asc, -1, rwTx)
+	require.NoError(t, err)
+	for it.HasNext() {
+		txNum, err := it.Next()
+		require.NoError(t, err)
+		require.Less(t, txNum, unwindTo)
+	}
+	it.Close()
+
+	// re-execute with different values: files for unwound steps must be built again
+	write(domains, unwindTo, maxTx, 2)
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	buildFiles()
+
+	rwTx, err = db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	require.Greater(t, ac.maxTxNumInFiles(), unwindTo)
+	domains, err = NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+	check(domains, maxTx-1)
+}
+
+// deepUnwindTestTx - releases files detached by deep unwind at end of tx, as temporal.Tx does
+type deepUnwindTestTx struct {
+	kv.RwTx
+	agg      *Aggregator
+	unwound  bool
+	finished bool
+}
+
+func (tx *deepUnwindTestTx) DeepUnwound() { tx.unwound = true }
+func (tx *deepUnwindTestTx) Commit() error {
+	if tx.finished {
+		return nil
+	}
+	tx.finished = true
+	if err := tx.RwTx.Commit(); err != nil {
+		if tx.unwound {
+			tx.agg.DeepUnwindRolledBack()
+		}
+		return err
+	}
+	if tx.unwound {
+		tx.agg.DeepUnwindCommitted()
+	}
+	return nil
+}
+func (tx *deepUnwindTestTx) Rollback() {
+	if tx.finished {
+		return
+	}
+	tx.finished = true
+	tx.RwTx.Rollback()
+	if tx.unwound {
+		tx.agg.DeepUnwindRolledBack()
+	}
+}
+
+func TestSharedDomain_AccountProofAsOf(t *testing.T) {
+	t.Parallel()
+
+	stepSize := uint64(10)
+	db, agg := testDbAndAggregatorv3(t, stepSize)
+	agg.KeepCommitmentHistory(true)
+	ctx := context.Background()
+
+	maxTx := 3 * stepSize
+	addrs := 4
+	addr := func(i int) []byte { a := make([]byte, length.Addr); a[0] = byte(i + 1); return a }
+	loc := func(i int) []byte { l := make([]byte, length.Hash); l[0] = byte(i + 1); return l }
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	// all accounts are created by first tx, then each tx updates one account and one of its slots
+	roots := make([][]byte, maxTx)
+	for txNum := uint64(0); txNum < maxTx; txNum++ {
+		domains.SetTxNum(txNum)
+		for i := 0; i < addrs; i++ {
+			a := addr(i)
+			if txNum > 0 && int(txNum)%addrs != i {
+				continue
+			}
+			pv, step, err := domains.DomainGet(kv.AccountsDomain, a, nil)
+			require.NoError(t, err)
+			v := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum+uint64(i)+1), nil, 0)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, a, nil, v, pv, step))
+		}
+
+		a := addr(int(txNum) % addrs)
+
+		l := loc(int(txNum) % 3)
+		pv, step, err := domains.DomainGet(kv.StorageDomain, a, l)
+		require.NoError(t, err)
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, a, l, []byte{byte(txNum + 1)}, pv, step))
+
+		roots[txNum], err = domains.ComputeCommitment(ctx, true, domains.BlockNum(), "")
+		require.NoError(t, err)
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+
+	for txNum := uint64(0); txNum < maxTx; txNum++ {
+		for i := 0; i < addrs; i++ {
+			p, root, err := domains.AccountProofAsOf(addr(i), [][]byte{loc(0), loc(1), loc(2)}, txNum+1)
+			require.NoError(t, err)
+			require.Equal(t, roots[txNum], root, "txNum %d", txNum)
+			require.NoError(t, commitment.VerifyAccountProof(nil, root, p), "txNum %d, account %d", txNum, i)
+
+			enc, _, err := ac.d[kv.AccountsDomain].GetAsOf(addr(i), txNum+1, rwTx)
+			require.NoError(t, err)
+			if len(enc) == 0 {
+				require.Zero(t, p.Nonce)
+				continue
+			}
+			nonce, balance, _ := types.DecodeAccountBytesV3(enc)
+			require.Equal(t, nonce, p.Nonce)
+			require.Equal(t, balance.Uint64(), p.Balance.Uint64())
+			for j, sp := range p.StorageProof {
+				sv, _, err := ac.d[kv.StorageDomain].GetAsOf(append(addr(i), loc(j)...), txNum+1, rwTx)
+				require.NoError(t, err)
+				require.Equal(t, sv, sp.Value, "txNum %d, account %d, loc %d", txNum, i, j)
+			}
+		}
+	}
+
+	// latest state does not need history
+	agg.KeepCommitmentHistory(false)
+	_, root, err := domains.AccountProofAsOf(addr(0), nil, maxTx)
+	require.NoError(t, err)
+	require.Equal(t, roots[maxTx-1], root)
+	_, _, err = domains.AccountProofAsOf(addr(0), nil, maxTx/2)
+	require.ErrorIs(t, err, ErrCommitmentHistoryDisabled)
+}
+
+func TestSharedDomain_CommitmentReaderAsOf(t *testing.T) {
+	t.Parallel()
+
+	db, agg := testDbAndAggregatorv3(t, 10)
+	agg.KeepCommitmentHistory(true)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	// first tx creates accounts, second one updates few of them
+	for txNum := uint64(0); txNum < 2; txNum++ {
+		domains.SetTxNum(txNum)
+		for i := 0; i < 64; i++ {
+			if txNum > 0 && i%16 != 0 {
+				continue
+			}
+			a := crypto.Keccak256([]byte{byte(i)})[:length.Addr]
+			pv, step, err := domains.DomainGet(kv.AccountsDomain, a, nil)
+			require.NoError(t, err)
+			v := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum+1), nil, 0)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, a, nil, v, pv, step))
+		}
+		_, err = domains.ComputeCommitment(ctx, true, domains.BlockNum(), "")
+		require.NoError(t, err)
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+
+	before, err := domains.CommitmentReaderAsOf(1)
+	require.NoError(t, err)
+	defer before.Close()
+	latest, err := domains.CommitmentReaderAsOf(math.MaxUint64)
+	require.NoError(t, err)
+	defer latest.Close()
+
+	var accounts int
+	require.NoError(t, inspect.Walk(latest, nil, func(n *inspect.Node) error {
+		for _, c := range n.Cells {
+			if len(c.AccountAddr) > 0 {
+				accounts++
+			}
+		}
+		return nil
+	}))
+	require.Equal(t, 64, accounts)
+
+	var changed int
+	require.NoError(t, inspect.Diff(before, latest, nil, func(d *inspect.NodeDiff) error {
+		require.NotNil(t, d.Before)
+		require.NotNil(t, d.After)
+		changed++
+		return nil
+	}))
+	require.NotZero(t, changed)
+}
+
+func TestSharedDomain_Witness(t *testing.T) {
+	t.Parallel()
+
+	db, agg := testDbAndAggregatorv3(t, 16)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	addr := func(i int) []byte { a := make([]byte, length.Addr); a[0] = byte(i + 1); return a }
+	loc := func(i int) []byte { l := make([]byte, length.Hash); l[0] = byte(i + 1); return l }
+	storageKey := func(a, l int) []byte { return append(addr(a), loc(l)...) }
+	putAccount := func(i int, nonce, balance uint64) {
+		pv, step, err := domains.DomainGet(kv.AccountsDomain, addr(i), nil)
+		require.NoError(t, err)
+		v := types.EncodeAccountBytesV3(nonce, uint256.NewInt(balance), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(i), nil, v, pv, step))
+	}
+	putStorage := func(a, l int, v []byte) {
+		pv, step, err := domains.DomainGet(kv.StorageDomain, addr(a), loc(l))
+		require.NoError(t, err)
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr(a), loc(l), v, pv, step))
+	}
+	code := []byte{0x60, 0x00, 0x60, 0x00, 0xfd}
+
+	// block 1
+	domains.SetTxNum(1)
+	for i := 0; i < 10; i++ {
+		putAccount(i, 1, uint64(i+1))
+		for l := 0; l < 3; l++ {
+			putStorage(i, l, []byte{byte(i), byte(l)})
+		}
+	}
+	require.NoError(t, domains.DomainPut(kv.CodeDomain, addr(2), nil, code, nil, 0))
+	_, err = domains.ComputeCommitment(ctx, true, 1, "")
+	require.NoError(t, err)
+
+	// block 2 is recorded
+	w := commitment.NewWitness()
+	domains.SetWitness(w)
+	domains.SetBlockNum(2)
+	for txNum := uint64(2); txNum < 5; txNum++ {
+		domains.SetTxNum(txNum)
+		putAccount(int(txNum), txNum, 100)
+		putStorage(1, int(txNum), []byte{byte(txNum)})
+		putStorage(3, 0, []byte{0xaa, byte(txNum)})
+	}
+	putAccount(11, 1, 1)
+	require.NoError(t, domains.DomainDel(kv.StorageDomain, addr(5), loc(1), nil, 0))
+	require.NoError(t, domains.DomainDel(kv.AccountsDomain, addr(6), nil, nil, 0))
+	rootHash, err := domains.ComputeCommitment(ctx, true, 2, "")
+	require.NoError(t, err)
+	domains.SetWitness(nil)
+
+	// pre-state of touched keys
+	require.EqualValues(t, 1, w.Accounts[string(addr(2))].Nonce)
+	require.EqualValues(t, 3, w.Accounts[string(addr(2))].Balance.Uint64())
+	require.Equal(t, code, w.Code[string(addr(2))])
+	require.True(t, w.Accounts[string(addr(11))].Deleted())
+	require.Equal(t, []byte{3, 0}, w.Storage[string(storageKey(3, 0))].Storage[:2])
+	require.True(t, w.Storage[string(storageKey(1, 4))].Deleted())
+	require.Equal(t, []byte{5, 1}, w.Storage[string(storageKey(5, 1))].Storage[:2])
+	require.Contains(t, w.Storage, string(storageKey(6, 2)))
+
+	// post-state of touched keys
+	post := make(map[string]*commitment.Update)
+	for _, i := range []int{2, 3, 4, 6, 11} {
+		post[string(addr(i))], err = domains.sdCtx.Account(addr(i))
+		require.NoError(t, err)
+	}
+	for _, k := range [][]byte{storageKey(1, 2), storageKey(1, 3), storageKey(1, 4), storageKey(3, 0), storageKey(5, 1),
+		storageKey(6, 0), storageKey(6, 1), storageKey(6, 2)} {
+		post[string(k)], err = domains.sdCtx.Storage(k)
+		require.NoError(t, err)
+	}
+
+	decoded, err := commitment.DecodeWitness(w.Encode())
+	require.NoError(t, err)
+	statelessRoot, err := commitment.VerifyWitness(ctx, decoded, post, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, rootHash, statelessRoot)
+}
+
+func TestSharedDomain_ParallelCommitment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint32(a, uint32(i+1))
+		return a
+	}
+	loc := func(i int) []byte {
+		l := make([]byte, length.Hash)
+		binary.BigEndian.PutUint32(l, uint32(i+1))
+		return l
+	}
+
+	run := func(parallel bool) (roots [][]byte) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		domains.SetParallelCommitment(parallel)
+
+		for block := uint64(1); block <= 4; block++ {
+			domains.SetBlockNum(block)
+			domains.SetTxNum(block)
+			for i := 0; i < 200; i++ {
+				if i%int(block) != 0 {
+					continue
+				}
+				v := types.EncodeAccountBytesV3(block, uint256.NewInt(uint64(i)*block), nil, 0)
+				require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(i), nil, v, nil, 0))
+				if i%10 == 0 {
+					require.NoError(t, domains.DomainPut(kv.StorageDomain, addr(i), loc(int(block)), []byte{byte(i), byte(block)}, nil, 0))
+				}
+			}
+			if block == 4 {
+				for i := 0; i < 200; i += 7 {
+					require.NoError(t, domains.DomainDel(kv.AccountsDomain, addr(i), nil, nil, 0))
+				}
+			}
+			root, err := domains.ComputeCommitment(ctx, true, block, "")
+			require.NoError(t, err)
+			roots = append(roots, root)
+		}
+		return roots
+	}
+	require.Equal(t, run(false), run(true))
+}
+
+func TestSharedDomain_VerifyCommitment(t *testing.T) {
+	t.Parallel()
+
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.KeepCommitmentHistory(true)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint32(a, uint32(i+1))
+		return a
+	}
+	putAccount := func(i int, nonce, balance uint64) {
+		pv, step, err := domains.DomainGet(kv.AccountsDomain, addr(i), nil)
+		require.NoError(t, err)
+		v := types.EncodeAccountBytesV3(nonce, uint256.NewInt(balance), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(i), nil, v, pv, step))
+	}
+
+	// block 1 creates accounts, block 2 updates some of them and deletes one
+	var roots [][]byte
+	for block := uint64(1); block <= 2; block++ {
+		domains.SetBlockNum(block)
+		domains.SetTxNum(block)
+		for i := 0; i < 100; i++ {
+			if block == 2 && i%3 != 0 {
+				continue
+			}
+			putAccount(i, block, uint64(i+1)*block)
+			if i%10 == 0 {
+				for l := byte(0); l < 3; l++ {
+					loc := make([]byte, length.Hash)
+					loc[0] = l + 1
+					require.NoError(t, domains.DomainPut(kv.StorageDomain, addr(i), loc, []byte{byte(i), l, byte(block)}, nil, 0))
+				}
+			}
+		}
+		if block == 2 {
+			require.NoError(t, domains.DomainDel(kv.AccountsDomain, addr(7), nil, nil, 0))
+		}
+		root, err := domains.ComputeCommitment(ctx, true, block, "")
+		require.NoError(t, err)
+		roots = append(roots, root)
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+
+	res, err := domains.VerifyCommitment(ctx, math.MaxUint64, "")
+	require.NoError(t, err)
+	require.True(t, res.Match())
+	require.Equal(t, roots[1], res.ComputedRoot)
+	require.EqualValues(t, 2, res.TxNum)
+	require.EqualValues(t, 99+30, res.Keys)
+	require.Zero(t, res.Mismatches)
+	require.Nil(t, res.DivergentPrefix)
+
+	// state as of txNum=2 is the state after block 1
+	res, err = domains.VerifyCommitment(ctx, 2, "")
+	require.NoError(t, err)
+	require.True(t, res.Match())
+	require.Equal(t, roots[0], res.StoredRoot)
+	require.EqualValues(t, 1, res.TxNum)
+	require.EqualValues(t, 100+30, res.Keys)
+	require.Zero(t, res.Mismatches)
+
+	// account is changed behind commitment's back
+	pv, step, err := domains.DomainGet(kv.AccountsDomain, addr(4), nil)
+	require.NoError(t, err)
+	w := ac.d[kv.AccountsDomain].NewWriter()
+	defer w.close()
+	w.SetTxNum(2)
+	require.NoError(t, w.PutWithPrev(addr(4), nil, types.EncodeAccountBytesV3(1, uint256.NewInt(12345), nil, 0), pv, step))
+	require.NoError(t, w.Flush(ctx, rwTx))
+
+	res, err = domains.VerifyCommitment(ctx, math.MaxUint64, "")
+	require.NoError(t, err)
+	require.False(t, res.Match())
+	require.Equal(t, roots[1], res.StoredRoot)
+	require.NotZero(t, res.Mismatches)
+	require.NotEmpty(t, res.DivergentPrefix)
+
+	hashedKey := crypto.Keccak256(addr(4))
+	nibbles := make([]byte, 0, 2*len(hashedKey))
+	for _, b := range hashedKey {
+		nibbles = append(nibbles, b>>4, b&0xf)
+	}
+	require.True(t, bytes.HasPrefix(nibbles, res.DivergentPrefix), "divergent prefix %x, key %x", res.DivergentPrefix, nibbles)
+}
+
+func TestSharedDomain_StorageRootAsOf(t *testing.T) {
+	t.Parallel()
+
+	db, agg := testDbAndAggregatorv3(t, 16)
+	agg.KeepCommitmentHistory(true)
+	ctx := context.Background()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	tx := WrapTxWithCtx(rwTx, ac)
+	domains, err := NewSharedDomains(tx, log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint32(a, uint32(i+1))
+		return a
+	}
+	loc := func(i int) []byte {
+		l := make([]byte, length.Hash)
+		binary.BigEndian.PutUint32(l, uint32(i+1))
+		return l
+	}
+	putStorage := func(a, l int, v []byte) {
+		pv, step, err := domains.DomainGet(kv.StorageDomain, addr(a), loc(l))
+		require.NoError(t, err)
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr(a), loc(l), v, pv, step))
+	}
+
+	// each block has 2 transactions, commitment is computed at the end of the block
+	maxTx := uint64(12)
+	for txNum := uint64(1); txNum <= maxTx; txNum++ {
+		domains.SetTxNum(txNum)
+		domains.SetBlockNum(txNum / 2)
+		if txNum == 1 {
+			for i := 0; i < 20; i++ {
+				v := types.EncodeAccountBytesV3(1, uint256.NewInt(uint64(i+1)), nil, 0)
+				require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(i), nil, v, nil, 0))
+			}
+			for l := 0; l < 40; l++ {
+				putStorage(3, l, []byte{byte(l + 1)})
+			}
+			putStorage(5, 0, []byte{1})
+		}
+		putStorage(3, int(txNum)%40, []byte{0xff, byte(txNum)})
+		putStorage(5, int(txNum)%3, []byte{byte(txNum)})
+		if txNum%3 == 0 {
+			require.NoError(t, domains.DomainDel(kv.StorageDomain, addr(3), loc(int(txNum)+10), nil, 0))
+		}
+		if txNum%2 == 1 {
+			_, err = domains.ComputeCommitment(ctx, true, domains.BlockNum(), "")
+			require.NoError(t, err)
+			require.NoError(t, rawdbv3.TxNums.Append(rwTx, domains.BlockNum(), txNum))
+		}
+	}
+	require.NoError(t, rawdbv3.TxNums.Append(rwTx, domains.BlockNum(), maxTx+1))
+	require.NoError(t, domains.Flush(ctx, rwTx))
+
+	check := func(txNum uint64) {
+		sd, err := NewSharedDomains(tx, log.New())
+		require.NoError(t, err)
+		defer sd.Close()
+		for _, a := range []int{3, 5, 7} {
+			root, err := StorageRootAsOf(ctx, tx, addr(a), txNum)
+			require.NoError(t, err)
+			fromScratch, err := sd.storageRootAsOf(ctx, tx, addr(a), txNum, false)
+			require.NoError(t, err)
+			require.Equal(t, fromScratch, root, "account %d txNum %d", a, txNum)
+			if a == 7 {
+				require.Equal(t, commitment.EmptyRootHash, root)
+			}
+			if txNum > 1 && txNum%2 == 0 && txNum <= maxTx+1 { // right after commitment computation
+				proof, _, err := domains.AccountProofAsOf(addr(a), nil, txNum)
+				require.NoError(t, err)
+				require.Equal(t, proof.StorageHash[:], root, "account %d txNum %d", a, txNum)
+			}
+		}
+	}
+	for txNum := uint64(1); txNum <= maxTx+1; txNum++ {
+		check(txNum)
+	}
+	check(math.MaxUint64)
+
+	// storage is changed after the last commitment computation
+	pv, step, err := domains.DomainGet(kv.StorageDomain, addr(3), loc(0))
+	require.NoError(t, err)
+	w := ac.d[kv.StorageDomain].NewWriter()
+	defer w.close()
+	w.SetTxNum(maxTx + 1)
+	require.NoError(t, w.PutWithPrev(addr(3), loc(0), []byte{0xee}, pv, step))
+	require.NoError(t, w.Flush(ctx, rwTx))
+
+	before, err := StorageRootAsOf(ctx, tx, addr(3), maxTx+1)
+	require.NoError(t, err)
+	after, err := StorageRootAsOf(ctx, tx, addr(3), math.MaxUint64)
+	require.NoError(t, err)
+	require.NotEqual(t, before, after)
+	check(maxTx + 2)
+	check(math.MaxUint64)
+}
+
+func TestSharedDomain_VerkleCommitment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	addr := func(i int) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint32(a, uint32(i+1))
+		return a
+	}
+	loc := func(l int) []byte {
+		b := make([]byte, length.Hash)
+		binary.BigEndian.PutUint16(b[length.Hash-2:], uint16(l))
+		return b
+	}
+	put := func(domains *SharedDomains, d kv.Domain, k1, k2, v []byte) {
+		pv, step, err := domains.DomainGet(d, k1, k2)
+		require.NoError(t, err)
+		require.NoError(t, domains.DomainPut(d, k1, k2, v, pv, step))
+	}
+	// blocks create accounts with storage and code, update and delete some of them
+	applyBlock := func(domains *SharedDomains, block int) {
+		for i := 0; i < 30; i++ {
+			if block > 1 && i%3 != 0 {
+				continue
+			}
+			put(domains, kv.AccountsDomain, addr(i), nil, types.EncodeAccountBytesV3(uint64(block), uint256.NewInt(uint64(i*block+1)), nil, 0))
+			if i%5 == 0 {
+				for l := 0; l < 3; l++ {
+					put(domains, kv.StorageDomain, addr(i), loc(l*100), []byte{byte(i), byte(l), byte(block)})
+				}
+			}
+			if i%7 == 0 {
+				put(domains, kv.CodeDomain, addr(i), nil, bytes.Repeat([]byte{0x5b, byte(block)}, 40*(i+block)))
+			}
+		}
+		if block == 2 {
+			require.NoError(t, domains.DomainDel(kv.AccountsDomain, addr(10), nil, nil, 0))
+		}
+	}
+
+	computeRoots := func(variant commitment.TrieVariant, commitEveryBlock bool) (roots [][]byte) {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		agg.SetCommitmentVariant(variant)
+
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+
+		for block := 1; block <= 3; block++ {
+			domains.SetBlockNum(uint64(block))
+			domains.SetTxNum(uint64(block))
+			applyBlock(domains, block)
+			require.NoError(t, rawdbv3.TxNums.Append(rwTx, uint64(block), uint64(block)))
+			if commitEveryBlock || block == 3 {
+				root, err := domains.ComputeCommitment(ctx, true, uint64(block), "")
+				require.NoError(t, err)
+				roots = append(roots, root)
+			}
+		}
+		require.NoError(t, domains.Flush(ctx, rwTx))
+
+		// commitment state is restored by new SharedDomains
+		restored, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer restored.Close()
+		require.EqualValues(t, 3, restored.BlockNum())
+		root, err := restored.ComputeCommitment(ctx, false, 3, "")
+		require.NoError(t, err)
+		require.Equal(t, roots[len(roots)-1], root)
+		return roots
+	}
+
+	verkle := computeRoots(commitment.VariantVerkleTrie, true)
+	require.Len(t, verkle, 3)
+	require.NotEqual(t, verkle[0], verkle[1])
+	require.NotEqual(t, verkle[1], verkle[2])
+
+	// root depends only on the state, not on how updates were batched
+	require.Equal(t, verkle[2], computeRoots(commitment.VariantVerkleTrie, false)[0])
+
+	hex := computeRoots(commitment.VariantHexPatriciaTrie, false)
+	require.Len(t, hex[0], length.Hash)
+	require.NotEqual(t, hex[0], verkle[2])
+}
+
+func TestSharedDomain_CommitmentHasher(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	computeRoot := func(hasher commitment.Hasher) []byte {
+		db, agg := testDbAndAggregatorv3(t, 16)
+		agg.SetCommitmentHasher(hasher)
+
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+
+		domains.SetBlockNum(1)
+		domains.SetTxNum(1)
+		for i := 0; i < 20; i++ {
+			addr := crypto.Keccak256([]byte{byte(i)})[:length.Addr]
+			v := types.EncodeAccountBytesV3(uint64(i), uint256.NewInt(uint64(i+1)), nil, 0)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr, nil, v, nil, 0))
+			require.NoError(t, domains.DomainPut(kv.StorageDomain, addr, make([]byte, length.Hash), []byte{byte(i + 1)}, nil, 0))
+		}
+		require.NoError(t, rawdbv3.TxNums.Append(rwTx, 1, 1))
+		root, err := domains.ComputeCommitment(ctx, true, 1, "")
+		require.NoError(t, err)
+		require.NoError(t, domains.Flush(ctx, rwTx))
+
+		// restored commitment state continues with the same hasher
+		restored, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer restored.Close()
+		restoredRoot, err := restored.ComputeCommitment(ctx, false, 1, "")
+		require.NoError(t, err)
+		require.Equal(t, root, restoredRoot)
+		return root
+	}
+
+	keccakRoot := computeRoot(commitment.KeccakHasher)
+	poseidonRoot := computeRoot(commitment.PoseidonHasher)
+	require.Len(t, poseidonRoot, length.Hash)
+	require.NotEqual(t, keccakRoot, poseidonRoot)
+}
@@ -0,0 +1,490 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	btree2 "github.com/tidwall/btree"
+
+	"github.com/Tangui-Bitfly/erigon-lib/etl"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+// Deep unwind - unwind without diffsets (they are stored only for last `config3.MaxReorgDepthV3` blocks).
+// Domain values are reconstructed from history: for each key changed in [truncateTo, txUnwindTo) - value as of `txUnwindTo`.
+// Files which have data after `truncateTo` are deleted, their data before `txUnwindTo` is restored into DB:
+//   - domain values - at step of last change of key
+//   - history and inverted indices - as is
+//
+// Commitment has no history: it's recalculated from last commitment state in files.
+// Background build/merge of files can't run at same time.
+//
+// All DB changes happen inside of `rwTx`, so files are only detached by it (not visible for new readers) and stay
+// on disk until `rwTx` commit: `Aggregator.DeepUnwindCommitted` removes them, `Aggregator.DeepUnwindRolledBack`
+// makes them visible again. Build/merge of files stays blocked until one of them is called - so deep unwind
+// is available only for DeepUnwindTx.
+
+var ErrDeepUnwindBusy = errors.New("deep unwind: files build or merge in progress")
+
+// DeepUnwindTx - RwTx which can own deep unwind (temporal.Tx). `DeepUnwound` is called after files are detached:
+// tx must re-open its files view (it still sees detached files), call `Aggregator.DeepUnwindCommitted` after commit
+// and `Aggregator.DeepUnwindRolledBack` after rollback.
+type DeepUnwindTx interface {
+	kv.RwTx
+	DeepUnwound()
+}
+
+// CanDeepUnwindTo - returns txNum to which files will be truncated to unwind to `txNum`,
+// `ok=false` if history needed to reconstruct domain values from `truncateTo` is not available anymore.
+func (ac *AggregatorRoTx) CanDeepUnwindTo(tx kv.Tx, txNum uint64) (truncateTo uint64, ok bool) {
+	ac.a.dirtyFilesLock.Lock()
+	truncateTo = ac.deepUnwindTruncateTo(txNum)
+	ac.a.dirtyFilesLock.Unlock()
+	return truncateTo, ac.historyAvailableFrom(tx, truncateTo) == nil
+}
+
+// deepUnwindTruncateTo - nearest txNum <= `txNum` which is step-aligned and not inside any file
+func (ac *AggregatorRoTx) deepUnwindTruncateTo(txNum uint64) uint64 {
+	truncateTo := txNum / ac.a.StepSize() * ac.a.StepSize()
+	for changed := true; changed; {
+		changed = false
+		for _, dirtyFiles := range ac.a.allDirtyFiles() {
+			dirtyFiles.Walk(func(items []*filesItem) bool {
+				for _, item := range items {
+					if item.startTxNum < truncateTo && item.endTxNum > truncateTo {
+						truncateTo, changed = item.startTxNum, true
+					}
+				}
+				return true
+			})
+		}
+	}
+	return truncateTo
+}
+
+// deepUnwoundFile - file detached by deep unwind, waiting for commit or rollback of RwTx which did unwind
+type deepUnwoundFile struct {
+	dirtyFiles *btree2.BTreeG[*filesItem]
+	item       *filesItem
+}
+
+// DeepUnwindCommitted - must be called after commit of RwTx which did deep unwind: removes files detached by it
+func (a *Aggregator) DeepUnwindCommitted() {
+	a.dirtyFilesLock.Lock()
+	unwound := a.deepUnwound
+	a.deepUnwound = nil
+	a.dirtyFilesLock.Unlock()
+	if len(unwound) == 0 {
+		return
+	}
+	for _, f := range unwound {
+		// new files with same name will be built soon - so don't wait for last reader to remove file
+		retireFile(f.item, a.logger)
+	}
+	a.logger.Info("[snapshots] deep unwind: deleted files", "count", len(unwound))
+	a.mergingFiles.Store(false)
+	a.buildingFiles.Store(false)
+}
+
+// DeepUnwindRolledBack - must be called after rollback of RwTx which did deep unwind: files detached by it are visible again
+func (a *Aggregator) DeepUnwindRolledBack() {
+	a.dirtyFilesLock.Lock()
+	unwound := a.deepUnwound
+	a.deepUnwound = nil
+	for _, f := range unwound {
+		f.dirtyFiles.Set(f.item)
+	}
+	a.dirtyFilesLock.Unlock()
+	if len(unwound) == 0 {
+		return
+	}
+	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
+	a.logger.Info("[snapshots] deep unwind: rolled back, files restored", "count", len(unwound))
+	a.mergingFiles.Store(false)
+	a.buildingFiles.Store(false)
+}
+
+func (a *Aggregator) allDirtyFiles() (res []*btree2.BTreeG[*filesItem]) {
+	for _, d := range a.d {
+		res = append(res, d.dirtyFiles, d.History.dirtyFiles, d.History.InvertedIndex.dirtyFiles)
+	}
+	for _, ii := range a.iis {
+		res = append(res, ii.dirtyFiles)
+	}
+	return res
+}
+
+func (ac *AggregatorRoTx) historyAvailableFrom(tx kv.Tx, txNum uint64) error {
+	for id, dt := range ac.d {
+		if kv.Domain(id) == kv.CommitmentDomain {
+			continue
+		}
+		if dt.d.historyDisabled {
+			return fmt.Errorf("deep unwind: %s has no history", dt.d.filenameBase)
+		}
+		iit := dt.ht.iit
+		if len(iit.files) > 0 {
+			if iit.files[0].startTxNum > txNum {
+				return fmt.Errorf("deep unwind: %s history starts at txNum=%d, need %d: %w", dt.d.filenameBase, iit.files[0].startTxNum, txNum, ErrHistoryPruned)
+			}
+			continue
+		}
+		if minTxNum := iit.ii.minTxNumInDB(tx); minTxNum != math.MaxUint64 && minTxNum > txNum {
+			return fmt.Errorf("deep unwind: %s history starts at txNum=%d, need %d: %w", dt.d.filenameBase, minTxNum, txNum, ErrHistoryPruned)
+		}
+	}
+	return nil
+}
+
+// deepUnwind - restores DB to state as of `txUnwindTo` (except commitment - caller must recalc it) and detaches files
+// after `truncateTo`. One deep unwind per RwTx: until its commit or rollback, next one returns ErrDeepUnwindBusy.
+// `ac` is not usable for reads after this method: it still sees detached files.
+func (ac *AggregatorRoTx) deepUnwind(ctx context.Context, rwTx kv.RwTx, txUnwindTo uint64, logEvery *time.Ticker) (truncateTo uint64, err error) {
+	a := ac.a
+	if a.follower {
+		return 0, ErrFollowerAggregator
+	}
+	if !a.buildingFiles.CompareAndSwap(false, true) {
+		return 0, ErrDeepUnwindBusy
+	}
+	if !a.mergingFiles.CompareAndSwap(false, true) {
+		a.buildingFiles.Store(false)
+		return 0, ErrDeepUnwindBusy
+	}
+	var detached int
+	defer func() {
+		if detached > 0 { // released by DeepUnwindCommitted or DeepUnwindRolledBack
+			return
+		}
+		a.mergingFiles.Store(false)
+		a.buildingFiles.Store(false)
+	}()
+
+	a.dirtyFilesLock.Lock()
+	truncateTo = ac.deepUnwindTruncateTo(txUnwindTo)
+	a.dirtyFilesLock.Unlock()
+	if err := ac.historyAvailableFrom(rwTx, truncateTo); err != nil {
+		return 0, err
+	}
+	a.logger.Info("[snapshots] deep unwind", "txUnwindTo", txUnwindTo, "truncateFilesTo", truncateTo,
+		"fromStep", truncateTo/a.StepSize(), "stepsRangeInDB", a.StepsRangeInDBAsStr(rwTx))
+
+	// 1. collect restored data. must be done before any file or DB modification
+	var flushers []flusher
+	var closers []func()
+	defer func() {
+		for _, closeFn := range closers {
+			closeFn()
+		}
+	}()
+	for id, dt := range ac.d {
+		if kv.Domain(id) == kv.CommitmentDomain {
+			continue
+		}
+		w := dt.NewWriter()
+		closers = append(closers, w.close)
+		if err := dt.collectDeepUnwind(ctx, rwTx, w, truncateTo, txUnwindTo, logEvery); err != nil {
+			return 0, err
+		}
+		flushers = append(flushers, w)
+	}
+	for _, iit := range ac.iis {
+		w := iit.NewWriter()
+		closers = append(closers, w.close)
+		if err := iit.collectDeepUnwind(ctx, rwTx, w, truncateTo, txUnwindTo, logEvery); err != nil {
+			return 0, err
+		}
+		flushers = append(flushers, w)
+	}
+
+	// 2. remove from DB everything after unwind point
+	for id, dt := range ac.d {
+		pruneFrom := txUnwindTo
+		if kv.Domain(id) == kv.CommitmentDomain {
+			pruneFrom = truncateTo
+		}
+		if err := dt.deleteValsFromStep(ctx, rwTx, truncateTo/a.StepSize()); err != nil {
+			return 0, err
+		}
+		if _, err := dt.ht.Prune(ctx, rwTx, pruneFrom, math.MaxUint64, math.MaxUint64, true, logEvery); err != nil {
+			return 0, fmt.Errorf("[domain][%s] deep unwind, prune history to txNum=%d: %w", dt.d.filenameBase, pruneFrom, err)
+		}
+	}
+	for _, iit := range ac.iis {
+		if err := iit.Unwind(ctx, rwTx, txUnwindTo, math.MaxUint64, math.MaxUint64, logEvery, true, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	// 3. write restored data
+	for _, f := range flushers {
+		if err := f.Flush(ctx, rwTx); err != nil {
+			return 0, err
+		}
+	}
+
+	// 4. detach files: must be last step - nothing can fail after it
+	a.dirtyFilesLock.Lock()
+	for _, dirtyFiles := range a.allDirtyFiles() {
+		var outs []*filesItem
+		dirtyFiles.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.endTxNum > truncateTo {
+					outs = append(outs, item)
+				}
+			}
+			return true
+		})
+		for _, out := range outs {
+			dirtyFiles.Delete(out)
+			a.deepUnwound = append(a.deepUnwound, deepUnwoundFile{dirtyFiles: dirtyFiles, item: out})
+		}
+		detached += len(outs)
+	}
+	a.dirtyFilesLock.Unlock()
+	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
+	a.logger.Info("[snapshots] deep unwind: detached files, will delete them after commit", "count", detached)
+	return truncateTo, nil
+}
+
+// collectDeepUnwind - for keys changed in [fromTxNum, toTxNum): history entries and value as of `toTxNum` at step of last change
+func (dt *DomainRoTx) collectDeepUnwind(ctx context.Context, roTx kv.Tx, w *domainBufferedWriter, fromTxNum, toTxNum uint64, logEvery *time.Ticker) error {
+	it := dt.ht.iit.IterateChangedKeys(fromTxNum, toTxNum, roTx)
+	defer it.Close()
+	var keys int
+	var k []byte
+	for it.HasNext() {
+		k = it.Next(k[:0])
+		txNums, err := dt.ht.iit.IdxRange(k, int(fromTxNum), int(toTxNum), order.Asc, -1, roTx)
+		if err != nil {
+			return err
+		}
+		// value replaced at `txNum` was written by previous change of key
+		prevStep, err := dt.ht.iit.stepOfChangeBefore(k, fromTxNum, roTx)
+		if err != nil {
+			txNums.Close()
+			return err
+		}
+		var last uint64
+		var changed bool
+		for txNums.HasNext() {
+			txNum, err := txNums.Next()
+			if err != nil {
+				txNums.Close()
+				return err
+			}
+			prev, _, err := dt.ht.HistorySeek(k, txNum, roTx)
+			if err != nil {
+				txNums.Close()
+				return err
+			}
+			w.SetTxNum(txNum)
+			if err := w.h.AddPrevValue(k, nil, prev, prevStep); err != nil {
+				txNums.Close()
+				return err
+			}
+			last, changed = txNum, true
+			prevStep = txNum / dt.d.aggregationStep
+		}
+		txNums.Close()
+		if !changed {
+			continue
+		}
+		v, _, err := dt.GetAsOf(k, toTxNum, roTx)
+		if err != nil {
+			return err
+		}
+		w.SetTxNum(last)
+		if err := w.addValue(k, nil, v); err != nil {
+			return err
+		}
+
+		keys++
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			dt.d.logger.Info("[snapshots] deep unwind: restore", "name", dt.d.filenameBase, "keys", keys, "key", fmt.Sprintf("%x", k))
+		default:
+		}
+	}
+	return nil
+}
+
+// stepOfChangeBefore - step of last change of `k` before `txNum`. 0 if key was not changed before
+func (iit *InvertedIndexRoTx) stepOfChangeBefore(k []byte, txNum uint64, roTx kv.Tx) (uint64, error) {
+	if txNum == 0 {
+		return 0, nil
+	}
+	it, err := iit.IdxRange(k, int(txNum)-1, -1, order.Desc, 1, roTx)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	if !it.HasNext() {
+		return 0, nil
+	}
+	prevTxNum, err := it.Next()
+	if err != nil {
+		return 0, err
+	}
+	return prevTxNum / iit.ii.aggregationStep, nil
+}
+
+// collectDeepUnwind - index entries in [fromTxNum, toTxNum)
+func (iit *InvertedIndexRoTx) collectDeepUnwind(ctx context.Context, roTx kv.Tx, w *invertedIndexBufferedWriter, fromTxNum, toTxNum uint64, logEvery *time.Ticker) error {
+	it := iit.IterateChangedKeys(fromTxNum, toTxNum, roTx)
+	defer it.Close()
+	var keys int
+	var k []byte
+	for it.HasNext() {
+		k = it.Next(k[:0])
+		txNums, err := iit.IdxRange(k, int(fromTxNum), int(toTxNum), order.Asc, -1, roTx)
+		if err != nil {
+			return err
+		}
+		for txNums.HasNext() {
+			txNum, err := txNums.Next()
+			if err != nil {
+				txNums.Close()
+				return err
+			}
+			w.SetTxNum(txNum)
+			if err := w.Add(k); err != nil {
+				txNums.Close()
+				return err
+			}
+		}
+		txNums.Close()
+
+		keys++
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			iit.ii.logger.Info("[snapshots] deep unwind: restore", "name", iit.ii.filenameBase, "keys", keys, "key", fmt.Sprintf("%x", k))
+		default:
+		}
+	}
+	return nil
+}
+
+// deleteValsFromStep - removes from DB values written at step >= `fromStep`
+func (dt *DomainRoTx) deleteValsFromStep(ctx context.Context, rwTx kv.RwTx, fromStep uint64) error {
+	collector := etl.NewCollector(dt.name.String()+".domain.unwind", dt.d.dirs.Tmp, etl.NewSortableBuffer(etl.BufferOptimalSize), dt.d.logger).LogLvl(log.LvlTrace)
+	defer collector.Close()
+
+	c, err := rwTx.Cursor(dt.d.valsTable)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		stepBytes := v
+		if dt.d.largeVals {
+			stepBytes = k[len(k)-8:]
+		}
+		if ^binary.BigEndian.Uint64(stepBytes[:8]) < fromStep {
+			continue
+		}
+		if err := collector.Collect(k, v); err != nil {
+			return err
+		}
+	}
+	c.Close()
+
+	if dt.d.largeVals {
+		return collector.Load(rwTx, dt.d.valsTable, func(k, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+			return rwTx.Delete(dt.d.valsTable, k)
+		}, etl.TransformArgs{Quit: ctx.Done()})
+	}
+	valsCursor, err := rwTx.RwCursorDupSort(dt.d.valsTable)
+	if err != nil {
+		return err
+	}
+	defer valsCursor.Close()
+	return collector.Load(rwTx, dt.d.valsTable, func(k, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+		return valsCursor.DeleteExact(k, v)
+	}, etl.TransformArgs{Quit: ctx.Done()})
+}
+
+// DeepUnwind - unwind to any txNum covered by history, see `AggregatorRoTx.CanDeepUnwindTo`. Unlike Unwind it doesn't
+// need diffsets and works below frozen files: files after unwind point are detached by `rwTx` and removed after its commit.
+// After it SharedDomains use own AggregatorRoTx.
+func (sd *SharedDomains) DeepUnwind(ctx context.Context, rwTx DeepUnwindTx, blockUnwindTo, txUnwindTo uint64) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	sf := time.Now()
+	defer mxUnwindSharedTook.ObserveDuration(sf)
+
+	if err := sd.Flush(ctx, rwTx); err != nil {
+		return err
+	}
+	if err := sd.deepUnwind(ctx, rwTx, blockUnwindTo, txUnwindTo, logEvery); err != nil {
+		return err
+	}
+	sd.SetTxNum(txUnwindTo)
+	sd.SetBlockNum(blockUnwindTo)
+	return sd.Flush(ctx, rwTx)
+}
+
+func (sd *SharedDomains) deepUnwind(ctx context.Context, rwTx DeepUnwindTx, blockUnwindTo, txUnwindTo uint64, logEvery *time.Ticker) error {
+	truncateTo, err := sd.aggTx.deepUnwind(ctx, rwTx, txUnwindTo, logEvery)
+	if err != nil {
+		return err
+	}
+
+	if sd.ownAggTx != nil {
+		sd.ownAggTx.Close()
+	}
+	sd.ownAggTx = sd.aggTx.a.BeginFilesRo()
+	sd.aggTx = sd.ownAggTx
+	rwTx.DeepUnwound()
+
+	// commitment: continue from last state in files and touch everything changed after it
+	sd.ClearRam(true)
+	sd.sdCtx.ResetBranchCache()
+	_, fromTxNum, _, err := sd.sdCtx.SeekCommitment(rwTx, sd.aggTx.d[kv.CommitmentDomain], 0, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	sd.logger.Info("[snapshots] deep unwind: recalc commitment", "fromTxNum", fromTxNum, "toTxNum", txUnwindTo, "truncatedTo", truncateTo)
+	if txUnwindTo == 0 {
+		return nil
+	}
+	if err := sd.touchChangedKeys(rwTx, fromTxNum); err != nil {
+		return err
+	}
+	sd.sdCtx.Reset()
+	sd.SetTxNum(txUnwindTo - 1)
+	sd.SetBlockNum(blockUnwindTo)
+	if _, err := sd.ComputeCommitment(ctx, true, blockUnwindTo, "deep unwind"); err != nil {
+		return err
+	}
+	return nil
+}
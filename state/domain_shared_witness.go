@@ -0,0 +1,83 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+// SetWitness enables witness recording mode: until SetWitness(nil), w collects pre-state of accounts, storage and code
+// updated through SharedDomains and everything commitment computation reads (see commitment.Witness).
+// Usually set at the beginning of the block, so post-state root of the block can be recomputed from witness and
+// block updates by commitment.VerifyWitness.
+func (sd *SharedDomains) SetWitness(w *commitment.Witness) {
+	sd.sdCtx.SetWitness(w)
+}
+
+func (sdc *SharedDomainsCommitmentContext) SetWitness(w *commitment.Witness) {
+	sdc.witness = w
+	if hph, ok := sdc.patriciaTrie.(*commitment.HexPatriciaHashed); ok {
+		hph.SetWitness(w)
+	}
+}
+
+// recordPreState puts into witness value of the key before its first update since recording started
+func (sdc *SharedDomainsCommitmentContext) recordPreState(d kv.Domain, key string, prev []byte) error {
+	w := sdc.witness
+	if w == nil {
+		return nil
+	}
+	switch d {
+	case kv.AccountsDomain:
+		if _, ok := w.Accounts[key]; ok {
+			return nil
+		}
+		u := accountUpdate(prev)
+		if len(prev) == 0 {
+			u.Flags = commitment.DeleteUpdate
+		}
+		w.Accounts[key] = u
+		if _, ok := w.Code[key]; ok {
+			return nil
+		}
+		// code is not updated yet, otherwise it would be already recorded
+		code, _, err := sdc.sharedDomains.DomainGet(kv.CodeDomain, []byte(key), nil)
+		if err != nil {
+			return err
+		}
+		w.Code[key] = common.Copy(code)
+	case kv.StorageDomain:
+		if _, ok := w.Storage[key]; ok {
+			return nil
+		}
+		u := new(commitment.Update)
+		if len(prev) == 0 {
+			u.Flags = commitment.DeleteUpdate
+		} else {
+			u.Flags = commitment.StorageUpdate
+			u.StorageLen = copy(u.Storage[:], prev)
+		}
+		w.Storage[key] = u
+	case kv.CodeDomain:
+		if _, ok := w.Code[key]; !ok {
+			w.Code[key] = common.Copy(prev)
+		}
+	}
+	return nil
+}
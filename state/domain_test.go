@@ -1456,6 +1456,108 @@ func TestDomain_GetAfterAggregation(t *testing.T) {
 	}
 }
 
+func TestDomain_DomainDiff(t *testing.T) {
+	db, d := testDbAndDomainOfStep(t, 25, log.New())
+	require := require.New(t)
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(err)
+	defer tx.Rollback()
+
+	d.historyLargeValues = false
+	d.History.compression = seg.CompressKeys | seg.CompressVals
+	d.compression = seg.CompressKeys | seg.CompressVals
+
+	dc := d.BeginFilesRo()
+	defer d.Close()
+	writer := dc.NewWriter()
+	defer writer.close()
+
+	totalTx := uint64(1000)
+	data := generateTestData(t, length.Addr, length.Addr+length.Hash, totalTx, 50, 100)
+	for key, updates := range data {
+		p := []byte{}
+		for i := 0; i < len(updates); i++ {
+			writer.SetTxNum(updates[i].txNum)
+			writer.PutWithPrev([]byte(key), nil, updates[i].value, p, 0)
+			p = common.Copy(updates[i].value)
+		}
+	}
+	writer.SetTxNum(totalTx)
+	require.NoError(writer.Flush(context.Background(), tx))
+
+	collateAndMerge(t, db, tx, d, totalTx)
+	dc.Close()
+
+	dc = d.BeginFilesRo()
+	defer dc.Close()
+
+	valueAsOf := func(updates []upd, txNum uint64) []byte {
+		var v []byte
+		for _, u := range updates {
+			if u.txNum >= txNum {
+				break
+			}
+			v = u.value
+		}
+		return v
+	}
+
+	for _, rng := range [][2]uint64{{0, 100}, {310, 650}, {600, 990}, {970, totalTx}} {
+		from, to := rng[0], rng[1]
+		expected := map[string][2][]byte{}
+		for key, updates := range data {
+			before, after := valueAsOf(updates, from), valueAsOf(updates, to)
+			if !bytes.Equal(before, after) {
+				expected[key] = [2][]byte{before, after}
+			}
+		}
+
+		it, err := dc.DomainDiff(nil, from, to, -1, tx)
+		require.NoError(err)
+		var prevK []byte
+		var allKeys [][]byte
+		cnt := 0
+		for it.HasNext() {
+			k, before, after, err := it.Next()
+			require.NoError(err)
+			require.Negativef(bytes.Compare(prevK, k), "keys must be sorted: %x >= %x", prevK, k)
+			prevK = common.Copy(k)
+			allKeys = append(allKeys, prevK)
+
+			exp, ok := expected[string(k)]
+			require.Truef(ok, "unexpected key %x in diff [%d, %d)", k, from, to)
+			require.EqualValuesf(exp[0], before, "before: key %x, range [%d, %d)", k, from, to)
+			require.EqualValuesf(exp[1], after, "after: key %x, range [%d, %d)", k, from, to)
+			cnt++
+		}
+		it.Close()
+		require.Equalf(len(expected), cnt, "range [%d, %d)", from, to)
+
+		it, err = dc.DomainDiff(nil, from, to, 3, tx)
+		require.NoError(err)
+		keys, _, _, err := stream.ToArrayKVV(it)
+		require.NoError(err)
+		require.Len(keys, min(3, len(expected)))
+
+		// continue from key: keys before it are skipped
+		if len(allKeys) == 0 {
+			continue
+		}
+		mid := len(allKeys) / 2
+		it, err = dc.DomainDiff(allKeys[mid], from, to, -1, tx)
+		require.NoError(err)
+		cnt = 0
+		for ; it.HasNext(); cnt++ {
+			k, _, _, err := it.Next()
+			require.NoError(err)
+			require.Equal(allKeys[mid+cnt], k)
+		}
+		it.Close()
+		require.Equal(len(allKeys)-mid, cnt)
+	}
+}
+
 func TestDomain_CanPruneAfterAggregation(t *testing.T) {
 	t.Parallel()
 
@@ -17,8 +17,11 @@
 package state
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -28,8 +31,50 @@ import (
 	bloomfilter "github.com/holiman/bloomfilter/v2"
 )
 
+// ExistenceFilterFormat - format of .kvei file. Files without header are bloom filters: see OpenExistenceFilter
+type ExistenceFilterFormat uint8
+
+const (
+	ExistenceFilterBloom       ExistenceFilterFormat = 0
+	ExistenceFilterBinaryFuse8 ExistenceFilterFormat = 1
+)
+
+func (f ExistenceFilterFormat) String() string {
+	switch f {
+	case ExistenceFilterBloom:
+		return "bloom"
+	case ExistenceFilterBinaryFuse8:
+		return "fuse8"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(f))
+	}
+}
+
+// DefaultExistenceFilterFormat - format of new .kvei files. Both formats are readable.
+// Binary fuse filter has lower false-positive rate, but needs all key hashes in RAM during build.
+var DefaultExistenceFilterFormat = defaultExistenceFilterFormat()
+
+func defaultExistenceFilterFormat() ExistenceFilterFormat {
+	if dbg.EnvBool("KVEI_FUSE", false) {
+		return ExistenceFilterBinaryFuse8
+	}
+	return ExistenceFilterBloom
+}
+
+// existenceFilterMagic - versioned header: magic, version, format, 2 reserved bytes.
+// Bloom filter files (bloomfilter/v2) start with 8 zero bytes - so they are never confused with versioned files.
+var existenceFilterMagic = []byte("exfl")
+
+const (
+	existenceFilterVersion    = 1
+	existenceFilterHeaderSize = 8
+)
+
 type ExistenceFilter struct {
 	filter             *bloomfilter.Filter
+	fuse               *binaryFuse8
+	format             ExistenceFilterFormat
+	hashes             []uint64 // collected for build of fuse filter
 	empty              bool
 	FileName, FilePath string
 	f                  *os.File
@@ -37,39 +82,59 @@ type ExistenceFilter struct {
 }
 
 func NewExistenceFilter(keysCount uint64, filePath string) (*ExistenceFilter, error) {
+	return NewExistenceFilterWithFormat(DefaultExistenceFilterFormat, keysCount, filePath)
+}
 
+func NewExistenceFilterWithFormat(format ExistenceFilterFormat, keysCount uint64, filePath string) (*ExistenceFilter, error) {
 	m := bloomfilter.OptimalM(keysCount, 0.01)
 	//TODO: make filters compatible by usinig same seed/keys
 	_, fileName := filepath.Split(filePath)
-	e := &ExistenceFilter{FilePath: filePath, FileName: fileName}
-	if keysCount < 2 {
+	e := &ExistenceFilter{FilePath: filePath, FileName: fileName, format: format}
+	switch {
+	case keysCount < 2:
 		e.empty = true
-	} else {
+	case format == ExistenceFilterBinaryFuse8:
+		e.hashes = make([]uint64, 0, keysCount)
+	case format == ExistenceFilterBloom:
 		var err error
 		e.filter, err = bloomfilter.New(m)
 		if err != nil {
 			return nil, fmt.Errorf("%w, %s", err, fileName)
 		}
+	default:
+		return nil, fmt.Errorf("unknown existence filter format: %s, %s", format, fileName)
 	}
 	return e, nil
 }
 
+func (b *ExistenceFilter) Format() ExistenceFilterFormat { return b.format }
+
 func (b *ExistenceFilter) AddHash(hash uint64) {
 	if b.empty {
 		return
 	}
+	if b.format == ExistenceFilterBinaryFuse8 {
+		b.hashes = append(b.hashes, hash)
+		return
+	}
 	b.filter.AddHash(hash)
 }
 func (b *ExistenceFilter) ContainsHash(v uint64) bool {
 	if b.empty {
 		return true
 	}
+	if b.fuse != nil {
+		return b.fuse.Contains(v)
+	}
 	return b.filter.ContainsHash(v)
 }
 func (b *ExistenceFilter) Contains(v hash.Hash64) bool {
 	if b.empty {
 		return true
 	}
+	if b.fuse != nil {
+		return b.fuse.Contains(v.Sum64())
+	}
 	return b.filter.Contains(v)
 }
 func (b *ExistenceFilter) Build() error {
@@ -90,7 +155,21 @@ func (b *ExistenceFilter) Build() error {
 	}
 	defer cf.Close()
 
-	if _, err := b.filter.WriteTo(cf); err != nil {
+	if b.format == ExistenceFilterBinaryFuse8 {
+		if b.fuse, err = newBinaryFuse8(b.hashes); err != nil {
+			return fmt.Errorf("%w, %s", err, b.FileName)
+		}
+		b.hashes = nil
+		header := make([]byte, existenceFilterHeaderSize)
+		copy(header, existenceFilterMagic)
+		header[4], header[5] = existenceFilterVersion, byte(b.format)
+		if _, err := cf.Write(header); err != nil {
+			return err
+		}
+		if _, err := b.fuse.WriteTo(cf); err != nil {
+			return err
+		}
+	} else if _, err := b.filter.WriteTo(cf); err != nil {
 		return err
 	}
 	if err = b.fsync(cf); err != nil {
@@ -144,25 +223,52 @@ func OpenExistenceFilter(filePath string) (exFilder *ExistenceFilter, err error)
 	if !exists {
 		return nil, fmt.Errorf("file doesn't exists: %s", fileName)
 	}
-	{
-		ff, err := os.Open(filePath)
-		if err != nil {
-			return nil, err
-		}
-		defer ff.Close()
-		stat, err := ff.Stat()
-		if err != nil {
-			return nil, err
-		}
-		idx.empty = stat.Size() == 0
+	ff, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer ff.Close()
+	stat, err := ff.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx.empty = stat.Size() == 0
+	if idx.empty {
+		return idx, nil
 	}
 
-	if !idx.empty {
-		var err error
-		idx.filter, _, err = bloomfilter.ReadFile(filePath)
-		if err != nil {
+	// only header is read to detect format: bloom filter is streamed from file
+	header := make([]byte, existenceFilterHeaderSize)
+	n, err := io.ReadFull(ff, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header[:n], existenceFilterMagic) {
+		idx.format = ExistenceFilterBloom
+		if _, err := ff.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if idx.filter, _, err = bloomfilter.ReadFrom(ff); err != nil {
 			return nil, fmt.Errorf("OpenExistenceFilter: %w, %s", err, fileName)
 		}
+		return idx, nil
+	}
+	if n < existenceFilterHeaderSize {
+		return nil, fmt.Errorf("OpenExistenceFilter: header too short, %s", fileName)
+	}
+	if header[4] != existenceFilterVersion {
+		return nil, fmt.Errorf("OpenExistenceFilter: unsupported version %d, %s", header[4], fileName)
+	}
+	idx.format = ExistenceFilterFormat(header[5])
+	if idx.format != ExistenceFilterBinaryFuse8 {
+		return nil, fmt.Errorf("OpenExistenceFilter: unsupported format %s, %s", idx.format, fileName)
+	}
+	data := make([]byte, stat.Size()-existenceFilterHeaderSize)
+	if _, err := io.ReadFull(ff, data); err != nil {
+		return nil, fmt.Errorf("OpenExistenceFilter: %w, %s", err, fileName)
+	}
+	if idx.fuse, err = readBinaryFuse8(data); err != nil {
+		return nil, fmt.Errorf("OpenExistenceFilter: %w, %s", err, fileName)
 	}
 	return idx, nil
 }
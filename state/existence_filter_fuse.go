@@ -0,0 +1,216 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// binaryFuse8 - 3-wise binary fuse filter with 8-bit fingerprints (Graf, Lemire: "Binary Fuse Filters: Fast and Smaller
+// Than Xor Filters"). ~9 bits per key, false-positive rate ~0.4%, lookup reads 3 bytes of one small window of array.
+// Built from already hashed keys: same hashes as bloom filter.
+type binaryFuse8 struct {
+	seed               uint64
+	segmentLength      uint32
+	segmentLengthMask  uint32
+	segmentCount       uint32
+	segmentCountLength uint32
+	fingerprints       []uint8
+}
+
+const binaryFuseMaxIterations = 100
+
+func newBinaryFuse8(hashes []uint64) (*binaryFuse8, error) {
+	// construction requires unique keys
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+
+	f := &binaryFuse8{}
+	f.initParams(uint32(len(hashes)))
+	capacity := len(f.fingerprints)
+	count := make([]uint32, capacity)
+	xorHash := make([]uint64, capacity)
+	queue := make([]uint32, 0, capacity)
+	type peeled struct {
+		hash uint64
+		slot uint32
+	}
+	stack := make([]peeled, 0, len(hashes))
+
+	rng := uint64(0x726b2b9d438b9d4d)
+	for i := 0; ; i++ {
+		if i == binaryFuseMaxIterations {
+			return nil, errors.New("binary fuse filter: too many iterations")
+		}
+		f.seed = splitMix64(&rng)
+		clear(count)
+		clear(xorHash)
+		queue, stack = queue[:0], stack[:0]
+
+		for _, k := range hashes {
+			h := binaryFuseMix(k, f.seed)
+			h0, h1, h2 := f.slots(h)
+			count[h0]++
+			count[h1]++
+			count[h2]++
+			xorHash[h0] ^= h
+			xorHash[h1] ^= h
+			xorHash[h2] ^= h
+		}
+		for slot, c := range count {
+			if c == 1 {
+				queue = append(queue, uint32(slot))
+			}
+		}
+		for len(queue) > 0 {
+			slot := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			if count[slot] != 1 {
+				continue
+			}
+			h := xorHash[slot]
+			stack = append(stack, peeled{hash: h, slot: slot})
+			h0, h1, h2 := f.slots(h)
+			for _, s := range [3]uint32{h0, h1, h2} {
+				count[s]--
+				xorHash[s] ^= h
+				if count[s] == 1 {
+					queue = append(queue, s)
+				}
+			}
+		}
+		if len(stack) == len(hashes) {
+			break
+		}
+	}
+
+	for i := len(stack) - 1; i >= 0; i-- {
+		h0, h1, h2 := f.slots(stack[i].hash)
+		f.fingerprints[stack[i].slot] = binaryFuseFingerprint(stack[i].hash) ^ f.fingerprints[h0] ^ f.fingerprints[h1] ^ f.fingerprints[h2]
+	}
+	return f, nil
+}
+
+func (f *binaryFuse8) initParams(size uint32) {
+	const arity = 3
+	if size > 1 {
+		f.segmentLength = 1 << int(math.Floor(math.Log(float64(size))/math.Log(3.33)+2.25))
+	} else {
+		f.segmentLength = 4
+	}
+	f.segmentLength = min(f.segmentLength, 1<<18)
+	f.segmentLengthMask = f.segmentLength - 1
+
+	capacity := uint32(0)
+	if size > 1 {
+		sizeFactor := max(1.125, 0.875+0.25*math.Log(1_000_000)/math.Log(float64(size)))
+		capacity = uint32(math.Round(float64(size) * sizeFactor))
+	}
+	segments := (capacity + f.segmentLength - 1) / f.segmentLength
+	f.segmentCount = 1
+	if segments > arity-1 {
+		f.segmentCount = segments - (arity - 1)
+	}
+	f.segmentCountLength = f.segmentCount * f.segmentLength
+	f.fingerprints = make([]uint8, (f.segmentCount+arity-1)*f.segmentLength)
+}
+
+// slots - 3 positions in 3 consecutive segments
+func (f *binaryFuse8) slots(h uint64) (h0, h1, h2 uint32) {
+	hi, _ := bits.Mul64(h, uint64(f.segmentCountLength))
+	h0 = uint32(hi)
+	h1 = h0 + f.segmentLength
+	h2 = h1 + f.segmentLength
+	h1 ^= uint32(h>>18) & f.segmentLengthMask
+	h2 ^= uint32(h) & f.segmentLengthMask
+	return h0, h1, h2
+}
+
+func (f *binaryFuse8) Contains(key uint64) bool {
+	h := binaryFuseMix(key, f.seed)
+	h0, h1, h2 := f.slots(h)
+	return binaryFuseFingerprint(h) == f.fingerprints[h0]^f.fingerprints[h1]^f.fingerprints[h2]
+}
+
+const binaryFuse8HeaderSize = 8 + 4*4 + 8
+
+func (f *binaryFuse8) WriteTo(w io.Writer) (int64, error) {
+	var header [binaryFuse8HeaderSize]byte
+	binary.LittleEndian.PutUint64(header[0:], f.seed)
+	binary.LittleEndian.PutUint32(header[8:], f.segmentLength)
+	binary.LittleEndian.PutUint32(header[12:], f.segmentLengthMask)
+	binary.LittleEndian.PutUint32(header[16:], f.segmentCount)
+	binary.LittleEndian.PutUint32(header[20:], f.segmentCountLength)
+	binary.LittleEndian.PutUint64(header[24:], uint64(len(f.fingerprints)))
+	n, err := w.Write(header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	n2, err := w.Write(f.fingerprints)
+	return int64(n + n2), err
+}
+
+// readBinaryFuse8 - fingerprints are not copied from `data`
+func readBinaryFuse8(data []byte) (*binaryFuse8, error) {
+	if len(data) < binaryFuse8HeaderSize {
+		return nil, fmt.Errorf("binary fuse filter: header too short: %d", len(data))
+	}
+	f := &binaryFuse8{
+		seed:               binary.LittleEndian.Uint64(data[0:]),
+		segmentLength:      binary.LittleEndian.Uint32(data[8:]),
+		segmentLengthMask:  binary.LittleEndian.Uint32(data[12:]),
+		segmentCount:       binary.LittleEndian.Uint32(data[16:]),
+		segmentCountLength: binary.LittleEndian.Uint32(data[20:]),
+	}
+	fingerprints := binary.LittleEndian.Uint64(data[24:])
+	data = data[binaryFuse8HeaderSize:]
+	if uint64(len(data)) != fingerprints {
+		return nil, fmt.Errorf("binary fuse filter: expected %d fingerprints, got %d", fingerprints, len(data))
+	}
+	if f.segmentLength == 0 || f.segmentLengthMask != f.segmentLength-1 || f.segmentCountLength != f.segmentCount*f.segmentLength ||
+		fingerprints != uint64(f.segmentCount+2)*uint64(f.segmentLength) {
+		return nil, errors.New("binary fuse filter: inconsistent header")
+	}
+	f.fingerprints = data
+	return f, nil
+}
+
+func binaryFuseMix(key, seed uint64) uint64 {
+	h := key + seed
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func binaryFuseFingerprint(h uint64) uint8 { return uint8(h ^ (h >> 32)) }
+
+func splitMix64(seed *uint64) uint64 {
+	*seed += 0x9e3779b97f4a7c15
+	z := *seed
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spaolacci/murmur3"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+func TestExistenceFilter(t *testing.T) {
+	t.Parallel()
+
+	const keys = 100_000
+	rnd := rand.New(rand.NewSource(0))
+	added := make([]uint64, keys)
+	for i := range added {
+		added[i] = rnd.Uint64()
+	}
+	absent := make([]uint64, keys)
+	for i := range absent {
+		absent[i] = rnd.Uint64()
+	}
+
+	for _, tc := range []struct {
+		format ExistenceFilterFormat
+		maxFP  float64
+	}{{ExistenceFilterBloom, 0.02}, {ExistenceFilterBinaryFuse8, 0.006}} {
+		t.Run(tc.format.String(), func(t *testing.T) {
+			fPath := filepath.Join(t.TempDir(), "v1-accounts.0-1.kvei")
+			f, err := NewExistenceFilterWithFormat(tc.format, keys+1, fPath)
+			require.NoError(t, err)
+			f.DisableFsync()
+			for _, h := range added {
+				f.AddHash(h)
+			}
+			f.AddHash(added[0]) // duplicate
+			require.NoError(t, f.Build())
+
+			f, err = OpenExistenceFilter(fPath)
+			require.NoError(t, err)
+			defer f.Close()
+			require.Equal(t, tc.format, f.Format())
+			for _, h := range added {
+				require.True(t, f.ContainsHash(h))
+			}
+			var fp int
+			for _, h := range absent {
+				if f.ContainsHash(h) {
+					fp++
+				}
+			}
+			require.Less(t, float64(fp)/keys, tc.maxFP)
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		fPath := filepath.Join(t.TempDir(), "v1-accounts.0-1.kvei")
+		f, err := NewExistenceFilterWithFormat(ExistenceFilterBinaryFuse8, 1, fPath)
+		require.NoError(t, err)
+		f.AddHash(1)
+		require.NoError(t, f.Build())
+		f, err = OpenExistenceFilter(fPath)
+		require.NoError(t, err)
+		require.True(t, f.ContainsHash(2))
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		fPath := filepath.Join(t.TempDir(), "v1-accounts.0-1.kvei")
+		f, err := NewExistenceFilterWithFormat(ExistenceFilterBinaryFuse8, keys, fPath)
+		require.NoError(t, err)
+		f.DisableFsync()
+		for _, h := range added {
+			f.AddHash(h)
+		}
+		require.NoError(t, f.Build())
+		data, err := os.ReadFile(fPath)
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(fPath, data[:len(data)-1], 0644))
+		_, err = OpenExistenceFilter(fPath)
+		require.Error(t, err)
+
+		data[4] = existenceFilterVersion + 1
+		require.NoError(t, os.WriteFile(fPath, data, 0644))
+		_, err = OpenExistenceFilter(fPath)
+		require.Error(t, err)
+	})
+}
+
+// BenchmarkExistenceFilter - lookup latency, false-positive rate and size of filters built from keys of domain file.
+// Real file: KVEI_BENCH_FILE=/datadir/snapshots/domain/v1-storage.0-256.kv (must have compressed keys if any compression used)
+func BenchmarkExistenceFilter(b *testing.B) {
+	logger := log.New()
+	tmp := b.TempDir()
+	dataPath := os.Getenv("KVEI_BENCH_FILE")
+	if dataPath == "" {
+		dataPath = generateKV(b, tmp, 52, 8, 1_000_000, logger, 0)
+	}
+	d, err := seg.NewDecompressor(dataPath)
+	require.NoError(b, err)
+	defer d.Close()
+
+	const salt = 0
+	var present, absent []uint64
+	r := seg.NewReader(d.MakeGetter(), seg.DetectCompressType(d.MakeGetter()))
+	var key []byte
+	for r.HasNext() {
+		w, _ := r.Next(nil)
+		key = append(key[:0], w...) // uncompressed word points to mmap
+		hi, _ := murmur3.Sum128WithSeed(key, salt)
+		present = append(present, hi)
+		key[len(key)/2] ^= 0xff // most likely is not in file
+		hi, _ = murmur3.Sum128WithSeed(key, salt)
+		absent = append(absent, hi)
+		r.Skip()
+	}
+
+	for _, format := range []ExistenceFilterFormat{ExistenceFilterBloom, ExistenceFilterBinaryFuse8} {
+		fPath := filepath.Join(tmp, format.String()+".kvei")
+		f, err := NewExistenceFilterWithFormat(format, uint64(len(present)), fPath)
+		require.NoError(b, err)
+		f.DisableFsync()
+		for _, h := range present {
+			f.AddHash(h)
+		}
+		require.NoError(b, f.Build())
+		f, err = OpenExistenceFilter(fPath)
+		require.NoError(b, err)
+		stat, err := os.Stat(fPath)
+		require.NoError(b, err)
+
+		var fp int
+		for _, h := range absent {
+			if f.ContainsHash(h) {
+				fp++
+			}
+		}
+
+		b.Run(format.String(), func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%2 == 0 {
+					f.ContainsHash(present[i%len(present)])
+				} else {
+					f.ContainsHash(absent[i%len(absent)])
+				}
+			}
+			b.ReportMetric(100*float64(fp)/float64(len(absent)), "fp%")
+			b.ReportMetric(float64(stat.Size()*8)/float64(len(present)), "bits/key")
+		})
+	}
+}
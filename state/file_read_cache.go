@@ -0,0 +1,191 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+// FileReadCache - optional process-wide cache of lookups in domain files. Unlike DomainGetFromFileCache (which
+// lives in one DomainRoTx) it's shared by all transactions, so hot keys are not decompressed in every transaction:
+//   - key is (domain, file range, key). Files are immutable: writes don't invalidate entries
+//   - entry is valid only for file it was read from: file of the same range may be re-created (unwind, squeeze)
+//   - entries of files which are not visible anymore (merged away) are dropped when visible files are recalculated
+//   - memory is bounded by byte budget split between shards, least recently used entries are evicted first
+//
+// One cache can be shared by many Aggregators, see Aggregator.SetFileReadCache.
+type FileReadCache struct {
+	seed   maphash.Seed
+	shards [fileReadCacheShards]fileReadCacheShard
+}
+
+const fileReadCacheShards = 64
+
+// fileReadCacheEntryOverhead - approximate size of map and list bookkeeping of one entry
+const fileReadCacheEntryOverhead = 128
+
+type fileReadCacheShard struct {
+	lock   sync.Mutex
+	items  map[string]*list.Element
+	lru    list.List // front is most recently used
+	size   int
+	budget int
+}
+
+type fileReadCacheEntry struct {
+	key    string
+	src    *filesItem
+	v      []byte
+	offset uint64
+	found  bool
+}
+
+func (e *fileReadCacheEntry) size() int { return len(e.key) + len(e.v) + fileReadCacheEntryOverhead }
+
+func NewFileReadCache(budget datasize.ByteSize) *FileReadCache {
+	c := &FileReadCache{seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].items = make(map[string]*list.Element)
+		c.shards[i].budget = int(budget.Bytes() / fileReadCacheShards)
+	}
+	return c
+}
+
+// fileReadCacheKey - appends (domain, file range, key) to buf
+func fileReadCacheKey(buf []byte, name kv.Domain, f *visibleFile, key []byte) []byte {
+	buf = append(buf[:0], byte(name))
+	buf = binary.BigEndian.AppendUint64(buf, f.startTxNum)
+	buf = binary.BigEndian.AppendUint64(buf, f.endTxNum)
+	return append(buf, key...)
+}
+
+func (c *FileReadCache) shard(key []byte) *fileReadCacheShard {
+	return &c.shards[maphash.Bytes(c.seed, key)%fileReadCacheShards]
+}
+
+// get - returns result of lookup in file `src`. `hit=false` if there is no entry for this file.
+func (c *FileReadCache) get(name kv.Domain, src *filesItem, key []byte) (v []byte, found bool, offset uint64, hit bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	el, ok := s.items[string(key)]
+	if ok && el.Value.(*fileReadCacheEntry).src == src {
+		s.lru.MoveToFront(el)
+		e := el.Value.(*fileReadCacheEntry)
+		v, found, offset = common.Copy(e.v), e.found, e.offset
+	} else {
+		ok = false
+	}
+	s.lock.Unlock()
+
+	if ok {
+		mxFileReadCacheHit[name].Inc()
+	} else {
+		mxFileReadCacheMiss[name].Inc()
+	}
+	return v, found, offset, ok
+}
+
+func (c *FileReadCache) put(src *filesItem, key []byte, v []byte, found bool, offset uint64) {
+	e := &fileReadCacheEntry{key: string(key), src: src, v: common.Copy(v), offset: offset, found: found}
+	s := c.shard(key)
+	if e.size() > s.budget {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delta := 0
+	if el, ok := s.items[e.key]; ok {
+		delta -= el.Value.(*fileReadCacheEntry).size()
+		s.lru.Remove(el)
+	}
+	s.items[e.key] = s.lru.PushFront(e)
+	delta += e.size()
+	for s.size+delta > s.budget {
+		el := s.lru.Back()
+		old := el.Value.(*fileReadCacheEntry)
+		s.lru.Remove(el)
+		delete(s.items, old.key)
+		delta -= old.size()
+	}
+	s.size += delta
+	mxFileReadCacheSize.Add(float64(delta))
+}
+
+// drop - removes entries of given files
+func (c *FileReadCache) drop(files map[*filesItem]struct{}) {
+	if len(files) == 0 {
+		return
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		delta := 0
+		for el := s.lru.Front(); el != nil; {
+			next := el.Next()
+			e := el.Value.(*fileReadCacheEntry)
+			if _, ok := files[e.src]; ok {
+				s.lru.Remove(el)
+				delete(s.items, e.key)
+				delta -= e.size()
+			}
+			el = next
+		}
+		s.size += delta
+		s.lock.Unlock()
+		mxFileReadCacheSize.Add(float64(delta))
+	}
+}
+
+// dropNotVisible - removes entries of files which are in `prev` but not in `files`
+func (c *FileReadCache) dropNotVisible(prev, files []visibleFile) {
+	gone := make(map[*filesItem]struct{})
+	for _, f := range prev {
+		gone[f.src] = struct{}{}
+	}
+	for _, f := range files {
+		delete(gone, f.src)
+	}
+	c.drop(gone)
+}
+
+// Len - amount of entries
+func (c *FileReadCache) Len() (n int) {
+	for i := range c.shards {
+		c.shards[i].lock.Lock()
+		n += len(c.shards[i].items)
+		c.shards[i].lock.Unlock()
+	}
+	return n
+}
+
+// Size - approximate memory used by entries
+func (c *FileReadCache) Size() (size datasize.ByteSize) {
+	for i := range c.shards {
+		c.shards[i].lock.Lock()
+		size += datasize.ByteSize(c.shards[i].size)
+		c.shards[i].lock.Unlock()
+	}
+	return size
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestFileReadCache(t *testing.T) {
+	t.Parallel()
+
+	c := NewFileReadCache(64 * datasize.KB)
+	f1 := &visibleFile{startTxNum: 0, endTxNum: 10, src: &filesItem{startTxNum: 0, endTxNum: 10}}
+	f2 := &visibleFile{startTxNum: 10, endTxNum: 20, src: &filesItem{startTxNum: 10, endTxNum: 20}}
+
+	k1 := fileReadCacheKey(nil, kv.AccountsDomain, f1, []byte("key"))
+	_, _, _, hit := c.get(kv.AccountsDomain, f1.src, k1)
+	require.False(t, hit)
+
+	c.put(f1.src, k1, []byte("value"), true, 7)
+	v, found, offset, hit := c.get(kv.AccountsDomain, f1.src, k1)
+	require.True(t, hit)
+	require.True(t, found)
+	require.Equal(t, []byte("value"), v)
+	require.EqualValues(t, 7, offset)
+	v[0] = 'x' // caller owns returned value
+	v, _, _, _ = c.get(kv.AccountsDomain, f1.src, k1)
+	require.Equal(t, []byte("value"), v)
+
+	// negative result is cached too
+	k2 := fileReadCacheKey(nil, kv.AccountsDomain, f2, []byte("key"))
+	c.put(f2.src, k2, nil, false, 0)
+	_, found, _, hit = c.get(kv.AccountsDomain, f2.src, k2)
+	require.True(t, hit)
+	require.False(t, found)
+
+	// other domain or re-created file of the same range don't hit
+	_, _, _, hit = c.get(kv.StorageDomain, f1.src, fileReadCacheKey(nil, kv.StorageDomain, f1, []byte("key")))
+	require.False(t, hit)
+	_, _, _, hit = c.get(kv.AccountsDomain, &filesItem{startTxNum: 0, endTxNum: 10}, k1)
+	require.False(t, hit)
+	require.Equal(t, 2, c.Len())
+
+	c.dropNotVisible([]visibleFile{*f1, *f2}, []visibleFile{*f2})
+	require.Equal(t, 1, c.Len())
+	_, _, _, hit = c.get(kv.AccountsDomain, f1.src, k1)
+	require.False(t, hit)
+
+	// budget
+	val := make([]byte, 100)
+	for i := 0; i < 10_000; i++ {
+		c.put(f1.src, fileReadCacheKey(nil, kv.AccountsDomain, f1, []byte(fmt.Sprintf("key%d", i))), val, true, 0)
+	}
+	require.LessOrEqual(t, c.Size(), 64*datasize.KB)
+	require.Greater(t, c.Len(), 100)
+}
+
+func TestAggregator_FileReadCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 10)
+	cache := NewFileReadCache(datasize.MB)
+	agg.SetFileReadCache(cache)
+
+	addr := func(i uint64) []byte {
+		a := make([]byte, 20)
+		binary.BigEndian.PutUint64(a, i)
+		return a
+	}
+	write := func(fromTxNum, toTxNum uint64) {
+		t.Helper()
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer rwTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+		require.NoError(t, err)
+		defer domains.Close()
+		for txNum := fromTxNum; txNum < toTxNum; txNum++ {
+			domains.SetTxNum(txNum)
+			buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+			require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(txNum%13), nil, buf, nil, 0))
+		}
+		require.NoError(t, domains.Flush(ctx, rwTx))
+		require.NoError(t, rwTx.Commit())
+	}
+	read := func() (res [][]byte) {
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		for i := uint64(0); i < 13; i++ {
+			// limited by txNum: skip per-tx cache
+			v, found, _, _, err := ac.d[kv.AccountsDomain].getFromFiles(addr(i), math.MaxUint64-1)
+			require.NoError(t, err)
+			require.True(t, found)
+			res = append(res, v)
+		}
+		return res
+	}
+	hits := func() uint64 { return mxFileReadCacheHit[kv.AccountsDomain].GetValueUint64() }
+
+	write(0, 25)
+	require.NoError(t, agg.BuildFiles(25))
+	expected := read()
+	require.NotZero(t, cache.Len())
+
+	// other transaction reads from cache
+	before := hits()
+	require.Equal(t, expected, read())
+	require.GreaterOrEqual(t, hits()-before, uint64(13))
+
+	// merge drops entries of merged files
+	write(25, 45)
+	require.NoError(t, agg.BuildFiles(45))
+	ac := agg.BeginFilesRo()
+	visible := make(map[*filesItem]struct{})
+	for _, f := range ac.d[kv.AccountsDomain].files {
+		visible[f.src] = struct{}{}
+	}
+	ac.Close()
+	for i := range cache.shards {
+		for _, el := range cache.shards[i].items {
+			require.Contains(t, visible, el.Value.(*fileReadCacheEntry).src)
+		}
+	}
+	read()
+}
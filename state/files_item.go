@@ -51,12 +51,17 @@ type filesItem struct {
 	// Frozen: file of size StepsInColdFile. Completely immutable.
 	// Cold: file of size < StepsInColdFile. Immutable, but can be closed/removed after merge to bigger file.
 	// Hot: Stored in DB. Providing Snapshot-Isolation by CopyOnWrite.
-	frozen   bool         // immutable, don't need atomic
-	refcount atomic.Int32 // only for `frozen=false`
+	frozen   bool // immutable, don't need atomic
+	refcount atomic.Int32
 
 	// file can be deleted in 2 cases: 1. when `refcount == 0 && canDelete == true` 2. on app startup when `file.isSubsetOfFrozenFile()`
 	// other processes (which also reading files, may have same logic)
 	canDelete atomic.Bool
+	// file is owned by another process (follower Aggregator): when it's not needed anymore - only close it, never remove
+	keepOnDisk atomic.Bool
+	// item was replaced by `replacedBy` which reads same accessors from other file (moved to another storage tier):
+	// when it's not needed anymore - only files which are not shared with `replacedBy` are closed. Set before `canDelete`
+	replacedBy *filesItem
 }
 
 func newFilesItem(startTxNum, endTxNum, stepSize uint64) *filesItem {
@@ -102,7 +107,35 @@ func (i *filesItem) closeFiles() {
 	}
 }
 
+// filePaths - data file and all accessors of item
+func (i *filesItem) filePaths() (paths []string) {
+	if i.decompressor != nil {
+		paths = append(paths, i.decompressor.FilePath())
+	}
+	if i.index != nil {
+		paths = append(paths, i.index.FilePath())
+	}
+	if i.bindex != nil {
+		paths = append(paths, i.bindex.FilePath())
+	}
+	if i.bm != nil {
+		paths = append(paths, i.bm.FilePath())
+	}
+	if i.existence != nil {
+		paths = append(paths, i.existence.FilePath)
+	}
+	return paths
+}
+
 func (i *filesItem) closeFilesAndRemove() {
+	if i.replacedBy != nil {
+		i.closeReplaced()
+		return
+	}
+	if i.keepOnDisk.Load() {
+		i.closeFiles()
+		return
+	}
 	if i.decompressor != nil {
 		i.decompressor.Close()
 		// paranoic-mode on: don't delete frozen files
@@ -161,6 +194,41 @@ func (i *filesItem) closeFilesAndRemove() {
 	}
 }
 
+// closeReplaced - closes files of item which are not used by `replacedBy`. Files on disk are not touched
+func (i *filesItem) closeReplaced() {
+	if i.decompressor != nil && i.decompressor != i.replacedBy.decompressor {
+		i.decompressor.Close()
+	}
+	if i.bindex != nil && i.bindex != i.replacedBy.bindex {
+		i.bindex.Close()
+	}
+	i.decompressor, i.index, i.bindex, i.bm, i.existence = nil, nil, nil, nil, nil
+}
+
+// detachWhatNotInList - removes from `dirtyFiles` items which data file is not in `fNames` (or not open), returns them
+// without closing
+func detachWhatNotInList(dirtyFiles *btree2.BTreeG[*filesItem], fNames []string) (detached []*filesItem) {
+	protectFiles := make(map[string]struct{}, len(fNames))
+	for _, f := range fNames {
+		protectFiles[f] = struct{}{}
+	}
+	dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.decompressor != nil {
+				if _, ok := protectFiles[item.decompressor.FileName()]; ok {
+					continue
+				}
+			}
+			detached = append(detached, item)
+		}
+		return true
+	})
+	for _, item := range detached {
+		dirtyFiles.Delete(item)
+	}
+	return detached
+}
+
 func deleteMergeFile(dirtyFiles *btree2.BTreeG[*filesItem], outs []*filesItem, filenameBase string, logger log.Logger) {
 	for _, out := range outs {
 		if out == nil {
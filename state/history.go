@@ -28,6 +28,7 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	btree2 "github.com/tidwall/btree"
@@ -90,6 +91,8 @@ type History struct {
 	snapshotsDisabled bool   // don't produce .v and .ef files, keep in db table. old data will be pruned anyway.
 	historyDisabled   bool   // skip all write operations to this History (even in DB)
 	keepRecentTxnInDB uint64 // When dontProduceHistoryFiles=true, keepRecentTxInDB is used to keep this amount of txn in db before pruning
+
+	retained atomic.Bool // retention policy is set: beginning of history may be removed, see Aggregator.SetRetention
 }
 
 type histCfg struct {
@@ -125,7 +128,7 @@ func NewHistory(cfg histCfg, aggregationStep uint64, filenameBase, indexKeysTabl
 	h._visibleFiles = []visibleFile{}
 	var err error
 	h.InvertedIndex, err = NewInvertedIndex(cfg.iiCfg, aggregationStep, filenameBase, indexKeysTable, indexTable, func(fromStep, toStep uint64) bool {
-		exists, err := dir.FileExist(h.vFilePath(fromStep, toStep))
+		exists, err := dir.FileExist(h.tiers.resolve(h.vFilePath(fromStep, toStep)))
 		if err != nil {
 			panic(err)
 		}
@@ -219,7 +222,7 @@ func (h *History) openDirtyFiles() error {
 		for _, item := range items {
 			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
 			if item.decompressor == nil {
-				fPath := h.vFilePath(fromStep, toStep)
+				fPath := h.tiers.resolve(h.vFilePath(fromStep, toStep))
 				exists, err := dir.FileExist(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
@@ -292,25 +295,8 @@ func (h *History) openDirtyFiles() error {
 }
 
 func (h *History) closeWhatNotInList(fNames []string) {
-	protectFiles := make(map[string]struct{}, len(fNames))
-	for _, f := range fNames {
-		protectFiles[f] = struct{}{}
-	}
-	var toClose []*filesItem
-	h.dirtyFiles.Walk(func(items []*filesItem) bool {
-		for _, item := range items {
-			if item.decompressor != nil {
-				if _, ok := protectFiles[item.decompressor.FileName()]; ok {
-					continue
-				}
-			}
-			toClose = append(toClose, item)
-		}
-		return true
-	})
-	for _, item := range toClose {
+	for _, item := range detachWhatNotInList(h.dirtyFiles, fNames) {
 		item.closeFiles()
-		h.dirtyFiles.Delete(item)
 	}
 }
 
@@ -614,6 +600,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		efHistoryPath = h.efFilePath(step, step+1)
 		startAt       = time.Now()
 		closeComp     = true
+		iot           = ioTaskFromCtx(ctx)
 	)
 	defer func() {
 		mxCollateTookHistory.ObserveDuration(startAt)
@@ -678,7 +665,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		defer cd.Close()
 	}
 
-	efComp, err := seg.NewCompressor(ctx, "collate idx "+h.filenameBase, efHistoryPath, h.dirs.Tmp, h.compressCfg, log.LvlTrace, h.logger)
+	efComp, err := seg.NewCompressor(ctx, "collate idx "+h.filenameBase, efHistoryPath, h.dirs.Tmp, h.InvertedIndex.compressCfg, log.LvlTrace, h.logger)
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s ef history compressor: %w", h.filenameBase, err)
 	}
@@ -693,8 +680,9 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		prevEf      []byte
 		prevKey     []byte
 		initialized bool
+		valsSize    int // values of `prevKey`, read from DB
 	)
-	efHistoryComp = seg.NewWriter(efComp, seg.CompressNone) // coll+build must be fast - no compression
+	efHistoryComp = seg.NewWriter(efComp, h.InvertedIndex.compression) // CompressNone by default: coll+build must be fast
 	collector.SortAndFlushInBackground(true)
 	defer bitmapdb.ReturnToPool64(bitmap)
 
@@ -729,6 +717,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 				if err = historyComp.AddWord(val); err != nil {
 					return fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, key, val, err)
 				}
+				valsSize += len(val)
 			} else {
 				val, err := cd.SeekBothRange(prevKey, numBuf)
 				if err != nil {
@@ -742,6 +731,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 				if err = historyComp.AddWord(val); err != nil {
 					return fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, prevKey, val, err)
 				}
+				valsSize += len(val)
 			}
 
 			ef.AddOffset(vTxNum)
@@ -757,6 +747,10 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		if err = efHistoryComp.AddWord(prevEf); err != nil {
 			return fmt.Errorf("add %s ef history val: %w", h.filenameBase, err)
 		}
+		if err = iot.accountRead(ctx, len(prevKey)+len(prevEf)+valsSize); err != nil {
+			return err
+		}
+		valsSize = 0
 
 		prevKey = append(prevKey[:0], k...)
 		txNum = binary.BigEndian.Uint64(v)
@@ -812,6 +806,26 @@ func (sf HistoryFiles) CleanupOnError() {
 		sf.efExistence.Close()
 	}
 }
+
+func (sf HistoryFiles) filePaths() (paths []string) {
+	if sf.historyDecomp != nil {
+		paths = append(paths, sf.historyDecomp.FilePath())
+	}
+	if sf.historyIdx != nil {
+		paths = append(paths, sf.historyIdx.FilePath())
+	}
+	if sf.efHistoryDecomp != nil {
+		paths = append(paths, sf.efHistoryDecomp.FilePath())
+	}
+	if sf.efHistoryIdx != nil {
+		paths = append(paths, sf.efHistoryIdx.FilePath())
+	}
+	if sf.efExistence != nil {
+		paths = append(paths, sf.efExistence.FilePath)
+	}
+	return paths
+}
+
 func (h *History) reCalcVisibleFiles(toTxNum uint64) {
 	h._visibleFiles = calcVisibleFiles(h.dirtyFiles, h.indexList, false, toTxNum)
 	h.InvertedIndex.reCalcVisibleFiles(toTxNum)
@@ -982,9 +996,7 @@ type HistoryRoTx struct {
 func (h *History) BeginFilesRo() *HistoryRoTx {
 	files := h._visibleFiles
 	for i := 0; i < len(files); i++ {
-		if !files[i].src.frozen {
-			files[i].src.refcount.Add(1)
-		}
+		files[i].src.refcount.Add(1)
 	}
 
 	return &HistoryRoTx{
@@ -1142,7 +1154,7 @@ func (ht *HistoryRoTx) Close() {
 	ht.files = nil
 	for i := 0; i < len(files); i++ {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -1178,7 +1190,17 @@ func (ht *HistoryRoTx) getFile(txNum uint64) (it visibleFile, ok bool) {
 	return it, false
 }
 
-func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) ([]byte, bool, error) {
+func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) (v []byte, found bool, err error) {
+	rt := ht.iit.readTrace
+	lt := rt.begin(readTraceHistorySeekInFiles, ht.h.filenameBase, key)
+	if lt != nil {
+		ht.iit.readLookup = lt
+		defer func() {
+			ht.iit.readLookup = nil
+			rt.end(lt, found && err == nil)
+		}()
+	}
+
 	// Files list of II and History is different
 	// it means II can't return index of file, but can return TxNum which History will use to find own file
 	ok, histTxNum := ht.iit.seekInFiles(key, txNum)
@@ -1194,14 +1216,17 @@ func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) ([]byte, boo
 	if reader.Empty() {
 		return nil, false, nil
 	}
+	g := ht.statelessGetter(historyItem.i)
+	p := lt.probe(&historyItem, g, "")
 	offset, ok := reader.Lookup(ht.encodeTs(histTxNum, key))
 	if !ok {
+		p.done(false)
 		return nil, false, nil
 	}
-	g := ht.statelessGetter(historyItem.i)
 	g.Reset(offset)
 
-	v, _ := g.Next(nil)
+	v, _ = g.Next(nil)
+	p.done(true)
 	if traceGetAsOf == ht.h.filenameBase {
 		fmt.Printf("GetAsOf(%s, %x, %d) -> %s, histTxNum=%d, isNil(v)=%t\n", ht.h.filenameBase, key, txNum, g.FileName(), histTxNum, v == nil)
 	}
@@ -1277,7 +1302,11 @@ func (ht *HistoryRoTx) encodeTs(txNum uint64, key []byte) []byte {
 
 // HistorySeek searches history for a value of specified key before txNum
 // second return value is true if the value is found in the history (even if it is nil)
+// returns ErrHistoryPruned if retention policy is set and txNum is before first history file
 func (ht *HistoryRoTx) HistorySeek(key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
+	if ht.h.retained.Load() && len(ht.files) > 0 && txNum < ht.files[0].startTxNum {
+		return nil, false, fmt.Errorf("%w: %s txNum=%d, first available=%d", ErrHistoryPruned, ht.h.filenameBase, txNum, ht.files[0].startTxNum)
+	}
 	v, ok, err := ht.historySeekInFiles(key, txNum)
 	if err != nil {
 		return nil, ok, err
@@ -1358,7 +1387,7 @@ func (ht *HistoryRoTx) WalkAsOf(ctx context.Context, startTxNum uint64, from, to
 			continue
 		}
 		// TODO: seek(from)
-		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.h.compression)
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.iit.ii.compression)
 		g.Reset(0)
 		if g.HasNext() {
 			key, offset := g.Next(nil)
@@ -1403,8 +1432,6 @@ type StateAsOfIterF struct {
 	startTxKey [8]byte
 	txnKey     [8]byte
 
-	k, v, kBackup, vBackup []byte
-
 	ctx context.Context
 }
 
@@ -1476,14 +1503,14 @@ func (hi *StateAsOfIterF) Next() ([]byte, []byte, error) {
 	}
 
 	hi.limit--
-	hi.k, hi.v = append(hi.k[:0], hi.nextKey...), append(hi.v[:0], hi.nextVal...)
-
-	// Satisfy stream.Duo Invariant 2
-	hi.k, hi.kBackup, hi.v, hi.vBackup = hi.kBackup, hi.k, hi.vBackup, hi.v
+	// advanceInFiles allocates new key and value: they stay valid after any amount of .Next() calls, so stream is
+	// safe to use in nested stream.UnionKV (e.g. DomainRange), which keeps values of its inputs for longer than
+	// stream.Duo Invariant 2 guarantees
+	k, v := hi.nextKey, hi.nextVal
 	if err := hi.advanceInFiles(); err != nil {
 		return nil, nil, err
 	}
-	return hi.kBackup, hi.vBackup, nil
+	return k, v, nil
 }
 
 // StateAsOfIterDB - returns state range at given time in history
@@ -1663,7 +1690,7 @@ func (ht *HistoryRoTx) iterateChangedFrozen(fromTxNum, toTxNum int, asc order.By
 		if toTxNum >= 0 && item.startTxNum >= uint64(toTxNum) {
 			break
 		}
-		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.h.compression)
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.iit.ii.compression)
 		g.Reset(0)
 		if g.HasNext() {
 			key, offset := g.Next(nil)
@@ -1774,6 +1801,9 @@ func (ht *HistoryRoTx) idxRangeRecent(key []byte, startTxNum, endTxNum int, asc
 	return dbIt, nil
 }
 func (ht *HistoryRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (stream.U64, error) {
+	if err := ht.iit.checkRetained(startTxNum, endTxNum, asc); err != nil {
+		return nil, err
+	}
 	frozenIt, err := ht.iit.iterateRangeFrozen(key, startTxNum, endTxNum, asc, limit)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,428 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/stream"
+	"github.com/Tangui-Bitfly/erigon-lib/recsplit"
+	"github.com/Tangui-Bitfly/erigon-lib/recsplit/eliasfano32"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+// Parallel scan of history files. Same result as `iterateChangedFrozen`, but:
+//   - every .ef file is decompressed by own goroutine
+//   - one goroutine merges keys of all files (first file with txNum in range wins) and splits them into batches of neighbour keys
+//   - `workers` goroutines lookup and decompress values of batches: it's the most CPU-heavy part
+//
+// Every goroutine uses own seg.Reader and recsplit.IndexReader. In ordered mode batches are returned in key order,
+// in unordered mode workers pass values to callback as soon as batch is ready.
+const historyScanBatchSize = 1024
+
+type historyScanItem struct {
+	key, val []byte
+	txNum    uint64
+	file     int // index in HistoryRoTx.files
+	found    bool
+}
+
+type historyScanBatch struct {
+	items []historyScanItem
+	done  chan struct{} // closed when values of batch are resolved. used only in ordered mode
+}
+
+func (ht *HistoryRoTx) scanChangedFrozen(ctx context.Context, g *errgroup.Group, fromTxNum, toTxNum int, workers int, ordered chan<- *historyScanBatch, f func(k, v []byte) error) error {
+	startTxNum := uint64(max(0, fromTxNum))
+	var efFiles, historyFiles []visibleFile
+	for _, item := range ht.iit.files {
+		if fromTxNum >= 0 && item.endTxNum <= uint64(fromTxNum) {
+			continue
+		}
+		if toTxNum >= 0 && item.startTxNum >= uint64(toTxNum) {
+			break
+		}
+		historyItem, ok := ht.getFileDeprecated(item.startTxNum, item.endTxNum)
+		if !ok {
+			return fmt.Errorf("scanChangedFrozen: no %s file found for %d-%d", ht.h.filenameBase, item.startTxNum/ht.h.aggregationStep, item.endTxNum/ht.h.aggregationStep)
+		}
+		efFiles, historyFiles = append(efFiles, item), append(historyFiles, historyItem)
+	}
+
+	cursors := make([]*historyScanCursor, len(efFiles))
+	for i := range efFiles {
+		ch := make(chan []historyScanItem, 2)
+		cursors[i] = &historyScanCursor{ch: ch, order: i}
+		g.Go(func() error {
+			defer close(ch)
+			return ht.readChangedKeys(ctx, efFiles[i], historyFiles[i].i, startTxNum, toTxNum, ch)
+		})
+	}
+
+	work := make(chan *historyScanBatch, workers)
+	g.Go(func() error {
+		defer close(work)
+		if ordered != nil {
+			defer close(ordered)
+		}
+		return mergeChangedKeys(ctx, cursors, work, ordered)
+	})
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			w := &historyScanWorker{ht: ht}
+			defer w.close()
+			for b := range work {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				w.resolve(b)
+				if ordered != nil {
+					close(b.done)
+					continue
+				}
+				for i := range b.items {
+					if !b.items[i].found {
+						continue
+					}
+					if err := f(b.items[i].key, b.items[i].val); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// readChangedKeys - sends keys of .ef file which have txNum in [startTxNum, endTxNum) - with first such txNum
+func (ht *HistoryRoTx) readChangedKeys(ctx context.Context, item visibleFile, historyFile int, startTxNum uint64, endTxNum int, out chan<- []historyScanItem) error {
+	g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.iit.ii.compression)
+	g.Reset(0)
+	send := func(batch []historyScanItem) error {
+		select {
+		case out <- batch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	batch := make([]historyScanItem, 0, historyScanBatchSize)
+	var idxVal []byte
+	for g.HasNext() {
+		key, _ := g.Next(nil)
+		if !g.HasNext() {
+			return fmt.Errorf("readChangedKeys: %s: no value for key %x", item.src.decompressor.FileName(), key)
+		}
+		idxVal, _ = g.Next(idxVal[:0])
+		n, ok := eliasfano32.Seek(idxVal, startTxNum)
+		if !ok || (endTxNum >= 0 && n >= uint64(endTxNum)) {
+			continue
+		}
+		batch = append(batch, historyScanItem{key: key, txNum: n, file: historyFile})
+		if len(batch) == historyScanBatchSize {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = make([]historyScanItem, 0, historyScanBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		return send(batch)
+	}
+	return nil
+}
+
+// mergeChangedKeys - merges sorted keys of all files: for same key - item of earliest file wins
+func mergeChangedKeys(ctx context.Context, cursors []*historyScanCursor, work chan<- *historyScanBatch, ordered chan<- *historyScanBatch) error {
+	var h historyScanHeap
+	for _, c := range cursors {
+		ok, err := c.advance(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+
+	send := func(items []historyScanItem) error {
+		b := &historyScanBatch{items: items}
+		if ordered != nil {
+			b.done = make(chan struct{})
+			select { // first reserve place in result order, then give batch to workers
+			case ordered <- b:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case work <- b:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	batch := make([]historyScanItem, 0, historyScanBatchSize)
+	var lastKey []byte
+	for h.Len() > 0 {
+		top := h[0]
+		item := top.items[0]
+		ok, err := top.advance(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+
+		if lastKey != nil && bytes.Equal(item.key, lastKey) {
+			continue
+		}
+		lastKey = item.key
+		batch = append(batch, item)
+		if len(batch) == historyScanBatchSize {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = make([]historyScanItem, 0, historyScanBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		return send(batch)
+	}
+	return nil
+}
+
+type historyScanCursor struct {
+	ch    <-chan []historyScanItem
+	items []historyScanItem // items[0] is current
+	order int               // files are sorted by txNum
+	began bool
+}
+
+// advance - moves to next item, returns false when file is exhausted
+func (c *historyScanCursor) advance(ctx context.Context) (bool, error) {
+	if c.began && len(c.items) > 1 {
+		c.items = c.items[1:]
+		return true, nil
+	}
+	c.began = true
+	select {
+	case items, ok := <-c.ch:
+		if !ok {
+			c.items = nil
+			return false, nil
+		}
+		c.items = items
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+type historyScanHeap []*historyScanCursor
+
+func (h historyScanHeap) Len() int { return len(h) }
+func (h historyScanHeap) Less(i, j int) bool {
+	c := bytes.Compare(h[i].items[0].key, h[j].items[0].key)
+	if c == 0 {
+		return h[i].order < h[j].order
+	}
+	return c < 0
+}
+func (h historyScanHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *historyScanHeap) Push(x any)   { *h = append(*h, x.(*historyScanCursor)) }
+func (h *historyScanHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+type historyScanWorker struct {
+	ht      *HistoryRoTx
+	getters []*seg.Reader
+	readers []*recsplit.IndexReader
+	txKey   [8]byte
+}
+
+func (w *historyScanWorker) resolve(b *historyScanBatch) {
+	if w.getters == nil {
+		w.getters = make([]*seg.Reader, len(w.ht.files))
+		w.readers = make([]*recsplit.IndexReader, len(w.ht.files))
+	}
+	for i := range b.items {
+		item := &b.items[i]
+		if w.readers[item.file] == nil {
+			w.readers[item.file] = w.ht.files[item.file].src.index.GetReaderFromPool()
+			w.getters[item.file] = seg.NewReader(w.ht.files[item.file].src.decompressor.MakeGetter(), w.ht.h.compression)
+		}
+		binary.BigEndian.PutUint64(w.txKey[:], item.txNum)
+		offset, ok := w.readers[item.file].Lookup2(w.txKey[:], item.key)
+		if !ok {
+			continue
+		}
+		g := w.getters[item.file]
+		g.Reset(offset)
+		item.val, _ = g.Next(nil)
+		item.found = true
+	}
+}
+
+func (w *historyScanWorker) close() {
+	for _, r := range w.readers {
+		r.Close()
+	}
+}
+
+// iterateChangedFrozenParallel - ordered parallel version of `iterateChangedFrozen`
+func (ht *HistoryRoTx) iterateChangedFrozenParallel(ctx context.Context, fromTxNum, toTxNum int, limit, workers int) (stream.KV, error) {
+	if len(ht.iit.files) == 0 {
+		return stream.EmptyKV, nil
+	}
+	if fromTxNum >= 0 && ht.iit.files.EndTxNum() <= uint64(fromTxNum) {
+		return stream.EmptyKV, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+	ordered := make(chan *historyScanBatch, 2*max(workers, 1))
+	if err := ht.scanChangedFrozen(ctx, g, fromTxNum, toTxNum, max(workers, 1), ordered, nil); err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &HistoryChangesIterParallel{ctx: ctx, cancel: cancel, g: g, ordered: ordered, limit: limit}
+	if err := s.advance(); err != nil {
+		s.Close() //it's responsibility of constructor (our) to close resource on error
+		return nil, err
+	}
+	return s, nil
+}
+
+// ScanChangedFrozen - unordered fast mode of `iterateChangedFrozen`: `f` is called concurrently by `workers` goroutines,
+// keys are not sorted. `k` and `v` are not reused by scanner - `f` can keep them.
+func (ht *HistoryRoTx) ScanChangedFrozen(ctx context.Context, fromTxNum, toTxNum int, workers int, f func(k, v []byte) error) error {
+	if len(ht.iit.files) == 0 {
+		return nil
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	if err := ht.scanChangedFrozen(ctx, g, fromTxNum, toTxNum, max(workers, 1), nil, f); err != nil {
+		return err
+	}
+	return g.Wait()
+}
+
+// HistoryRangeParallel - same as `HistoryRange`, but files are scanned by `workers` goroutines
+func (ht *HistoryRoTx) HistoryRangeParallel(ctx context.Context, fromTxNum, toTxNum int, limit, workers int, roTx kv.Tx) (stream.KVS, error) {
+	itOnFiles, err := ht.iterateChangedFrozenParallel(ctx, fromTxNum, toTxNum, limit, workers)
+	if err != nil {
+		return nil, err
+	}
+	itOnDB, err := ht.iterateChangedRecent(fromTxNum, toTxNum, order.Asc, limit, roTx)
+	if err != nil {
+		itOnFiles.Close()
+		return nil, err
+	}
+	return stream.MergeKVS(itOnDB, itOnFiles, limit), nil
+}
+
+type HistoryChangesIterParallel struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	g       *errgroup.Group
+	ordered <-chan *historyScanBatch
+	batch   []historyScanItem
+
+	nextKey, nextVal []byte
+	err              error
+	limit            int
+}
+
+func (hi *HistoryChangesIterParallel) Close() {
+	if hi.cancel == nil {
+		return
+	}
+	hi.cancel()
+	hi.cancel = nil
+	_ = hi.g.Wait()
+}
+
+func (hi *HistoryChangesIterParallel) advance() error {
+	for {
+		for len(hi.batch) > 0 {
+			item := hi.batch[0]
+			hi.batch = hi.batch[1:]
+			if !item.found {
+				continue
+			}
+			hi.nextKey, hi.nextVal = item.key, item.val
+			return nil
+		}
+		b, ok := <-hi.ordered
+		if !ok {
+			hi.nextKey = nil
+			return hi.g.Wait()
+		}
+		select {
+		case <-b.done:
+		case <-hi.ctx.Done():
+			hi.nextKey = nil
+			if err := hi.g.Wait(); err != nil {
+				return err
+			}
+			return hi.ctx.Err()
+		}
+		hi.batch = b.items
+	}
+}
+
+func (hi *HistoryChangesIterParallel) HasNext() bool {
+	if hi.err != nil { // always true, then .Next() call will return this error
+		return true
+	}
+	if hi.limit == 0 { // limit reached
+		return false
+	}
+	return hi.nextKey != nil
+}
+
+// Next - returned `k` and `v` are not reused by iterator
+func (hi *HistoryChangesIterParallel) Next() ([]byte, []byte, error) {
+	if hi.err != nil {
+		return nil, nil, hi.err
+	}
+	hi.limit--
+	k, v := hi.nextKey, hi.nextVal
+	if err := hi.advance(); err != nil {
+		hi.err = err
+	}
+	return k, v, nil
+}
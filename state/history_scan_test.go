@@ -0,0 +1,123 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/stream"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+func TestHistoryScanParallel(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	ctx := context.Background()
+
+	test := func(t *testing.T, h *History, db kv.RwDB, txs uint64) {
+		t.Helper()
+		require := require.New(t)
+
+		collateAndMergeHistory(t, db, h, txs, true)
+
+		tx, err := db.BeginRo(ctx)
+		require.NoError(err)
+		defer tx.Rollback()
+		hc := h.BeginFilesRo()
+		defer hc.Close()
+
+		collect := func(it stream.KV) (res []string) {
+			defer it.Close()
+			for it.HasNext() {
+				k, v, err := it.Next()
+				require.NoError(err)
+				res = append(res, fmt.Sprintf("%x=%x", k, v))
+			}
+			return res
+		}
+		for _, r := range [][2]int{{0, 1000}, {0, int(txs)}, {2, 20}, {100, 600}, {500, 520}, {300, 301}} {
+			it, err := hc.iterateChangedFrozen(r[0], r[1], order.Asc, -1)
+			require.NoError(err)
+			expect := collect(it)
+			require.NotEmpty(expect, "range=%v", r)
+
+			for _, workers := range []int{1, 3} {
+				it, err := hc.iterateChangedFrozenParallel(ctx, r[0], r[1], -1, workers)
+				require.NoError(err)
+				require.Equal(expect, collect(it), "range=%v, workers=%d", r, workers)
+			}
+
+			var mu sync.Mutex
+			var unordered []string
+			err = hc.ScanChangedFrozen(ctx, r[0], r[1], 3, func(k, v []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				unordered = append(unordered, fmt.Sprintf("%x=%x", k, v))
+				return nil
+			})
+			require.NoError(err)
+			sort.Strings(unordered)
+			expect = append([]string{}, expect...)
+			sort.Strings(expect)
+			require.Equal(expect, unordered, "range=%v", r)
+		}
+
+		// with limit and recent part in db: same as HistoryRange
+		for _, limit := range []int{-1, 2} {
+			seq, err := hc.HistoryRange(0, 1000, order.Asc, limit, tx)
+			require.NoError(err)
+			par, err := hc.HistoryRangeParallel(ctx, 0, 1000, limit, 2, tx)
+			require.NoError(err)
+			require.Equal(collect(stream.WrapKV(seq)), collect(stream.WrapKV(par)))
+		}
+
+		// early close: background goroutines are stopped
+		it, err := hc.iterateChangedFrozenParallel(ctx, 0, int(txs), -1, 2)
+		require.NoError(err)
+		require.True(it.HasNext())
+		_, _, err = it.Next()
+		require.NoError(err)
+		it.Close()
+
+		errStop := errors.New("stop")
+		err = hc.ScanChangedFrozen(ctx, 0, int(txs), 2, func(k, v []byte) error { return errStop })
+		require.ErrorIs(err, errStop)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err = hc.ScanChangedFrozen(cctx, 0, int(txs), 2, func(k, v []byte) error { return nil })
+		require.ErrorIs(err, context.Canceled)
+	}
+	t.Run("large_values", func(t *testing.T) {
+		db, h, txs := filledHistory(t, true, logger)
+		test(t, h, db, txs)
+	})
+	t.Run("small_values", func(t *testing.T) {
+		db, h, txs := filledHistory(t, false, logger)
+		test(t, h, db, txs)
+	})
+}
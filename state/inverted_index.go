@@ -32,6 +32,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
@@ -91,12 +92,15 @@ type InvertedIndex struct {
 
 	compressCfg seg.Cfg
 	indexList   idxList
+
+	retained atomic.Bool // retention policy is set: beginning of index may be removed, see Aggregator.SetRetention
 }
 
 type iiCfg struct {
-	salt *uint32
-	dirs datadir.Dirs
-	db   kv.RoDB // global db pointer. mostly for background warmup.
+	salt  *uint32
+	dirs  datadir.Dirs
+	db    kv.RoDB       // global db pointer. mostly for background warmup.
+	tiers *storageTiers // secondary storage for cold files. nil means all files are in `dirs`
 }
 type iiVisible struct {
 	files  []visibleFile
@@ -154,15 +158,15 @@ func filesFromDir(dir string) ([]string, error) {
 	return filtered, nil
 }
 func (ii *InvertedIndex) fileNamesOnDisk() (idx, hist, domain []string, err error) {
-	idx, err = filesFromDir(ii.dirs.SnapIdx)
+	idx, err = ii.tiers.filesFromDir(ii.dirs.SnapIdx)
 	if err != nil {
 		return
 	}
-	hist, err = filesFromDir(ii.dirs.SnapHistory)
+	hist, err = ii.tiers.filesFromDir(ii.dirs.SnapHistory)
 	if err != nil {
 		return
 	}
-	domain, err = filesFromDir(ii.dirs.SnapDomain)
+	domain, err = ii.tiers.filesFromDir(ii.dirs.SnapDomain)
 	if err != nil {
 		return
 	}
@@ -285,7 +289,7 @@ func (ii *InvertedIndex) openDirtyFiles() error {
 			item := item
 			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
 			if item.decompressor == nil {
-				fPath := ii.efFilePath(fromStep, toStep)
+				fPath := ii.tiers.resolve(ii.efFilePath(fromStep, toStep))
 				exists, err := dir.FileExist(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
@@ -348,26 +352,8 @@ func (ii *InvertedIndex) openDirtyFiles() error {
 }
 
 func (ii *InvertedIndex) closeWhatNotInList(fNames []string) {
-	protectFiles := make(map[string]struct{}, len(fNames))
-	for _, f := range fNames {
-		protectFiles[f] = struct{}{}
-	}
-	var toClose []*filesItem
-	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
-		for _, item := range items {
-			if item.decompressor != nil {
-				if _, ok := protectFiles[item.decompressor.FileName()]; ok {
-					continue
-				}
-			}
-
-			toClose = append(toClose, item)
-		}
-		return true
-	})
-	for _, item := range toClose {
+	for _, item := range detachWhatNotInList(ii.dirtyFiles, fNames) {
 		item.closeFiles()
-		ii.dirtyFiles.Delete(item)
 	}
 }
 
@@ -405,6 +391,8 @@ type invertedIndexBufferedWriter struct {
 	txNum           uint64
 	aggregationStep uint64
 	txNumBytes      [8]byte
+
+	journal *sdJournal // SharedDomains checkpoints
 }
 
 // loadFunc - is analog of etl.Identity, but it signaling to etl - use .Put instead of .AppendDup - to allow duplicates
@@ -420,6 +408,9 @@ func (w *invertedIndexBufferedWriter) SetTxNum(txNum uint64) {
 
 // Add - !NotThreadSafe. Must use WalRLock/BatchHistoryWriteEnd
 func (w *invertedIndexBufferedWriter) Add(key []byte) error {
+	if w.journal.active() {
+		return w.journal.deferIndexAdd(w, key)
+	}
 	return w.add(key, key)
 }
 
@@ -488,9 +479,7 @@ func (iit *InvertedIndexRoTx) newWriter(tmpdir string, discard bool) *invertedIn
 func (ii *InvertedIndex) BeginFilesRo() *InvertedIndexRoTx {
 	files := ii._visible.files
 	for i := 0; i < len(files); i++ {
-		if !files[i].src.frozen {
-			files[i].src.refcount.Add(1)
-		}
+		files[i].src.refcount.Add(1)
 	}
 	return &InvertedIndexRoTx{
 		ii:      ii,
@@ -506,7 +495,7 @@ func (iit *InvertedIndexRoTx) Close() {
 	iit.files = nil
 	for i := 0; i < len(files); i++ {
 		src := files[i].src
-		if src == nil || src.frozen {
+		if src == nil {
 			continue
 		}
 		refCnt := src.refcount.Add(-1)
@@ -555,6 +544,9 @@ type InvertedIndexRoTx struct {
 	readers []*recsplit.IndexReader
 
 	seekInFilesCache *IISeekInFilesCache
+
+	readTrace  *ReadTrace   // see AggregatorRoTx.EnableReadTrace
+	readLookup *LookupTrace // traced lookup in progress: seekInFiles is a part of historySeekInFiles
 }
 
 // hashKey - change of salt will require re-gen of indices
@@ -608,9 +600,15 @@ func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool,
 		if ok && fromCache.requested <= txNum {
 			if txNum <= fromCache.found {
 				iit.seekInFilesCache.hit++
+				if iit.readLookup != nil {
+					iit.readLookup.Cache = "tx"
+				}
 				return true, fromCache.found
 			} else if fromCache.found == 0 {
 				iit.seekInFilesCache.hit++
+				if iit.readLookup != nil {
+					iit.readLookup.Cache = "tx"
+				}
 				return false, 0
 			}
 		}
@@ -620,19 +618,26 @@ func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool,
 		if iit.files[i].endTxNum <= txNum {
 			continue
 		}
+		g := iit.statelessGetter(i)
+		var p *FileProbe
+		if iit.readLookup != nil {
+			p = iit.readLookup.probe(&iit.files[i], g, "")
+		}
 		offset, ok := iit.statelessIdxReader(i).TwoLayerLookupByHash(hi, lo)
 		if !ok {
+			p.done(false)
 			continue
 		}
 
-		g := iit.statelessGetter(i)
 		g.Reset(offset)
 		k, _ := g.Next(nil)
 		if !bytes.Equal(k, key) {
+			p.done(false)
 			continue
 		}
 		eliasVal, _ := g.Next(nil)
 		equalOrHigherTxNum, found = eliasfano32.Seek(eliasVal, txNum)
+		p.done(found)
 
 		if found {
 			if iit.seekInFilesCache != nil {
@@ -652,9 +657,14 @@ func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool,
 // is to be used in public API, therefore it relies on read-only transaction
 // so that iteration can be done even when the inverted index is being updated.
 // [startTxNum; endNumTx)
+// returns ErrHistoryPruned if retention policy is set and lower bound of range is before first index file.
+// Range without lower bound (-1) is truncated by retention silently.
 
 // todo IdxRange operates over ii.indexTable . Passing `nil` as a key will not return all keys
 func (iit *InvertedIndexRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (stream.U64, error) {
+	if err := iit.checkRetained(startTxNum, endTxNum, asc); err != nil {
+		return nil, err
+	}
 	frozenIt, err := iit.iterateRangeFrozen(key, startTxNum, endTxNum, asc, limit)
 	if err != nil {
 		return nil, err
@@ -666,6 +676,24 @@ func (iit *InvertedIndexRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc
 	return stream.Union[uint64](frozenIt, recentIt, asc, limit), nil
 }
 
+// checkRetained - returns ErrHistoryPruned if retention policy is set and range [startTxNum; endTxNum) starts before first file
+func (iit *InvertedIndexRoTx) checkRetained(startTxNum, endTxNum int, asc order.By) error {
+	if !iit.ii.retained.Load() || len(iit.files) == 0 {
+		return nil
+	}
+	lowerTxNum := startTxNum
+	if !asc {
+		if endTxNum < 0 {
+			return nil
+		}
+		lowerTxNum = endTxNum + 1
+	}
+	if lowerTxNum >= 0 && uint64(lowerTxNum) < iit.files[0].startTxNum {
+		return fmt.Errorf("%w: %s txNum=%d, first available=%d", ErrHistoryPruned, iit.ii.filenameBase, lowerTxNum, iit.files[0].startTxNum)
+	}
+	return nil
+}
+
 func (iit *InvertedIndexRoTx) recentIterateRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (stream.U64, error) {
 	//optimization: return empty pre-allocated iterator if range is frozen
 	if asc {
@@ -1490,6 +1518,7 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		}
 	}()
 
+	iot := ioTaskFromCtx(ctx)
 	comp, err := seg.NewCompressor(ctx, "collate idx "+ii.filenameBase, coll.iiPath, ii.dirs.Tmp, ii.compressCfg, log.LvlTrace, ii.logger)
 	if err != nil {
 		return InvertedIndexCollation{}, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
@@ -1533,6 +1562,9 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		if err = coll.writer.AddWord(prevEf); err != nil {
 			return fmt.Errorf("add %s efi index val: %w", ii.filenameBase, err)
 		}
+		if err = iot.accountRead(ctx, len(prevKey)+len(prevEf)); err != nil {
+			return err
+		}
 
 		prevKey = append(prevKey[:0], k...)
 		txNum = binary.BigEndian.Uint64(v)
@@ -1570,6 +1602,19 @@ func (sf InvertedFiles) CleanupOnError() {
 	}
 }
 
+func (sf InvertedFiles) filePaths() (paths []string) {
+	if sf.decomp != nil {
+		paths = append(paths, sf.decomp.FilePath())
+	}
+	if sf.index != nil {
+		paths = append(paths, sf.index.FilePath())
+	}
+	if sf.existence != nil {
+		paths = append(paths, sf.existence.FilePath)
+	}
+	return paths
+}
+
 type InvertedIndexCollation struct {
 	iiPath string
 	writer *seg.Writer
@@ -0,0 +1,364 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/metrics"
+)
+
+var (
+	mxIOQueue     = metrics.GetOrCreateGauge("domain_io_queue")
+	mxIOPaused    = metrics.GetOrCreateGauge("domain_io_paused")
+	mxIOReadSize  = metrics.GetOrCreateCounter(`domain_io_size{type="read"}`)
+	mxIOWriteSize = metrics.GetOrCreateCounter(`domain_io_size{type="write"}`)
+	mxIOThrottled = metrics.GetOrCreateSummary("domain_io_throttled")
+)
+
+// IOPriority - lower value served first
+type IOPriority uint8
+
+const (
+	IOPriorityBuild      IOPriority = iota // moving data from DB to files - to keep DB small
+	IOPriorityMerge                        // merging small files to bigger ones
+	IOPriorityBackground                   // optional indices, storage tiers migration, etc...
+)
+
+func (p IOPriority) String() string {
+	switch p {
+	case IOPriorityBuild:
+		return "build"
+	case IOPriorityMerge:
+		return "merge"
+	case IOPriorityBackground:
+		return "background"
+	default:
+		return fmt.Sprintf("unknown io priority: %d", p)
+	}
+}
+
+// ioChunk - tasks account IO by chunks: to not touch scheduler's lock on every word
+const ioChunk = 1 * datasize.MB
+
+// ioBucket - token bucket. rate=0 means unlimited.
+type ioBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *ioBucket) set(rate datasize.ByteSize) {
+	b.rate = float64(rate.Bytes())
+	b.burst = b.rate // 1 second of IO
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	}
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// wait - how long to wait until `n` bytes are available. Requests bigger than `burst` are served when bucket is full.
+func (b *ioBucket) wait(now time.Time, n float64) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	need := min(n, b.burst)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *ioBucket) take(n float64) {
+	if b.rate == 0 {
+		return
+	}
+	b.tokens -= n // may go below zero: next requests will wait longer
+}
+
+// IOScheduler - shared IO budget for background files building/merging.
+//   - token-bucket budget for read and write bytes per second
+//   - read: data read by collate/merge loops (see ioTask.accountRead) and by files copy
+//   - write: size of produced files - compressed data, accessors and existence filters (see ioTask.accountFiles).
+//     Compressor and index builders write and fsync files without throttling, so files are accounted after they
+//     are written: task waits before next IO, and other tasks wait for restored budget.
+//   - tasks waiting for budget are served by priority: build before merge, small before large
+//   - merge and background tasks can be paused (for example while node is far from chain-tip)
+type IOScheduler struct {
+	lock        sync.Mutex
+	read, write ioBucket
+	waiting     map[*ioTask]struct{}
+	tasks       map[*ioTask]struct{}
+
+	paused   atomic.Bool
+	pauseIf  atomic.Pointer[func() bool]
+	readSum  atomic.Uint64
+	writeSum atomic.Uint64
+	started  time.Time
+}
+
+func NewIOScheduler() *IOScheduler {
+	return &IOScheduler{waiting: map[*ioTask]struct{}{}, tasks: map[*ioTask]struct{}{}, started: time.Now()}
+}
+
+// SetBudget - read/write bytes per second. 0 means unlimited.
+func (s *IOScheduler) SetBudget(read, write datasize.ByteSize) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.read.set(read)
+	s.write.set(write)
+}
+
+// Pause - merge and background tasks will stop on next IO. Build tasks are never paused - DB must not grow.
+func (s *IOScheduler) Pause()  { s.paused.Store(true); mxIOPaused.SetInt(1) }
+func (s *IOScheduler) Resume() { s.paused.Store(false); mxIOPaused.SetInt(0) }
+
+// PauseIf - hook checked on every IO chunk. For example: `func() bool { return chainTipLag() > 64 }`
+// to give all disk bandwidth to execution while node is catching up. nil removes hook.
+func (s *IOScheduler) PauseIf(f func() bool) {
+	if f == nil {
+		s.pauseIf.Store(nil)
+		return
+	}
+	s.pauseIf.Store(&f)
+}
+
+func (s *IOScheduler) isPaused(p IOPriority) bool {
+	if p == IOPriorityBuild {
+		return false
+	}
+	if s.paused.Load() {
+		return true
+	}
+	if f := s.pauseIf.Load(); f != nil {
+		return (*f)()
+	}
+	return false
+}
+
+// begin - registers task in queue. Task must be finished by `end`. nil-safe.
+func (s *IOScheduler) begin(ctx context.Context, p IOPriority, size uint64, name string) (context.Context, *ioTask) {
+	if s == nil {
+		return ctx, nil
+	}
+	t := &ioTask{s: s, priority: p, size: size, name: name}
+	s.lock.Lock()
+	s.tasks[t] = struct{}{}
+	mxIOQueue.SetInt(len(s.tasks))
+	s.lock.Unlock()
+	return context.WithValue(ctx, ioTaskCtxKey{}, t), t
+}
+
+func (s *IOScheduler) end(t *ioTask) {
+	if t == nil {
+		return
+	}
+	t.flush()
+	s.lock.Lock()
+	delete(s.tasks, t)
+	mxIOQueue.SetInt(len(s.tasks))
+	s.lock.Unlock()
+}
+
+// hasBetterWaiter - is somebody with higher priority waiting for budget. must be called under lock.
+func (s *IOScheduler) hasBetterWaiter(t *ioTask) bool {
+	for w := range s.waiting {
+		if w.less(t) {
+			return true
+		}
+	}
+	return false
+}
+
+const ioPausePollInterval = 100 * time.Millisecond
+
+func (s *IOScheduler) wait(ctx context.Context, t *ioTask, readN, writeN uint64) error {
+	startedAt := time.Now()
+	throttled := false
+	s.lock.Lock()
+	s.waiting[t] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.waiting, t)
+		s.lock.Unlock()
+		if throttled {
+			mxIOThrottled.ObserveDuration(startedAt)
+		}
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for {
+		d := ioPausePollInterval
+		if !s.isPaused(t.priority) {
+			s.lock.Lock()
+			if !s.hasBetterWaiter(t) {
+				now := time.Now()
+				d = max(s.read.wait(now, float64(readN)), s.write.wait(now, float64(writeN)))
+				if d == 0 {
+					s.read.take(float64(readN))
+					s.write.take(float64(writeN))
+					s.lock.Unlock()
+					s.readSum.Add(readN)
+					s.writeSum.Add(writeN)
+					mxIOReadSize.AddUint64(readN)
+					mxIOWriteSize.AddUint64(writeN)
+					return nil
+				}
+			} else {
+				d = time.Millisecond
+			}
+			s.lock.Unlock()
+		}
+		throttled = true
+		timer.Reset(d)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// String - queue and throughput. Used by `Aggregator.BackgroundProgress`
+func (s *IOScheduler) String() string {
+	s.lock.Lock()
+	tasks := make([]*ioTask, 0, len(s.tasks))
+	for t := range s.tasks {
+		tasks = append(tasks, t)
+	}
+	s.lock.Unlock()
+	if len(tasks) == 0 {
+		return ""
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].less(tasks[j]) })
+
+	var sb strings.Builder
+	sb.WriteString("io: ")
+	for i, t := range tasks {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("%s(%s)=%s", t.priority, t.name, common.ByteCount(t.done.Load())))
+	}
+	took := time.Since(s.started).Seconds()
+	sb.WriteString(fmt.Sprintf("; read=%s/s, write=%s/s", common.ByteCount(uint64(float64(s.readSum.Load())/took)), common.ByteCount(uint64(float64(s.writeSum.Load())/took))))
+	if s.paused.Load() {
+		sb.WriteString("; paused")
+	}
+	return sb.String()
+}
+
+type ioTaskCtxKey struct{}
+
+func ioTaskFromCtx(ctx context.Context) *ioTask {
+	t, _ := ctx.Value(ioTaskCtxKey{}).(*ioTask)
+	return t
+}
+
+// ioTask - unit of background work (build of step, merge of range, ...). nil-safe: nil means "not throttled".
+type ioTask struct {
+	s        *IOScheduler
+	priority IOPriority
+	size     uint64 // in txNums. smaller tasks served first
+	name     string
+
+	pendingRead, pendingWrite atomic.Uint64
+	done                      atomic.Uint64
+}
+
+func (t *ioTask) less(o *ioTask) bool {
+	if t.priority != o.priority {
+		return t.priority < o.priority
+	}
+	return t.size < o.size
+}
+
+// accountRead - accounts data read by collate/merge loops. Blocks when accumulated chunk exceeds budget.
+func (t *ioTask) accountRead(ctx context.Context, n int) error { return t.throttle(ctx, n, 0) }
+
+// accountFiles - accounts size of files produced by task as written. Missing files are ignored.
+func (t *ioTask) accountFiles(ctx context.Context, paths []string) error {
+	if t == nil {
+		return nil
+	}
+	var n int64
+	for _, fPath := range paths {
+		if st, err := os.Stat(fPath); err == nil {
+			n += st.Size()
+		}
+	}
+	return t.throttle(ctx, 0, int(n))
+}
+
+// throttle - accounts IO. Blocks when accumulated chunk exceeds budget. Safe for concurrent use.
+func (t *ioTask) throttle(ctx context.Context, readN, writeN int) error {
+	if t == nil {
+		return nil
+	}
+	r, w := t.pendingRead.Add(uint64(readN)), t.pendingWrite.Add(uint64(writeN))
+	if r+w < uint64(ioChunk) {
+		return nil
+	}
+	r, w = t.pendingRead.Swap(0), t.pendingWrite.Swap(0)
+	t.done.Add(r + w)
+	return t.s.wait(ctx, t, r, w)
+}
+
+func (t *ioTask) flush() {
+	r, w := t.pendingRead.Swap(0), t.pendingWrite.Swap(0)
+	t.done.Add(r + w)
+	t.s.readSum.Add(r)
+	t.s.writeSum.Add(w)
+	mxIOReadSize.AddUint64(r)
+	mxIOWriteSize.AddUint64(w)
+}
+
+// ioThrottledReader - accounts every read as read and write (used for copy)
+type ioThrottledReader struct {
+	ctx context.Context
+	t   *ioTask
+	r   io.Reader
+}
+
+func (r *ioThrottledReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if n > 0 {
+		if terr := r.t.throttle(r.ctx, n, n); terr != nil {
+			return n, terr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOScheduler_Budget(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	s := NewIOScheduler()
+	s.SetBudget(0, 1000)
+	ctx, task := s.begin(ctx, IOPriorityMerge, 1, "test")
+	defer s.end(task)
+
+	start := time.Now()
+	require.NoError(t, s.wait(ctx, task, 0, 1000)) // bucket is full at start
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	start = time.Now()
+	require.NoError(t, s.wait(ctx, task, 0, 500))
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	// unlimited
+	s.SetBudget(0, 0)
+	start = time.Now()
+	require.NoError(t, s.wait(ctx, task, 1<<30, 1<<30))
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	s.SetBudget(0, 1)
+	require.ErrorIs(t, s.wait(cancelCtx, task, 0, 1000), context.Canceled)
+}
+
+func TestIOScheduler_Priority(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	s := NewIOScheduler()
+	s.SetBudget(0, 1000)
+	_, merge := s.begin(ctx, IOPriorityMerge, 64, "merge")
+	defer s.end(merge)
+	_, smallMerge := s.begin(ctx, IOPriorityMerge, 2, "small merge")
+	defer s.end(smallMerge)
+	_, build := s.begin(ctx, IOPriorityBuild, 1, "build")
+	defer s.end(build)
+	require.NoError(t, s.wait(ctx, merge, 0, 1000)) // drain bucket
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for _, task := range []*ioTask{merge, smallMerge, build} {
+		task := task
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, s.wait(ctx, task, 0, 200))
+			mu.Lock()
+			order = append(order, task.name)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, []string{"build", "small merge", "merge"}, order)
+	require.Contains(t, s.String(), "io: build(build)=0B, merge(small merge)=0B, merge(merge)=0B;")
+}
+
+func TestIOScheduler_Pause(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	s := NewIOScheduler()
+	_, merge := s.begin(ctx, IOPriorityMerge, 64, "merge")
+	defer s.end(merge)
+	_, build := s.begin(ctx, IOPriorityBuild, 1, "build")
+	defer s.end(build)
+
+	s.Pause()
+	require.NoError(t, s.wait(ctx, build, 1, 1)) // build is never paused
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, s.wait(ctx, merge, 1, 1))
+	}()
+	select {
+	case <-done:
+		t.Fatal("merge must wait while paused")
+	case <-time.After(2 * ioPausePollInterval):
+	}
+	s.Resume()
+	<-done
+
+	var lag = 100
+	s.PauseIf(func() bool { return lag > 64 })
+	shortCtx, cancel := context.WithTimeout(ctx, 2*ioPausePollInterval)
+	defer cancel()
+	require.ErrorIs(t, s.wait(shortCtx, merge, 1, 1), context.DeadlineExceeded)
+	s.PauseIf(nil)
+	require.NoError(t, s.wait(ctx, merge, 1, 1))
+}
+
+func TestIOTask_Throttle(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var nilTask *ioTask
+	require.NoError(t, nilTask.throttle(ctx, 1, 1))
+	require.Nil(t, ioTaskFromCtx(ctx))
+
+	s := NewIOScheduler()
+	ctx, task := s.begin(ctx, IOPriorityBuild, 1, "build")
+	require.Equal(t, task, ioTaskFromCtx(ctx))
+	require.NoError(t, task.throttle(ctx, int(ioChunk), 0))
+	require.NoError(t, task.throttle(ctx, 0, 10))
+	require.Equal(t, uint64(ioChunk), task.done.Load())
+	s.end(task)
+	require.Equal(t, uint64(ioChunk)+10, task.done.Load())
+	require.Equal(t, uint64(ioChunk), s.readSum.Load())
+	require.Equal(t, uint64(10), s.writeSum.Load())
+	require.Empty(t, s.String())
+}
+
+func TestIOTask_AccountFiles(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir := t.TempDir()
+	f1, f2 := filepath.Join(dir, "v1-accounts.0-1.kv"), filepath.Join(dir, "v1-accounts.0-1.kvi")
+	require.NoError(t, os.WriteFile(f1, make([]byte, 100), 0644))
+	require.NoError(t, os.WriteFile(f2, make([]byte, 20), 0644))
+
+	var nilTask *ioTask
+	require.NoError(t, nilTask.accountFiles(ctx, []string{f1}))
+
+	s := NewIOScheduler()
+	ctx, task := s.begin(ctx, IOPriorityMerge, 1, "merge")
+	require.NoError(t, task.accountRead(ctx, 5))
+	require.NoError(t, task.accountFiles(ctx, []string{f1, f2, filepath.Join(dir, "missing.kv")}))
+	s.end(task)
+	require.Equal(t, uint64(5), s.readSum.Load())
+	require.Equal(t, uint64(120), s.writeSum.Load())
+}
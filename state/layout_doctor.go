@@ -0,0 +1,518 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+var ErrLayoutRepairBusy = errors.New("layout repair: files build or merge in progress")
+
+// layoutFileVersion - version of files which this code produces and reads, see kvFilePath, vFilePath, efFilePath
+const layoutFileVersion = 1
+
+// LayoutIssueKind - problem of files layout in snapshots dirs. `scanDirtyFiles` silently skips such files
+type LayoutIssueKind uint8
+
+const (
+	LayoutGap             LayoutIssueKind = iota // steps are not covered by files
+	LayoutOverlap                                // files partially overlap: none of them is subset of another
+	LayoutRedundant                              // file is subset of bigger file: leftover of merge
+	LayoutCorrupted                              // data file can't be opened
+	LayoutPartial                                // .tmp file: leftover of interrupted write
+	LayoutMissedAccessor                         // data file has no accessor
+	LayoutOrphanAccessor                         // accessor has no data file
+	LayoutFilesAhead                             // history files after end of domain files (or vice versa): ignored on open, see protectFromHistoryFilesAheadOfDomainFiles
+	LayoutVersionMismatch                        // file of version which is not supported
+)
+
+func (k LayoutIssueKind) String() string {
+	switch k {
+	case LayoutGap:
+		return "gap"
+	case LayoutOverlap:
+		return "overlap"
+	case LayoutRedundant:
+		return "redundant"
+	case LayoutCorrupted:
+		return "corrupted"
+	case LayoutPartial:
+		return "partial"
+	case LayoutMissedAccessor:
+		return "missed accessor"
+	case LayoutOrphanAccessor:
+		return "orphan accessor"
+	case LayoutFilesAhead:
+		return "files ahead"
+	case LayoutVersionMismatch:
+		return "version mismatch"
+	default:
+		return fmt.Sprintf("unknown layout issue: %d", k)
+	}
+}
+
+// LayoutFix - safe fix of LayoutIssue, applied by RepairLayout
+type LayoutFix uint8
+
+const (
+	LayoutFixNone           LayoutFix = iota // requires operator's decision
+	LayoutFixDelete                          // remove files
+	LayoutFixBuildAccessors                  // build missed accessors, see BuildMissedIndices
+	LayoutFixMerge                           // remove files, then merge smaller files which cover same steps
+	LayoutFixDownload                        // remove local copy (if any): steps must be downloaded again
+)
+
+func (f LayoutFix) String() string {
+	switch f {
+	case LayoutFixNone:
+		return "none"
+	case LayoutFixDelete:
+		return "delete"
+	case LayoutFixBuildAccessors:
+		return "build accessors"
+	case LayoutFixMerge:
+		return "merge"
+	case LayoutFixDownload:
+		return "download"
+	default:
+		return fmt.Sprintf("unknown layout fix: %d", f)
+	}
+}
+
+type LayoutIssue struct {
+	Kind             LayoutIssueKind
+	Name             string // domain or inverted index
+	FileKind         TierFileKind
+	FromStep, ToStep uint64
+	Files            []string // affected files
+	Fix              LayoutFix
+
+	paths []string // files removed by fix
+}
+
+func (i LayoutIssue) String() string {
+	s := fmt.Sprintf("%s(%s.%s=%d-%d): fix=%s", i.Kind, i.Name, i.FileKind, i.FromStep, i.ToStep, i.Fix)
+	if len(i.Files) > 0 {
+		s += ", files=" + strings.Join(i.Files, ",")
+	}
+	return s
+}
+
+type LayoutReport struct {
+	Issues []LayoutIssue
+}
+
+func (r *LayoutReport) Empty() bool { return len(r.Issues) == 0 }
+
+// WithFix - for example: LayoutFixDownload - steps which must be downloaded again
+func (r *LayoutReport) WithFix(fix LayoutFix) (issues []LayoutIssue) {
+	for _, i := range r.Issues {
+		if i.Fix == fix {
+			issues = append(issues, i)
+		}
+	}
+	return issues
+}
+
+func (r *LayoutReport) String() string {
+	ss := make([]string, 0, len(r.Issues))
+	for _, i := range r.Issues {
+		ss = append(ss, i.String())
+	}
+	return strings.Join(ss, "; ")
+}
+
+// layoutGroup - data files of one kind of domain or inverted index, and their accessors
+type layoutGroup struct {
+	name      string
+	kind      TierFileKind
+	dir, ext  string
+	accessors []layoutAccessor
+	fromZero  bool // history may start later: pruned by retention
+	domain    bool // files of domain: values, history or it's index
+	tiers     *storageTiers
+}
+
+type layoutAccessor struct {
+	dir, ext string
+}
+
+func (a *Aggregator) layoutGroups() (groups []layoutGroup) {
+	efi := []layoutAccessor{{a.dirs.SnapAccessors, "efi"}}
+	for _, d := range a.d {
+		var accessors []layoutAccessor
+		if UseBpsTree {
+			accessors = append(accessors, layoutAccessor{a.dirs.SnapDomain, "bt"})
+			if d.indexList&withExistence != 0 {
+				accessors = append(accessors, layoutAccessor{a.dirs.SnapDomain, "kvei"})
+			}
+		} else {
+			accessors = append(accessors, layoutAccessor{a.dirs.SnapDomain, "kvi"})
+		}
+		groups = append(groups, layoutGroup{name: d.filenameBase, kind: TierFileDomain, dir: a.dirs.SnapDomain, ext: "kv", accessors: accessors, fromZero: true, domain: true, tiers: a.tiers})
+		if d.History.snapshotsDisabled {
+			continue
+		}
+		groups = append(groups,
+			layoutGroup{name: d.filenameBase, kind: TierFileHistory, dir: a.dirs.SnapHistory, ext: "v", accessors: []layoutAccessor{{a.dirs.SnapAccessors, "vi"}}, domain: true, tiers: a.tiers},
+			layoutGroup{name: d.filenameBase, kind: TierFileIdx, dir: a.dirs.SnapIdx, ext: "ef", accessors: efi, domain: true, tiers: a.tiers})
+	}
+	for _, ii := range a.iis {
+		groups = append(groups, layoutGroup{name: ii.filenameBase, kind: TierFileIdx, dir: a.dirs.SnapIdx, ext: "ef", accessors: efi, tiers: a.tiers})
+	}
+	return groups
+}
+
+var layoutFileRe = regexp.MustCompile(`^v([0-9]+)-([a-zA-Z0-9]+)\.([0-9]+)-([0-9]+)\.(.+)$`)
+
+type layoutFile struct {
+	name             string
+	version          uint64
+	fromStep, toStep uint64
+	ext              string
+}
+
+func parseLayoutFile(name string) (f layoutFile, base string, ok bool) {
+	subs := layoutFileRe.FindStringSubmatch(name)
+	if len(subs) != 6 {
+		return f, "", false
+	}
+	var err error
+	f.name, base, f.ext = name, subs[2], subs[5]
+	if f.version, err = strconv.ParseUint(subs[1], 10, 64); err != nil {
+		return f, "", false
+	}
+	if f.fromStep, err = strconv.ParseUint(subs[3], 10, 64); err != nil {
+		return f, "", false
+	}
+	if f.toStep, err = strconv.ParseUint(subs[4], 10, 64); err != nil {
+		return f, "", false
+	}
+	return f, base, f.fromStep < f.toStep
+}
+
+func (f layoutFile) isSubsetOf(o layoutFile) bool {
+	return o.fromStep <= f.fromStep && f.toStep <= o.toStep && (o.fromStep != f.fromStep || o.toStep != f.toStep)
+}
+
+// canonical - range which can be produced by merge: aligned power of 2 steps
+func (f layoutFile) canonical() bool {
+	span := f.toStep - f.fromStep
+	return span&(span-1) == 0 && f.fromStep%span == 0
+}
+
+// DiagnoseLayout - checks files in snapshots dirs (all tiers). Doesn't change anything, see RepairLayout.
+// Must be called when files are not built or merged: otherwise may report their intermediate state.
+func (a *Aggregator) DiagnoseLayout() (*LayoutReport, error) {
+	listings := map[string][]string{}
+	list := func(dir string) ([]string, error) {
+		if names, ok := listings[dir]; ok {
+			return names, nil
+		}
+		names, err := a.tiers.filesFromDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		listings[dir] = names
+		return names, nil
+	}
+
+	report := &LayoutReport{}
+	groups := a.layoutGroups()
+	scans := make([]*layoutScan, 0, len(groups))
+	for _, g := range groups {
+		names, err := list(g.dir)
+		if err != nil {
+			return nil, err
+		}
+		s := &layoutScan{g: g, accessorNames: make([]map[string]struct{}, len(g.accessors))}
+		for i, acc := range g.accessors {
+			names, err := list(acc.dir)
+			if err != nil {
+				return nil, err
+			}
+			s.accessorNames[i] = map[string]struct{}{}
+			for _, name := range names {
+				if f, base, ok := parseLayoutFile(name); ok && base == g.name && f.ext == acc.ext {
+					s.accessorNames[i][name] = struct{}{}
+				}
+			}
+		}
+		a.scanLayoutGroup(s, names, report)
+		scans = append(scans, s)
+	}
+
+	// like `Domain.dirtyFilesEndTxNumMinimax`: on open, files of domain after this step are closed
+	aheadFrom := map[string]uint64{}
+	for _, s := range scans {
+		if !s.g.domain || len(s.kept) == 0 {
+			continue
+		}
+		end := s.kept[len(s.kept)-1].toStep
+		if minimax, ok := aheadFrom[s.g.name]; !ok || end < minimax {
+			aheadFrom[s.g.name] = end
+		}
+	}
+	for _, s := range scans {
+		minimax, ok := aheadFrom[s.g.name]
+		if !s.g.domain || !ok {
+			minimax = math.MaxUint64
+		}
+		a.checkLayoutGroup(s, minimax, report)
+	}
+	return report, nil
+}
+
+// layoutScan - files of layoutGroup found on disk
+type layoutScan struct {
+	g             layoutGroup
+	accessorNames []map[string]struct{}
+	files         []layoutFile // data files of supported version
+	kept          []layoutFile // files which must stay: not redundant or overlapping
+}
+
+func (s *layoutScan) issue(kind LayoutIssueKind, fix LayoutFix, fromStep, toStep uint64, files ...layoutFile) LayoutIssue {
+	i := LayoutIssue{Kind: kind, Name: s.g.name, FileKind: s.g.kind, FromStep: fromStep, ToStep: toStep, Fix: fix}
+	for _, f := range files {
+		i.Files = append(i.Files, f.name)
+		i.paths = append(i.paths, s.g.tiers.resolve(filepath.Join(s.g.dir, f.name)))
+	}
+	return i
+}
+
+// issueWithAccessors - issue of data file and it's accessors
+func (s *layoutScan) issueWithAccessors(kind LayoutIssueKind, fix LayoutFix, f layoutFile) LayoutIssue {
+	i := s.issue(kind, fix, f.fromStep, f.toStep, f)
+	for j, acc := range s.g.accessors {
+		name := strings.TrimSuffix(f.name, s.g.ext) + acc.ext
+		if _, ok := s.accessorNames[j][name]; ok {
+			i.Files = append(i.Files, name)
+			i.paths = append(i.paths, filepath.Join(acc.dir, name))
+		}
+	}
+	return i
+}
+
+// scanLayoutGroup - finds partial, redundant, overlapping files and orphan accessors
+func (a *Aggregator) scanLayoutGroup(s *layoutScan, names []string, report *LayoutReport) {
+	g := s.g
+	for _, name := range names {
+		f, base, ok := parseLayoutFile(name)
+		if !ok || base != g.name {
+			continue
+		}
+		switch {
+		case f.ext == g.ext+".tmp":
+			report.Issues = append(report.Issues, s.issue(LayoutPartial, LayoutFixDelete, f.fromStep, f.toStep, f))
+		case f.ext != g.ext:
+		case f.version != layoutFileVersion:
+			report.Issues = append(report.Issues, s.issue(LayoutVersionMismatch, LayoutFixNone, f.fromStep, f.toStep, f))
+		default:
+			s.files = append(s.files, f)
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool {
+		if s.files[i].fromStep == s.files[j].fromStep {
+			return s.files[i].toStep > s.files[j].toStep
+		}
+		return s.files[i].fromStep < s.files[j].fromStep
+	})
+
+	// partial overlaps: merge produces only canonical ranges - non-canonical file is removed if canonical files cover it's steps
+	var canonical, rest []layoutFile
+	for _, f := range s.files {
+		if f.canonical() {
+			canonical = append(canonical, f)
+		}
+	}
+	for _, f := range s.files {
+		if !f.canonical() && overlapsLayoutFiles(f, s.files) && coveredByLayoutFiles(f, canonical) {
+			report.Issues = append(report.Issues, s.issueWithAccessors(LayoutOverlap, LayoutFixMerge, f))
+			continue
+		}
+		rest = append(rest, f)
+	}
+
+	// sorted by fromStep, bigger first: subset is after it's superset
+	for _, f := range rest {
+		if len(s.kept) == 0 {
+			s.kept = append(s.kept, f)
+			continue
+		}
+		prev := s.kept[len(s.kept)-1]
+		if f.isSubsetOf(prev) {
+			report.Issues = append(report.Issues, s.issueWithAccessors(LayoutRedundant, LayoutFixDelete, f))
+			continue
+		}
+		if f.fromStep < prev.toStep {
+			report.Issues = append(report.Issues, s.issue(LayoutOverlap, LayoutFixNone, f.fromStep, prev.toStep, prev, f))
+		}
+		s.kept = append(s.kept, f)
+	}
+
+	for j, acc := range g.accessors {
+		for name := range s.accessorNames[j] {
+			f, _, _ := parseLayoutFile(name)
+			if f.version != layoutFileVersion {
+				continue // see LayoutVersionMismatch
+			}
+			if !containsLayoutFile(s.files, strings.TrimSuffix(name, acc.ext)+g.ext) {
+				i := LayoutIssue{Kind: LayoutOrphanAccessor, Name: g.name, FileKind: g.kind, FromStep: f.fromStep, ToStep: f.toStep, Fix: LayoutFixDelete,
+					Files: []string{name}, paths: []string{filepath.Join(acc.dir, name)}}
+				report.Issues = append(report.Issues, i)
+			}
+		}
+	}
+}
+
+// checkLayoutGroup - finds gaps, files ahead of `aheadFrom` step, corrupted files and missed accessors
+func (a *Aggregator) checkLayoutGroup(s *layoutScan, aheadFrom uint64, report *LayoutReport) {
+	g := s.g
+	var cursor uint64
+	if !g.fromZero && len(s.kept) > 0 {
+		cursor = s.kept[0].fromStep
+	}
+	for _, f := range s.kept {
+		if f.fromStep >= aheadFrom {
+			report.Issues = append(report.Issues, s.issueWithAccessors(LayoutFilesAhead, LayoutFixDelete, f))
+			continue
+		}
+		if f.fromStep > cursor {
+			report.Issues = append(report.Issues, s.issue(LayoutGap, LayoutFixDownload, cursor, f.fromStep))
+		}
+		cursor = max(cursor, f.toStep)
+
+		d, err := seg.NewDecompressor(g.tiers.resolve(filepath.Join(g.dir, f.name)))
+		if err != nil {
+			report.Issues = append(report.Issues, s.issueWithAccessors(LayoutCorrupted, LayoutFixDownload, f))
+			continue
+		}
+		d.Close()
+		for j, acc := range g.accessors {
+			if _, ok := s.accessorNames[j][strings.TrimSuffix(f.name, g.ext)+acc.ext]; !ok {
+				report.Issues = append(report.Issues, s.issue(LayoutMissedAccessor, LayoutFixBuildAccessors, f.fromStep, f.toStep, f))
+				break
+			}
+		}
+	}
+}
+
+// overlapsLayoutFiles - `f` partially overlaps with some of `files`: none of them is subset of another
+func overlapsLayoutFiles(f layoutFile, files []layoutFile) bool {
+	for _, o := range files {
+		if f.fromStep < o.toStep && o.fromStep < f.toStep && !f.isSubsetOf(o) && !o.isSubsetOf(f) && f.name != o.name {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredByLayoutFiles - steps of `f` are covered by other files (sorted by fromStep)
+func coveredByLayoutFiles(f layoutFile, files []layoutFile) bool {
+	cursor := f.fromStep
+	for _, o := range files {
+		if o.name == f.name || o.toStep <= cursor {
+			continue
+		}
+		if o.fromStep > cursor {
+			break
+		}
+		cursor = o.toStep
+	}
+	return cursor >= f.toStep
+}
+
+func containsLayoutFile(files []layoutFile, name string) bool {
+	for _, f := range files {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RepairLayout - applies fixes of report (all if `fixes` is empty), then re-opens files. LayoutFixNone is never applied.
+// Must not be called while readers use files: removed files are closed.
+func (a *Aggregator) RepairLayout(ctx context.Context, report *LayoutReport, fixes ...LayoutFix) error {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
+	if !a.buildingFiles.CompareAndSwap(false, true) {
+		return ErrLayoutRepairBusy
+	}
+	defer a.buildingFiles.Store(false)
+	if !a.mergingFiles.CompareAndSwap(false, true) {
+		return ErrLayoutRepairBusy
+	}
+	defer a.mergingFiles.Store(false)
+
+	var buildAccessors, merge bool
+	for _, i := range report.Issues {
+		if i.Fix == LayoutFixNone || (len(fixes) > 0 && !containsLayoutFix(fixes, i.Fix)) {
+			continue
+		}
+		switch i.Fix {
+		case LayoutFixBuildAccessors:
+			buildAccessors = true
+			continue
+		case LayoutFixMerge:
+			merge = true
+		}
+		for _, fPath := range i.paths {
+			if err := os.Remove(fPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("RepairLayout: %w", err)
+			}
+			_ = os.Remove(fPath + ".torrent")
+		}
+		a.logger.Info("[snapshots] repair layout", "issue", i.String())
+	}
+
+	if err := a.OpenFolder(); err != nil {
+		return err
+	}
+	if buildAccessors {
+		if err := a.BuildMissedIndices(ctx, a.collateAndBuildWorkers); err != nil {
+			return err
+		}
+	}
+	if merge {
+		if err := a.MergeLoop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsLayoutFix(fixes []LayoutFix, fix LayoutFix) bool {
+	for _, f := range fixes {
+		if f == fix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestAggregatorV3_RepairLayout(t *testing.T) {
+	t.Parallel()
+
+	aggStep := uint64(10)
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+	dirs := agg.dirs
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := aggStep * 4
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		_, err := rnd.Read(addr[:2])
+		require.NoError(t, err)
+		err = domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0), nil, 0)
+		require.NoError(t, err)
+		err = domains.DomainPut(kv.CodeDomain, addr, nil, addr, nil, 0)
+		require.NoError(t, err)
+	}
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, agg.BuildFiles(txs))
+	require.NoError(t, agg.MergeLoop(ctx))
+
+	report, err := agg.DiagnoseLayout()
+	require.NoError(t, err)
+	require.True(t, report.Empty(), report.String())
+
+	copyFile := func(from, to string) {
+		t.Helper()
+		data, err := os.ReadFile(from)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(to, data, 0644))
+	}
+	accounts, code, receipt := agg.d[kv.AccountsDomain], agg.d[kv.CodeDomain], agg.d[kv.ReceiptDomain]
+	copyFile(accounts.kvFilePath(0, 4), accounts.kvFilePath(0, 1))
+	require.NoError(t, os.Remove(accounts.kvBtFilePath(0, 4)))
+	copyFile(accounts.History.vAccessorFilePath(0, 4), accounts.History.vAccessorFilePath(8, 9))
+	require.NoError(t, os.WriteFile(accounts.kvFilePath(4, 5)+".tmp", []byte("partial"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dirs.SnapDomain, "v2-code.0-4.kv"), []byte("v2"), 0644))
+	logAddrs := agg.iis[kv.LogAddrIdxPos]
+	require.NoError(t, os.WriteFile(logAddrs.efFilePath(6, 8), []byte("corrupted"), 0644))
+	copyFile(code.History.vFilePath(0, 4), code.History.vFilePath(4, 5))
+	copyFile(receipt.kvFilePath(0, 4), receipt.kvFilePath(2, 5))
+	copyFile(receipt.kvFilePath(0, 4), receipt.kvFilePath(4, 5))
+
+	report, err = agg.DiagnoseLayout()
+	require.NoError(t, err)
+	issues := map[string]LayoutFix{}
+	for _, i := range report.Issues {
+		issues[fmt.Sprintf("%s(%s.%s=%d-%d)", i.Kind, i.Name, i.FileKind, i.FromStep, i.ToStep)] = i.Fix
+	}
+	require.Equal(t, map[string]LayoutFix{
+		"redundant(accounts.domain=0-1)":        LayoutFixDelete,
+		"missed accessor(accounts.domain=0-4)":  LayoutFixBuildAccessors,
+		"orphan accessor(accounts.history=8-9)": LayoutFixDelete,
+		"partial(accounts.domain=4-5)":          LayoutFixDelete,
+		"version mismatch(code.domain=0-4)":     LayoutFixNone,
+		"gap(logaddrs.idx=4-6)":                 LayoutFixDownload,
+		"corrupted(logaddrs.idx=6-8)":           LayoutFixDownload,
+		"files ahead(code.history=4-5)":         LayoutFixDelete,
+		"overlap(receipt.domain=2-5)":           LayoutFixMerge,
+		"files ahead(receipt.domain=4-5)":       LayoutFixDelete,
+	}, issues, report.String())
+	require.Len(t, report.WithFix(LayoutFixDownload), 2)
+
+	require.NoError(t, agg.RepairLayout(ctx, report))
+
+	report, err = agg.DiagnoseLayout()
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 1, report.String())
+	require.Equal(t, LayoutVersionMismatch, report.Issues[0].Kind)
+
+	exists, err := dir.FileExist(accounts.kvBtFilePath(0, 4))
+	require.NoError(t, err)
+	require.True(t, exists)
+	exists, err = dir.FileExist(receipt.kvFilePath(2, 5))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	require.Equal(t, uint64(4), ac.d[kv.AccountsDomain].FirstStepNotInFiles())
+}
@@ -432,6 +432,7 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 	}
 	p := ps.AddNew("merge "+path.Base(kvFilePath), 1)
 	defer ps.Delete(p)
+	iot := ioTaskFromCtx(ctx)
 
 	var cp CursorHeap
 	heap.Init(&cp)
@@ -491,6 +492,9 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 				if err = kvWriter.AddWord(valBuf); err != nil {
 					return nil, nil, nil, err
 				}
+				if err = iot.accountRead(ctx, len(keyBuf)+len(valBuf)); err != nil {
+					return nil, nil, nil, err
+				}
 			}
 			keyBuf = append(keyBuf[:0], lastKey...)
 			valBuf = append(valBuf[:0], lastVal...)
@@ -598,6 +602,7 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 	write := seg.NewWriter(comp, iit.ii.compression)
 	p := ps.AddNew(path.Base(datPath), 1)
 	defer ps.Delete(p)
+	iot := ioTaskFromCtx(ctx)
 
 	var cp CursorHeap
 	heap.Init(&cp)
@@ -657,6 +662,9 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 			if err = write.AddWord(valBuf); err != nil {
 				return nil, err
 			}
+			if err = iot.accountRead(ctx, len(keyBuf)+len(valBuf)); err != nil {
+				return nil, err
+			}
 		}
 		keyBuf = append(keyBuf[:0], lastKey...)
 		if keyBuf == nil {
@@ -755,6 +763,7 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 		}
 		p := ps.AddNew(path.Base(datPath), 1)
 		defer ps.Delete(p)
+		iot := ioTaskFromCtx(ctx)
 
 		var cp CursorHeap
 		heap.Init(&cp)
@@ -807,6 +816,9 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 					if err = compr.AddWord(valBuf); err != nil {
 						return nil, nil, err
 					}
+					if err = iot.accountRead(ctx, len(valBuf)); err != nil {
+						return nil, nil, err
+					}
 				}
 				// fmt.Printf("fput '%x'->%x\n", lastKey, ci1.val)
 				keyCount += int(count)
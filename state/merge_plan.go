@@ -0,0 +1,390 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+)
+
+var (
+	ErrMergePlanStale   = errors.New("merge plan is stale")
+	ErrMergeRangePinned = errors.New("merge range is pinned")
+)
+
+// MergeKind - which files of domain or inverted index are merged
+type MergeKind uint8
+
+const (
+	MergeValues  MergeKind = iota // domain .kv files
+	MergeHistory                  // history .v files
+	MergeIndex                    // inverted index .ef files: of domain history or standalone
+	mergeKindLen
+)
+
+func (k MergeKind) String() string {
+	switch k {
+	case MergeValues:
+		return "val"
+	case MergeHistory:
+		return "hist"
+	case MergeIndex:
+		return "idx"
+	default:
+		return fmt.Sprintf("unknown merge kind: %d", k)
+	}
+}
+
+// MergePlanItem - one merge range: files of `Name` in steps [FromStep, ToStep) will be merged to 1 file
+type MergePlanItem struct {
+	Name              string // domain or inverted index: accounts, logaddrs, ...
+	Kind              MergeKind
+	FromStep, ToStep  uint64
+	Files             []string // data files to merge
+	FilesSize         int64
+	EstimatedSize     int64         // size of merged data file
+	EstimatedDuration time.Duration // if merged alone
+}
+
+func (i MergePlanItem) String() string {
+	return fmt.Sprintf("%s.%s=%d-%d", i.Name, i.Kind, i.FromStep, i.ToStep)
+}
+
+type MergePlan struct {
+	Items []MergePlanItem
+}
+
+func (p *MergePlan) Empty() bool { return len(p.Items) == 0 }
+
+func (p *MergePlan) FilesSize() (size int64) {
+	for _, i := range p.Items {
+		size += i.FilesSize
+	}
+	return size
+}
+
+// EstimatedDuration - upper bound: items are merged by `mergeWorkers` in parallel
+func (p *MergePlan) EstimatedDuration() (d time.Duration) {
+	for _, i := range p.Items {
+		d += i.EstimatedDuration
+	}
+	return d
+}
+
+// Select - plan of items with given name (and kinds, all if empty). To merge single range.
+func (p *MergePlan) Select(name string, kinds ...MergeKind) *MergePlan {
+	res := &MergePlan{}
+	for _, i := range p.Items {
+		if i.Name != name {
+			continue
+		}
+		if len(kinds) > 0 && !containsMergeKind(kinds, i.Kind) {
+			continue
+		}
+		res.Items = append(res.Items, i)
+	}
+	return res
+}
+
+func containsMergeKind(kinds []MergeKind, k MergeKind) bool {
+	for _, kind := range kinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *MergePlan) String() string {
+	var sb strings.Builder
+	for i, item := range p.Items {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(fmt.Sprintf("%s: files=%d(%s), est=%s/%s", item, len(item.Files), common.ByteCount(uint64(item.FilesSize)),
+			common.ByteCount(uint64(item.EstimatedSize)), item.EstimatedDuration.Round(time.Millisecond)))
+	}
+	return sb.String()
+}
+
+// PlanMerge - dry-run of next MergeLoop step: what will be merged now. MergeLoop repeats steps until nothing to merge,
+// so after execution of this plan - next plan may contain bigger ranges.
+func (ac *AggregatorRoTx) PlanMerge() (*MergePlan, error) {
+	r := ac.findMergeRange(ac.a.visibleFilesMinimaxTxNum.Load(), StepsInColdFile*ac.a.StepSize())
+	plan := &MergePlan{}
+	if !r.any() {
+		return plan, nil
+	}
+	outs, err := ac.staticFilesInRange(r)
+	if err != nil {
+		return nil, err
+	}
+	step := ac.a.StepSize()
+	add := func(name string, kind MergeKind, mr MergeRange, files []*filesItem) {
+		if !mr.needMerge {
+			return
+		}
+		item := MergePlanItem{Name: name, Kind: kind, FromStep: mr.from / step, ToStep: mr.to / step}
+		for _, f := range files {
+			if f.decompressor == nil {
+				continue
+			}
+			item.Files = append(item.Files, f.decompressor.FileName())
+			item.FilesSize += f.decompressor.Size()
+		}
+		item.EstimatedSize, item.EstimatedDuration = ac.a.mergeStats.estimate(kind, item.FilesSize)
+		plan.Items = append(plan.Items, item)
+	}
+	for id, dr := range r.domain {
+		name := ac.d[id].d.filenameBase
+		add(name, MergeValues, dr.values, outs.d[id])
+		add(name, MergeHistory, dr.history.history, outs.dHist[id])
+		add(name, MergeIndex, dr.history.index, outs.dIdx[id])
+	}
+	for id, mr := range r.invertedIndex {
+		add(ac.iis[id].ii.filenameBase, MergeIndex, *mr, outs.ii[id])
+	}
+	return plan, nil
+}
+
+// ExecuteMergePlan - merges items of plan (all or some of them, see MergePlan.Select). Waits for running merge.
+// Plan must be still actual: ErrMergePlanStale if files were changed since PlanMerge.
+// Ranges which must be merged together with selected ones (history with it's index, commitment with accounts and storage)
+// are merged also. After cancellation - files stay unchanged.
+func (a *Aggregator) ExecuteMergePlan(ctx context.Context, plan *MergePlan) error {
+	if a.follower {
+		return ErrFollowerAggregator
+	}
+	if plan.Empty() {
+		return nil
+	}
+	for !a.mergingFiles.CompareAndSwap(false, true) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer a.mergingFiles.Store(false)
+
+	aggTx := a.BeginFilesRo()
+	defer aggTx.Close()
+	r, err := aggTx.selectMergeRanges(plan)
+	if err != nil {
+		return err
+	}
+	if err := a.mergeRanges(ctx, aggTx, r); err != nil {
+		return err
+	}
+	a.migrateStorageTiersAfterMerge(ctx)
+	return nil
+}
+
+// selectMergeRanges - ranges of plan items, validated against ranges which MergeLoop would merge now
+func (ac *AggregatorRoTx) selectMergeRanges(plan *MergePlan) (RangesV3, error) {
+	step := ac.a.StepSize()
+	for _, item := range plan.Items {
+		if ac.a.mergePins.overlaps(item.FromStep*step, item.ToStep*step) {
+			return RangesV3{}, fmt.Errorf("%w: %s", ErrMergeRangePinned, item)
+		}
+	}
+
+	cur := ac.findMergeRange(ac.a.visibleFilesMinimaxTxNum.Load(), StepsInColdFile*step)
+	var sel RangesV3
+	for id := range sel.domain {
+		sel.domain[id].name, sel.domain[id].aggStep = cur.domain[id].name, cur.domain[id].aggStep
+	}
+	for id := range sel.invertedIndex {
+		sel.invertedIndex[id] = &MergeRange{}
+	}
+	for _, item := range plan.Items {
+		cr, sr := ac.mergeRangeOf(&cur, item.Name, item.Kind), ac.mergeRangeOf(&sel, item.Name, item.Kind)
+		if cr == nil {
+			return RangesV3{}, fmt.Errorf("merge plan: unknown %s", item)
+		}
+		if !cr.needMerge || cr.from != item.FromStep*step || cr.to != item.ToStep*step {
+			return RangesV3{}, fmt.Errorf("%w: %s, now: %s", ErrMergePlanStale, item, cur.String())
+		}
+		*sr = *cr
+	}
+
+	for id := range sel.domain {
+		c, s := cur.domain[id].history, &sel.domain[id].history
+		if s.any() && c.history.needMerge && c.index.needMerge && c.history.Equal(&c.index) {
+			s.history, s.index = c.history, c.index
+		}
+	}
+	if ac.a.commitmentValuesTransform && sel.domain[kv.CommitmentDomain].values.needMerge {
+		for _, id := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+			if cur.domain[id].values.needMerge {
+				sel.domain[id].values = cur.domain[id].values
+			}
+		}
+	}
+	return sel, nil
+}
+
+func (ac *AggregatorRoTx) mergeRangeOf(r *RangesV3, name string, kind MergeKind) *MergeRange {
+	for id, dt := range ac.d {
+		if dt.d.filenameBase != name {
+			continue
+		}
+		switch kind {
+		case MergeValues:
+			return &r.domain[id].values
+		case MergeHistory:
+			return &r.domain[id].history.history
+		case MergeIndex:
+			return &r.domain[id].history.index
+		}
+	}
+	if kind == MergeIndex {
+		for id, iit := range ac.iis {
+			if iit.ii.filenameBase == name {
+				return r.invertedIndex[id]
+			}
+		}
+	}
+	return nil
+}
+
+// PinMergeRange - files which have txNums of steps [fromStep, toStep) will not be merged until UnpinMergeRange.
+// For example: while they are seeded. Doesn't affect merge which is already running.
+func (a *Aggregator) PinMergeRange(fromStep, toStep uint64) error {
+	if fromStep >= toStep {
+		return fmt.Errorf("PinMergeRange: invalid range %d-%d", fromStep, toStep)
+	}
+	a.mergePins.add(MergeRange{true, fromStep * a.StepSize(), toStep * a.StepSize()})
+	return nil
+}
+
+// UnpinMergeRange - removes pin created by PinMergeRange with same range. Returns false if there was no such pin.
+func (a *Aggregator) UnpinMergeRange(fromStep, toStep uint64) bool {
+	return a.mergePins.remove(MergeRange{true, fromStep * a.StepSize(), toStep * a.StepSize()})
+}
+
+// PinnedMergeRanges - in txNums
+func (a *Aggregator) PinnedMergeRanges() []MergeRange { return a.mergePins.list() }
+
+type mergePins struct {
+	lock   sync.RWMutex
+	ranges []MergeRange
+}
+
+func (p *mergePins) add(mr MergeRange) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ranges = append(p.ranges, mr)
+}
+
+func (p *mergePins) remove(mr MergeRange) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := range p.ranges {
+		if p.ranges[i].Equal(&mr) {
+			p.ranges = append(p.ranges[:i], p.ranges[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *mergePins) list() []MergeRange {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return append([]MergeRange(nil), p.ranges...)
+}
+
+func (p *mergePins) overlaps(from, to uint64) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, pin := range p.ranges {
+		if from < pin.to && pin.from < to {
+			return true
+		}
+	}
+	return false
+}
+
+// exclude - drops merge ranges which overlap pinned ranges
+func (p *mergePins) exclude(mrs ...*MergeRange) {
+	for _, mr := range mrs {
+		if mr.needMerge && p.overlaps(mr.from, mr.to) {
+			*mr = MergeRange{}
+		}
+	}
+}
+
+// defaultMergeThroughput - used for estimations until first merge is done
+const defaultMergeThroughput = 64 * datasize.MB
+
+// mergeStats - observed results of merges: to estimate size and duration of planned merges
+type mergeStats struct {
+	lock    sync.Mutex
+	in, out [mergeKindLen]int64
+	inTotal int64
+	took    time.Duration
+}
+
+func (s *mergeStats) add(outs SelectedStaticFilesV3, in MergedFilesV3, took time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addKind := func(kind MergeKind, files []*filesItem, merged *filesItem) {
+		if merged == nil || merged.decompressor == nil {
+			return
+		}
+		for _, f := range files {
+			if f.decompressor != nil {
+				s.in[kind] += f.decompressor.Size()
+				s.inTotal += f.decompressor.Size()
+			}
+		}
+		s.out[kind] += merged.decompressor.Size()
+	}
+	for id := range outs.d {
+		addKind(MergeValues, outs.d[id], in.d[id])
+		addKind(MergeHistory, outs.dHist[id], in.dHist[id])
+		addKind(MergeIndex, outs.dIdx[id], in.dIdx[id])
+	}
+	for id := range outs.ii {
+		addKind(MergeIndex, outs.ii[id], in.iis[id])
+	}
+	s.took += took
+}
+
+func (s *mergeStats) estimate(kind MergeKind, inSize int64) (size int64, took time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	size = inSize
+	if s.in[kind] > 0 {
+		size = int64(float64(inSize) * float64(s.out[kind]) / float64(s.in[kind]))
+	}
+	throughput := float64(defaultMergeThroughput.Bytes()) // bytes per second
+	if s.inTotal > 0 && s.took > 0 {
+		throughput = float64(s.inTotal) / s.took.Seconds()
+	}
+	return size, time.Duration(float64(inSize) / throughput * float64(time.Second))
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestAggregatorV3_MergePlan(t *testing.T) {
+	t.Parallel()
+
+	aggStep := uint64(10)
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+
+	// while pinned - background merge after BuildFiles must not touch first steps
+	require.NoError(t, agg.PinMergeRange(0, 1))
+	require.Error(t, agg.PinMergeRange(1, 1))
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := aggStep * 4
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		_, err := rnd.Read(addr[:2])
+		require.NoError(t, err)
+		err = domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0), nil, 0)
+		require.NoError(t, err)
+	}
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, agg.BuildFiles(txs))
+
+	planMerge := func() *MergePlan {
+		t.Helper()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		plan, err := ac.PlanMerge()
+		require.NoError(t, err)
+		return plan
+	}
+	require.True(t, planMerge().Empty())
+	accVals := &MergePlan{Items: []MergePlanItem{{Name: kv.AccountsDomain.String(), Kind: MergeValues, FromStep: 0, ToStep: 2}}}
+	require.ErrorIs(t, agg.ExecuteMergePlan(ctx, accVals), ErrMergeRangePinned)
+
+	require.True(t, agg.UnpinMergeRange(0, 1))
+	require.False(t, agg.UnpinMergeRange(0, 1))
+	require.Empty(t, agg.PinnedMergeRanges())
+
+	plan := planMerge()
+	acc := plan.Select(kv.AccountsDomain.String())
+	require.Len(t, acc.Items, 3, plan.String())
+	for _, item := range acc.Items {
+		require.Equal(t, uint64(0), item.FromStep)
+		require.Equal(t, uint64(2), item.ToStep)
+		require.Len(t, item.Files, 2)
+		require.Positive(t, item.FilesSize)
+		require.Positive(t, item.EstimatedSize)
+		require.Positive(t, item.EstimatedDuration)
+	}
+
+	// cancelled merge doesn't change files
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, agg.ExecuteMergePlan(cctx, plan), context.Canceled)
+	require.Equal(t, plan.Items, planMerge().Items)
+
+	// single range: history is merged together with it's index
+	require.NoError(t, agg.ExecuteMergePlan(ctx, plan.Select(kv.AccountsDomain.String(), MergeHistory)))
+	require.ErrorIs(t, agg.ExecuteMergePlan(ctx, acc), ErrMergePlanStale)
+	vals := planMerge().Select(kv.AccountsDomain.String(), MergeValues)
+	require.Len(t, vals.Items, 1)
+	require.Equal(t, uint64(2), vals.Items[0].ToStep)
+	hist := planMerge().Select(kv.AccountsDomain.String(), MergeHistory)
+	require.Len(t, hist.Items, 1)
+	require.Equal(t, uint64(4), hist.Items[0].ToStep, "0-2 is merged: next merge is 0-4")
+
+	for plan = planMerge(); !plan.Empty(); plan = planMerge() {
+		require.NoError(t, agg.ExecuteMergePlan(ctx, plan))
+	}
+	exists, err := dir.FileExist(agg.d[kv.AccountsDomain].kvFilePath(0, 4))
+	require.NoError(t, err)
+	require.True(t, exists)
+}
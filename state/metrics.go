@@ -59,6 +59,24 @@ var (
 	mxFlushTook            = metrics.GetOrCreateSummary("domain_flush_took")
 	mxCommitmentRunning    = metrics.GetOrCreateGauge("domain_running_commitment")
 	mxCommitmentTook       = metrics.GetOrCreateSummary("domain_commitment_took")
+	mxFileReadCacheSize    = metrics.GetOrCreateGauge("domain_file_cache_size")
+)
+
+var (
+	mxFileReadCacheHit = [kv.DomainLen]metrics.Counter{
+		kv.AccountsDomain:   metrics.GetOrCreateCounter(`domain_file_cache{result="hit",domain="account"}`),
+		kv.StorageDomain:    metrics.GetOrCreateCounter(`domain_file_cache{result="hit",domain="storage"}`),
+		kv.CodeDomain:       metrics.GetOrCreateCounter(`domain_file_cache{result="hit",domain="code"}`),
+		kv.CommitmentDomain: metrics.GetOrCreateCounter(`domain_file_cache{result="hit",domain="commitment"}`),
+		kv.ReceiptDomain:    metrics.GetOrCreateCounter(`domain_file_cache{result="hit",domain="receipt"}`),
+	}
+	mxFileReadCacheMiss = [kv.DomainLen]metrics.Counter{
+		kv.AccountsDomain:   metrics.GetOrCreateCounter(`domain_file_cache{result="miss",domain="account"}`),
+		kv.StorageDomain:    metrics.GetOrCreateCounter(`domain_file_cache{result="miss",domain="storage"}`),
+		kv.CodeDomain:       metrics.GetOrCreateCounter(`domain_file_cache{result="miss",domain="code"}`),
+		kv.CommitmentDomain: metrics.GetOrCreateCounter(`domain_file_cache{result="miss",domain="commitment"}`),
+		kv.ReceiptDomain:    metrics.GetOrCreateCounter(`domain_file_cache{result="miss",domain="receipt"}`),
+	}
 )
 
 var (
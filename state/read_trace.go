@@ -0,0 +1,231 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/hexutility"
+	"github.com/Tangui-Bitfly/erigon-lib/metrics"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+// ReadTrace - read amplification of lookups in files made by one AggregatorRoTx: which files were probed, how
+// existence filters worked, how many bytes were decompressed. Opt-in, see AggregatorRoTx.EnableReadTrace.
+// Traced lookups also update `domain_read_amplification` metrics. Can be returned by RPC debug endpoints as JSON
+// after transaction is done.
+type ReadTrace struct {
+	Summary   ReadTraceSummary `json:"summary"`
+	Lookups   []*LookupTrace   `json:"lookups"`
+	Truncated bool             `json:"truncated,omitempty"` // more than `limit` lookups, only Summary has all of them
+
+	lock  sync.Mutex
+	limit int
+}
+
+// LookupTrace - one getFromFiles (latest value in domain files) or historySeekInFiles (value as of txNum in history
+// files) call.
+type LookupTrace struct {
+	Op       string           `json:"op"`
+	Name     string           `json:"name"` // domain or history
+	Key      hexutility.Bytes `json:"key"`
+	Found    bool             `json:"found"`
+	Cache    string           `json:"cache,omitempty"` // "tx" if served by cache of transaction, files are not probed
+	Probes   []*FileProbe     `json:"probes,omitempty"`
+	Duration time.Duration    `json:"duration"`
+
+	start time.Time
+}
+
+// FileProbe - lookup of key in one file
+type FileProbe struct {
+	File string `json:"file"`
+	// Filter - answer of existence filter: "absent" (file is skipped) or "present". Empty if file has no filter
+	Filter string `json:"filter,omitempty"`
+	// Index - lookup in accessor (.kvi/.bt/.efi/.vi) is done
+	Index bool `json:"index"`
+	// Cached - served by FileReadCache
+	Cached bool `json:"cached,omitempty"`
+	Found  bool `json:"found"`
+	// FalsePositive - filter answered "present", but file has no key
+	FalsePositive     bool   `json:"falsePositive,omitempty"`
+	BytesDecompressed uint64 `json:"bytesDecompressed"`
+
+	g         *seg.Reader
+	bytesFrom uint64
+}
+
+type ReadTraceSummary struct {
+	Lookups           uint64 `json:"lookups"`
+	Probes            uint64 `json:"probes"`
+	IndexLookups      uint64 `json:"indexLookups"`
+	FilterSkips       uint64 `json:"filterSkips"`
+	FalsePositives    uint64 `json:"falsePositives"`
+	BytesDecompressed uint64 `json:"bytesDecompressed"`
+}
+
+const (
+	readTraceGetFromFiles       = "getFromFiles"
+	readTraceHistorySeekInFiles = "historySeekInFiles"
+)
+
+// DefaultReadTraceLimit - max amount of lookups kept in ReadTrace
+const DefaultReadTraceLimit = 10_000
+
+func NewReadTrace(limit int) *ReadTrace { return &ReadTrace{limit: limit} }
+
+// EnableReadTrace - starts tracing of lookups in files of all domains and inverted indices made by this transaction.
+// Keeps up to `limit` lookups (DefaultReadTraceLimit if 0). Not thread-safe: call it before using transaction.
+// RPC handlers can reach AggregatorRoTx of their transaction by HasAggTx.
+func (ac *AggregatorRoTx) EnableReadTrace(limit int) *ReadTrace {
+	if limit <= 0 {
+		limit = DefaultReadTraceLimit
+	}
+	t := NewReadTrace(limit)
+	for _, d := range ac.d {
+		d.ht.iit.readTrace = t
+	}
+	for _, ii := range ac.iis {
+		ii.readTrace = t
+	}
+	return t
+}
+
+// begin - starts traced lookup. nil-safe: returns nil if tracing is disabled
+func (t *ReadTrace) begin(op, name string, key []byte) *LookupTrace {
+	if t == nil {
+		return nil
+	}
+	return &LookupTrace{Op: op, Name: name, Key: common.Copy(key), start: time.Now()}
+}
+
+func (t *ReadTrace) end(lt *LookupTrace, found bool) {
+	lt.Found = found
+	lt.Duration = time.Since(lt.start)
+
+	var s ReadTraceSummary
+	s.Lookups = 1
+	for _, p := range lt.Probes {
+		s.Probes++
+		if p.Index {
+			s.IndexLookups++
+		}
+		if p.Filter == "absent" {
+			s.FilterSkips++
+		}
+		if p.FalsePositive {
+			s.FalsePositives++
+		}
+		s.BytesDecompressed += p.BytesDecompressed
+	}
+	readAmplificationMetrics(lt.Op, lt.Name).add(&s)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Summary.add(&s)
+	if len(t.Lookups) >= t.limit {
+		t.Truncated = true
+		return
+	}
+	t.Lookups = append(t.Lookups, lt)
+}
+
+// filterSkip - existence filter answered "absent"
+func (lt *LookupTrace) filterSkip(f *visibleFile) {
+	if lt == nil {
+		return
+	}
+	lt.Probes = append(lt.Probes, &FileProbe{File: f.src.decompressor.FileName(), Filter: "absent"})
+}
+
+// probe - starts lookup of key in file. `filter` is answer of existence filter
+func (lt *LookupTrace) probe(f *visibleFile, g *seg.Reader, filter string) *FileProbe {
+	if lt == nil {
+		return nil
+	}
+	p := &FileProbe{File: f.src.decompressor.FileName(), Filter: filter, Index: true, g: g, bytesFrom: g.ReadBytes()}
+	lt.Probes = append(lt.Probes, p)
+	return p
+}
+
+// cacheHit - value is served by FileReadCache, file is not touched
+func (p *FileProbe) cacheHit() {
+	if p == nil {
+		return
+	}
+	p.Cached, p.Index = true, false
+}
+
+func (p *FileProbe) done(found bool) {
+	if p == nil {
+		return
+	}
+	p.Found = found
+	p.FalsePositive = p.Filter == "present" && !found
+	p.BytesDecompressed = p.g.ReadBytes() - p.bytesFrom
+	p.g = nil
+}
+
+func (s *ReadTraceSummary) add(o *ReadTraceSummary) {
+	s.Lookups += o.Lookups
+	s.Probes += o.Probes
+	s.IndexLookups += o.IndexLookups
+	s.FilterSkips += o.FilterSkips
+	s.FalsePositives += o.FalsePositives
+	s.BytesDecompressed += o.BytesDecompressed
+}
+
+func (s ReadTraceSummary) String() string {
+	return fmt.Sprintf("lookups=%d probes=%d index_lookups=%d filter_skips=%d false_positives=%d decompressed=%s",
+		s.Lookups, s.Probes, s.IndexLookups, s.FilterSkips, s.FalsePositives, common.ByteCount(s.BytesDecompressed))
+}
+
+type readAmplificationCounters struct {
+	lookups, probes, indexLookups, filterSkips, falsePositives, bytes metrics.Counter
+}
+
+var readAmplificationCountersMap sync.Map // op+name -> *readAmplificationCounters
+
+func readAmplificationMetrics(op, name string) *readAmplificationCounters {
+	if c, ok := readAmplificationCountersMap.Load(op + name); ok {
+		return c.(*readAmplificationCounters)
+	}
+	counter := func(typ string) metrics.Counter {
+		return metrics.GetOrCreateCounter(fmt.Sprintf(`domain_read_amplification{op="%s",name="%s",type="%s"}`, op, name, typ))
+	}
+	c, _ := readAmplificationCountersMap.LoadOrStore(op+name, &readAmplificationCounters{
+		lookups:        counter("lookups"),
+		probes:         counter("probes"),
+		indexLookups:   counter("index_lookups"),
+		filterSkips:    counter("filter_skips"),
+		falsePositives: counter("false_positives"),
+		bytes:          counter("bytes_decompressed"),
+	})
+	return c.(*readAmplificationCounters)
+}
+
+func (c *readAmplificationCounters) add(s *ReadTraceSummary) {
+	c.lookups.AddUint64(s.Lookups)
+	c.probes.AddUint64(s.Probes)
+	c.indexLookups.AddUint64(s.IndexLookups)
+	c.filterSkips.AddUint64(s.FilterSkips)
+	c.falsePositives.AddUint64(s.FalsePositives)
+	c.bytes.AddUint64(s.BytesDecompressed)
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestAggregator_ReadTrace(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 10)
+
+	addr := func(i uint64) []byte {
+		a := make([]byte, 20)
+		binary.BigEndian.PutUint64(a, i)
+		return a
+	}
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	for txNum := uint64(0); txNum < 45; txNum++ {
+		domains.SetTxNum(txNum)
+		buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(txNum%7), nil, buf, nil, 0))
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	require.NoError(t, agg.BuildFiles(45))
+
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	dt := ac.d[kv.AccountsDomain]
+	require.NotEmpty(t, dt.files)
+
+	// not traced
+	_, found, _, _, err := dt.getFromFiles(addr(100), 0)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	trace := ac.EnableReadTrace(2)
+
+	_, found, _, _, err = dt.getFromFiles(addr(1), 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, trace.Lookups, 1)
+	lt := trace.Lookups[0]
+	require.Equal(t, readTraceGetFromFiles, lt.Op)
+	require.Equal(t, "accounts", lt.Name)
+	require.True(t, lt.Found)
+	require.Empty(t, lt.Cache)
+	require.NotEmpty(t, lt.Probes)
+	last := lt.Probes[len(lt.Probes)-1]
+	require.True(t, last.Found)
+	require.True(t, last.Index)
+	require.NotZero(t, last.BytesDecompressed)
+	require.Equal(t, dt.files[len(dt.files)-1].src.decompressor.FileName(), lt.Probes[0].File) // newest file first
+
+	// per-tx cache
+	_, found, _, _, err = dt.getFromFiles(addr(1), 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, trace.Lookups, 2)
+	require.Equal(t, "tx", trace.Lookups[1].Cache)
+	require.Empty(t, trace.Lookups[1].Probes)
+
+	// history
+	v, found, err := dt.ht.historySeekInFiles(addr(2), 3)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NotEmpty(t, v)
+	require.True(t, trace.Truncated)
+	require.Len(t, trace.Lookups, 2)
+	require.Nil(t, dt.ht.iit.readLookup)
+
+	s := trace.Summary
+	require.EqualValues(t, 3, s.Lookups)
+	require.GreaterOrEqual(t, s.Probes, uint64(len(lt.Probes)+2)) // at least one .ef and .v file
+	require.Greater(t, s.BytesDecompressed, last.BytesDecompressed)
+	require.Equal(t, s.Probes, s.IndexLookups+s.FilterSkips)
+	require.Contains(t, s.String(), "lookups=3")
+	require.NotZero(t, readAmplificationMetrics(readTraceHistorySeekInFiles, "accounts").lookups.GetValueUint64())
+
+	b, err := json.Marshal(trace)
+	require.NoError(t, err)
+	var decoded ReadTrace
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, trace.Summary, decoded.Summary)
+	require.Equal(t, lt.Key, decoded.Lookups[0].Key)
+}
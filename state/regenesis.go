@@ -0,0 +1,310 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/background"
+	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/memdb"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/stream"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+type RegenesisResult struct {
+	BlockNum uint64 // block and txNum of commitment state in new datadir
+	TxNum    uint64
+	Root     []byte
+	Steps    uint64               // new domain files are [0; Steps)
+	Keys     [kv.DomainLen]uint64 // keys in new domain files
+}
+
+// Regenesis writes state as of the last commitment state computed before `txNum` (math.MaxUint64 for the latest one)
+// into empty datadir `dst`: one file of each domain, starting at step 0 and ending at step of that state.
+// Commitment is computed from scratch and must match stored root. History and inverted indices are dropped, unless
+// `keepHistory`: then their files are hard-linked (or copied) to `dst`, it requires state at step boundary and
+// history files up to it. New datadir is opened by Aggregator.OpenFolder, its DB must be empty.
+// Domains are read from DB and files, so SharedDomains must be flushed. Regenesis of not latest state requires
+// CommitmentDomain history (see Aggregator.KeepCommitmentHistory).
+func (sd *SharedDomains) Regenesis(ctx context.Context, txNum uint64, dst datadir.Dirs, keepHistory bool, logPrefix string) (*RegenesisResult, error) {
+	a := sd.aggTx.a
+	sdc := NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, a.commitmentVariant)
+	defer sdc.Close()
+	blockNum, stateTxNum, ok, err := sd.restoreCommitmentStateAsOf(sdc, txNum)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("commitment state before txNum=%d is not found", txNum)
+	}
+	storedRoot, err := sdc.patriciaTrie.RootHash()
+	if err != nil {
+		return nil, err
+	}
+	asOfTxNum := stateTxNum + 1
+	res := &RegenesisResult{BlockNum: blockNum, TxNum: stateTxNum, Steps: (asOfTxNum + a.StepSize() - 1) / a.StepSize()}
+	if keepHistory && asOfTxNum%a.StepSize() != 0 {
+		return nil, fmt.Errorf("regenesis with history: state of txNum=%d is not at step boundary (step size %d)", stateTxNum, a.StepSize())
+	}
+	if err := a.prepareRegenesisDir(ctx, dst); err != nil {
+		return nil, err
+	}
+	if keepHistory {
+		if err := sd.aggTx.linkHistoryFiles(ctx, dst, asOfTxNum); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	db := memdb.NewStateDB(dst.Tmp) // only to build commitment, new datadir's DB stays empty
+	defer db.Close()
+	to, err := NewAggregator(ctx, dst, a.StepSize(), db, sd.logger)
+	if err != nil {
+		return nil, err
+	}
+	defer to.Close()
+	to.commitmentVariant, to.commitmentHasher = a.commitmentVariant, a.commitmentHasher
+	if err := to.OpenFolder(); err != nil {
+		return nil, err
+	}
+
+	for d := kv.Domain(0); d < kv.DomainLen; d++ {
+		if d == kv.CommitmentDomain {
+			continue
+		}
+		it, err := sd.aggTx.DomainRange(ctx, sd.roTx, d, nil, nil, asOfTxNum, order.Asc, -1)
+		if err != nil {
+			return nil, err
+		}
+		coll, err := to.d[d].regenesisCollate(ctx, res.Steps, it)
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Keys[d] = uint64(coll.valuesCount)
+		if err := to.d[d].regenesisBuild(ctx, res.Steps, coll); err != nil {
+			return nil, err
+		}
+		sd.logger.Info(fmt.Sprintf("[%s] regenesis", logPrefix), "domain", d, "keys", common.PrettyCounter(res.Keys[d]))
+	}
+	to.recalcVisibleFiles(to.DirtyFilesEndTxNumMinimax())
+
+	if res.Root, res.Keys[kv.CommitmentDomain], err = to.regenesisCommitment(ctx, db, blockNum, stateTxNum, res.Steps, logPrefix); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(res.Root, storedRoot) {
+		return nil, fmt.Errorf("regenesis: computed root %x != stored root %x (block %d)", res.Root, storedRoot, blockNum)
+	}
+	to.recalcVisibleFiles(to.DirtyFilesEndTxNumMinimax())
+	if err := to.BuildMissedIndices(ctx, 1); err != nil {
+		return nil, err
+	}
+	sd.logger.Info(fmt.Sprintf("[%s] regenesis done", logPrefix), "block", blockNum, "txNum", stateTxNum,
+		"root", fmt.Sprintf("%x", res.Root), "steps", res.Steps, "history", keepHistory, "took", time.Since(start))
+	return res, nil
+}
+
+// prepareRegenesisDir - checks that `dst` has no state files and gives it salt of indices of `a`:
+// files linked from `a` are opened without re-indexing
+func (a *Aggregator) prepareRegenesisDir(ctx context.Context, dst datadir.Dirs) error {
+	for _, d := range []string{dst.SnapDomain, dst.SnapHistory, dst.SnapIdx, dst.SnapAccessors} {
+		files, err := dir.ListFiles(d)
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			return fmt.Errorf("regenesis: %s is not empty", d)
+		}
+	}
+	from, to := filepath.Join(a.dirs.Snap, "salt-state.txt"), filepath.Join(dst.Snap, "salt-state.txt")
+	if err := os.Remove(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return copyFileWithFsync(ctx, from, to)
+}
+
+// linkHistoryFiles - history and inverted index files which end before `toTxNum` are hard-linked to `dst`
+func (ac *AggregatorRoTx) linkHistoryFiles(ctx context.Context, dst datadir.Dirs, toTxNum uint64) error {
+	link := func(name string, files visibleFiles, dataDir string) error {
+		if len(files) == 0 {
+			return nil
+		}
+		n := 0
+		for n < len(files) && files[n].endTxNum <= toTxNum {
+			n++
+		}
+		if end := files[:n].EndTxNum(); end != toTxNum {
+			return fmt.Errorf("regenesis: %s files end at txNum=%d, need %d: build files or drop history", name, end, toTxNum)
+		}
+		for _, f := range files[:n] {
+			if err := linkOrCopyFile(ctx, f.src.decompressor.FilePath(), dataDir); err != nil {
+				return err
+			}
+			if f.src.index != nil {
+				if err := linkOrCopyFile(ctx, f.src.index.FilePath(), dst.SnapAccessors); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, d := range ac.d {
+		if d.d.historyDisabled {
+			continue
+		}
+		if err := link(d.d.filenameBase, d.ht.files, dst.SnapHistory); err != nil {
+			return err
+		}
+		if err := link(d.d.filenameBase, d.ht.iit.files, dst.SnapIdx); err != nil {
+			return err
+		}
+	}
+	for _, ii := range ac.iis {
+		if err := link(ii.ii.filenameBase, ii.files, dst.SnapIdx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func linkOrCopyFile(ctx context.Context, from, toDir string) error {
+	to := filepath.Join(toDir, filepath.Base(from))
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+	return copyFileWithFsync(ctx, from, to) // other file system
+}
+
+// regenesisCollate - like collateETL, but values of all steps [0; stepTo) are streamed from `it`
+func (d *Domain) regenesisCollate(ctx context.Context, stepTo uint64, it stream.KV) (coll Collation, err error) {
+	closeCollation := true
+	defer func() {
+		if closeCollation {
+			coll.Close()
+		}
+	}()
+
+	coll.valuesPath = d.kvFilePath(0, stepTo)
+	if coll.valuesComp, err = seg.NewCompressor(ctx, d.filenameBase+".domain.regenesis", coll.valuesPath, d.dirs.Tmp, d.compressCfg, log.LvlTrace, d.logger); err != nil {
+		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
+	}
+	compress := seg.CompressNone
+	if stepTo > DomainMinStepsToCompress {
+		compress = d.compression
+	}
+	comp := seg.NewWriter(coll.valuesComp, compress)
+	for it.HasNext() {
+		k, v, err := it.Next()
+		if err != nil {
+			return coll, err
+		}
+		if len(v) == 0 { // deleted
+			continue
+		}
+		if err = comp.AddWord(k); err != nil {
+			return coll, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
+		}
+		if err = comp.AddWord(v); err != nil {
+			return coll, fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, k, v, err)
+		}
+		select {
+		case <-ctx.Done():
+			return coll, ctx.Err()
+		default:
+		}
+	}
+	closeCollation = false
+	coll.valuesCount = coll.valuesComp.Count() / 2
+	return coll, nil
+}
+
+// regenesisBuild - builds file [0; stepTo) and its accessors. Unlike integrateDirtyFiles doesn't add history files.
+func (d *Domain) regenesisBuild(ctx context.Context, stepTo uint64, coll Collation) error {
+	sf, err := d.buildFileRange(ctx, 0, stepTo, coll, background.NewProgressSet())
+	if err != nil {
+		return err
+	}
+	fi := newFilesItem(0, stepTo*d.aggregationStep, d.aggregationStep)
+	fi.decompressor = sf.valuesDecomp
+	fi.index = sf.valuesIdx
+	fi.bindex = sf.valuesBt
+	fi.existence = sf.bloom
+	d.dirtyFiles.Set(fi)
+	return nil
+}
+
+// regenesisCommitment - computes commitment of accounts and storage files of `a` from scratch and writes it to
+// commitment file [0; stepTo)
+func (a *Aggregator) regenesisCommitment(ctx context.Context, db kv.RoDB, blockNum, txNum, stepTo uint64, logPrefix string) (root []byte, branches uint64, err error) {
+	tx, err := db.BeginRo(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+	ac := a.BeginFilesRo()
+	defer ac.Close()
+	sd, err := NewSharedDomains(wrapTxWithCtxForTest(tx, ac), a.logger)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer sd.Close()
+
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+		it, err := ac.DomainRangeLatest(tx, d, nil, nil, -1)
+		if err != nil {
+			return nil, 0, err
+		}
+		for it.HasNext() {
+			k, _, err := it.Next()
+			if err != nil {
+				it.Close()
+				return nil, 0, err
+			}
+			sd.sdCtx.TouchKey(d, string(k), nil)
+		}
+		it.Close()
+	}
+	sd.SetBlockNum(blockNum)
+	sd.SetTxNum(txNum)
+	if root, err = sd.sdCtx.ComputeCommitment(ctx, true, blockNum, logPrefix); err != nil {
+		return nil, 0, err
+	}
+
+	cd := a.d[kv.CommitmentDomain]
+	coll, err := cd.collateETL(ctx, 0, stepTo, sd.domainWriters[kv.CommitmentDomain].values, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	branches = uint64(coll.valuesCount)
+	if err := cd.regenesisBuild(ctx, stepTo, coll); err != nil {
+		return nil, 0, err
+	}
+	return common.Copy(root), branches, nil
+}
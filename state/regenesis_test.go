@@ -0,0 +1,194 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/datadir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/mdbx"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/rawdbv3"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestSharedDomains_Regenesis(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 10)
+	agg.KeepCommitmentHistory(true)
+
+	addr := func(i uint64) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(a, i+1)
+		return a
+	}
+	// block `b` is txNums [b*10; b*10+10), last block 4 is [40; 45)
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer rwTx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(rwTx, ac), log.New())
+	require.NoError(t, err)
+	for txNum := uint64(0); txNum < 45; txNum++ {
+		domains.SetTxNum(txNum)
+		domains.SetBlockNum(txNum / 10)
+		v := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum+1), nil, 0)
+		require.NoError(t, domains.DomainPut(kv.AccountsDomain, addr(txNum%13), nil, v, nil, 0))
+		loc := make([]byte, length.Hash)
+		loc[0] = byte(txNum % 3)
+		require.NoError(t, domains.DomainPut(kv.StorageDomain, addr(txNum%5), loc, []byte{byte(txNum)}, nil, 0))
+		if txNum == 25 {
+			require.NoError(t, domains.DomainDel(kv.AccountsDomain, addr(3), nil, nil, 0))
+		}
+		if txNum%10 == 9 || txNum == 44 {
+			_, err := domains.ComputeCommitment(ctx, true, txNum/10, "")
+			require.NoError(t, err)
+			require.NoError(t, rawdbv3.TxNums.Append(rwTx, txNum/10, txNum))
+		}
+	}
+	require.NoError(t, domains.Flush(ctx, rwTx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, rwTx.Commit())
+	require.NoError(t, agg.BuildFiles(45))
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err = NewSharedDomains(WrapTxWithCtx(roTx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	stateAsOf := func(ac *AggregatorRoTx, tx kv.Tx, d kv.Domain, txNum uint64) map[string]string {
+		res := make(map[string]string)
+		it, err := ac.DomainRange(ctx, tx, d, nil, nil, txNum, order.Asc, -1)
+		require.NoError(t, err)
+		defer it.Close()
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(t, err)
+			if len(v) > 0 {
+				res[string(k)] = string(v)
+			}
+		}
+		return res
+	}
+	// opens regenesis datadir and checks that its state is the state of `agg` as of `txNum`
+	check := func(dirs datadir.Dirs, res *RegenesisResult, txNum uint64) *AggregatorRoTx {
+		t.Helper()
+		newDb := mdbx.NewMDBX(log.New()).InMem(dirs.Chaindata).GrowthStep(32 * datasize.MB).MapSize(2 * datasize.GB).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+			return kv.ChaindataTablesCfg
+		}).MustOpen()
+		t.Cleanup(newDb.Close)
+		newAgg, err := NewAggregator(ctx, dirs, 10, newDb, log.New())
+		require.NoError(t, err)
+		t.Cleanup(newAgg.Close)
+		require.NoError(t, newAgg.OpenFolder())
+		require.Equal(t, res.Steps*10, newAgg.EndTxNumMinimax())
+
+		rwTx, err := newDb.BeginRw(ctx)
+		require.NoError(t, err)
+		t.Cleanup(rwTx.Rollback)
+		require.NoError(t, rawdbv3.TxNums.Append(rwTx, res.BlockNum, res.TxNum))
+		newAc := newAgg.BeginFilesRo()
+		t.Cleanup(newAc.Close)
+		for _, d := range []kv.Domain{kv.AccountsDomain, kv.StorageDomain} {
+			expected := stateAsOf(ac, roTx, d, txNum)
+			require.NotEmpty(t, expected)
+			require.Equal(t, expected, stateAsOf(newAc, rwTx, d, math.MaxUint64), d.String())
+			require.EqualValues(t, len(expected), res.Keys[d])
+		}
+
+		newDomains, err := NewSharedDomains(WrapTxWithCtx(rwTx, newAc), log.New())
+		require.NoError(t, err)
+		t.Cleanup(newDomains.Close)
+		require.Equal(t, res.TxNum, newDomains.TxNum())
+		require.Equal(t, res.BlockNum, newDomains.BlockNum())
+		v, err := newDomains.VerifyCommitment(ctx, math.MaxUint64, "")
+		require.NoError(t, err)
+		require.True(t, v.Match())
+		require.Equal(t, res.Root, v.ComputedRoot)
+		return newAc
+	}
+
+	// latest state, history is dropped
+	dirs := datadir.New(t.TempDir())
+	res, err := domains.Regenesis(ctx, math.MaxUint64, dirs, false, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 44, res.TxNum)
+	require.EqualValues(t, 4, res.BlockNum)
+	require.EqualValues(t, 5, res.Steps)
+	newAc := check(dirs, res, 45)
+	for _, f := range newAc.a.Files() {
+		require.True(t, strings.HasSuffix(f, ".0-5.kv"), f)
+	}
+
+	_, err = domains.Regenesis(ctx, math.MaxUint64, dirs, false, "")
+	require.ErrorContains(t, err, "is not empty")
+
+	// state after block 3, history is kept
+	dirs = datadir.New(t.TempDir())
+	res, err = domains.Regenesis(ctx, 41, dirs, true, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 39, res.TxNum)
+	require.EqualValues(t, 3, res.BlockNum)
+	require.EqualValues(t, 4, res.Steps)
+	newAc = check(dirs, res, 40)
+	var historyFiles int
+	for _, f := range newAc.a.Files() {
+		if strings.HasSuffix(f, ".v") || strings.HasSuffix(f, ".ef") {
+			historyFiles++
+		}
+	}
+	require.NotZero(t, historyFiles)
+	v, ok, err := newAc.d[kv.AccountsDomain].ht.HistorySeek(addr(2), 5, nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	expected, ok, err := ac.d[kv.AccountsDomain].ht.HistorySeek(addr(2), 5, roTx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, expected, v)
+
+	// history needs state at step boundary
+	_, err = domains.Regenesis(ctx, math.MaxUint64, datadir.New(t.TempDir()), true, "")
+	require.ErrorContains(t, err, "step boundary")
+	// and history files which end there
+	_, err = domains.Regenesis(ctx, 25, datadir.New(t.TempDir()), true, "")
+	require.ErrorContains(t, err, "files end at txNum=0, need 20")
+
+	// state after block 1, history is dropped
+	dirs = datadir.New(t.TempDir())
+	res, err = domains.Regenesis(ctx, 25, dirs, false, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 19, res.TxNum)
+	require.EqualValues(t, 1, res.BlockNum)
+	check(dirs, res, 20)
+}
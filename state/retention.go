@@ -0,0 +1,348 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	btree2 "github.com/tidwall/btree"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/rawdbv3"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+// ErrHistoryPruned - requested txNum is older than history kept by retention policy
+var ErrHistoryPruned = errors.New("history is pruned by retention policy")
+
+// RetentionPolicy - how much history to keep. Zero value - keep everything.
+// If several fields are set - the longest history is kept.
+type RetentionPolicy struct {
+	Blocks uint64        // keep history of last N blocks
+	TxNums uint64        // keep history of last N txNums
+	Age    time.Duration // keep history of blocks not older than Age. Requires Retention.BlockTime
+}
+
+func (p RetentionPolicy) IsZero() bool { return p.Blocks == 0 && p.TxNums == 0 && p.Age == 0 }
+
+func (p RetentionPolicy) String() string {
+	var parts []string
+	if p.Blocks > 0 {
+		parts = append(parts, fmt.Sprintf("blocks=%d", p.Blocks))
+	}
+	if p.TxNums > 0 {
+		parts = append(parts, fmt.Sprintf("txNums=%d", p.TxNums))
+	}
+	if p.Age > 0 {
+		parts = append(parts, fmt.Sprintf("age=%s", p.Age))
+	}
+	if len(parts) == 0 {
+		return "forever"
+	}
+	return strings.Join(parts, ",")
+}
+
+// Retention - history retention of every domain and standalone inverted index.
+// Drives pruning of history tables in DB and deletion of old history files.
+type Retention struct {
+	Domains [kv.DomainLen]RetentionPolicy
+	Indices [kv.StandaloneIdxLen]RetentionPolicy
+
+	// BlockTime - unix timestamp of block. Needed only for RetentionPolicy.Age
+	BlockTime func(tx kv.Tx, blockNum uint64) (uint64, error)
+	// Now - allows to override current time. Default: time.Now
+	Now func() time.Time
+}
+
+func (r *Retention) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+// horizon - first txNum which must be kept. Everything before it can be removed. 0 means "keep everything".
+func (r *Retention) horizon(tx kv.Tx, p RetentionPolicy) (txNum uint64, err error) {
+	if p.IsZero() {
+		return 0, nil
+	}
+	lastBlock, lastTxNum, err := rawdbv3.TxNums.Last(tx)
+	if err != nil {
+		return 0, err
+	}
+	txNum = lastTxNum
+	if p.TxNums > 0 {
+		if p.TxNums >= lastTxNum {
+			return 0, nil
+		}
+		txNum = min(txNum, lastTxNum-p.TxNums)
+	}
+	if p.Blocks > 0 {
+		if p.Blocks > lastBlock {
+			return 0, nil
+		}
+		fromTxNum, err := rawdbv3.TxNums.Min(tx, lastBlock-p.Blocks+1)
+		if err != nil {
+			return 0, err
+		}
+		txNum = min(txNum, fromTxNum)
+	}
+	if p.Age > 0 {
+		if r.BlockTime == nil {
+			return 0, errors.New("retention by age requires Retention.BlockTime")
+		}
+		minTime := uint64(r.now().Add(-p.Age).Unix())
+		var searchErr error
+		// first block which is not older than `minTime`
+		fromBlock := uint64(sort.Search(int(lastBlock+1), func(i int) bool {
+			if searchErr != nil {
+				return true
+			}
+			blockTime, err := r.BlockTime(tx, uint64(i))
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return blockTime >= minTime
+		}))
+		if searchErr != nil {
+			return 0, searchErr
+		}
+		if fromBlock == 0 {
+			return 0, nil
+		}
+		if fromBlock > lastBlock {
+			fromBlock = lastBlock
+		}
+		fromTxNum, err := rawdbv3.TxNums.Min(tx, fromBlock)
+		if err != nil {
+			return 0, err
+		}
+		txNum = min(txNum, fromTxNum)
+	}
+	return txNum, nil
+}
+
+// SetRetention - per-domain and per-index history retention. nil - keep everything.
+func (a *Aggregator) SetRetention(r *Retention) {
+	for id, d := range a.d {
+		retained := r != nil && !r.Domains[id].IsZero()
+		d.History.retained.Store(retained)
+		d.History.InvertedIndex.retained.Store(retained)
+	}
+	for id, ii := range a.iis {
+		ii.retained.Store(r != nil && !r.Indices[id].IsZero())
+	}
+	a.retention.Store(r)
+}
+
+// RetentionEntry - what retention policy removes from one history or inverted index
+type RetentionEntry struct {
+	Name         string
+	Policy       RetentionPolicy
+	HorizonTxNum uint64   // history before this txNum is removed
+	Files        []string // files which will be deleted
+	FilesSize    int64
+	DBFromTxNum  uint64 // [DBFromTxNum, DBToTxNum) will be pruned from DB
+	DBToTxNum    uint64
+}
+
+type RetentionReport struct {
+	DryRun  bool
+	Entries []RetentionEntry
+}
+
+func (r *RetentionReport) String() string {
+	var sb strings.Builder
+	for i, e := range r.Entries {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		sb.WriteString(fmt.Sprintf("%s(%s): horizon=%d, files=%d(%s)", e.Name, e.Policy, e.HorizonTxNum, len(e.Files), common.ByteCount(uint64(e.FilesSize))))
+		if e.DBFromTxNum < e.DBToTxNum {
+			sb.WriteString(fmt.Sprintf(", db=[%d-%d)", e.DBFromTxNum, e.DBToTxNum))
+		}
+	}
+	return sb.String()
+}
+
+// retentionFiles - files which end before horizon. must be called under `dirtyFilesLock`
+func retentionFiles(dirtyFiles *btree2.BTreeG[*filesItem], horizon uint64) (outs []*filesItem) {
+	dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum > horizon {
+				return false
+			}
+			outs = append(outs, item)
+		}
+		return true
+	})
+	return outs
+}
+
+func addRetentionFiles(e *RetentionEntry, items []*filesItem) {
+	for _, item := range items {
+		if item.decompressor == nil {
+			continue
+		}
+		e.Files = append(e.Files, item.decompressor.FileName())
+		e.FilesSize += item.decompressor.Size()
+		if item.index != nil {
+			e.Files = append(e.Files, item.index.FileName())
+			e.FilesSize += item.index.Size()
+		}
+	}
+}
+
+// deleteRetentionFiles - like `deleteMergeFile`, but also removes frozen files
+func deleteRetentionFiles(dirtyFiles *btree2.BTreeG[*filesItem], outs []*filesItem, logger log.Logger) {
+	for _, out := range outs {
+		dirtyFiles.Delete(out)
+		retireFile(out, logger)
+	}
+}
+
+// retireFile - removes files of `out` from disk now (`closeFilesAndRemove` keeps frozen files), but keeps them open
+// until last reader of `out` is closed
+func retireFile(out *filesItem, logger log.Logger) {
+	for _, fPath := range out.filePaths() {
+		if err := os.Remove(fPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("[snapshots] remove file", "err", err, "file", fPath)
+		}
+		_ = os.Remove(fPath + ".torrent")
+	}
+	out.keepOnDisk.Store(true) // already removed
+	out.canDelete.Store(true)
+	if out.refcount.Load() == 0 {
+		out.closeFiles()
+	}
+}
+
+// RetentionReport - dry-run: what PruneRetention would remove now
+func (ac *AggregatorRoTx) RetentionReport(tx kv.Tx) (*RetentionReport, error) {
+	return ac.retention(context.Background(), tx, 0, nil, true)
+}
+
+// PruneRetention - removes history older than retention policy: prunes DB tables of histories which don't produce files
+// and deletes old history/index files. Noop if retention is not set.
+func (ac *AggregatorRoTx) PruneRetention(ctx context.Context, tx kv.RwTx, limit uint64, logEvery *time.Ticker) (*RetentionReport, error) {
+	if ac.a.follower {
+		return nil, ErrFollowerAggregator
+	}
+	return ac.retention(ctx, tx, limit, logEvery, false)
+}
+
+func (ac *AggregatorRoTx) retention(ctx context.Context, tx kv.Tx, limit uint64, logEvery *time.Ticker, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{DryRun: dryRun}
+	r := ac.a.retention.Load()
+	if r == nil {
+		return report, nil
+	}
+	if !dryRun && logEvery == nil {
+		logEvery = time.NewTicker(30 * time.Second)
+		defer logEvery.Stop()
+	}
+
+	type deletion struct {
+		dirtyFiles *btree2.BTreeG[*filesItem]
+		horizon    uint64
+	}
+	var deletions []deletion
+	for id, dt := range ac.d {
+		p := r.Domains[id]
+		if p.IsZero() || dt.d.historyDisabled {
+			continue
+		}
+		horizon, err := r.horizon(tx, p)
+		if err != nil {
+			return nil, fmt.Errorf("retention %s: %w", dt.d.filenameBase, err)
+		}
+		if horizon == 0 {
+			continue
+		}
+		e := RetentionEntry{Name: dt.d.filenameBase, Policy: p, HorizonTxNum: horizon}
+		h := dt.ht.h
+		if h.snapshotsDisabled {
+			if minTxNum := h.InvertedIndex.minTxNumInDB(tx); minTxNum < horizon {
+				e.DBFromTxNum, e.DBToTxNum = minTxNum, horizon
+				if !dryRun {
+					if _, err := dt.ht.Prune(ctx, tx.(kv.RwTx), 0, horizon, limit, true, logEvery); err != nil {
+						return nil, fmt.Errorf("retention %s: %w", dt.d.filenameBase, err)
+					}
+				}
+			}
+		}
+		ac.a.dirtyFilesLock.Lock()
+		addRetentionFiles(&e, retentionFiles(h.dirtyFiles, horizon))
+		addRetentionFiles(&e, retentionFiles(h.InvertedIndex.dirtyFiles, horizon))
+		ac.a.dirtyFilesLock.Unlock()
+		deletions = append(deletions, deletion{h.dirtyFiles, horizon}, deletion{h.InvertedIndex.dirtyFiles, horizon})
+		report.Entries = append(report.Entries, e)
+	}
+	for id, iit := range ac.iis {
+		p := r.Indices[id]
+		if p.IsZero() {
+			continue
+		}
+		horizon, err := r.horizon(tx, p)
+		if err != nil {
+			return nil, fmt.Errorf("retention %s: %w", iit.ii.filenameBase, err)
+		}
+		if horizon == 0 {
+			continue
+		}
+		e := RetentionEntry{Name: iit.ii.filenameBase, Policy: p, HorizonTxNum: horizon}
+		// like history of domain with disabled snapshots: part of index in DB before horizon is not needed, files of it are deleted below
+		if minTxNum := iit.ii.minTxNumInDB(tx); minTxNum < horizon {
+			e.DBFromTxNum, e.DBToTxNum = minTxNum, horizon
+			if !dryRun {
+				if _, err := iit.Prune(ctx, tx.(kv.RwTx), 0, horizon, limit, logEvery, true, nil); err != nil {
+					return nil, fmt.Errorf("retention %s: %w", iit.ii.filenameBase, err)
+				}
+			}
+		}
+		ac.a.dirtyFilesLock.Lock()
+		addRetentionFiles(&e, retentionFiles(iit.ii.dirtyFiles, horizon))
+		ac.a.dirtyFilesLock.Unlock()
+		deletions = append(deletions, deletion{iit.ii.dirtyFiles, horizon})
+		report.Entries = append(report.Entries, e)
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	var deleted int
+	ac.a.dirtyFilesLock.Lock()
+	for _, d := range deletions {
+		outs := retentionFiles(d.dirtyFiles, d.horizon)
+		deleteRetentionFiles(d.dirtyFiles, outs, ac.a.logger)
+		deleted += len(outs)
+	}
+	ac.a.dirtyFilesLock.Unlock()
+	if deleted > 0 {
+		ac.a.recalcVisibleFiles(ac.a.DirtyFilesEndTxNumMinimax())
+		ac.a.logger.Info("[snapshots] retention", "report", report.String())
+	}
+	return report, nil
+}
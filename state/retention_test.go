@@ -0,0 +1,190 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/memdb"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/rawdbv3"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/stream"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+// fillTxNumsBlocks - every block has `txsPerBlock` txs
+func fillTxNumsBlocks(t *testing.T, tx kv.RwTx, blocks, txsPerBlock uint64) {
+	t.Helper()
+	for b := uint64(0); b < blocks; b++ {
+		require.NoError(t, rawdbv3.TxNums.Append(tx, b, (b+1)*txsPerBlock-1))
+	}
+}
+
+func TestRetention_Horizon(t *testing.T) {
+	t.Parallel()
+
+	db := memdb.NewTestDB(t)
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	fillTxNumsBlocks(t, tx, 100, 10) // last block 99, last txNum 999
+
+	now := time.Unix(10_000, 0)
+	r := &Retention{
+		BlockTime: func(tx kv.Tx, blockNum uint64) (uint64, error) { return 9_000 + blockNum*10, nil },
+		Now:       func() time.Time { return now },
+	}
+	horizon := func(p RetentionPolicy) uint64 {
+		t.Helper()
+		h, err := r.horizon(tx, p)
+		require.NoError(t, err)
+		return h
+	}
+	require.Zero(t, horizon(RetentionPolicy{}))
+	require.Equal(t, uint64(899), horizon(RetentionPolicy{TxNums: 100}))
+	require.Zero(t, horizon(RetentionPolicy{TxNums: 10_000}))
+	require.Equal(t, uint64(900), horizon(RetentionPolicy{Blocks: 10}))
+	require.Zero(t, horizon(RetentionPolicy{Blocks: 100}))
+	// blocks not older than 200s: 80..99
+	require.Equal(t, uint64(800), horizon(RetentionPolicy{Age: 200 * time.Second}))
+	// the most conservative policy wins
+	require.Equal(t, uint64(800), horizon(RetentionPolicy{Blocks: 10, Age: 200 * time.Second}))
+
+	r.BlockTime = nil
+	_, err = r.horizon(tx, RetentionPolicy{Age: time.Hour})
+	require.Error(t, err)
+}
+
+func TestAggregatorV3_PruneRetention(t *testing.T) {
+	t.Parallel()
+
+	aggStep := uint64(10)
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := aggStep * StepsInColdFile * 2
+	rnd := rand.New(rand.NewSource(0))
+	addr := make([]byte, length.Addr)
+	_, err = rnd.Read(addr)
+	require.NoError(t, err)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		prev, _, err := domains.DomainGet(kv.AccountsDomain, addr, nil)
+		require.NoError(t, err)
+		err = domains.DomainPut(kv.AccountsDomain, addr, nil, types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0), prev, 0)
+		require.NoError(t, err)
+		require.NoError(t, domains.IndexAdd(kv.LogAddrIdx, addr))
+	}
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	fillTxNumsBlocks(t, tx, txs/10, 10)
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, agg.BuildFiles(txs))
+	require.NoError(t, agg.MergeLoop(ctx))
+
+	// keep last 60 blocks: horizon=680, history files 0-64 steps are older
+	agg.SetRetention(&Retention{
+		Domains: [kv.DomainLen]RetentionPolicy{kv.AccountsDomain: {Blocks: 60}},
+		Indices: [kv.StandaloneIdxLen]RetentionPolicy{kv.LogAddrIdxPos: {Blocks: 60}},
+	})
+	oldHistory := agg.d[kv.AccountsDomain].History.vFilePath(0, StepsInColdFile)
+	oldIdx := agg.d[kv.AccountsDomain].History.InvertedIndex.efFilePath(0, StepsInColdFile)
+	logAddrs := agg.iis[kv.LogAddrIdxPos]
+	oldLogAddrs := logAddrs.efFilePath(0, StepsInColdFile)
+
+	tx, err = db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac = agg.BeginFilesRo()
+	report, err := ac.RetentionReport(tx)
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Len(t, report.Entries, 2)
+	require.Equal(t, uint64(680), report.Entries[0].HorizonTxNum)
+	require.Contains(t, report.Entries[0].Files, filepath.Base(oldHistory))
+	require.Contains(t, report.Entries[0].Files, filepath.Base(oldIdx))
+	require.Positive(t, report.Entries[0].FilesSize)
+	require.Equal(t, logAddrs.filenameBase, report.Entries[1].Name)
+	require.Contains(t, report.Entries[1].Files, filepath.Base(oldLogAddrs))
+	require.Equal(t, uint64(680), report.Entries[1].DBToTxNum, "index tables in DB are pruned too")
+	require.Less(t, report.Entries[1].DBFromTxNum, report.Entries[1].DBToTxNum)
+	exists, err := dir.FileExist(oldHistory)
+	require.NoError(t, err)
+	require.True(t, exists, "dry-run must not remove files")
+
+	_, err = ac.PruneRetention(ctx, tx, 0, nil)
+	require.NoError(t, err)
+	ac.Close()
+	require.GreaterOrEqual(t, logAddrs.minTxNumInDB(tx), uint64(680))
+	require.NoError(t, tx.Commit())
+
+	for _, fPath := range []string{oldHistory, oldIdx, oldLogAddrs} {
+		exists, err = dir.FileExist(fPath)
+		require.NoError(t, err)
+		require.False(t, exists, fPath)
+	}
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	ac = agg.BeginFilesRo()
+	defer ac.Close()
+	_, _, err = ac.d[kv.AccountsDomain].ht.HistorySeek(addr, 100, roTx)
+	require.ErrorIs(t, err, ErrHistoryPruned)
+	v, ok, err := ac.d[kv.AccountsDomain].ht.HistorySeek(addr, 1000, roTx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, types.EncodeAccountBytesV3(999, uint256.NewInt(999), nil, 0), v)
+	for _, idx := range []kv.InvertedIdx{kv.AccountsHistoryIdx, kv.LogAddrIdx} {
+		_, err = ac.IndexRange(idx, addr, 100, -1, order.Asc, -1, roTx)
+		require.ErrorIs(t, err, ErrHistoryPruned, idx)
+		_, err = ac.IndexRange(idx, addr, -1, 100, order.Desc, -1, roTx)
+		require.ErrorIs(t, err, ErrHistoryPruned, idx)
+		it, err := ac.IndexRange(idx, addr, 1000, -1, order.Asc, -1, roTx)
+		require.NoError(t, err, idx)
+		txNums, err := stream.ToArrayU64(it)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1000), txNums[0], idx)
+	}
+
+	// without retention policy - missing beginning of history is not reported as pruned
+	agg.SetRetention(nil)
+	_, _, err = ac.d[kv.AccountsDomain].ht.HistorySeek(addr, 100, roTx)
+	require.NoError(t, err)
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Tangui-Bitfly/erigon-lib/commitment"
+	"github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/kv/order"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+)
+
+// StorageRootAsOf returns root hash of storage trie of account `addr` as of `txNum` (before execution of `txNum`,
+// same as DomainGetAsOf), math.MaxUint64 means the latest state.
+// Branches of the last commitment state computed before `txNum` are reused: only slots of the account changed since
+// that state are re-hashed. If branches are not available (there is no commitment state yet, or CommitmentDomain
+// history is disabled or pruned, see Aggregator.KeepCommitmentHistory), all slots of the account are iterated
+// and storage trie is computed from scratch.
+func StorageRootAsOf(ctx context.Context, tx kv.TemporalTx, addr []byte, txNum uint64) ([]byte, error) {
+	if len(addr) != length.Addr {
+		return nil, fmt.Errorf("storage root: address %x length %d, expected %d", addr, len(addr), length.Addr)
+	}
+	sd, err := NewSharedDomains(tx, log.New())
+	if err != nil {
+		return nil, err
+	}
+	defer sd.Close()
+	return sd.storageRootAsOf(ctx, tx, addr, txNum, true)
+}
+
+func (sd *SharedDomains) storageRootAsOf(ctx context.Context, tx kv.TemporalTx, addr []byte, txNum uint64, reuseBranches bool) ([]byte, error) {
+	values := NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, commitment.VariantHexPatriciaTrie)
+	defer values.Close()
+	if txNum != math.MaxUint64 {
+		values.historyAsOfTxNum = txNum
+	}
+	sdc := NewSharedDomainsCommitmentContext(sd, commitment.ModeDirect, commitment.VariantHexPatriciaTrie)
+	defer sdc.Close()
+	rc := &storageRootContext{values: values, branches: make(map[string][]byte)}
+	sdc.patriciaTrie.ResetContext(rc)
+
+	var stateTxNum uint64
+	if reuseBranches {
+		_, restoredTxNum, ok, err := sd.restoreCommitmentStateAsOf(sdc, txNum)
+		switch {
+		case errors.Is(err, ErrCommitmentHistoryDisabled) || errors.Is(err, ErrHistoryPruned):
+			// branches are not available, compute from scratch
+		case err != nil:
+			return nil, err
+		case ok:
+			rc.stored, stateTxNum = sdc, restoredTxNum
+		}
+	}
+
+	var touched bool
+	touch := func(k []byte) error {
+		touched = true
+		return sdc.updates.TouchUniquePlainKey(common.Copy(k))
+	}
+	if rc.stored != nil {
+		// re-hash only slots changed since commitment state
+		it, err := tx.DomainDiff(kv.StorageDomain, nil, stateTxNum+1, txNum, -1)
+		if err != nil {
+			return nil, err
+		}
+		defer it.Close()
+		for it.HasNext() {
+			k, _, _, err := it.Next()
+			if err != nil {
+				return nil, err
+			}
+			if len(k) == length.Addr+length.Hash && bytes.HasPrefix(k, addr) {
+				if err := touch(k); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else if txNum == math.MaxUint64 {
+		if err := sd.IterateStoragePrefix(addr, func(k, v []byte, step uint64) error {
+			if len(v) == 0 {
+				return nil
+			}
+			return touch(k)
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		to, _ := kv.NextSubtree(addr)
+		it, err := tx.DomainRange(kv.StorageDomain, addr, to, txNum, order.Asc, -1)
+		if err != nil {
+			return nil, err
+		}
+		defer it.Close()
+		for it.HasNext() {
+			k, v, err := it.Next()
+			if err != nil {
+				return nil, err
+			}
+			if len(v) == 0 { // deleted
+				continue
+			}
+			if err := touch(k); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if touched {
+		if err := touch(addr); err != nil {
+			return nil, err
+		}
+		if _, err := sdc.patriciaTrie.Process(ctx, sdc.updates, "storage-root"); err != nil {
+			return nil, err
+		}
+	}
+	hph, ok := sdc.patriciaTrie.(*commitment.HexPatriciaHashed)
+	if !ok {
+		return nil, fmt.Errorf("storage root is not supported by patricia trie type: %T", sdc.patriciaTrie)
+	}
+	proof, err := hph.ProveAccount(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return proof.StorageHash[:], nil
+}
+
+// storageRootContext reads branches of restored commitment state (if any) and values as of requested txNum.
+// Updated branches are kept in memory.
+type storageRootContext struct {
+	stored   *SharedDomainsCommitmentContext
+	values   *SharedDomainsCommitmentContext
+	branches map[string][]byte
+}
+
+func (rc *storageRootContext) Branch(prefix []byte) ([]byte, uint64, error) {
+	if data, ok := rc.branches[string(prefix)]; ok {
+		return data, 0, nil
+	}
+	if rc.stored == nil {
+		return nil, 0, nil
+	}
+	return rc.stored.Branch(prefix)
+}
+
+func (rc *storageRootContext) PutBranch(prefix []byte, data []byte, prevData []byte, prevStep uint64) error {
+	rc.branches[string(prefix)] = common.Copy(data)
+	return nil
+}
+
+func (rc *storageRootContext) Account(plainKey []byte) (*commitment.Update, error) {
+	return rc.values.Account(plainKey)
+}
+
+func (rc *storageRootContext) Storage(plainKey []byte) (*commitment.Update, error) {
+	return rc.values.Storage(plainKey)
+}
@@ -0,0 +1,457 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	btree2 "github.com/tidwall/btree"
+
+	common2 "github.com/Tangui-Bitfly/erigon-lib/common"
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/seg"
+)
+
+// Tiered storage:
+//   - tier "fast" is `datadir.Dirs.Snap` - all new files are created there
+//   - every StorageTier is a directory with same layout as `datadir.Dirs.Snap`: `domain/`, `history/`, `idx/`
+//   - only data files (.kv, .v, .ef) can move between tiers. Accessors (.kvi, .bt, .kvei, .vi, .efi) always stay on fast tier
+//   - only files of at least StepsInColdFile steps can move - small files will be merged soon anyway
+//   - migration and merge are mutually exclusive (share `Aggregator.mergingFiles`), so merge never sees moved file
+
+type TierFileKind uint8
+
+const (
+	TierFileDomain  TierFileKind = iota // .kv
+	TierFileHistory                     // .v
+	TierFileIdx                         // .ef
+)
+
+func (k TierFileKind) String() string {
+	switch k {
+	case TierFileDomain:
+		return "domain"
+	case TierFileHistory:
+		return "history"
+	case TierFileIdx:
+		return "idx"
+	default:
+		return fmt.Sprintf("unknown tier file kind: %d", k)
+	}
+}
+
+// TierFile - description of data file passed to TierPolicy
+type TierFile struct {
+	Name             string // file name without directory
+	Kind             TierFileKind
+	FromStep, ToStep uint64
+	Size             int64
+	LastStep         uint64 // end of files visible by Aggregator. Allows policies like "older than N steps"
+}
+
+// TierPolicy - returns true if file must live on given tier
+type TierPolicy func(f TierFile) bool
+
+// OlderThanSteps - files which end at least `n` steps before the end of visible files
+func OlderThanSteps(n uint64) TierPolicy {
+	return func(f TierFile) bool { return f.ToStep+n <= f.LastStep }
+}
+
+// LargerThan - files which size is bigger than `size`. Usually it's merged files.
+func LargerThan(size datasize.ByteSize) TierPolicy {
+	return func(f TierFile) bool { return f.Size > int64(size.Bytes()) }
+}
+
+// OfKind - applies `p` only to files of given kind
+func OfKind(kind TierFileKind, p TierPolicy) TierPolicy {
+	return func(f TierFile) bool { return f.Kind == kind && p(f) }
+}
+
+// AllOf - file must satisfy all policies
+func AllOf(policies ...TierPolicy) TierPolicy {
+	return func(f TierFile) bool {
+		for _, p := range policies {
+			if !p(f) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// StorageTier - secondary (usually slower and bigger) storage for snapshot files
+type StorageTier struct {
+	Dir    string
+	Policy TierPolicy
+}
+
+// storageTiers - shared by all Domain/History/InvertedIndex of Aggregator. nil-safe: nil means "only fast tier".
+type storageTiers struct {
+	snapDir string
+	tiers   []StorageTier // ordered from fast to slow
+}
+
+func newStorageTiers(snapDir string) *storageTiers {
+	return &storageTiers{snapDir: snapDir}
+}
+
+func (st *storageTiers) enabled() bool { return st != nil && len(st.tiers) > 0 }
+
+// tierPath - path of file on given tier. `fastPath` is path of file on fast tier.
+func (st *storageTiers) tierPath(tier int, fastPath string) (string, error) {
+	rel, err := filepath.Rel(st.snapDir, fastPath)
+	if err != nil {
+		return "", fmt.Errorf("file %s is not in snapshots dir %s: %w", fastPath, st.snapDir, err)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %s is not in snapshots dir %s", fastPath, st.snapDir)
+	}
+	return filepath.Join(st.tiers[tier].Dir, rel), nil
+}
+
+// resolve - returns path of existing file. Fast tier has priority. If file doesn't exist on any tier - returns `fastPath`.
+func (st *storageTiers) resolve(fastPath string) string {
+	if !st.enabled() {
+		return fastPath
+	}
+	if exists, _ := dir.FileExist(fastPath); exists {
+		return fastPath
+	}
+	for i := range st.tiers {
+		fPath, err := st.tierPath(i, fastPath)
+		if err != nil {
+			return fastPath
+		}
+		if exists, _ := dir.FileExist(fPath); exists {
+			return fPath
+		}
+	}
+	return fastPath
+}
+
+// filesFromDir - like `filesFromDir` but also lists same dir on all tiers. Result has no duplicates.
+func (st *storageTiers) filesFromDir(fastDir string) ([]string, error) {
+	res, err := filesFromDir(fastDir)
+	if err != nil || !st.enabled() {
+		return res, err
+	}
+	seen := make(map[string]struct{}, len(res))
+	for _, name := range res {
+		seen[name] = struct{}{}
+	}
+	for i := range st.tiers {
+		tierDir, err := st.tierPath(i, fastDir)
+		if err != nil {
+			return nil, err
+		}
+		exists, err := dir.Exist(tierDir)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		names, err := filesFromDir(tierDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+// target - returns index of the slowest tier which accepts file. -1 means fast tier.
+func (st *storageTiers) target(f TierFile) int {
+	for i := len(st.tiers) - 1; i >= 0; i-- {
+		if st.tiers[i].Policy != nil && st.tiers[i].Policy(f) {
+			return i
+		}
+	}
+	return -1
+}
+
+type tierMove struct {
+	files    *btree2.BTreeG[*filesItem]
+	item     *filesItem
+	from, to string
+	reopen   func(item *filesItem) error // re-open accessors which depend on decompressor (for example .bt)
+}
+
+// plan - list of files which are not on their tier. must be called under `dirtyFilesLock`
+func (st *storageTiers) plan(files *btree2.BTreeG[*filesItem], kind TierFileKind, stepSize, lastStep uint64, fastPath func(fromStep, toStep uint64) string, reopen func(item *filesItem) error) (moves []tierMove, err error) {
+	if !st.enabled() {
+		return nil, nil
+	}
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum-item.startTxNum < StepsInColdFile*stepSize || item.decompressor == nil || item.canDelete.Load() {
+				continue
+			}
+			fromStep, toStep := item.startTxNum/stepSize, item.endTxNum/stepSize
+			fPath := fastPath(fromStep, toStep)
+			to := fPath
+			if tier := st.target(TierFile{Name: filepath.Base(fPath), Kind: kind, FromStep: fromStep, ToStep: toStep, Size: item.decompressor.Size(), LastStep: lastStep}); tier >= 0 {
+				if to, err = st.tierPath(tier, fPath); err != nil {
+					return false
+				}
+			}
+			if to == item.decompressor.FilePath() {
+				continue
+			}
+			moves = append(moves, tierMove{files: files, item: item, from: item.decompressor.FilePath(), to: to, reopen: reopen})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+// switchFile - puts item which reads from `m.to` into `m.files` instead of `m.item`. `m.to` must be already fully
+// written and fsynced. must be called under `dirtyFilesLock`. Old item stays visible until `recalcVisibleFiles`,
+// then must be released by `retireSwitched`.
+func (st *storageTiers) switchFile(m tierMove) (switched bool, err error) {
+	old := m.item
+	if cur, ok := m.files.Get(old); !ok || cur != old || old.canDelete.Load() || old.decompressor == nil || old.decompressor.FilePath() != m.from {
+		// file was closed/replaced while we were copying it
+		if cur == nil || cur.decompressor == nil || cur.decompressor.FilePath() != m.to {
+			_ = os.Remove(m.to)
+		}
+		return false, nil
+	}
+
+	item := &filesItem{startTxNum: old.startTxNum, endTxNum: old.endTxNum, frozen: old.frozen,
+		index: old.index, bindex: old.bindex, bm: old.bm, existence: old.existence}
+	if item.decompressor, err = seg.NewDecompressor(m.to); err != nil {
+		_ = os.Remove(m.to)
+		return false, err
+	}
+	if m.reopen != nil {
+		if err = m.reopen(item); err != nil {
+			item.decompressor.Close()
+			_ = os.Remove(m.to)
+			return false, err
+		}
+	}
+	m.files.Set(item)
+	old.replacedBy = item
+	return true, nil
+}
+
+// retireSwitched - releases `m.item` after `switchFile` and `recalcVisibleFiles`: new readers can't see it anymore.
+// must be called under `dirtyFilesLock`. Readers which already use old item - continue read from old file:
+// it's removed from disk, but stays open until last of them is closed.
+func (st *storageTiers) retireSwitched(m tierMove) error {
+	old := m.item
+	old.canDelete.Store(true)
+	if old.refcount.Load() == 0 {
+		old.closeFilesAndRemove()
+	}
+
+	if err := os.Rename(m.from+".torrent", m.to+".torrent"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("retireSwitched: move %s: %w", m.from+".torrent", err)
+	}
+	if err := os.Remove(m.from); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// on some OS can't remove opened file. it's ok - fast tier has priority on next start, file will be moved again
+		return fmt.Errorf("retireSwitched: remove %s: %w", m.from, err)
+	}
+	return nil
+}
+
+// copyFileWithFsync - copy `from` to `to` through tmp file. `to` appears atomically and only after fsync.
+func copyFileWithFsync(ctx context.Context, from, to string) (err error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := to + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	if _, err = io.Copy(dst, &ioThrottledReader{ctx: ctx, t: ioTaskFromCtx(ctx), r: src}); err != nil {
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, to); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// SetStorageTiers - configure secondary storage. Must be called before OpenFolder.
+// Tiers are ordered from fast to slow. File goes to the slowest tier which policy accepts it.
+func (a *Aggregator) SetStorageTiers(tiers ...StorageTier) {
+	for _, t := range tiers {
+		dir.MustExist(
+			filepath.Join(t.Dir, filepath.Base(a.dirs.SnapDomain)),
+			filepath.Join(t.Dir, filepath.Base(a.dirs.SnapHistory)),
+			filepath.Join(t.Dir, filepath.Base(a.dirs.SnapIdx)),
+		)
+	}
+	a.tiers.tiers = tiers
+}
+
+// migrateStorageTiersAfterMerge - must be called by goroutine which owns `a.mergingFiles`
+func (a *Aggregator) migrateStorageTiersAfterMerge(ctx context.Context) {
+	if !a.tiers.enabled() {
+		return
+	}
+	if _, err := a.migrateStorageTiers(ctx); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, common2.ErrStopped) {
+			return
+		}
+		a.logger.Warn("[snapshots] MigrateStorageTiers", "err", err)
+	}
+}
+
+// MigrateStorageTiers - moves cold files to tiers selected by policies. Files are copied without holding locks,
+// then visible files are switched atomically. Returns amount of moved files. Noop if merge is running.
+func (a *Aggregator) MigrateStorageTiers(ctx context.Context) (moved int, err error) {
+	if !a.tiers.enabled() {
+		return 0, nil
+	}
+	if ok := a.mergingFiles.CompareAndSwap(false, true); !ok {
+		return 0, nil
+	}
+	defer a.mergingFiles.Store(false)
+	return a.migrateStorageTiers(ctx)
+}
+
+func (a *Aggregator) migrateStorageTiers(ctx context.Context) (moved int, err error) {
+	if a.follower {
+		return 0, ErrFollowerAggregator
+	}
+	lastStep := a.visibleFilesMinimaxTxNum.Load() / a.StepSize()
+
+	a.dirtyFilesLock.Lock()
+	var moves []tierMove
+	for _, d := range a.d {
+		dMoves, err := d.tierMoves(lastStep)
+		if err != nil {
+			a.dirtyFilesLock.Unlock()
+			return 0, fmt.Errorf("MigrateStorageTiers: %w", err)
+		}
+		moves = append(moves, dMoves...)
+	}
+	for _, ii := range a.iis {
+		iiMoves, err := ii.tierMoves(lastStep)
+		if err != nil {
+			a.dirtyFilesLock.Unlock()
+			return 0, fmt.Errorf("MigrateStorageTiers: %w", err)
+		}
+		moves = append(moves, iiMoves...)
+	}
+	a.dirtyFilesLock.Unlock()
+
+	for _, m := range moves {
+		select {
+		case <-ctx.Done():
+			return moved, ctx.Err()
+		default:
+		}
+		mctx, iot := a.io.begin(ctx, IOPriorityBackground, m.item.endTxNum-m.item.startTxNum, "move "+filepath.Base(m.from))
+		err := copyFileWithFsync(mctx, m.from, m.to)
+		a.io.end(iot)
+		if err != nil {
+			return moved, fmt.Errorf("MigrateStorageTiers: %w", err)
+		}
+		a.dirtyFilesLock.Lock()
+		switched, err := a.tiers.switchFile(m)
+		a.dirtyFilesLock.Unlock()
+		if err != nil {
+			return moved, fmt.Errorf("MigrateStorageTiers: %w", err)
+		}
+		if !switched {
+			continue
+		}
+		moved++
+		// like after merge: first hide old item from new readers, only then release it
+		a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
+		a.dirtyFilesLock.Lock()
+		err = a.tiers.retireSwitched(m)
+		a.dirtyFilesLock.Unlock()
+		a.logger.Debug("[snapshots] moved to another storage tier", "f", filepath.Base(m.to), "dir", filepath.Dir(m.to))
+		if err != nil {
+			return moved, fmt.Errorf("MigrateStorageTiers: %w", err)
+		}
+	}
+	if moved > 0 {
+		a.logger.Info("[snapshots] storage tiers migration done", "files", moved)
+	}
+	return moved, nil
+}
+
+func (d *Domain) tierMoves(lastStep uint64) ([]tierMove, error) {
+	reopenBt := func(item *filesItem) (err error) {
+		if item.bindex == nil {
+			return nil
+		}
+		fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+		item.bindex, err = OpenBtreeIndexWithDecompressor(d.kvBtFilePath(fromStep, toStep), DefaultBtreeM, item.decompressor, d.compression)
+		return err
+	}
+	moves, err := d.tiers.plan(d.dirtyFiles, TierFileDomain, d.aggregationStep, lastStep, d.kvFilePath, reopenBt)
+	if err != nil {
+		return nil, err
+	}
+	hMoves, err := d.History.tiers.plan(d.History.dirtyFiles, TierFileHistory, d.aggregationStep, lastStep, d.History.vFilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	iiMoves, err := d.History.InvertedIndex.tierMoves(lastStep)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(moves, hMoves...), iiMoves...), nil
+}
+
+func (ii *InvertedIndex) tierMoves(lastStep uint64) ([]tierMove, error) {
+	return ii.tiers.plan(ii.dirtyFiles, TierFileIdx, ii.aggregationStep, lastStep, ii.efFilePath, nil)
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Tangui-Bitfly/erigon-lib/common/dir"
+	"github.com/Tangui-Bitfly/erigon-lib/common/length"
+	"github.com/Tangui-Bitfly/erigon-lib/kv"
+	"github.com/Tangui-Bitfly/erigon-lib/log/v3"
+	"github.com/Tangui-Bitfly/erigon-lib/types"
+)
+
+func TestStorageTiers_Target(t *testing.T) {
+	t.Parallel()
+
+	st := newStorageTiers("/snapshots")
+	st.tiers = []StorageTier{
+		{Dir: "/ssd", Policy: LargerThan(1 * datasize.MB)},
+		{Dir: "/hdd", Policy: OfKind(TierFileHistory, OlderThanSteps(128))},
+	}
+
+	require.Equal(t, -1, st.target(TierFile{Kind: TierFileDomain, Size: 1024, ToStep: 64, LastStep: 1000}))
+	require.Equal(t, 0, st.target(TierFile{Kind: TierFileDomain, Size: 2 * 1024 * 1024, ToStep: 64, LastStep: 1000}))
+	require.Equal(t, 1, st.target(TierFile{Kind: TierFileHistory, Size: 2 * 1024 * 1024, ToStep: 64, LastStep: 1000}))
+	require.Equal(t, 0, st.target(TierFile{Kind: TierFileHistory, Size: 2 * 1024 * 1024, ToStep: 960, LastStep: 1000}))
+
+	tierPath, err := st.tierPath(1, filepath.Join("/snapshots", "history", "v1-accounts.0-64.v"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("/hdd", "history", "v1-accounts.0-64.v"), tierPath)
+	_, err = st.tierPath(1, filepath.Join("/other", "history", "v1-accounts.0-64.v"))
+	require.Error(t, err)
+
+	var disabled *storageTiers
+	require.Equal(t, "/snapshots/domain/a.kv", disabled.resolve("/snapshots/domain/a.kv"))
+}
+
+func TestAggregatorV3_MigrateStorageTiers(t *testing.T) {
+	t.Parallel()
+
+	aggStep := uint64(10)
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+	dirs := agg.dirs
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	defer ac.Close()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+	defer domains.Close()
+
+	txs := aggStep * StepsInColdFile * 2
+	rnd := rand.New(rand.NewSource(0))
+	latest := map[string][]byte{}
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		domains.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		_, err := rnd.Read(addr[:2])
+		require.NoError(t, err)
+
+		buf := types.EncodeAccountBytesV3(txNum, uint256.NewInt(txNum), nil, 0)
+		err = domains.DomainPut(kv.AccountsDomain, addr, nil, buf, nil, 0)
+		require.NoError(t, err)
+		latest[string(addr)] = buf
+	}
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, agg.BuildFiles(txs))
+	require.NoError(t, agg.MergeLoop(ctx))
+
+	coldDir := t.TempDir()
+	agg.SetStorageTiers(StorageTier{Dir: coldDir, Policy: OlderThanSteps(0)})
+
+	coldKv := filepath.Base(agg.d[kv.AccountsDomain].kvFilePath(0, txs/aggStep))
+	require.NoError(t, os.WriteFile(filepath.Join(dirs.SnapDomain, coldKv+".torrent"), []byte("d4:infod4:name0:ee"), 0644))
+
+	// reader opened before move keeps old file open until it's closed
+	reader := agg.BeginFilesRo()
+	old := reader.d[kv.AccountsDomain].files[0].src
+	require.Equal(t, coldKv, old.decompressor.FileName())
+
+	moved, err := agg.MigrateStorageTiers(ctx)
+	require.NoError(t, err)
+	require.Positive(t, moved)
+
+	require.True(t, old.canDelete.Load())
+	require.NotNil(t, old.decompressor)
+	replacedBy := old.replacedBy
+	require.NotNil(t, replacedBy)
+	fresh := agg.BeginFilesRo()
+	require.Equal(t, replacedBy, fresh.d[kv.AccountsDomain].files[0].src, "new readers must not see released item")
+	fresh.Close()
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	for k, want := range latest {
+		v, _, ok, err := reader.GetLatest(kv.AccountsDomain, []byte(k), nil, roTx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, v)
+	}
+	roTx.Rollback()
+	reader.Close()
+	require.Nil(t, old.decompressor)
+	require.NotNil(t, replacedBy.decompressor, "new file must stay open")
+	require.NotNil(t, replacedBy.bindex, "accessors are shared with new file")
+
+	exists, err := dir.FileExist(filepath.Join(coldDir, "domain", coldKv+".torrent"))
+	require.NoError(t, err)
+	require.True(t, exists, ".torrent must be moved with file")
+	exists, err = dir.FileExist(filepath.Join(dirs.SnapDomain, coldKv+".torrent"))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	exists, err = dir.FileExist(filepath.Join(coldDir, "domain", coldKv))
+	require.NoError(t, err)
+	require.True(t, exists)
+	exists, err = dir.FileExist(filepath.Join(dirs.SnapDomain, coldKv))
+	require.NoError(t, err)
+	require.False(t, exists)
+	exists, err = dir.FileExist(agg.d[kv.AccountsDomain].kvBtFilePath(0, txs/aggStep))
+	require.NoError(t, err)
+	require.True(t, exists, "accessors must stay on fast tier")
+
+	// nothing left to move
+	moved, err = agg.MigrateStorageTiers(ctx)
+	require.NoError(t, err)
+	require.Zero(t, moved)
+
+	checkLatest := func(agg *Aggregator) {
+		t.Helper()
+		roTx, err := db.BeginRo(ctx)
+		require.NoError(t, err)
+		defer roTx.Rollback()
+		ac := agg.BeginFilesRo()
+		defer ac.Close()
+		for k, want := range latest {
+			v, _, ok, err := ac.GetLatest(kv.AccountsDomain, []byte(k), nil, roTx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, want, v)
+		}
+	}
+	checkLatest(agg)
+
+	// re-open: files must be discovered on all tiers
+	files := agg.Files()
+	agg.Close()
+
+	agg, err = NewAggregator(ctx, dirs, aggStep, db, log.New())
+	require.NoError(t, err)
+	defer agg.Close()
+	agg.SetStorageTiers(StorageTier{Dir: coldDir, Policy: OlderThanSteps(0)})
+	require.NoError(t, agg.OpenFolder())
+	require.Equal(t, files, agg.Files())
+	checkLatest(agg)
+}